@@ -1,117 +1,141 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"flag"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/url"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/ShowMax/go-fqdn"
-	"github.com/prometheus/common/log"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/promlog"
+	"github.com/prometheus/common/version"
+	"gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/robustperception/pushprox/pushclient"
 	"github.com/robustperception/pushprox/util"
 )
 
 var (
-	myFqdn   = flag.String("fqdn", fqdn.Get(), "FQDN to register with")
-	proxyUrl = flag.String("proxy-url", "", "Push proxy to talk to.")
+	metricsAddr string
+	configFile  = kingpin.Flag("config.file", "YAML file of settings, which take precedence over flags. Reloaded on SIGHUP.").String()
+	enablePprof = kingpin.Flag("web.enable-pprof", "Serve Go's profiling endpoints at /debug/pprof/ on --web.listen-address, to look into memory growth and the like.").Bool()
+
+	runCommand      = kingpin.Command("run", "Poll the proxy for scrapes and perform them. The default.").Default()
+	checkCommand    = kingpin.Command("check-config", "Check the flags and config file, and exit.")
+	selftestCommand = kingpin.Command("selftest", "Register with the proxy as a made up client, scrape a target of its own through the proxy, and check the result comes back, for deployment pipelines.")
+	selftestTimeout = selftestCommand.Flag("timeout", "How long the self-test may take.").Default("30s").Duration()
 )
 
-func doScrape(request *http.Request, client *http.Client) {
-	logger := log.With("scrape_id", request.Header.Get("id"))
-	ctx, _ := context.WithTimeout(request.Context(), util.GetScrapeTimeout(request.Header))
-	request = request.WithContext(ctx)
+func init() {
+	kingpin.Flag("web.listen-address", "Address to serve the client's own metrics, health checks and forwarded remote writes on, such as :9369. Empty to not listen at all.").StringVar(&metricsAddr)
+	kingpin.Flag("metrics-addr", "Old name of --web.listen-address.").Hidden().StringVar(&metricsAddr)
+}
 
-	// We cannot handle http requests at the proxy, as we would only
-	// see a CONNECT, so use a URL parameter to trigger it.
-	params := request.URL.Query()
-	if params.Get("_scheme") == "https" {
-		request.URL.Scheme = "https"
-		params.Del("_scheme")
-		request.URL.RawQuery = params.Encode()
+func main() {
+	var cfg pushclient.Config
+	cfg.RegisterFlags(kingpin.CommandLine, "")
+	var logFormat promlog.AllowedFormat
+	kingpin.Flag("log.format", "Output format of log messages. One of: logfmt, json.").Default("logfmt").SetValue(&logFormat)
+	util.SetEnvars(kingpin.CommandLine, "PUSHPROX")
+	kingpin.Version(version.Print("pushprox-client"))
+	kingpin.HelpFlag.Short('h')
+	command := kingpin.Parse()
+	logger := util.NewLogger(&cfg.LogLevel, &logFormat)
+	base := cfg
+	if *configFile != "" {
+		var err error
+		if cfg, err = pushclient.LoadConfigFile(*configFile, base); err != nil {
+			fatal(logger, "Error loading config", "file", *configFile, "err", err)
+		}
 	}
-
-	scrapeResp, err := client.Do(request)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to scrape %s: %s", request.URL.String(), err)
-		log.Warn(msg)
-		resp := &http.Response{
-			StatusCode: 500,
-			Header:     http.Header{},
-			Body:       ioutil.NopCloser(strings.NewReader(msg)),
+	if cfg.ProxyURL == "" && cfg.ProxySRV == "" {
+		fatal(logger, "--proxy.url or --proxy.srv flag must be specified.")
+	}
+	if cfg.RemoteWrite && metricsAddr == "" {
+		fatal(logger, "--remote-write.enabled needs --web.listen-address to accept remote writes on.")
+	}
+	switch command {
+	case checkCommand.FullCommand():
+		if err := pushclient.CheckConfig(cfg); err != nil {
+			fatal(logger, "Invalid config", "err", err)
 		}
-		err = doPush(resp, request, client)
-		if err != nil {
-			log.Warnf("Failed to push failed scrape response: %s", err)
-			return
+		fmt.Println("Config is valid")
+		return
+	case selftestCommand.FullCommand():
+		ctx, cancel := context.WithTimeout(context.Background(), *selftestTimeout)
+		defer cancel()
+		if err := pushclient.SelfTest(ctx, cfg, logger, os.Stdout); err != nil {
+			fatal(logger, "Self-test failed", "err", err)
 		}
-		log.Info("Pushed failed scrape response")
+		fmt.Println("Self-test passed")
 		return
 	}
-	logger.Info("Retrieved scrape response")
-
-	err = doPush(scrapeResp, request, client)
+	prometheus.MustRegister(version.NewCollector("pushprox"))
+	c, err := pushclient.New(cfg, prometheus.DefaultRegisterer, logger)
 	if err != nil {
-		logger.Warnf("Failed to push scrape response: %s", err)
-		return
+		fatal(logger, "Error starting", "err", err)
 	}
-	logger.Info("Pushed scrape result")
-}
-
-// Report the result of the scrape back up to the proxy.
-func doPush(resp *http.Response, origRequest *http.Request, client *http.Client) error {
-	resp.Header.Set("id", origRequest.Header.Get("id")) // Link the request and response
-	// Remaining scrape deadline.
-	deadline, _ := origRequest.Context().Deadline()
-	resp.Header.Set("X-Prometheus-Scrape-Timeout", fmt.Sprintf("%f", float64(time.Until(deadline))/1e9))
-
-	u, _ := url.Parse(*proxyUrl + "/push")
-
-	buf := &bytes.Buffer{}
-	resp.Write(buf)
-	request := &http.Request{
-		Method:        "POST",
-		URL:           u,
-		Body:          ioutil.NopCloser(buf),
-		ContentLength: int64(buf.Len()),
+	if *configFile != "" {
+		c.SetConfigFile(*configFile, base)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := c.Reload(); err != nil {
+					level.Warn(logger).Log("msg", "Error reloading config", "file", *configFile, "err", err)
+				}
+			}
+		}()
 	}
-	request = request.WithContext(origRequest.Context())
-	_, err := client.Do(request)
-	if err != nil {
-		return err
+	if metricsAddr != "" {
+		// Not http.DefaultServeMux, which net/http/pprof registers on.
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/api/v1/write", c.RemoteWriteHandler())
+		mux.Handle("/version", util.VersionHandler())
+		mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "Healthy")
+		})
+		mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+			if !c.Ready() {
+				http.Error(w, "Not polling a proxy", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "Ready")
+		})
+		if *enablePprof {
+			mux.Handle("/debug/pprof/", util.PprofHandler())
+		}
+		go func() {
+			fatal(logger, "Error serving metrics", "err", http.ListenAndServe(metricsAddr, mux))
+		}()
 	}
-	return nil
+	go notifySystemd(c, logger)
+	c.Run()
 }
 
-func loop() {
-	client := &http.Client{}
-	resp, err := client.Post(*proxyUrl+"/poll", "", strings.NewReader(*myFqdn))
-	if err != nil {
-		log.Infof("Error polling: %s", err)
-		time.Sleep(time.Second) // Don't pound the server. TODO: Randomised exponential backoff.
+// Tell systemd the client is ready once it's polling a proxy, and ping its
+// watchdog while the poll loop is going round.
+func notifySystemd(c *pushclient.Client, logger log.Logger) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
 		return
 	}
-	defer resp.Body.Close()
-	request, _ := http.ReadRequest(bufio.NewReader(resp.Body))
-	log.With("scrape_id", request.Header.Get("id")).With("url", request.URL).Info("Got scrape request")
-	request.RequestURI = ""
-
-	go doScrape(request, client)
-}
-
-func main() {
-	flag.Parse()
-	if *proxyUrl == "" {
-		log.Fatal("-proxy-url flag must be specified.")
+	for !c.Ready() {
+		time.Sleep(time.Second)
 	}
-	log.With("proxy_url", *proxyUrl).Infof("Using FQDN of %s", *myFqdn)
-	for {
-		loop()
+	if _, err := util.SystemdNotify("READY=1"); err != nil {
+		level.Warn(logger).Log("msg", "Error notifying systemd", "err", err)
 	}
+	util.RunSystemdWatchdog(c.Alive)
+}
+
+func fatal(logger log.Logger, msg string, keyvals ...interface{}) {
+	level.Error(logger).Log(append([]interface{}{"msg", msg}, keyvals...)...)
+	os.Exit(1)
 }
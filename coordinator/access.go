@@ -0,0 +1,145 @@
+package coordinator
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Tokens required as "Authorization: Bearer <token>" on requests.
+type AuthorizationConfig struct {
+	// For polls, pushes, discovery reports, remote writes and tunnels from
+	// clients.
+	ClientTokens []string `yaml:"client_tokens"`
+	// For the admin and debug endpoints, and reloading.
+	AdminTokens []string `yaml:"admin_tokens"`
+	// JWTs clients may use alongside or instead of ClientTokens.
+	ClientJWT ClientJWTConfig `yaml:"client_jwt"`
+}
+
+// Who may use the proxy. Empty lists allow everyone.
+type ACLConfig struct {
+	// Regexes matching FQDNs clients may register with.
+	ClientFQDNs []string `yaml:"client_fqdns"`
+	// Networks scrapes through the proxy and service discovery from /clients
+	// may come from.
+	ScraperCIDRs []string `yaml:"scraper_cidrs"`
+	// Networks clients may poll, push and so on from.
+	ClientCIDRs []string `yaml:"client_cidrs"`
+}
+
+// Whether the request has one of the tokens, or there are none.
+func hasToken(r *http.Request, tokens []string) bool {
+	return len(tokens) == 0 || tokenIn(clientToken(r), tokens)
+}
+
+// The bearer token of a request, empty if it has none.
+func clientToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// Whether token is one of tokens, taking the same time whichever it matches.
+func tokenIn(token string, tokens []string) bool {
+	if token == "" {
+		return false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a request to a client endpoint has a token or JWT that lets it in.
+func (rc *runtimeConfig) clientAuthenticated(r *http.Request) bool {
+	// Clients may use their token from the inventory instead, which
+	// polls check is the one for their FQDN.
+	if len(rc.inventoryTokens) > 0 && hasToken(r, rc.inventoryTokens) {
+		return true
+	}
+	// Or their tenant's, which was checked when the tenant was picked.
+	if tenant := rc.tenant(tenantOf(r.Context())); tenant != nil && len(tenant.ClientTokens) > 0 {
+		return true
+	}
+	// Or a JWT, whose subject polls check. With JWTs configured, no client
+	// tokens means only JWTs are accepted.
+	if rc.clientJWT != nil {
+		return rc.hasClientJWT(r) || len(rc.Authorization.ClientTokens) > 0 && hasToken(r, rc.Authorization.ClientTokens)
+	}
+	return hasToken(r, rc.Authorization.ClientTokens)
+}
+
+// Whether a client may register with the FQDN.
+func (rc *runtimeConfig) clientAllowed(fqdn string) bool {
+	if len(rc.clientFQDNs) == 0 {
+		return true
+	}
+	for _, re := range rc.clientFQDNs {
+		if re.MatchString(fqdn) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the remote address is in one of the networks, or there are none.
+func addrAllowed(nets []*net.IPNet, remoteAddr string) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the request is allowed, failing it if not.
+func (c *Coordinator) authorize(cfg *runtimeConfig, w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case r.URL.Host != "":
+		if !addrAllowed(cfg.scraperNets, r.RemoteAddr) {
+			c.metrics.aclRejections.WithLabelValues("scrape").Inc()
+			c.metrics.observeStage(stageAccept, c.now(), "forbidden")
+			c.scrapeErrorResponse(w, http.StatusForbidden, "forbidden", "Scrapes from this address are not allowed")
+			return false
+		}
+	case r.URL.Path == "/clients":
+		if !addrAllowed(cfg.scraperNets, r.RemoteAddr) {
+			c.metrics.aclRejections.WithLabelValues("service_discovery").Inc()
+			http.Error(w, "Service discovery from this address is not allowed", http.StatusForbidden)
+			return false
+		}
+	case r.URL.Path == "/poll" || r.URL.Path == "/push" || r.URL.Path == "/push-batch" || r.URL.Path == "/push-chunk" || r.URL.Path == "/discovery" || r.URL.Path == "/remote-write" || r.URL.Path == "/tunnel" || r.URL.Path == "/publish":
+		if !addrAllowed(cfg.clientNets, r.RemoteAddr) {
+			c.metrics.aclRejections.WithLabelValues("client").Inc()
+			http.Error(w, "Clients may not connect from this address", http.StatusForbidden)
+			return false
+		}
+		if !cfg.clientAuthenticated(r) {
+			http.Error(w, "A valid client token is required", http.StatusUnauthorized)
+			return false
+		}
+	case strings.HasPrefix(r.URL.Path, "/debug/") || r.URL.Path == "/-/reload" || strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/api/"):
+		if !hasToken(r, cfg.Authorization.AdminTokens) {
+			http.Error(w, "A valid admin token is required", http.StatusUnauthorized)
+			return false
+		}
+	}
+	return true
+}
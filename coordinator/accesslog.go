@@ -0,0 +1,160 @@
+package coordinator
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Where requests are logged, in the common log format or as JSON.
+type accessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	asJSON bool
+}
+
+func newAccessLog(path, format string) (*accessLog, error) {
+	if format != "common" && format != "json" {
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	al := &accessLog{asJSON: format == "json"}
+	if path == "-" {
+		al.w = os.Stdout
+		return al, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening access log: %s", err)
+	}
+	al.w = f
+	return al, nil
+}
+
+// A ResponseWriter that records what's needed for the access log.
+type accessRecord struct {
+	http.ResponseWriter
+	r        *http.Request
+	start    time.Time
+	duration time.Duration
+	status   int
+	bytes    int64
+	// The scrape the request was part of and the client it was for.
+	scrapeID string
+	fqdn     string
+	// The target, if the request was a scrape.
+	target string
+}
+
+func (a *accessRecord) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *accessRecord) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(p)
+	a.bytes += int64(n)
+	return n, err
+}
+
+func (a *accessRecord) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hand the connection over, such as for a tunnel.
+func (a *accessRecord) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := a.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	a.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Note which scrape and client a request was for, if it's being logged.
+func noteAccess(w http.ResponseWriter, scrapeID, fqdn string) {
+	if a, ok := w.(*accessRecord); ok {
+		a.scrapeID = scrapeID
+		a.fqdn = fqdn
+	}
+}
+
+// Note the target of a scrape, if it's being logged.
+func noteScrape(w http.ResponseWriter, target string) {
+	if a, ok := w.(*accessRecord); ok {
+		a.target = target
+	}
+}
+
+type accessEntry struct {
+	Time     string  `json:"time"`
+	Remote   string  `json:"remote_addr"`
+	User     string  `json:"user,omitempty"`
+	Method   string  `json:"method"`
+	URL      string  `json:"url"`
+	Proto    string  `json:"proto"`
+	Status   int     `json:"status"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+	ScrapeID string  `json:"scrape_id,omitempty"`
+	FQDN     string  `json:"fqdn,omitempty"`
+}
+
+func (al *accessLog) write(a *accessRecord) {
+	e := accessEntry{
+		Time:     a.start.Format(time.RFC3339Nano),
+		Remote:   a.r.RemoteAddr,
+		Method:   a.r.Method,
+		URL:      a.r.RequestURI,
+		Proto:    a.r.Proto,
+		Status:   a.status,
+		Bytes:    a.bytes,
+		Duration: a.duration.Seconds(),
+		ScrapeID: a.scrapeID,
+		FQDN:     a.fqdn,
+	}
+	if host, _, err := net.SplitHostPort(e.Remote); err == nil {
+		e.Remote = host
+	}
+	// Who presented a client certificate, if anyone did.
+	if a.r.TLS != nil && len(a.r.TLS.PeerCertificates) > 0 {
+		e.User = a.r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	var line []byte
+	if al.asJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s - %s [%s] %s %d %d %s %s\n",
+			e.Remote, orDash(e.User), a.start.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(e.Method+" "+e.URL+" "+e.Proto), e.Status, e.Bytes,
+			strconv.Quote(orDash(e.ScrapeID)), strconv.Quote(orDash(e.FQDN))))
+	}
+	al.mu.Lock()
+	al.w.Write(line)
+	al.mu.Unlock()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+package coordinator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// How often to check the certificates from the ACME CA, which renews them
+// when they're within 30 days of expiring.
+const acmeCheckInterval = time.Hour
+
+// Obtains and renews the proxy's certificates from an ACME CA such as Let's
+// Encrypt, answering its challenges over TLS-ALPN-01 on the proxy's listener
+// and HTTP-01 on ACMEHTTPAddress if set.
+type acmeManager struct {
+	c       *Coordinator
+	m       *autocert.Manager
+	domains []string
+
+	mu sync.Mutex
+	// When the certificate of each domain last handed out expires.
+	expiry map[string]time.Time
+}
+
+func newACMEManager(c *Coordinator, cfg Config) (*acmeManager, error) {
+	if cfg.TLS.enabled() {
+		return nil, errors.New("a TLS certificate can't be given as well as ACME domains")
+	}
+	if cfg.ACMECacheDir == "" {
+		return nil, errors.New("an ACME cache directory is needed to keep certificates across restarts")
+	}
+	a := &acmeManager{c: c, expiry: map[string]time.Time{}}
+	for _, d := range strings.Split(cfg.ACMEDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			a.domains = append(a.domains, d)
+		}
+	}
+	a.m = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(a.domains...),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+	}
+	if cfg.ACMEDirectoryURL != "" {
+		a.m.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+	}
+	return a, nil
+}
+
+func (a *acmeManager) isDomain(name string) bool {
+	for _, d := range a.domains {
+		if strings.EqualFold(d, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			// A TLS-ALPN-01 challenge from the CA.
+			return a.m.GetCertificate(hello)
+		}
+	}
+	cert, err := a.m.GetCertificate(hello)
+	if err != nil {
+		// Names that aren't ours are scanners and the like.
+		if a.isDomain(hello.ServerName) {
+			a.c.metrics.acmeErrors.Inc()
+			level.Warn(a.c.logger).Log("msg", "Error getting certificate from ACME CA", "domain", hello.ServerName, "err", err)
+		}
+		return nil, err
+	}
+	a.observe(strings.ToLower(hello.ServerName), cert)
+	return cert, nil
+}
+
+// Note the expiry of a certificate handed out, counting new ones.
+func (a *acmeManager) observe(domain string, cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.expiry[domain].Equal(leaf.NotAfter) {
+		return
+	}
+	a.expiry[domain] = leaf.NotAfter
+	a.c.metrics.acmeCertificates.Inc()
+	level.Info(a.c.logger).Log("msg", "Using new certificate from ACME CA", "domain", domain, "expiry", leaf.NotAfter)
+	earliest := leaf.NotAfter
+	for _, t := range a.expiry {
+		if t.Before(earliest) {
+			earliest = t
+		}
+	}
+	a.c.metrics.tlsExpiry.Set(float64(earliest.Unix()))
+}
+
+// Get the certificates of all domains every acmeCheckInterval, so they're
+// obtained before the first scrape and renewals show up in the metrics.
+func (a *acmeManager) run(stop <-chan struct{}) {
+	for {
+		for _, d := range a.domains {
+			// As a client supporting ECDSA would, so the same certificate is
+			// used.
+			a.getCertificate(&tls.ClientHelloInfo{
+				ServerName:       d,
+				SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				SupportedCurves:  []tls.CurveID{tls.CurveP256},
+				CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			})
+		}
+		timer := time.NewTimer(acmeCheckInterval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// TLS configuration using the certificates from the CA.
+func (a *acmeManager) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			protos := []string{"http/1.1", acme.ALPNProto}
+			if a.c.config().HTTP2 {
+				protos = append([]string{"h2"}, protos...)
+			}
+			return &tls.Config{GetCertificate: a.getCertificate, NextProtos: protos}, nil
+		},
+	}
+}
+
+// Answer HTTP-01 challenges from the CA on ACMEHTTPAddress, if set,
+// redirecting anything else there to HTTPS.
+func (c *Coordinator) ListenACME() error {
+	cfg := c.config()
+	if c.acme == nil || cfg.ACMEHTTPAddress == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", cfg.ACMEHTTPAddress)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: c.acme.m.HTTPHandler(nil)}
+	level.Info(c.logger).Log("msg", "Listening for ACME HTTP-01 challenges", "address", cfg.ACMEHTTPAddress)
+	go func() {
+		<-c.stop
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			level.Error(c.logger).Log("msg", "Error serving ACME HTTP-01 challenges", "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,145 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// States of a scrape in progress.
+const (
+	scrapeQueued     = "queued"
+	scrapeDispatched = "dispatched"
+)
+
+// A scrape waiting for its client to pick it up or push the result.
+type InflightScrape struct {
+	ID      string    `json:"id"`
+	FQDN    string    `json:"fqdn"`
+	URL     string    `json:"url"`
+	State   string    `json:"state"`
+	Started time.Time `json:"started"`
+	// Who asked for the scrape, and the instance of the client that picked
+	// it up and when, once one has.
+	Scraper    string     `json:"scraper,omitempty"`
+	Instance   string     `json:"instance,omitempty"`
+	Dispatched *time.Time `json:"dispatched,omitempty"`
+
+	// Gives up on the scrape, with why.
+	cancel context.CancelCauseFunc
+}
+
+func (c *Coordinator) trackScrape(s *InflightScrape) {
+	shard := c.scrapeShard(s.ID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.scrapes[s.ID] = s
+}
+
+// Note that an instance of the client picked up the scrape.
+func (c *Coordinator) markDispatched(id, instance string) {
+	shard := c.scrapeShard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if s, ok := shard.scrapes[id]; ok {
+		now := c.now()
+		s.State = scrapeDispatched
+		s.Instance = instance
+		s.Dispatched = &now
+	}
+}
+
+func (c *Coordinator) untrackScrape(id string) {
+	shard := c.scrapeShard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	delete(shard.scrapes, id)
+}
+
+// Scrapes in progress, oldest first.
+func (c *Coordinator) InflightScrapes() []InflightScrape {
+	var scrapes []InflightScrape
+	for i := range c.scrapeShards {
+		shard := &c.scrapeShards[i]
+		shard.mu.Lock()
+		for _, s := range shard.scrapes {
+			scrapes = append(scrapes, *s)
+		}
+		shard.mu.Unlock()
+	}
+	sort.Slice(scrapes, func(i, j int) bool { return scrapes[i].Started.Before(scrapes[j].Started) })
+	return scrapes
+}
+
+// The body of successful API responses.
+type apiResponse struct {
+	Status string      `json:"status"`
+	Data   interface{} `json:"data"`
+}
+
+func apiSuccess(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: data})
+}
+
+// Fail an API request with the same error body as scrapes get.
+func apiError(w http.ResponseWriter, code int, errorType, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(scrapeError{Status: "error", ErrorType: errorType, Error: msg})
+}
+
+// Serve the JSON API under /api/v1/.
+func handleAPI(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET is supported")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/")
+	switch {
+	case path == "clients":
+		apiSuccess(w, c.ClientStatuses())
+	case strings.HasPrefix(path, "clients/"):
+		fqdn := strings.TrimPrefix(path, "clients/")
+		for _, s := range c.ClientStatuses() {
+			if s.FQDN == fqdn {
+				apiSuccess(w, s)
+				return
+			}
+		}
+		apiError(w, http.StatusNotFound, "not_found", "No client with this FQDN is known: "+fqdn)
+	case path == "scrapes/inflight":
+		apiSuccess(w, c.InflightScrapes())
+	case path == "targets":
+		targets := c.TargetStats()
+		if fqdn := r.URL.Query().Get("fqdn"); fqdn != "" {
+			matching := targets[:0]
+			for _, t := range targets {
+				if t.FQDN == fqdn || fqdnHost(t.FQDN) == fqdn {
+					matching = append(matching, t)
+				}
+			}
+			targets = matching
+		}
+		apiSuccess(w, targets)
+	case path == "stats":
+		dimensions := c.config().statsDimensions
+		if by, ok := r.URL.Query()["by"]; ok {
+			var err error
+			if dimensions, err = parseStatsDimensions(strings.Join(by, ",")); err != nil {
+				apiError(w, http.StatusBadRequest, "bad_data", err.Error())
+				return
+			}
+		}
+		apiSuccess(w, c.Stats(dimensions))
+	case path == "usage":
+		clients, tenants := c.Usage()
+		apiSuccess(w, map[string]interface{}{"clients": clients, "tenants": tenants})
+	default:
+		apiError(w, http.StatusNotFound, "not_found", "Unknown API endpoint")
+	}
+}
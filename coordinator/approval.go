@@ -0,0 +1,111 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/go-kit/log/level"
+)
+
+// States of things an operator has to approve.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+)
+
+var (
+	errClientNotApproved = errors.New("client has not been approved")
+	errClientRejected    = errors.New("client has been rejected")
+	errUnknownApproval   = errors.New("no such client awaiting approval")
+)
+
+// The approval state of a client, recording it as pending if it's new. Must
+// be called with the lock of the client's shard held.
+func (c *Coordinator) approvalState(shard *clientShard, fqdn string) string {
+	cfg := c.config()
+	if !cfg.RequireApproval {
+		return approvalApproved
+	}
+	state, ok := shard.approvals[fqdn]
+	if !ok {
+		state = approvalPending
+		if cfg.autoApprove != nil && cfg.autoApprove.MatchString(fqdn) {
+			state = approvalApproved
+		}
+		shard.approvals[fqdn] = state
+		level.Info(c.logger).Log("msg", "New client", "fqdn", fqdn, "state", state)
+	}
+	return state
+}
+
+func (c *Coordinator) isApproved(fqdn string) bool {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return c.approvalState(shard, fqdn) == approvalApproved
+}
+
+// Approve or reject a client.
+func (c *Coordinator) SetClientApproval(fqdn, state string) error {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.approvals[fqdn]; !ok {
+		return errUnknownApproval
+	}
+	shard.approvals[fqdn] = state
+	level.Info(c.logger).Log("msg", "Changed approval state of client", "fqdn", fqdn, "state", state)
+	return nil
+}
+
+// A client and its approval state.
+type ClientApproval struct {
+	FQDN  string `json:"fqdn"`
+	State string `json:"state"`
+}
+
+// All clients that have needed approval.
+func (c *Coordinator) ClientApprovals() []ClientApproval {
+	approvals := []ClientApproval{}
+	for i := range c.clientShards {
+		shard := &c.clientShards[i]
+		shard.mu.Lock()
+		for fqdn, state := range shard.approvals {
+			approvals = append(approvals, ClientApproval{FQDN: fqdn, State: state})
+		}
+		shard.mu.Unlock()
+	}
+	sort.Slice(approvals, func(i, j int) bool { return approvals[i].FQDN < approvals[j].FQDN })
+	return approvals
+}
+
+// List clients and their approval state, or approve or reject one with a POST.
+func handleClientApprovals(coordinator *Coordinator, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var state string
+		switch r.FormValue("action") {
+		case "approve":
+			state = approvalApproved
+		case "reject":
+			state = approvalRejected
+		default:
+			http.Error(w, "action must be approve or reject", 400)
+			return
+		}
+		err := coordinator.SetClientApproval(r.FormValue("fqdn"), state)
+		if err == errUnknownApproval {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coordinator.ClientApprovals())
+}
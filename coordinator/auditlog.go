@@ -0,0 +1,131 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout of the suffix of rotated audit log files, which sorts by time.
+const auditLogRotatedLayout = "20060102T150405.000Z"
+
+// Where scrapes through the proxy are recorded as JSON lines, rotated once
+// the file gets too big or old and with only so many rotated files kept.
+type auditLog struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	// Counts failures to write or rotate.
+	errors func()
+	// What the age of files and their rotated names go by.
+	clock Clock
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newAuditLog(cfg Config, clock Clock, errors func()) (*auditLog, error) {
+	al := &auditLog{
+		path:     cfg.AuditLogFile,
+		maxSize:  cfg.AuditLogMaxSize,
+		maxAge:   cfg.AuditLogMaxAge,
+		maxFiles: cfg.AuditLogMaxFiles,
+		errors:   errors,
+		clock:    clock,
+	}
+	if err := al.open(); err != nil {
+		return nil, fmt.Errorf("error opening audit log: %s", err)
+	}
+	return al, nil
+}
+
+func (al *auditLog) open() error {
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.f, al.size, al.opened = f, fi.Size(), al.clock.Now()
+	return nil
+}
+
+// Move the current file aside with the time as a suffix, start a new one and
+// delete the oldest rotated files beyond maxFiles.
+func (al *auditLog) rotate() error {
+	al.f.Close()
+	rotated := al.path + "." + al.clock.Now().UTC().Format(auditLogRotatedLayout)
+	if err := os.Rename(al.path, rotated); err != nil {
+		// Keep appending to the file we have.
+		if openErr := al.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := al.open(); err != nil {
+		return err
+	}
+	old, _ := filepath.Glob(al.path + ".[0-9]*")
+	sort.Strings(old)
+	for al.maxFiles > 0 && len(old) > al.maxFiles {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
+
+type auditEntry struct {
+	Time      string  `json:"time"`
+	ScrapeID  string  `json:"scrape_id,omitempty"`
+	Requester string  `json:"requester_ip"`
+	Target    string  `json:"target_url"`
+	Client    string  `json:"client,omitempty"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration_seconds"`
+}
+
+func (al *auditLog) write(a *accessRecord) {
+	e := auditEntry{
+		Time:      a.start.UTC().Format(time.RFC3339Nano),
+		ScrapeID:  a.scrapeID,
+		Requester: a.r.RemoteAddr,
+		Target:    a.target,
+		Client:    a.fqdn,
+		Status:    a.status,
+		Bytes:     a.bytes,
+		Duration:  a.duration.Seconds(),
+	}
+	if host, _, err := net.SplitHostPort(e.Requester); err == nil {
+		e.Requester = strings.Trim(host, "[]")
+	}
+	if e.Status == 0 {
+		e.Status = 200
+	}
+	line, _ := json.Marshal(e)
+	line = append(line, '\n')
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.size > 0 && (al.maxSize > 0 && al.size+int64(len(line)) > al.maxSize || al.maxAge > 0 && al.clock.Now().Sub(al.opened) >= al.maxAge) {
+		if err := al.rotate(); err != nil {
+			al.errors()
+		}
+	}
+	n, err := al.f.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		al.errors()
+	}
+}
@@ -0,0 +1,168 @@
+package coordinator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// The answer to scrapes of a blocked client, unless the block sets another.
+const (
+	defaultBlockStatus = http.StatusServiceUnavailable
+	defaultBlockBody   = "Client is blocked for maintenance\n"
+)
+
+// A client, or some of its paths, whose scrapes are answered by the proxy
+// rather than sent to it, such as during a maintenance window.
+type Block struct {
+	// As admin endpoints show it, <tenant>/<fqdn> for tenants' clients. With
+	// a port only scrapes of that port are blocked.
+	FQDN string `json:"fqdn"`
+	// Only these paths are blocked, or all of them if there are none.
+	Paths   []string   `json:"paths,omitempty"`
+	Status  int        `json:"status"`
+	Body    string     `json:"body"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (b *Block) blocks(path string) bool {
+	if len(b.Paths) == 0 {
+		return true
+	}
+	for _, p := range b.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Block scrapes of a client, replacing any earlier block of it.
+func (c *Coordinator) SetBlock(b Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocks[b.FQDN] = &b
+	level.Info(c.logger).Log("msg", "Blocked client", "fqdn", b.FQDN, "paths", fmt.Sprint(b.Paths), "status", b.Status)
+}
+
+// Unblock a client, returning whether it was blocked.
+func (c *Coordinator) RemoveBlock(fqdn string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.blocks[fqdn]
+	delete(c.blocks, fqdn)
+	if ok {
+		level.Info(c.logger).Log("msg", "Unblocked client", "fqdn", fqdn)
+	}
+	return ok
+}
+
+// Clients that are blocked, by FQDN.
+func (c *Coordinator) Blocks() []Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blocks := make([]Block, 0, len(c.blocks))
+	for _, b := range c.blocks {
+		if b.Expires == nil || c.now().Before(*b.Expires) {
+			blocks = append(blocks, *b)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].FQDN < blocks[j].FQDN })
+	return blocks
+}
+
+// Forget blocks that have expired. Must be called with the lock held.
+func (c *Coordinator) gcBlocks() {
+	for fqdn, b := range c.blocks {
+		if b.Expires != nil && !c.now().Before(*b.Expires) {
+			delete(c.blocks, fqdn)
+		}
+	}
+}
+
+// The answer to a scrape of a blocked client, or nil if it isn't blocked.
+func (c *Coordinator) blockedResponse(tenant string, r *http.Request) *http.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.blocks) == 0 {
+		return nil
+	}
+	var block *Block
+	// A block of the port takes precedence over one of the whole client.
+	for _, fqdn := range []string{r.URL.Host, r.URL.Hostname()} {
+		if b, ok := c.blocks[tenantClient(tenant, fqdn)]; ok && (b.Expires == nil || c.now().Before(*b.Expires)) && b.blocks(r.URL.Path) {
+			block = b
+			break
+		}
+	}
+	if block == nil {
+		return nil
+	}
+	contentType := "text/plain; charset=utf-8"
+	if block.Status/100 == 2 {
+		contentType = "text/plain; version=0.0.4"
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", block.Status, http.StatusText(block.Status)),
+		StatusCode:    block.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}, "Content-Length": {strconv.Itoa(len(block.Body))}},
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(block.Body))),
+		ContentLength: int64(len(block.Body)),
+		Request:       r,
+	}
+}
+
+// List blocked clients, block one with a POST, or unblock one with a DELETE.
+func handleBlocklist(coordinator *Coordinator, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		b := Block{FQDN: r.FormValue("fqdn"), Status: defaultBlockStatus, Body: defaultBlockBody}
+		if b.FQDN == "" {
+			http.Error(w, "fqdn is required", 400)
+			return
+		}
+		b.Paths = r.Form["path"]
+		if s := r.FormValue("status"); s != "" {
+			status, err := strconv.Atoi(s)
+			if err != nil || status < 200 || status > 599 {
+				http.Error(w, "status must be an HTTP status code", 400)
+				return
+			}
+			b.Status = status
+		}
+		if _, ok := r.Form["body"]; ok {
+			b.Body = r.FormValue("body")
+		}
+		if s := r.FormValue("duration"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				http.Error(w, "duration must be positive", 400)
+				return
+			}
+			expires := coordinator.now().Add(d).UTC()
+			b.Expires = &expires
+		}
+		coordinator.SetBlock(b)
+	case "DELETE":
+		if !coordinator.RemoveBlock(r.FormValue("fqdn")) {
+			http.Error(w, fmt.Sprintf("Client %q is not blocked", r.FormValue("fqdn")), 404)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coordinator.Blocks())
+}
@@ -0,0 +1,47 @@
+package coordinator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+var (
+	errPushCorrupted = errors.New("pushed result does not match its checksum")
+	errPushTooLarge  = errors.New("push with a checksum is too large to verify")
+)
+
+// Read the whole of a push whose client sent a checksum, up to the most
+// bytes held to verify one, and check it before anything of it is passed on.
+// Pushes without one, such as from older clients, are passed on unchecked.
+func (c *Coordinator) verifyPush(cfg *runtimeConfig, w http.ResponseWriter, r *http.Request) error {
+	if _, ok := r.Trailer[http.CanonicalHeaderKey(util.ContentSHA256Trailer)]; !ok {
+		return nil
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.VerifyPushMaxBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("%w, the limit is %d bytes", errPushTooLarge, tooLarge.Limit)
+	}
+	if err != nil {
+		return err
+	}
+	if got, want := checksumOf(body), r.Trailer.Get(util.ContentSHA256Trailer); got != want {
+		c.metrics.corruptedPushes.Inc()
+		return fmt.Errorf("%w: got %q, the client sent %q", errPushCorrupted, got, want)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// The hex SHA-256 of a push's body as sent.
+func checksumOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,29 @@
+package coordinator
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Add a label with the FQDN of the client a scrape went through to its
+// samples, as it's streamed. Responses in other formats, compressed by the
+// target or that aren't a successful scrape are left as they are.
+func addClientLabel(resp *http.Response, label, fqdn string) {
+	if resp.StatusCode/100 != 2 || resp.Header.Get(util.ScrapeErrorHeader) != "" || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	el := util.NewExtraLabels(map[string]string{label: fqdn})
+	contentType := resp.Header.Get("Content-Type")
+	switch {
+	case util.CanAddLabels(contentType):
+		util.RewriteBody(resp, func(w io.Writer, r io.Reader) error {
+			return util.AddLabels(w, r, el)
+		})
+	case util.IsProtoDelimited(contentType):
+		util.RewriteBody(resp, func(w io.Writer, r io.Reader) error {
+			return util.AddLabelsProto(w, r, el)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package coordinator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// Keeps a Consul service registered for each known client, with a TTL check
+// that passes while it's polling, for consul_sd_configs.
+type consulSync struct {
+	c      *Coordinator
+	client *http.Client
+	// Clients registered, and the tags they were registered with.
+	registered map[string]string
+}
+
+func newConsulSync(c *Coordinator) *consulSync {
+	return &consulSync{c: c, client: &http.Client{Timeout: 10 * time.Second}, registered: map[string]string{}}
+}
+
+// The Consul service ID of a client, which can't have a /.
+func consulServiceID(key string) string {
+	return "pushprox:" + strings.Replace(key, "/", ":", -1)
+}
+
+// Sync every interval until stop is closed.
+func (s *consulSync) run(stop <-chan struct{}, interval time.Duration) {
+	for {
+		s.sync(interval)
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Register new clients and ones whose labels changed, pass the checks of all
+// of them and deregister those that are gone.
+func (s *consulSync) sync(interval time.Duration) {
+	cfg := s.c.config()
+	current := map[string][]string{}
+	for _, key := range s.c.KnownClients() {
+		labels := s.c.clientLabels(key)
+		tags := make([]string, 0, len(labels))
+		for name, value := range labels {
+			tags = append(tags, name+"="+value)
+		}
+		sort.Strings(tags)
+		current[key] = tags
+	}
+	for key, tags := range current {
+		id := consulServiceID(key)
+		sig := strings.Join(tags, ",")
+		if old, ok := s.registered[key]; !ok || old != sig {
+			tenant, fqdn := splitTenantClient(key)
+			meta := map[string]string{"fqdn": fqdn}
+			if tenant != "" {
+				meta["tenant"] = tenant
+			}
+			service := map[string]interface{}{
+				"ID":   id,
+				"Name": cfg.ConsulService,
+				// The guess at where the client's exporter is, for
+				// __address__.
+				"Address": fqdn,
+				"Port":    cfg.ConsulServicePort,
+				"Tags":    tags,
+				"Meta":    meta,
+				"Check": map[string]string{
+					"CheckID": id,
+					// Missing a couple of syncs fails it.
+					"TTL":                            (3 * interval).String(),
+					"DeregisterCriticalServiceAfter": cfg.RegistrationTimeout.String(),
+				},
+			}
+			if err := s.put(cfg, "/v1/agent/service/register", service); err != nil {
+				continue
+			}
+			s.registered[key] = sig
+		}
+		s.put(cfg, "/v1/agent/check/pass/"+id, nil)
+	}
+	for key := range s.registered {
+		if _, ok := current[key]; !ok {
+			if err := s.put(cfg, "/v1/agent/service/deregister/"+consulServiceID(key), nil); err == nil {
+				delete(s.registered, key)
+			}
+		}
+	}
+}
+
+func (s *consulSync) put(cfg *runtimeConfig, path string, body interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest("PUT", strings.TrimSuffix(cfg.ConsulAddress, "/")+path, r)
+	if err == nil {
+		if cfg.ConsulToken != "" {
+			req.Header.Set("X-Consul-Token", cfg.ConsulToken)
+		}
+		var resp *http.Response
+		if resp, err = s.client.Do(req); err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		level.Warn(s.c.logger).Log("msg", "Error updating Consul", "path", path, "err", err)
+		s.c.metrics.consulErrors.Inc()
+	}
+	return err
+}
@@ -0,0 +1,973 @@
+package coordinator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// How long to remember that a scrape was answered, which is longer than
+// any scrape could still be in progress for.
+const answeredRetention = 10 * time.Minute
+
+var (
+	errCoordinatorFull = errors.New("coordinator has reached its maximum number of clients")
+	errNoClient        = errors.New("matching client not found")
+	errUnknownClient   = errors.New("no client with this FQDN has registered")
+	errQueueFull       = errors.New("too many scrapes waiting for client")
+	errTooManyInflight = errors.New("too many scrapes in progress")
+	errNoResponse      = errors.New("client did not push a result in time")
+	errClientStale     = errors.New("client has not polled recently")
+	errDuplicateResult = errors.New("a result for this scrape was already received")
+	errDuplicateID     = errors.New("a scrape with the same ID is outstanding")
+	errAbandoned       = errors.New("the scraper went away before the result was relayed")
+	errOrphaned        = errors.New("no scrape is waiting for this result")
+	errUnknownScrape   = errors.New("no scrape was issued with this ID")
+	errExpiredScrape   = errors.New("the scrape this result is for has expired")
+	errInvalidResult   = errors.New("client pushed a malformed exposition")
+)
+
+type Coordinator struct {
+	// Goroutines in DoScrape and WaitForScrapeInstruction. First for the
+	// alignment atomic needs.
+	scrapesInProgress int64
+	pollsWaiting      int64
+	// When the GC last finished, in Unix nanoseconds.
+	lastGC int64
+	// Clients known over all shards, so the maximum can be checked without
+	// locking them all.
+	knownClients int64
+
+	logger   log.Logger
+	clock    Clock
+	resolver Resolver
+	// The *runtimeConfig in effect.
+	cfg     atomic.Value
+	metrics *metrics
+	// The *tlsBundle in effect, nil without TLS.
+	tlsBundle atomic.Value
+
+	// What's used for every poll and scrape, by client and by scrape ID,
+	// each shard with a lock of its own rather than under mu.
+	clientShards [stateShards]clientShard
+	scrapeShards [stateShards]scrapeShard
+
+	mu sync.Mutex
+
+	// In progress scrapes that others can share the result of.
+	coalescing map[string]*coalescedScrape
+	// The last successful scrape of each target, for caching and stale serving.
+	lastGood map[string]*cachedResponse
+	// The latest result clients in push mode published of each target.
+	published map[string]*cachedResponse
+	// The scrape rate limit of all clients together, under its own lock.
+	globalLimiterMu sync.Mutex
+	globalLimiter   *rate.Limiter
+	// The current or last restart rollout.
+	rollout *restartRollout
+	// Targets clients found on their LAN, by host:port.
+	discovered map[string]*DiscoveredTarget
+	// DNS checks of clients, by FQDN and address.
+	dnsChecks map[string]*dnsCheck
+	// Pushes arriving in chunks by scrape ID, and the bytes they'll take.
+	chunkedPushes map[string]*chunkedPush
+	chunkedBytes  int64
+	// Clients whose scrapes are answered by the proxy, by FQDN.
+	blocks map[string]*Block
+	// Tunnels waiting for their client to connect back, by ID.
+	tunnels map[string]chan tunnelResult
+
+	// Recent scrape failures, for debugging.
+	failures *failureStats
+	// How scrapes of each target have gone, for the API.
+	targets *targetStats
+	// Registrations shared with other proxies, nil if there are none.
+	shared sharedState
+	// Where requests are logged, nil if they aren't.
+	accessLog *accessLog
+	// Where scrapes are recorded, nil if they aren't.
+	auditLog *auditLog
+
+	// Closed once the coordinator starts draining to shut down.
+	draining  chan struct{}
+	drainOnce sync.Once
+	drain     *drainStats
+	// Closed by Stop.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// Contents of the last TLS files that failed to load.
+	badTLSSum [sha256.Size]byte
+	// Gets certificates from an ACME CA, if enabled.
+	acme *acmeManager
+	// Results clients push deltas against.
+	deltas *deltaBases
+	// Serves /debug/pprof/, if enabled.
+	pprof http.Handler
+
+	// Where to reload configuration from.
+	configFile string
+	baseConfig Config
+}
+
+// A new coordinator, with its metrics registered with reg if it's not nil. If
+// logger is a util.LevelSetter, its level follows the configuration.
+func New(cfg Config, reg prometheus.Registerer, logger log.Logger) (*Coordinator, error) {
+	return NewWithOptions(cfg, Options{Registerer: reg, Logger: logger})
+}
+
+// A new coordinator, using what opts gives in place of the defaults.
+func NewWithOptions(cfg Config, opts Options) (*Coordinator, error) {
+	logger, reg, clock := opts.Logger, opts.Registerer, opts.Clock
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	resolver := opts.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	c := &Coordinator{
+		logger:        logger,
+		clock:         clock,
+		resolver:      resolver,
+		metrics:       newMetrics(clock),
+		failures:      newFailureStats(clock),
+		targets:       newTargetStats(clock),
+		blocks:        map[string]*Block{},
+		chunkedPushes: map[string]*chunkedPush{},
+		coalescing:    map[string]*coalescedScrape{},
+		lastGood:      map[string]*cachedResponse{},
+		published:     map[string]*cachedResponse{},
+		discovered:    map[string]*DiscoveredTarget{},
+		dnsChecks:     map[string]*dnsCheck{},
+		tunnels:       map[string]chan tunnelResult{},
+		draining:      make(chan struct{}),
+		stop:          make(chan struct{}),
+		drain:         &drainStats{notified: map[string]struct{}{}},
+		deltas:        newDeltaBases(),
+		pprof:         opts.Pprof,
+		lastGC:        clock.Now().UnixNano(),
+	}
+	c.initShards()
+	err := c.ApplyConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.metrics.configReloadSuccess.Set(1)
+	c.metrics.configReloadTime.SetToCurrentTime()
+	if c.shared, err = newSharedState(cfg, logger); err != nil {
+		return nil, err
+	}
+	if cfg.ACMEDomains != "" {
+		if c.acme, err = newACMEManager(c, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AccessLogFile != "" {
+		if c.accessLog, err = newAccessLog(cfg.AccessLogFile, cfg.AccessLogFormat); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AuditLogFile != "" {
+		if c.auditLog, err = newAuditLog(cfg, clock, c.metrics.auditLogErrors.Inc); err != nil {
+			return nil, err
+		}
+	}
+	if reg != nil {
+		if err := c.metrics.register(reg, append(c.internalCollectors(), newInventoryCollector(c), newUsageCollector(c), newProtocolCollector(c), newRollupCollector(c))...); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Run the coordinator's background work, such as expiring clients, until ctx
+// is done or Stop is called.
+func (c *Coordinator) Run(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Stop()
+		case <-c.stop:
+		}
+	}()
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	run(c.gc)
+	run(c.watchTLS)
+	if peers, ok := c.shared.(*peerState); ok {
+		run(func() { peers.run(c.stop, c.config().SharedPeerInterval) })
+	}
+	if cfg := c.config(); cfg.ConsulAddress != "" {
+		run(func() { newConsulSync(c).run(c.stop, cfg.ConsulSyncInterval) })
+	}
+	if c.acme != nil {
+		run(func() { c.acme.run(c.stop) })
+	}
+	if cfg := c.config(); cfg.NATSURL != "" {
+		run(func() { newNATSBridge(c).run(c.stop, cfg.NATSURL) })
+	}
+	wg.Wait()
+}
+
+// Stop the coordinator's background work, and answer waiting polls so their
+// clients go elsewhere.
+func (c *Coordinator) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// Prefix of IDs, for the format of what follows it. IDs from before it was
+// added were <unix time>-<counter>-<pid>. Clients treat IDs as opaque.
+const idVersion = "v2-"
+
+// Generate a unique ID, a random UUID so IDs can't be guessed or repeat
+// across restarts.
+func genId() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("error generating ID: %s", err))
+	}
+	// Version 4, variant 10.
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%s%x-%x-%x-%x-%x", idVersion, b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Generate an ID for a scrape that no outstanding scrape has.
+func (c *Coordinator) newScrapeID() string {
+	for {
+		id := genId()
+		shard := c.scrapeShard(id)
+		shard.mu.Lock()
+		_, issued := shard.issued[id]
+		_, waiting := shard.responses[id]
+		shard.mu.Unlock()
+		if !issued && !waiting {
+			return id
+		}
+		c.metrics.scrapeIDCollisions.Inc()
+		level.Warn(c.logger).Log("msg", "Generated the ID of an outstanding scrape, generating another", "scrape_id", id)
+	}
+}
+
+// A scrape waiting for its result to be pushed.
+type pendingResult struct {
+	// The client the scrape went to.
+	fqdn string
+	// The scrape this is an attempt of, and when it started waiting.
+	scrapeID string
+	since    time.Time
+	results  chan *http.Response
+	// Closed once the scrape stops waiting, such as when it times out.
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Stop waiting for the result, however many times it's called.
+func (p *pendingResult) stop() {
+	p.stopOnce.Do(func() { close(p.done) })
+}
+
+// Start waiting for the result of a scrape, before it's handed to a client
+// so a result can't arrive before there's anywhere to deliver it.
+// The result of the scrape is only accepted until it expires.
+func (c *Coordinator) expectResult(id, scrapeID, fqdn string, expires time.Time) (*pendingResult, error) {
+	shard := c.scrapeShard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.responses[id]; ok {
+		c.metrics.scrapeIDCollisions.Inc()
+		return nil, errDuplicateID
+	}
+	p := &pendingResult{fqdn: fqdn, scrapeID: scrapeID, since: c.now(), results: make(chan *http.Response), done: make(chan struct{})}
+	shard.responses[id] = p
+	shard.issued[id] = expires
+	return p, nil
+}
+
+// The scrape waiting for a result, if any is.
+func (c *Coordinator) pendingResultFor(id string) (*pendingResult, bool) {
+	shard := c.scrapeShard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	p, ok := shard.responses[id]
+	return p, ok
+}
+
+func (c *Coordinator) getControlChannel(fqdn string) chan string {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	ch, ok := shard.control[fqdn]
+	if !ok {
+		ch = make(chan string, 10)
+		shard.control[fqdn] = ch
+	}
+	return ch
+}
+
+// Queue a control message for the client, delivered on its next poll.
+func (c *Coordinator) sendControl(fqdn, msg string) {
+	select {
+	case c.getControlChannel(fqdn) <- msg:
+	default:
+		level.Warn(c.logger).Log("msg", "Too many queued control messages for client, dropping", "fqdn", fqdn, "control", msg)
+	}
+}
+
+// Stop waiting for the result of a scrape, so a result being pushed for it
+// is dropped at once.
+func (c *Coordinator) forgetResult(id string, p *pendingResult) {
+	shard := c.scrapeShard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	delete(shard.responses, id)
+	p.stop()
+}
+
+// How long a scrape of the target may take, at most its client's maximum.
+// Cold start targets get an extended timeout until they've been scraped once
+// since their client registered.
+func (c *Coordinator) ScrapeTimeout(r *http.Request) time.Duration {
+	cfg := c.config()
+	timeouts := cfg.ScrapeTimeouts
+	timeouts.Max = c.clientLimits(clientKey(r.Context(), c.routeFor(r.URL))).MaxScrapeTimeout
+	timeout := timeouts.GetScrapeTimeout(r.Header)
+	if cfg.coldStart == nil || !cfg.coldStart.MatchString(r.URL.Host) || timeout >= cfg.ColdStartTimeout {
+		return timeout
+	}
+	fqdn := NormalizeFQDN(hostname(r.URL.Host))
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.warm[fqdn][r.URL.Host]; ok {
+		return timeout
+	}
+	return cfg.ColdStartTimeout
+}
+
+func (c *Coordinator) markWarm(target string) {
+	fqdn := NormalizeFQDN(hostname(target))
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.warm[fqdn] == nil {
+		shard.warm[fqdn] = map[string]struct{}{}
+	}
+	shard.warm[fqdn][target] = struct{}{}
+}
+
+type dispatchTimeoutKey struct{}
+
+// Limit how long a scrape waits for a client to pick it up, separately from
+// its overall deadline.
+func withDispatchTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, dispatchTimeoutKey{}, d)
+}
+
+// Request a scrape.
+func (c *Coordinator) DoScrape(ctx context.Context, r *http.Request) (*http.Response, error) {
+	cfg := c.config()
+	inProgress := atomic.AddInt64(&c.scrapesInProgress, 1)
+	defer atomic.AddInt64(&c.scrapesInProgress, -1)
+	if cfg.MaxInflight > 0 && inProgress > int64(cfg.MaxInflight) {
+		err := fmt.Errorf("%w, the limit is %d", errTooManyInflight, cfg.MaxInflight)
+		c.metrics.observeStage(stageAccept, c.now(), failureReasonForError(err))
+		return nil, err
+	}
+	if owner := cfg.shardOwner(clientKey(ctx, c.routeFor(r.URL))); owner != "" && r.Header.Get(forwardedHeader) == "" {
+		return c.forwardToShard(ctx, r, owner)
+	}
+	if resp := c.blockedResponse(tenantOf(ctx), r); resp != nil {
+		level.Debug(c.logger).Log("msg", "Answering scrape of blocked client", "url", r.URL.String())
+		c.metrics.blockedScrapes.Inc()
+		return resp, nil
+	}
+	if stub := cfg.maintenanceStub(r); stub != nil && tenantOf(ctx) == "" {
+		level.Debug(c.logger).Log("msg", "Serving maintenance stub", "url", r.URL.String())
+		return stub, nil
+	}
+	if resp := c.publishedResult(ctx, r); resp != nil {
+		level.Debug(c.logger).Log("msg", "Serving published scrape", "url", r.URL.String())
+		return resp, nil
+	}
+	interval := cfg.minInterval(r.URL)
+	// Only GETs can be shared, others may change something on the target.
+	if r.Method != http.MethodGet || cfg.CoalesceWindow <= 0 && cfg.CacheTTL <= 0 && cfg.StaleMaxAge <= 0 && interval <= 0 {
+		return c.doScrape(ctx, r)
+	}
+
+	// Different formats and encodings may be negotiated, so those can't be
+	// shared.
+	key := tenantOf(ctx) + " " + r.URL.String() + " " + r.Header.Get("Accept") + " " + r.Header.Get("Accept-Encoding")
+	if cached := c.getCachedResponse(key); cached != nil {
+		level.Debug(c.logger).Log("msg", "Serving cached scrape", "url", r.URL.String())
+		return cached.copy(), nil
+	}
+	if interval > 0 && !c.allowScrape(limitedTarget(r.URL), interval) {
+		if cr := c.getLastGood(key, interval); cr != nil {
+			level.Debug(c.logger).Log("msg", "Scraped too often, serving last result", "url", r.URL.String())
+			resp := cr.result.copy()
+			resp.Header.Set("X-PushProx-Stale", fmt.Sprintf("%f", c.since(cr.at).Seconds()))
+			return resp, nil
+		}
+		err := fmt.Errorf("%w: %q more often than every %s", errTooFrequent, r.URL.Host, interval)
+		c.metrics.observeStage(stageAccept, c.now(), failureReasonForError(err))
+		return nil, err
+	}
+	scrapeCtx := ctx
+	if c.hasStaleResponse(key) {
+		// Leave time to serve the stale response before the scraper gives up.
+		if deadline, ok := ctx.Deadline(); ok {
+			scrapeCtx = withDispatchTimeout(ctx, time.Until(deadline)/2)
+		}
+	}
+	result, err := c.doBufferedScrape(scrapeCtx, key, r)
+	if errors.Is(err, errNoClient) || errors.Is(err, errUnknownClient) || errors.Is(err, errClientStale) {
+		if stale := c.getStaleResponse(key); stale != nil {
+			level.Info(c.logger).Log("msg", "No client, serving stale scrape", "url", r.URL.String())
+			return stale, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.resp.StatusCode/100 == 2 {
+		c.setLastGood(key, result)
+	}
+	return result.copy(), nil
+}
+
+func (c *Coordinator) doScrape(ctx context.Context, r *http.Request) (resp *http.Response, err error) {
+	st := c.metrics.startStage(stageAccept)
+	defer func() { st.end(stageOutcome(resp, err)) }()
+	fqdn := clientKey(ctx, c.routeFor(r.URL))
+	if client, ok := c.discoveredTargetClient(tenantOf(ctx), r.URL.Host); ok {
+		fqdn = client
+	}
+	if !c.isKnownClient(fqdn) {
+		if resp, ok, err := c.forwardScrape(ctx, r, fqdn); ok {
+			return resp, err
+		}
+		return nil, fmt.Errorf("%w: %q", errUnknownClient, fqdn)
+	}
+	// Don't pass on that it was forwarded to the target.
+	r.Header.Del(forwardedHeader)
+	if !c.isApproved(fqdn) {
+		return nil, fmt.Errorf("%w: %q", errClientNotApproved, fqdn)
+	}
+	if freshness := c.config().ClientFreshness; freshness > 0 && !c.polledWithin(fqdn, freshness) {
+		c.metrics.staleClientScrapes.Inc()
+		return nil, fmt.Errorf("%w: %q not within %s", errClientStale, fqdn, freshness)
+	}
+	if !c.allowRate(fqdn) {
+		return nil, fmt.Errorf("%w for %q", errRateLimited, fqdn)
+	}
+	if c.overQuota(c.config(), fqdn) {
+		return nil, fmt.Errorf("%w for %q", errQuotaExceeded, fqdn)
+	}
+	if err := c.enqueue(fqdn); err != nil {
+		return nil, err
+	}
+	defer func() {
+		c.failures.recordScrape(fqdn, err != nil || resp.StatusCode/100 != 2 || resp.Header.Get(util.ScrapeErrorHeader) != "")
+	}()
+	dequeued := false
+	dequeue := func() {
+		if !dequeued {
+			c.dequeue(fqdn)
+			dequeued = true
+		}
+	}
+	defer dequeue()
+
+	id := c.newScrapeID()
+	level.Debug(c.logger).Log("msg", "DoScrape", "scrape_id", id, "fqdn", fqdn, "url", r.URL.String())
+	// Set rather than added, so an Id the scraper sent can't stand in for ours.
+	r.Header.Set("Id", id)
+	// The watchdog gives up on scrapes stuck long past any timeout.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer func() {
+		if err != nil && context.Cause(ctx) == errStuckScrape {
+			err = errStuckScrape
+		}
+	}()
+	c.trackScrape(&InflightScrape{ID: id, FQDN: fqdn, URL: r.URL.String(), State: scrapeQueued, Started: c.now(), Scraper: r.RemoteAddr, cancel: cancel})
+	defer c.untrackScrape(id)
+	cfg := c.config()
+	priority := cfg.scrapePriority(r)
+	r.Header.Del(util.PriorityHeader)
+	dispatchTimeout := cfg.DispatchTimeout
+	if d, ok := ctx.Value(dispatchTimeoutKey{}).(time.Duration); ok && (dispatchTimeout <= 0 || d < dispatchTimeout) {
+		dispatchTimeout = d
+	}
+
+	// Results are only accepted until the scrape times out, by the clock
+	// everything else expires by.
+	deadline := c.now().Add(cfg.ScrapeTimeouts.Max)
+	if d, ok := ctx.Deadline(); ok {
+		deadline = c.now().Add(time.Until(d))
+	}
+
+	// Hand the scrape to an instance of the client not tried yet, and wait
+	// for its result.
+	tried := map[string]bool{}
+	attempt := func(attemptID string) (resp *http.Response, instance string, err error) {
+		dispatchCtx := ctx
+		if dispatchTimeout > 0 {
+			var cancel context.CancelFunc
+			dispatchCtx, cancel = context.WithTimeout(ctx, dispatchTimeout)
+			defer cancel()
+		}
+		pending, err := c.expectResult(attemptID, id, fqdn, deadline)
+		if err != nil {
+			return nil, "", err
+		}
+		defer c.forgetResult(attemptID, pending)
+		if signer := cfg.scrapeSigner; signer != nil {
+			if err := signer.Sign(r, deadline); err != nil {
+				return nil, "", fmt.Errorf("error signing scrape request: %w", err)
+			}
+		}
+		dispatched := c.now()
+		if instance, err = c.dispatch(dispatchCtx, fqdn, r, tried, priority); err != nil {
+			return nil, "", err
+		}
+		pickedUp := c.now()
+		dequeue()
+		st.next(stageClientScrape)
+		c.markDispatched(id, instance)
+		c.addInFlight(fqdn, 1)
+		defer c.addInFlight(fqdn, -1)
+		defer func() { c.drainedScrape(err) }()
+
+		var responseTimeout <-chan time.Time
+		if cfg.ResponseTimeout > 0 {
+			timer := time.NewTimer(cfg.ResponseTimeout)
+			defer timer.Stop()
+			responseTimeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return nil, instance, ctx.Err()
+		case <-responseTimeout:
+			return nil, instance, fmt.Errorf("%w for %q after %s", errNoResponse, r.URL.String(), cfg.ResponseTimeout)
+		case resp := <-pending.results:
+			c.metrics.notePhases(resp, pickedUp.Sub(dispatched), c.since(pickedUp))
+			if cfg.coldStart != nil && resp.StatusCode/100 == 2 {
+				c.markWarm(r.URL.Host)
+			}
+			if cfg.Validate {
+				if err := c.validateResult(resp, fqdn); err != nil {
+					return nil, instance, err
+				}
+			}
+			if cfg.ClientLabel != "" {
+				_, name := splitTenantClient(fqdn)
+				addClientLabel(resp, cfg.ClientLabel, name)
+			}
+			return resp, instance, nil
+		}
+	}
+
+	st.next(stageDispatch)
+	attemptID := id
+	for retries := 0; ; retries++ {
+		resp, instance, err := attempt(attemptID)
+		if err != nil && instance == "" {
+			return nil, err
+		}
+		tried[instance] = true
+		if retries >= cfg.PoolRetries || !retryOnAnotherInstance(resp, err) || ctx.Err() != nil || !c.hasUntriedInstance(fqdn, tried) {
+			return resp, err
+		}
+		level.Debug(c.logger).Log("msg", "Retrying scrape on another instance of the client", "scrape_id", id, "fqdn", fqdn, "instance", instance, "err", err)
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		c.metrics.poolRetries.Inc()
+		st.nextAfter(stageOutcome(resp, err), stageDispatch)
+		attemptID = c.newScrapeID()
+		r.Header.Set("Id", attemptID)
+		if r.GetBody != nil {
+			if r.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Record that a client is polling, without waiting for a scrape for it.
+func (c *Coordinator) RegisterClient(fqdn string) error {
+	if !c.addKnownClient(fqdn) {
+		return errCoordinatorFull
+	}
+	c.registerShared(fqdn)
+	if c.clientRejected(fqdn) {
+		return errClientRejected
+	}
+	return nil
+}
+
+// Client registering to accept a scrape request. Blocking.
+// Returns either a scrape request or a control message for the client.
+func (c *Coordinator) WaitForScrapeInstruction(fqdn string) (*http.Request, string, error) {
+	return c.WaitForInstanceScrapeInstruction(context.Background(), fqdn, "")
+}
+
+// As WaitForScrapeInstruction, for one of several instances of a client
+// registered with the same FQDN, giving up once ctx is done. Scrapes are
+// spread over the instances polling.
+func (c *Coordinator) WaitForInstanceScrapeInstruction(ctx context.Context, fqdn, instance string) (*http.Request, string, error) {
+	level.Debug(c.logger).Log("msg", "WaitForScrapeInstruction", "fqdn", fqdn, "instance", instance)
+	atomic.AddInt64(&c.pollsWaiting, 1)
+	defer atomic.AddInt64(&c.pollsWaiting, -1)
+	if err := c.RegisterClient(fqdn); err != nil {
+		return nil, "", err
+	}
+	if c.isDraining() {
+		c.notifyShutdown(fqdn)
+		return nil, "", errShuttingDown
+	}
+	if rollout := c.currentRollout(); rollout != nil {
+		rollout.clientPolled(fqdn)
+	}
+	control := c.getControlChannel(fqdn)
+	for {
+		p := c.addIdlePoll(fqdn, instance)
+		select {
+		case msg := <-control:
+			if !c.removeIdlePoll(fqdn, p) {
+				// Handed a scrape at the same time, the message can wait.
+				c.sendControl(fqdn, msg)
+				return <-p.requests, "", nil
+			}
+			if rollout := c.currentRollout(); msg == util.ControlRestart && rollout != nil {
+				rollout.restartDelivered(fqdn)
+			}
+			return nil, msg, nil
+		case <-c.draining:
+			if !c.removeIdlePoll(fqdn, p) {
+				return <-p.requests, "", nil
+			}
+			c.notifyShutdown(fqdn)
+			return nil, "", errShuttingDown
+		case <-c.stop:
+			if !c.removeIdlePoll(fqdn, p) {
+				return <-p.requests, "", nil
+			}
+			return nil, "", errShuttingDown
+		case <-ctx.Done():
+			if !c.removeIdlePoll(fqdn, p) {
+				return <-p.requests, "", nil
+			}
+			return nil, "", ctx.Err()
+		case request := <-p.requests:
+			select {
+			case <-request.Context().Done():
+				// Request has timed out, get another one.
+			default:
+				return request, "", nil
+			}
+		}
+	}
+}
+
+// A response body that signals when whoever is relaying it is done with it,
+// and whether they read all of it.
+type relayedBody struct {
+	io.ReadCloser
+	once      sync.Once
+	done      chan struct{}
+	eof       bool
+	abandoned bool
+}
+
+func (b *relayedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *relayedBody) Close() error {
+	b.once.Do(func() {
+		b.abandoned = !b.eof
+		close(b.done)
+	})
+	return nil
+}
+
+// Client sending a scrape result in.
+// The body of r is streamed straight through to the DoScrape caller, so this
+// blocks until the caller has closed it or the scrape times out. If the
+// caller closed it before reading all of it, errAbandoned is returned. If
+// the scrape isn't waiting for a result, such as as it already timed out,
+// errOrphaned is returned straight away.
+func (c *Coordinator) ScrapeResult(r *http.Response) error {
+	id := r.Header.Get("Id")
+	level.Debug(c.logger).Log("msg", "ScrapeResult", "scrape_id", id)
+	// A scrape may have been handed to more than one client, the first
+	// result to arrive wins.
+	if err := c.claimResult(id); err != nil {
+		if err == errDuplicateResult {
+			c.metrics.lateDuplicateResults.Inc()
+		}
+		return err
+	}
+	pending, ok := c.pendingResultFor(id)
+	if !ok {
+		c.metrics.orphanedResults.Inc()
+		return errOrphaned
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.config().ScrapeTimeouts.GetScrapeTimeout(r.Header))
+	defer cancel()
+	// Don't expose internal headers.
+	r.Header.Del("Id")
+	r.Header.Del("X-Prometheus-Scrape-Timeout-Seconds")
+	body := &relayedBody{ReadCloser: r.Body, done: make(chan struct{})}
+	r.Body = body
+	select {
+	case pending.results <- r:
+	case <-pending.done:
+		c.metrics.orphanedResults.Inc()
+		return errOrphaned
+	}
+	select {
+	case <-body.done:
+		if body.abandoned {
+			return errAbandoned
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Claim the right to deliver the result of a scrape, failing if it wasn't
+// issued, another result already has or it's expired.
+func (c *Coordinator) claimResult(id string) error {
+	shard := c.scrapeShard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	expires, err := shard.unansweredExpiry(id)
+	if err != nil {
+		return err
+	}
+	if c.now().After(expires) {
+		return errExpiredScrape
+	}
+	shard.answered[id] = c.now()
+	return nil
+}
+
+// When a scrape issued and not yet answered expires. Must be called with the
+// shard's lock held.
+func (s *scrapeShard) unansweredExpiry(id string) (time.Time, error) {
+	expires, ok := s.issued[id]
+	if !ok {
+		return time.Time{}, errUnknownScrape
+	}
+	if _, ok := s.answered[id]; ok {
+		return time.Time{}, errDuplicateResult
+	}
+	return expires, nil
+}
+
+// Count a scrape as waiting for the client, unless too many already are or
+// too many of its scrapes are in progress.
+func (c *Coordinator) enqueue(fqdn string) error {
+	limits := c.clientLimits(fqdn)
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if limits.MaxQueue > 0 && shard.queued[fqdn] >= limits.MaxQueue {
+		return fmt.Errorf("%w %q", errQueueFull, fqdn)
+	}
+	if limits.MaxConcurrency > 0 && shard.queued[fqdn]+shard.inFlight[fqdn] >= limits.MaxConcurrency {
+		return fmt.Errorf("%w for %q, the limit is %d", errTooManyInflight, fqdn, limits.MaxConcurrency)
+	}
+	shard.queued[fqdn]++
+	return nil
+}
+
+func (c *Coordinator) dequeue(fqdn string) {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.queued[fqdn]--
+	if shard.queued[fqdn] <= 0 {
+		delete(shard.queued, fqdn)
+	}
+}
+
+func (c *Coordinator) addInFlight(fqdn string, n int) {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.inFlight[fqdn] += n
+	if shard.inFlight[fqdn] <= 0 {
+		delete(shard.inFlight, fqdn)
+	}
+}
+
+func (c *Coordinator) isKnownClient(fqdn string) bool {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	t, ok := shard.known[fqdn]
+	return ok && c.since(t) < c.config().RegistrationTimeout
+}
+
+// Record that a client contacted us. Returns false if it's a new client
+// and we're already at capacity.
+func (c *Coordinator) addKnownClient(fqdn string) bool {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, ok := shard.known[fqdn]; !ok {
+		n := atomic.AddInt64(&c.knownClients, 1)
+		if maxClients := c.config().MaxClients; maxClients > 0 && n > int64(maxClients) {
+			atomic.AddInt64(&c.knownClients, -1)
+			return false
+		}
+		// A new registration, so its cold start targets are cold again.
+		delete(shard.warm, fqdn)
+	}
+	shard.known[fqdn] = c.now()
+	return true
+}
+
+// The hostname part of a host:port.
+func hostname(hostport string) string {
+	u := url.URL{Host: hostport}
+	return u.Hostname()
+}
+
+// Mark clients as known without them having polled, e.g. from a previous
+// snapshot of /clients. They expire as usual unless they poll.
+func (c *Coordinator) PrimeKnownClients(fqdns []string) {
+	now := c.now()
+	requireApproval := c.config().RequireApproval
+	for _, fqdn := range fqdns {
+		fqdn = NormalizeFQDN(fqdn)
+		shard := c.clientShard(fqdn)
+		shard.mu.Lock()
+		if _, ok := shard.known[fqdn]; !ok {
+			shard.known[fqdn] = now
+			atomic.AddInt64(&c.knownClients, 1)
+		}
+		// They were visible, so must have been approved.
+		if requireApproval {
+			shard.approvals[fqdn] = approvalApproved
+		}
+		shard.mu.Unlock()
+	}
+}
+
+func (c *Coordinator) clientRejected(fqdn string) bool {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return c.approvalState(shard, fqdn) == approvalRejected
+}
+
+// What clients are alive and approved.
+func (c *Coordinator) KnownClients() []string {
+	limit := c.now().Add(-c.config().RegistrationTimeout)
+	known := make([]string, 0, atomic.LoadInt64(&c.knownClients))
+	for i := range c.clientShards {
+		shard := &c.clientShards[i]
+		shard.mu.Lock()
+		for k, t := range shard.known {
+			if limit.Before(t) && c.approvalState(shard, k) == approvalApproved {
+				known = append(known, k)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return known
+}
+
+// Garbage collect old clients every GCInterval, until stopped.
+func (c *Coordinator) gc() {
+	for {
+		timer := time.NewTimer(c.config().GCInterval)
+		select {
+		case <-c.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		func() {
+			deleted := c.gcClientShards()
+			level.Info(c.logger).Log("msg", "GC of clients completed", "deleted", deleted, "remaining", atomic.LoadInt64(&c.knownClients))
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.gcDiscoveredTargets()
+			c.gcBlocks()
+			c.gcChunkedPushes()
+			c.targets.gc()
+			cfg := c.config()
+			keep := cfg.CacheTTL
+			if cfg.StaleMaxAge > keep {
+				keep = cfg.StaleMaxAge
+			}
+			if longest := cfg.maxMinInterval(); longest > keep {
+				keep = longest
+			}
+			for k, cr := range c.lastGood {
+				if c.since(cr.at) >= keep {
+					delete(c.lastGood, k)
+				}
+			}
+			for k, cr := range c.published {
+				if c.since(cr.at) >= cfg.PublishedMaxAge {
+					delete(c.published, k)
+				}
+			}
+			c.gcDNSChecks()
+		}()
+		c.gcPools()
+		c.gcScrapeShards()
+		c.expireStuckScrapes()
+		atomic.StoreInt64(&c.lastGC, c.now().UnixNano())
+	}
+}
+
+// Whether the coordinator's background work is getting done, as it isn't if
+// something holds the lock it all needs forever.
+func (c *Coordinator) Alive() bool {
+	last := time.Unix(0, atomic.LoadInt64(&c.lastGC))
+	return c.since(last) <= 2*c.config().GCInterval+time.Minute
+}
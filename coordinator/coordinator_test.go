@@ -0,0 +1,272 @@
+package coordinator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// How many clients the benchmarks have polling at once.
+const benchmarkClients = 10000
+
+func benchmarkFQDN(i int) string {
+	return fmt.Sprintf("node%d.example.com", i)
+}
+
+func newBenchmarkCoordinator(b *testing.B) *Coordinator {
+	b.Helper()
+	c, err := NewWithOptions(DefaultConfig(), Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(c.Stop)
+	return c
+}
+
+// Run f b.N times in all, spread over a goroutine for each client.
+func runPerClient(b *testing.B, f func(fqdn string)) {
+	var next int64
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < benchmarkClients; i++ {
+		wg.Add(1)
+		go func(fqdn string) {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) <= int64(b.N) {
+				f(fqdn)
+			}
+		}(benchmarkFQDN(i))
+	}
+	wg.Wait()
+	b.StopTimer()
+}
+
+func pollRequest(ctx context.Context, fqdn string) *http.Request {
+	r := httptest.NewRequest("POST", util.PathPrefix+"/poll", strings.NewReader(fqdn)).WithContext(ctx)
+	r.Header.Set(util.LabelsHeader, "site=berlin&job=node")
+	return r
+}
+
+// Poll as a client does, pushing the result of each scrape it's handed,
+// until ctx is done.
+func pollAndPush(ctx context.Context, c *Coordinator, fqdn string) {
+	for ctx.Err() == nil {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, pollRequest(ctx, fqdn))
+		if w.Code != http.StatusOK {
+			continue
+		}
+		request, err := http.ReadRequest(bufio.NewReader(w.Body))
+		if err != nil {
+			continue
+		}
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Id": {request.Header.Get("Id")}, "Content-Type": {"text/plain; version=0.0.4"}},
+			Body:          ioutil.NopCloser(strings.NewReader("up 1\n")),
+			ContentLength: 5,
+		}
+		var buf bytes.Buffer
+		resp.Write(&buf)
+		// Pushes are answered once the scrape is done with the result.
+		go c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", util.PathPrefix+"/push", &buf))
+	}
+}
+
+// Polls that only register the client, so they don't wait for a scrape.
+func BenchmarkPoll(b *testing.B) {
+	c := newBenchmarkCoordinator(b)
+	ctx := context.Background()
+	b.ReportAllocs()
+	runPerClient(b, func(fqdn string) {
+		r := pollRequest(ctx, fqdn)
+		r.Header.Set(util.RegisterOnlyHeader, "1")
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Errorf("poll of %s got status %d: %s", fqdn, w.Code, w.Body)
+		}
+	})
+}
+
+// Scrapes through the proxy of clients polling for them, one scrape of each
+// client at a time.
+func BenchmarkScrape(b *testing.B) {
+	c := newBenchmarkCoordinator(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	var clients sync.WaitGroup
+	defer func() {
+		cancel()
+		clients.Wait()
+	}()
+	for i := 0; i < benchmarkClients; i++ {
+		clients.Add(1)
+		go func(fqdn string) {
+			defer clients.Done()
+			pollAndPush(ctx, c, fqdn)
+		}(benchmarkFQDN(i))
+	}
+	for atomic.LoadInt64(&c.knownClients) < benchmarkClients {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.ReportAllocs()
+	runPerClient(b, func(fqdn string) {
+		r := httptest.NewRequest("GET", "http://"+fqdn+":9100/metrics", nil)
+		r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "up 1\n" {
+			b.Errorf("scrape of %s got status %d: %q", fqdn, w.Code, w.Body)
+		}
+	})
+}
+
+// A scrape taken by a poll taking several while it waited for a poll mustn't
+// also be handed to the next poll.
+func TestDispatchTakenByBatchPoll(t *testing.T) {
+	c, err := NewWithOptions(DefaultConfig(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	r := httptest.NewRequest("GET", "http://node1:9100/metrics", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dispatched := make(chan string, 1)
+	go func() {
+		instance, err := c.dispatch(ctx, "node1", r, map[string]bool{}, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		dispatched <- instance
+	}()
+	shard := c.clientShard("node1")
+	for {
+		shard.mu.Lock()
+		queued := len(shard.poolFor("node1").queued)
+		shard.mu.Unlock()
+		if queued > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if requests := c.moreScrapeInstructions("node1", "batcher", 1); len(requests) != 1 || requests[0] != r {
+		t.Fatalf("got %d scrapes for the poll taking several, want the queued one", len(requests))
+	}
+	p := c.addIdlePoll("node1", "other")
+	if instance := <-dispatched; instance != "batcher" {
+		t.Errorf("got scrape dispatched to %q, want %q", instance, "batcher")
+	}
+	if !c.removeIdlePoll("node1", p) {
+		t.Errorf("scrape was handed to a second poll too")
+	}
+}
+
+// A clock that only moves when told to, running the timers it passes.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	t := &fakeTimer{clock: fc, at: fc.now.Add(d), f: f, active: true}
+	fc.timers = append(fc.timers, t)
+	return t
+}
+
+func (fc *fakeClock) advance(d time.Duration) {
+	fc.mu.Lock()
+	fc.now = fc.now.Add(d)
+	var due []func()
+	for _, t := range fc.timers {
+		if t.active && !t.at.After(fc.now) {
+			t.active = false
+			due = append(due, t.f)
+		}
+	}
+	fc.mu.Unlock()
+	for _, f := range due {
+		f()
+	}
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.at, t.active = t.clock.now.Add(d), true
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+// A coalesced scrape runs until the latest deadline of its callers by the
+// coordinator's clock.
+func TestCoalescedScrapeExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	c, err := NewWithOptions(DefaultConfig(), Options{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	scrapeCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := &coalescedScrape{started: c.now(), done: make(chan struct{}), cancel: cancel}
+	first, cancelFirst := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelFirst()
+	second, cancelSecond := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancelSecond()
+
+	c.mu.Lock()
+	c.joinCoalesced(first, cs)
+	c.mu.Unlock()
+	clock.advance(50 * time.Second)
+	c.mu.Lock()
+	c.joinCoalesced(second, cs)
+	c.mu.Unlock()
+	clock.advance(30 * time.Second)
+	if scrapeCtx.Err() != nil {
+		t.Fatal("scrape cancelled at the first caller's deadline, want the second's")
+	}
+	clock.advance(time.Minute)
+	if scrapeCtx.Err() == nil {
+		t.Error("scrape not cancelled after the last caller's deadline")
+	}
+}
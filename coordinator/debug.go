@@ -0,0 +1,42 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// The longest a client can be asked to log verbosely for.
+const maxClientDebugDuration = 24 * time.Hour
+
+// Ask a client to log verbosely for a while with a POST, passed on with its
+// next poll.
+func handleClientDebug(coordinator *Coordinator, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	fqdn := r.FormValue("fqdn")
+	if !coordinator.isKnownClient(fqdn) {
+		http.Error(w, fmt.Sprintf("Unknown client %q", fqdn), 404)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil || d <= 0 || d > maxClientDebugDuration {
+		http.Error(w, fmt.Sprintf("duration must be positive and at most %s", maxClientDebugDuration), 400)
+		return
+	}
+	coordinator.sendControl(fqdn, fmt.Sprintf("%s %s", util.ControlDebug, d))
+	level.Info(coordinator.logger).Log("msg", "Asked client to log verbosely", "fqdn", fqdn, "duration", d)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		FQDN  string `json:"fqdn"`
+		Until string `json:"until"`
+	}{FQDN: fqdn, Until: coordinator.now().Add(d).UTC().Format(time.RFC3339)})
+}
@@ -0,0 +1,116 @@
+package coordinator
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+var errDeltaBaseMissing = errors.New("delta base not known")
+
+// Pushed results clients asked to be kept, by their DeltaHash, dropping the
+// least recently used beyond DeltaCacheSize bytes.
+type deltaBases struct {
+	mu    sync.Mutex
+	lru   *list.List
+	bases map[string]*list.Element
+	size  int
+}
+
+type deltaBase struct {
+	hash string
+	body []byte
+}
+
+func newDeltaBases() *deltaBases {
+	return &deltaBases{lru: list.New(), bases: map[string]*list.Element{}}
+}
+
+func (d *deltaBases) get(hash string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.bases[hash]
+	if !ok {
+		return nil, false
+	}
+	d.lru.MoveToFront(e)
+	return e.Value.(*deltaBase).body, true
+}
+
+func (d *deltaBases) add(body []byte, max int) {
+	hash := util.DeltaHash(body)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.bases[hash]; ok {
+		d.lru.MoveToFront(e)
+		return
+	}
+	d.bases[hash] = d.lru.PushFront(&deltaBase{hash: hash, body: body})
+	d.size += len(body)
+	for d.size > max {
+		e := d.lru.Back()
+		b := d.lru.Remove(e).(*deltaBase)
+		delete(d.bases, b.hash)
+		d.size -= len(b.body)
+	}
+}
+
+// Rebuild a pushed result sent as a delta, and keep it if the client asked
+// to, so the body is the whole result with the delta headers removed.
+func (c *Coordinator) resolveDelta(result *http.Response) error {
+	max := c.config().DeltaCacheSize
+	base := result.Header.Get(util.DeltaBaseHeader)
+	if result.Header.Get(util.DeltaKeepHeader) == "" && base == "" {
+		return nil
+	}
+	result.Header.Del(util.DeltaBaseHeader)
+	result.Header.Del(util.DeltaKeepHeader)
+	if max <= 0 {
+		if base != "" {
+			c.metrics.deltaPushes.WithLabelValues("base_missing").Inc()
+			return errDeltaBaseMissing
+		}
+		return nil
+	}
+	// Anything too big to keep is passed on as it comes.
+	body, err := ioutil.ReadAll(io.LimitReader(result.Body, int64(max)+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > max {
+		if base != "" {
+			return errors.New("delta larger than the delta cache")
+		}
+		result.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), result.Body), Closer: result.Body}
+		return nil
+	}
+	if base != "" {
+		b, ok := c.deltas.get(base)
+		if !ok {
+			c.metrics.deltaPushes.WithLabelValues("base_missing").Inc()
+			return errDeltaBaseMissing
+		}
+		if body, err = util.ApplyDelta(b, body, max); err != nil {
+			return err
+		}
+		c.metrics.deltaPushes.WithLabelValues("applied").Inc()
+	}
+	c.deltas.add(body, max)
+	result.Body = readCloser{Reader: bytes.NewReader(body), Closer: result.Body}
+	result.ContentLength = int64(len(body))
+	result.TransferEncoding = nil
+	result.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,220 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// How long a discovered target is remembered after its client last reported it.
+const discoveredTargetExpiry = 24 * time.Hour
+
+var errUnknownDiscoveredTarget = errors.New("no such discovered target")
+
+// An exporter a client found on a neighbouring host. It can only be scraped
+// through the client once an operator approves it.
+type DiscoveredTarget struct {
+	Target    string    `json:"target"`
+	Client    string    `json:"client"`
+	State     string    `json:"state"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Labels the client gave it, added to /clients as
+	// __meta_pushprox_<name>.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// What a client reports it discovered.
+type DiscoveryReport struct {
+	FQDN    string   `json:"fqdn"`
+	Targets []string `json:"targets"`
+	// Labels of each target, if any.
+	Labels map[string]map[string]string `json:"labels,omitempty"`
+	// Whether these are all the client's targets, so any others it reported
+	// before are gone, such as pods that were deleted.
+	Complete bool `json:"complete,omitempty"`
+}
+
+// Record targets a client discovered.
+func (c *Coordinator) AddDiscoveredTargets(fqdn string, targets []string) {
+	c.AddDiscoveryReport(DiscoveryReport{FQDN: fqdn, Targets: targets})
+}
+
+// Record the targets of a report from a client.
+func (c *Coordinator) AddDiscoveryReport(report DiscoveryReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fqdn := report.FQDN
+	// Targets are only the client's tenant's, as the same host:port may be
+	// another tenant's altogether.
+	tenant, _ := splitTenantClient(fqdn)
+	autoApprove := c.config().autoApproveDiscovered
+	now := c.now()
+	reported := map[string]bool{}
+	for _, t := range report.Targets {
+		key := tenantClient(tenant, t)
+		reported[key] = true
+		dt, ok := c.discovered[key]
+		if !ok {
+			dt = &DiscoveredTarget{Target: t, Client: fqdn, State: approvalPending, FirstSeen: now}
+			c.discovered[key] = dt
+			if autoApprove != nil && autoApprove.MatchString(fqdn) {
+				dt.State = approvalApproved
+				level.Info(c.logger).Log("msg", "New discovered target approved", "fqdn", fqdn, "target", t)
+			} else {
+				level.Info(c.logger).Log("msg", "New discovered target pending approval", "fqdn", fqdn, "target", t)
+			}
+		}
+		if dt.Client != fqdn {
+			level.Warn(c.logger).Log("msg", "Target was already discovered by another client, ignoring", "fqdn", fqdn, "target", t, "owner", dt.Client)
+			continue
+		}
+		dt.LastSeen = now
+		dt.Labels = nil
+		for name, value := range report.Labels[t] {
+			if util.IsValidLabelName(name) {
+				if dt.Labels == nil {
+					dt.Labels = map[string]string{}
+				}
+				dt.Labels[name] = value
+			}
+		}
+	}
+	if report.Complete {
+		for key, dt := range c.discovered {
+			if dt.Client == fqdn && !reported[key] {
+				level.Info(c.logger).Log("msg", "Discovered target is gone", "fqdn", fqdn, "target", dt.Target)
+				delete(c.discovered, key)
+			}
+		}
+	}
+}
+
+// The discovered targets of a tenant's clients, or of clients of no tenant
+// if it's empty, sorted by target.
+func (c *Coordinator) DiscoveredTargets(tenant string) []DiscoveredTarget {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	targets := []DiscoveredTarget{}
+	for _, dt := range c.discovered {
+		if t, _ := splitTenantClient(dt.Client); t == tenant {
+			targets = append(targets, *dt)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Target < targets[j].Target })
+	return targets
+}
+
+// Approve or reject a discovered target of a tenant.
+func (c *Coordinator) SetDiscoveredTargetState(tenant, target, state string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dt, ok := c.discovered[tenantClient(tenant, target)]
+	if !ok {
+		return errUnknownDiscoveredTarget
+	}
+	dt.State = state
+	level.Info(c.logger).Log("msg", "Changed state of discovered target", "target", target, "fqdn", dt.Client, "state", state)
+	return nil
+}
+
+// The client to scrape an approved discovered host:port of a tenant through.
+func (c *Coordinator) discoveredTargetClient(tenant, hostport string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dt, ok := c.discovered[tenantClient(tenant, hostport)]
+	if !ok || dt.State != approvalApproved {
+		return "", false
+	}
+	return dt.Client, true
+}
+
+// Approved discovered targets by the client they're scraped through.
+func (c *Coordinator) ApprovedDiscoveredTargets() map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	approved := map[string][]string{}
+	for _, dt := range c.discovered {
+		if dt.State == approvalApproved {
+			approved[dt.Client] = append(approved[dt.Client], dt.Target)
+		}
+	}
+	for _, targets := range approved {
+		sort.Strings(targets)
+	}
+	return approved
+}
+
+// Forget targets that haven't been reported in a long time. Must be called
+// with the lock held.
+func (c *Coordinator) gcDiscoveredTargets() {
+	limit := c.now().Add(-discoveredTargetExpiry)
+	for key, dt := range c.discovered {
+		if dt.LastSeen.Before(limit) {
+			delete(c.discovered, key)
+		}
+	}
+}
+
+// Clients reporting exporters they found with a POST to /discovery.
+func handleDiscoveryReport(coordinator *Coordinator, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	report := DiscoveryReport{}
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing discovery report: %s", err), 400)
+		return
+	}
+	// Only a client may report what it found, as it would poll.
+	fqdn, ok := coordinator.clientIdentity(coordinator.config(), w, r, report.FQDN)
+	if !ok {
+		return
+	}
+	report.FQDN = clientKey(r.Context(), fqdn)
+	coordinator.AddDiscoveryReport(report)
+	level.Info(coordinator.logger).Log("msg", "Got /discovery", "fqdn", report.FQDN, "target_count", len(report.Targets))
+}
+
+// List the discovered targets of the tenant asking, or approve or reject one
+// with a POST.
+func handleDiscoveredTargets(coordinator *Coordinator, w http.ResponseWriter, r *http.Request) {
+	tenant := tenantOf(r.Context())
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var state string
+		switch r.FormValue("action") {
+		case "approve":
+			state = approvalApproved
+		case "reject":
+			state = approvalRejected
+		default:
+			http.Error(w, "action must be approve or reject", 400)
+			return
+		}
+		err := coordinator.SetDiscoveredTargetState(tenant, r.FormValue("target"), state)
+		if err == errUnknownDiscoveredTarget {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coordinator.DiscoveredTargets(tenant))
+}
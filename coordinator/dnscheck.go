@@ -0,0 +1,168 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// How long a DNS check of a registration may take.
+const dnsCheckTimeout = 5 * time.Second
+
+var errDNSMismatch = errors.New("client address does not match the DNS of its FQDN")
+
+// Looks up names and addresses, as net.Resolver does.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// A cached DNS check of a client registering from an address.
+type dnsCheck struct {
+	at  time.Time
+	err error
+}
+
+func validateDNSCheck(cfg Config) error {
+	switch cfg.DNSCheck {
+	case "", "none", "forward", "reverse", "both":
+	default:
+		return fmt.Errorf("invalid DNS check %q, must be one of none, forward, reverse or both", cfg.DNSCheck)
+	}
+	switch cfg.DNSCheckFailurePolicy {
+	case "", "allow", "reject":
+	default:
+		return fmt.Errorf("invalid DNS check failure policy %q, must be allow or reject", cfg.DNSCheckFailurePolicy)
+	}
+	return nil
+}
+
+// Whether err is from looking up a name or address that doesn't exist, which
+// is a mismatch rather than a failure to check.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// Whether the FQDN resolves to ip.
+func forwardMatches(ctx context.Context, resolver Resolver, fqdn string, ip net.IP) (bool, error) {
+	addrs, err := resolver.LookupHost(ctx, fqdn)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if ip.Equal(net.ParseIP(a)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Whether ip has the FQDN as one of its names.
+func reverseMatches(ctx context.Context, resolver Resolver, fqdn string, ip net.IP) (bool, error) {
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if strings.EqualFold(strings.TrimSuffix(n, "."), strings.TrimSuffix(fqdn, ".")) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check the client registering as fqdn from ip against DNS. Returns
+// errDNSMismatch if it doesn't match, or the error looking it up.
+func (c *Coordinator) lookupDNSCheck(ctx context.Context, cfg *runtimeConfig, fqdn string, ip net.IP) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsCheckTimeout)
+	defer cancel()
+	if cfg.DNSCheck == "forward" || cfg.DNSCheck == "both" {
+		ok, err := forwardMatches(ctx, c.resolver, fqdn, ip)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errDNSMismatch
+		}
+	}
+	if cfg.DNSCheck == "reverse" || cfg.DNSCheck == "both" {
+		ok, err := reverseMatches(ctx, c.resolver, fqdn, ip)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errDNSMismatch
+		}
+	}
+	return nil
+}
+
+// Whether a client may register as fqdn from remoteAddr, as far as DNS is
+// concerned. Results are cached, except for failed lookups, which are
+// allowed or rejected as the failure policy says.
+func (c *Coordinator) dnsAllowed(ctx context.Context, cfg *runtimeConfig, fqdn, remoteAddr string) bool {
+	if cfg.DNSCheck == "" || cfg.DNSCheck == "none" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	// Clients registered per port are checked by their host.
+	fqdn = fqdnHost(fqdn)
+	key := fqdn + "/" + ip.String()
+
+	c.mu.Lock()
+	check, ok := c.dnsChecks[key]
+	c.mu.Unlock()
+	if !ok || c.since(check.at) >= cfg.DNSCheckCacheTTL {
+		check = &dnsCheck{at: c.now(), err: c.lookupDNSCheck(ctx, cfg, fqdn, ip)}
+		if check.err == nil || check.err == errDNSMismatch {
+			c.mu.Lock()
+			c.dnsChecks[key] = check
+			c.mu.Unlock()
+		}
+	}
+
+	switch {
+	case check.err == nil:
+		return true
+	case check.err == errDNSMismatch:
+		level.Info(c.logger).Log("msg", "Rejecting client whose address does not match its DNS", "fqdn", fqdn, "addr", ip, "check", cfg.DNSCheck)
+		c.metrics.dnsCheckRejections.WithLabelValues("mismatch").Inc()
+		return false
+	case cfg.DNSCheckFailurePolicy == "reject":
+		level.Warn(c.logger).Log("msg", "Rejecting client as its DNS could not be checked", "fqdn", fqdn, "addr", ip, "err", check.err)
+		c.metrics.dnsCheckRejections.WithLabelValues("lookup_error").Inc()
+		return false
+	default:
+		level.Warn(c.logger).Log("msg", "Allowing client whose DNS could not be checked", "fqdn", fqdn, "addr", ip, "err", check.err)
+		return true
+	}
+}
+
+// Forget DNS checks that have expired. Must be called with the lock held.
+func (c *Coordinator) gcDNSChecks() {
+	ttl := c.config().DNSCheckCacheTTL
+	for key, check := range c.dnsChecks {
+		if c.since(check.at) >= ttl {
+			delete(c.dnsChecks, key)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// How far back failure stats go.
+const failureWindow = 15 * time.Minute
+
+type failureKey struct {
+	Target string
+	Reason string
+}
+
+// Counts of scrape failures over the last failureWindow, kept in per-minute
+// buckets so memory is bounded by the number of distinct failures.
+type failureStats struct {
+	mu      sync.Mutex
+	clock   Clock
+	buckets [int(failureWindow / time.Minute)]failureBucket
+}
+
+type failureBucket struct {
+	minute int64
+	counts map[failureKey]int
+	// Scrapes dispatched to each client and how many of them failed.
+	scrapes map[string]int
+	failed  map[string]int
+}
+
+func newFailureStats(clock Clock) *failureStats {
+	return &failureStats{clock: clock}
+}
+
+// The bucket for now. Must be called with the lock held.
+func (s *failureStats) current() *failureBucket {
+	minute := s.clock.Now().Unix() / 60
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute || b.counts == nil {
+		*b = failureBucket{
+			minute:  minute,
+			counts:  map[failureKey]int{},
+			scrapes: map[string]int{},
+			failed:  map[string]int{},
+		}
+	}
+	return b
+}
+
+func (s *failureStats) record(target, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current().counts[failureKey{Target: target, Reason: reason}]++
+}
+
+// Record a scrape dispatched to a client and whether it failed.
+func (s *failureStats) recordScrape(fqdn string, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.current()
+	b.scrapes[fqdn]++
+	if failed {
+		b.failed[fqdn]++
+	}
+}
+
+// Scrapes dispatched to each client within the window, and how many failed.
+func (s *failureStats) clientScrapes() (scrapes, failed map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldest := s.clock.Now().Unix()/60 - int64(len(s.buckets)) + 1
+	scrapes, failed = map[string]int{}, map[string]int{}
+	for _, b := range s.buckets {
+		if b.minute < oldest {
+			continue
+		}
+		for fqdn, n := range b.scrapes {
+			scrapes[fqdn] += n
+		}
+		for fqdn, n := range b.failed {
+			failed[fqdn] += n
+		}
+	}
+	return scrapes, failed
+}
+
+type failureCount struct {
+	failureKey
+	Count int
+}
+
+// Failures within the window, most frequent first.
+func (s *failureStats) top(limit int) []failureCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldest := s.clock.Now().Unix()/60 - int64(len(s.buckets)) + 1
+	totals := map[failureKey]int{}
+	for _, b := range s.buckets {
+		if b.minute < oldest {
+			continue
+		}
+		for k, n := range b.counts {
+			totals[k] += n
+		}
+	}
+	counts := make([]failureCount, 0, len(totals))
+	for k, n := range totals {
+		counts = append(counts, failureCount{failureKey: k, Count: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		if counts[i].Target != counts[j].Target {
+			return counts[i].Target < counts[j].Target
+		}
+		return counts[i].Reason < counts[j].Reason
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// Write a human readable summary, for /debug/errors.
+func (s *failureStats) writeSummary(w io.Writer, limit int) {
+	counts := s.top(limit)
+	fmt.Fprintf(w, "Top scrape failures over the last %s by target and reason:\n\n", failureWindow)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "COUNT\tREASON\tTARGET")
+	for _, c := range counts {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", c.Count, c.Reason, c.Target)
+	}
+	tw.Flush()
+	if len(counts) == 0 {
+		fmt.Fprintln(w, "\nNo failures.")
+	}
+}
+
+// Why a scrape failed, given the error from DoScrape.
+func failureReasonForError(err error) string {
+	switch {
+	case errors.Is(err, errUnknownClient):
+		return "unknown_client"
+	case errors.Is(err, errQueueFull):
+		return "queue_full"
+	case errors.Is(err, errTooManyInflight):
+		return "max_inflight"
+	case errors.Is(err, errClientNotApproved):
+		return "not_approved"
+	case errors.Is(err, errNoClient):
+		return "no_client"
+	case errors.Is(err, errNoResponse):
+		return "no_response"
+	case errors.Is(err, errStuckScrape):
+		return "stuck"
+	case errors.Is(err, errClientStale):
+		return "client_stale"
+	case errors.Is(err, errShuttingDown):
+		return "shutting_down"
+	case errors.Is(err, errTooFrequent):
+		return "too_frequent"
+	case errors.Is(err, errRateLimited):
+		return "rate_limited"
+	case errors.Is(err, errQuotaExceeded):
+		return "quota_exceeded"
+	case errors.Is(err, errDuplicateResult):
+		return "duplicate"
+	case errors.Is(err, errAbandoned):
+		return "abandoned"
+	case errors.Is(err, errOrphaned):
+		return "orphaned"
+	case errors.Is(err, errUnknownScrape):
+		return "unknown_scrape"
+	case errors.Is(err, errExpiredScrape):
+		return "expired"
+	case errors.Is(err, errDeltaBaseMissing):
+		return "delta_base_missing"
+	case errors.Is(err, errPushCorrupted):
+		return "corrupted"
+	case errors.Is(err, errInvalidResult):
+		return "invalid_exposition"
+	case errors.Is(err, errInvalidSelector):
+		return "invalid_selector"
+	case errors.Is(err, errInvalidProbe):
+		return "invalid_probe"
+	case errors.Is(err, errNoSelectorMatch):
+		return "no_selector_match"
+	case errors.Is(err, errAmbiguousSelector):
+		return "ambiguous_selector"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "error"
+}
+
+// The HTTP status to return to the scraper for an error from DoScrape.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, errUnknownClient), errors.Is(err, errNoSelectorMatch):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidSelector), errors.Is(err, errInvalidProbe):
+		return http.StatusBadRequest
+	case errors.Is(err, errAmbiguousSelector):
+		return http.StatusConflict
+	case errors.Is(err, errQueueFull), errors.Is(err, errTooManyInflight), errors.Is(err, errTooFrequent), errors.Is(err, errRateLimited), errors.Is(err, errQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errClientNotApproved):
+		return http.StatusForbidden
+	case errors.Is(err, errShuttingDown):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errClientStale), errors.Is(err, errInvalidResult):
+		return http.StatusBadGateway
+	case errors.Is(err, errNoClient), errors.Is(err, errNoResponse), errors.Is(err, errStuckScrape), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// Why a scrape failed, given a non-2xx status pushed by the client.
+func failureReasonForStatus(code int) string {
+	return fmt.Sprintf("http_%d", code)
+}
@@ -0,0 +1,1050 @@
+package coordinator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Metrics of a coordinator.
+type metrics struct {
+	// What durations are measured by.
+	clock Clock
+
+	pushWireBytes         *prometheus.CounterVec
+	pushUncompressedBytes *prometheus.CounterVec
+	scrapeResponses       *prometheus.CounterVec
+	clientScrapeErrors    *prometheus.CounterVec
+	lateDuplicateResults  prometheus.Counter
+	abandonedPushes       prometheus.Counter
+	orphanedResults       prometheus.Counter
+	poolRetries           prometheus.Counter
+	staleClientScrapes    prometheus.Counter
+	blockedScrapes        prometheus.Counter
+	invalidResults        *prometheus.CounterVec
+	consulErrors          prometheus.Counter
+	natsConnected         prometheus.Gauge
+	rejectedPushes        *prometheus.CounterVec
+	corruptedPushes       prometheus.Counter
+	scrapeIDCollisions    prometheus.Counter
+	stuckScrapes          *prometheus.CounterVec
+	coalescedScrapes      prometheus.Counter
+	deltaPushes           *prometheus.CounterVec
+	remoteWriteRequests   *prometheus.CounterVec
+	publishedResults      *prometheus.CounterVec
+	tunnelConnections     *prometheus.CounterVec
+	dnsCheckRejections    *prometheus.CounterVec
+	aclRejections         *prometheus.CounterVec
+	shardHandoffs         *prometheus.CounterVec
+	stageOutcomes         *prometheus.CounterVec
+	stageDuration         *prometheus.HistogramVec
+	phaseDuration         *prometheus.HistogramVec
+	configReloadSuccess   prometheus.Gauge
+	configReloadTime      prometheus.Gauge
+	tlsReloadSuccess      prometheus.Gauge
+	tlsReloadFailures     prometheus.Counter
+	tlsExpiry             prometheus.Gauge
+	acmeCertificates      prometheus.Counter
+	acmeErrors            prometheus.Counter
+	auditLogErrors        prometheus.Counter
+}
+
+func newMetrics(clock Clock) *metrics {
+	return &metrics{
+		clock: clock,
+		pushWireBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_push_wire_bytes_total",
+				Help: "Bytes of pushed scrape results as received from clients, by encoding.",
+			}, []string{"encoding"},
+		),
+		scrapeResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_scrape_responses_total",
+				Help: "Responses to scrapes through the proxy, by HTTP status code.",
+			}, []string{"code"},
+		),
+		clientScrapeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_scrape_errors_total",
+				Help: "Scrapes clients failed to perform, by kind of failure.",
+			}, []string{"kind"},
+		),
+		lateDuplicateResults: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_late_duplicate_results_total",
+				Help: "Pushed scrape results discarded as a result for the scrape was already received.",
+			},
+		),
+		abandonedPushes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_abandoned_pushes_total",
+				Help: "Pushed scrape results cut short as the scraper went away while they were relayed.",
+			},
+		),
+		orphanedResults: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_orphaned_results_total",
+				Help: "Pushed scrape results dropped as the scrape had already stopped waiting for them, such as after timing out.",
+			},
+		),
+		poolRetries: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_pool_retries_total",
+				Help: "Scrapes retried on another instance of a client after the one they went to failed.",
+			},
+		),
+		rejectedPushes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_rejected_pushes_total",
+				Help: "Pushed results refused, by whether their scrape was never issued, already answered, expired or had given up.",
+			}, []string{"reason"},
+		),
+		corruptedPushes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_corrupted_pushes_total",
+				Help: "Pushed results not matching the checksum their client sent, which it was asked to push again.",
+			},
+		),
+		scrapeIDCollisions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_scrape_id_collisions_total",
+				Help: "Scrape IDs generated that an outstanding scrape already had.",
+			},
+		),
+		stuckScrapes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_stuck_scrapes_total",
+				Help: "Scrapes expired as still outstanding past --scrape.max-timeout and --scrape.stuck-grace, by the state they were stuck in.",
+			}, []string{"state"},
+		),
+		coalescedScrapes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_coalesced_scrapes_total",
+				Help: "Scrapes answered with the result of one of the same target already in progress, rather than sent to the client.",
+			},
+		),
+		deltaPushes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_delta_pushes_total",
+				Help: "Pushed results sent as a delta against an earlier one, by whether it was applied or the earlier one wasn't known.",
+			}, []string{"result"},
+		),
+		staleClientScrapes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_stale_client_scrapes_total",
+				Help: "Scrapes failed straight away as their client hadn't polled within --scrape.client-freshness.",
+			},
+		),
+		blockedScrapes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_blocked_scrapes_total",
+				Help: "Scrapes of clients blocked through /admin/blocklist, answered without being sent to them.",
+			},
+		),
+		invalidResults: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_invalid_results_total",
+				Help: "Pushed results failed by --scrape.validate as malformed, by client.",
+			}, []string{"fqdn"},
+		),
+		consulErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_consul_errors_total",
+				Help: "Requests to the Consul agent to register, deregister or pass the checks of clients that failed.",
+			},
+		),
+		natsConnected: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_nats_connected",
+				Help: "Whether the proxy is connected to the NATS server from --nats.url.",
+			},
+		),
+		publishedResults: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_published_results_total",
+				Help: "Results of scrapes clients in push mode made on their own and published, by whether they were stored or why not.",
+			},
+			[]string{"result"},
+		),
+		remoteWriteRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_remote_write_requests_total",
+				Help: "Remote write requests from clients relayed to the receiver, by its status code or error if it couldn't be reached.",
+			}, []string{"code"},
+		),
+		tunnelConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_tunnel_connections_total",
+				Help: "Connections accepted on tunnel ports, by listen address and whether the client opened the tunnel or it failed.",
+			}, []string{"listen", "outcome"},
+		),
+		stageOutcomes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_scrape_stage_total",
+				Help: "Scrapes through the proxy that went through each stage, by outcome: success, target_error for failures of the target, or what went wrong.",
+			}, []string{"stage", "outcome"},
+		),
+		stageDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "pushprox_scrape_stage_duration_seconds",
+				Help:    "How long scrapes through the proxy spent in each stage.",
+				Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+			}, []string{"stage"},
+		),
+		phaseDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "pushprox_scrape_phase_duration_seconds",
+				Help:    "How long scrapes waited for a poll, the client took to fetch them from the target, and the rest of the time until their result arrived, by phase.",
+				Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+			}, []string{"phase"},
+		),
+		dnsCheckRejections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_dns_check_rejections_total",
+				Help: "Polls rejected by DNS checks of the client, by whether its DNS didn't match or couldn't be looked up.",
+			}, []string{"reason"},
+		),
+		pushUncompressedBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_push_uncompressed_bytes_total",
+				Help: "Bytes of pushed scrape results after decompression, by encoding.",
+			}, []string{"encoding"},
+		),
+		configReloadSuccess: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_config_last_reload_successful",
+				Help: "Whether the last reload of the config file succeeded.",
+			},
+		),
+		configReloadTime: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_config_last_reload_success_timestamp_seconds",
+				Help: "When the config file was last reloaded successfully.",
+			},
+		),
+		tlsReloadSuccess: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_tls_last_reload_successful",
+				Help: "Whether the last load of a rotated TLS certificate succeeded.",
+			},
+		),
+		tlsReloadFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_tls_reload_failures_total",
+				Help: "Rotated TLS certificates that failed validation, so the previous one was kept.",
+			},
+		),
+		tlsExpiry: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_tls_certificate_expiry_timestamp_seconds",
+				Help: "When the TLS certificate in use expires.",
+			},
+		),
+		aclRejections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_acl_rejections_total",
+				Help: "Requests refused as they came from outside the acl.scraper_cidrs or acl.client_cidrs, by endpoint.",
+			},
+			[]string{"endpoint"},
+		),
+		shardHandoffs: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_shard_handoffs_total",
+				Help: "Polls and scrapes of clients another proxy in --shard.members owns, by endpoint and whether they were redirected or forwarded to it.",
+			},
+			[]string{"endpoint", "action"},
+		),
+		acmeCertificates: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_acme_certificates_obtained_total",
+				Help: "Certificates obtained or renewed from the ACME CA and put in use.",
+			},
+		),
+		auditLogErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_audit_log_errors_total",
+				Help: "Failures to write or rotate the audit log.",
+			},
+		),
+		acmeErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_acme_errors_total",
+				Help: "Failures getting a certificate for one of --tls.acme-domains from the ACME CA.",
+			},
+		),
+	}
+}
+
+func (m *metrics) register(reg prometheus.Registerer, extra ...prometheus.Collector) error {
+	for _, c := range append([]prometheus.Collector{m.pushWireBytes, m.pushUncompressedBytes, m.scrapeResponses, m.clientScrapeErrors, m.lateDuplicateResults, m.abandonedPushes, m.orphanedResults, m.poolRetries, m.staleClientScrapes, m.blockedScrapes, m.invalidResults, m.consulErrors, m.natsConnected, m.rejectedPushes, m.corruptedPushes, m.scrapeIDCollisions, m.stuckScrapes, m.coalescedScrapes, m.deltaPushes, m.publishedResults, m.remoteWriteRequests, m.tunnelConnections, m.dnsCheckRejections, m.aclRejections, m.shardHandoffs, m.stageOutcomes, m.stageDuration, m.phaseDuration, m.configReloadSuccess, m.configReloadTime, m.tlsReloadSuccess, m.tlsReloadFailures, m.tlsExpiry, m.acmeCertificates, m.acmeErrors, m.auditLogErrors}, extra...) {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Readers for parsing pushed responses, reused as there's one per scrape.
+var bufioReaders = sync.Pool{New: func() interface{} { return bufio.NewReader(nil) }}
+
+// Writers for sending scrapes to clients. Request.WriteProxy sets up a 4KiB
+// bufio.Writer of its own for every request otherwise, as a ResponseWriter
+// isn't an io.ByteWriter.
+var bufioWriters = sync.Pool{New: func() interface{} { return bufio.NewWriter(nil) }}
+
+// Write the scrapes as full requests, as the body of a poll's response.
+func writeScrapeRequests(w io.Writer, requests []*http.Request) error {
+	bw := bufioWriters.Get().(*bufio.Writer)
+	bw.Reset(w)
+	defer func() {
+		bw.Reset(nil)
+		bufioWriters.Put(bw)
+	}()
+	for _, request := range requests {
+		if err := request.WriteProxy(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func copyHttpResponse(resp *http.Response, w http.ResponseWriter) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	// Send the headers now rather than with the first chunk of the body, so
+	// the scraper hears back as soon as the push starts arriving.
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	io.Copy(w, resp.Body)
+}
+
+// The body of errors returned to scrapers.
+type scrapeError struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// Fail a scrape with a JSON error body.
+func (c *Coordinator) scrapeErrorResponse(w http.ResponseWriter, code int, errorType string, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(scrapeError{Status: "error", ErrorType: errorType, Error: msg})
+	c.metrics.scrapeResponses.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+// Refuse a push, with a JSON body saying why as for scrapes.
+func pushErrorResponse(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(scrapeError{Status: "error", ErrorType: failureReasonForError(err), Error: err.Error()})
+}
+
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// Start a rolling restart of clients with a POST, or show its progress.
+func handleRestartRollout(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	var status *RestartRolloutStatus
+	switch r.Method {
+	case "POST":
+		waveSize, err := strconv.Atoi(r.FormValue("wave_size"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid wave_size: %s", err), 400)
+			return
+		}
+		waveTimeout := 5 * time.Minute
+		if v := r.FormValue("wave_timeout"); v != "" {
+			waveTimeout, err = time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid wave_timeout: %s", err), 400)
+				return
+			}
+		}
+		status, err = c.StartRestartRollout(waveSize, waveTimeout)
+		if err == errRolloutInProgress {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	case "GET":
+		status = c.RestartRolloutStatus()
+		if status == nil {
+			http.Error(w, "No restart rollout has been started", 404)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Load the targets of a file_sd_configs file.
+func LoadSDFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	targetGroups := []*targetGroup{}
+	if err := json.Unmarshal(content, &targetGroups); err != nil {
+		return nil, err
+	}
+	targets := []string{}
+	for _, tg := range targetGroups {
+		targets = append(targets, tg.Targets...)
+	}
+	return targets, nil
+}
+
+// The path of one of the proxy's own endpoints a request is for, without
+// util.PathPrefix. False if it's not for one, such as a scrape.
+func (c *Coordinator) SelfPath(r *http.Request) (string, bool) {
+	if r.URL.Host != "" {
+		return "", false
+	}
+	if strings.HasPrefix(r.URL.Path, util.PathPrefix+"/") {
+		return strings.TrimPrefix(r.URL.Path, util.PathPrefix), true
+	}
+	return r.URL.Path, c.config().LegacyPaths
+}
+
+// The largest request body passed on to a target, such as for a POST.
+const maxScrapeRequestBody = 1 << 20
+
+// Read the body of a request to a target, so it can be handed to a client and
+// handed again if the scrape is retried. Returns false if it's too large.
+func bufferRequestBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxScrapeRequestBody+1))
+	if err != nil || len(body) > maxScrapeRequestBody {
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	return true
+}
+
+// Serve scrapes from Prometheus, polls and pushes from clients and the
+// coordinator's own endpoints. Metrics aren't served, as those are up to
+// whoever registered them.
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.accessLog != nil || c.auditLog != nil {
+		a := &accessRecord{ResponseWriter: w, r: r, start: c.now()}
+		defer func() {
+			a.duration = c.since(a.start)
+			if c.accessLog != nil {
+				c.accessLog.write(a)
+			}
+			if c.auditLog != nil && a.target != "" {
+				c.auditLog.write(a)
+			}
+		}()
+		w = a
+	}
+	cfg := c.config()
+	// Requests for a tenant's own view of the proxy, such as from its clients.
+	named := ""
+	if r.URL.Host == "" {
+		if name, rest, ok := tenantPath(r.URL.Path); ok {
+			u := *r.URL
+			u.Path, u.RawPath = rest, ""
+			rewritten := *r
+			rewritten.URL = &u
+			r, named = &rewritten, name
+		}
+	}
+	if named != "" || len(cfg.Tenants) > 0 {
+		path, self := c.SelfPath(r)
+		tenant, ok := cfg.requestTenant(r, named, !self || path == "/clients" || path == "/proxy" || path == "/probe")
+		if !ok {
+			http.Error(w, "Unknown tenant, or a valid token for it is required", http.StatusUnauthorized)
+			return
+		}
+		if tenant != nil {
+			r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant.Name))
+		}
+	}
+	// Anything not for the proxy itself is a scrape. Prometheus puts the
+	// target in the URL, but something in front of the proxy may have moved
+	// it to the Host header.
+	probed := false
+	if r.URL.Host == "" {
+		path, ok := c.SelfPath(r)
+		u := *r.URL
+		if ok {
+			u.Path, u.RawPath = path, ""
+		} else {
+			u.Scheme, u.Host = "http", r.Host
+		}
+		if ok && path == "/proxy" {
+			// A scrape of the client picked out by label selector.
+			target, err := c.selectorTarget(tenantOf(r.Context()), &u)
+			if err != nil {
+				level.Info(c.logger).Log("msg", "Error resolving label selector", "selector", u.Query().Get("selector"), "err", err)
+				c.scrapeErrorResponse(w, statusForError(err), failureReasonForError(err), err.Error())
+				return
+			}
+			u = *target
+		}
+		if ok && path == "/probe" {
+			// A probe by a multi-target exporter behind a client.
+			target, err := probeTarget(&u)
+			if err != nil {
+				c.scrapeErrorResponse(w, statusForError(err), failureReasonForError(err), err.Error())
+				return
+			}
+			u = *target
+			probed = true
+		}
+		rewritten := *r
+		rewritten.URL = &u
+		if u.Host != "" {
+			// Passed on to the client, which would otherwise scrape us.
+			rewritten.Host = u.Host
+		}
+		r = &rewritten
+	}
+	if r.URL.Host != "" {
+		noteScrape(w, r.URL.String())
+	}
+	if !c.authorize(cfg, w, r) {
+		return
+	}
+
+	// Proxy request
+	if r.URL.Host != "" {
+		// Probes name the proxy in their URL, so can be sent to another one.
+		if owner := cfg.shardOwner(clientKey(r.Context(), c.routeFor(r.URL))); owner != "" && probed && r.Header.Get(forwardedHeader) == "" {
+			c.redirectToShard(w, r, owner, "scrape")
+			return
+		}
+		delivered := c.now()
+		outcome := outcomeSuccess
+		defer func() { c.metrics.observeStage(stageDeliver, delivered, outcome) }()
+		status, scrapeError := 0, ""
+		defer func() {
+			c.targets.record(tenantOf(r.Context()), r.URL.Host, r.URL.Path, status, scrapeError, c.since(delivered))
+		}()
+		timeout := c.ScrapeTimeout(r)
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		cfg.requestHeaders.apply(r.Header, isProxyHeader)
+		// Let the client know how long it really has.
+		r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", timeout.Seconds()))
+		request := r.WithContext(ctx)
+		request.RequestURI = ""
+		if !bufferRequestBody(request) {
+			outcome = "request_too_large"
+			status, scrapeError = http.StatusRequestEntityTooLarge, fmt.Sprintf("Request bodies for targets are limited to %d bytes", maxScrapeRequestBody)
+			c.scrapeErrorResponse(w, status, outcome, scrapeError)
+			return
+		}
+
+		resp, err := c.DoScrape(ctx, request)
+		noteAccess(w, request.Header.Get("Id"), request.URL.Hostname())
+		if err != nil {
+			level.Info(c.logger).Log("msg", "Error scraping", "url", request.URL.String(), "err", err)
+			reason := failureReasonForError(err)
+			outcome = reason
+			c.failures.record(request.URL.String(), reason)
+			status, scrapeError = statusForError(err), err.Error()
+			c.scrapeErrorResponse(w, status, reason, fmt.Sprintf("Error scraping %q: %s", request.URL.String(), scrapeError))
+			return
+		}
+		defer resp.Body.Close()
+		if resp.Header.Get(util.ScrapeErrorHeader) != "" {
+			scrapeErr := util.ReadScrapeError(resp)
+			// Read the rest, so the push isn't taken as abandoned.
+			io.Copy(ioutil.Discard, resp.Body)
+			level.Info(c.logger).Log("msg", "Client failed to scrape", "url", request.URL.String(), "kind", scrapeErr.Kind, "err", scrapeErr.Error)
+			c.metrics.clientScrapeErrors.WithLabelValues(scrapeErr.Kind).Inc()
+			reason := "scrape_error_" + scrapeErr.Kind
+			outcome = outcomeTargetError
+			c.failures.record(request.URL.String(), reason)
+			status, scrapeError = scrapeErr.StatusCode(), scrapeErr.Error
+			c.scrapeErrorResponse(w, status, reason, scrapeError)
+			return
+		}
+		status = resp.StatusCode
+		if resp.StatusCode/100 != 2 {
+			outcome = outcomeTargetError
+			c.failures.record(request.URL.String(), failureReasonForStatus(resp.StatusCode))
+			scrapeError = "server returned HTTP status " + resp.Status
+		}
+		cfg.responseHeaders.apply(resp.Header, isProxyHeader)
+		if cfg.HealthSeries {
+			addHealthSeries(resp, c.healthSeries(r.Context(), request))
+		}
+		copyHttpResponse(resp, w)
+		c.metrics.scrapeResponses.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+		return
+	}
+
+	// Client registering and asking for scrapes.
+	if r.URL.Path == "/poll" {
+		body, _ := ioutil.ReadAll(r.Body)
+		fqdn, ok := c.clientIdentity(cfg, w, r, string(body))
+		if !ok {
+			return
+		}
+		// From here on the client is known by its key within its tenant.
+		fqdn = clientKey(r.Context(), fqdn)
+		if owner := cfg.shardOwner(fqdn); owner != "" {
+			c.redirectToShard(w, r, owner, "poll")
+			return
+		}
+		if tenant := cfg.tenant(tenantOf(r.Context())); c.tenantFull(tenant, fqdn) {
+			http.Error(w, fmt.Sprintf("Tenant %q has reached its maximum number of clients", tenant.Name), 503)
+			return
+		}
+		c.setClientLabels(fqdn, pollLabels(r))
+		version := c.negotiateProtocol(fqdn, r)
+		w.Header().Set(util.ProtocolVersionHeader, strconv.Itoa(version))
+		if r.Header.Get(util.RegisterOnlyHeader) != "" {
+			err := c.RegisterClient(fqdn)
+			noteAccess(w, "", fqdn)
+			if err == errClientRejected {
+				http.Error(w, err.Error(), 403)
+			} else if err != nil {
+				http.Error(w, err.Error(), 503)
+			}
+			return
+		}
+		ctx := r.Context()
+		if cfg.MaxPollDuration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.MaxPollDuration)
+			defer cancel()
+		}
+		request, control, err := c.WaitForInstanceScrapeInstruction(ctx, fqdn, pollInstance(r))
+		noteAccess(w, "", fqdn)
+		if err != nil && err == r.Context().Err() {
+			// The client went away.
+			return
+		}
+		if err != nil && err == ctx.Err() {
+			// Nothing to scrape for a while, the client polls again.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err == errCoordinatorFull && cfg.OverflowURL != "" {
+			level.Info(c.logger).Log("msg", "Redirecting client to overflow coordinator", "fqdn", fqdn, "overflow_url", cfg.OverflowURL)
+			http.Redirect(w, r, strings.TrimRight(cfg.OverflowURL, "/")+util.PathPrefix+"/poll", http.StatusTemporaryRedirect)
+			return
+		}
+		if err == errClientRejected {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		if err == errShuttingDown {
+			http.Error(w, err.Error(), 503)
+			return
+		}
+		if err != nil {
+			level.Info(c.logger).Log("msg", "Error waiting for scrape instruction", "fqdn", fqdn, "err", err)
+			http.Error(w, fmt.Sprintf("Error waiting for scrape instruction: %s", err.Error()), 503)
+			return
+		}
+		if control != "" {
+			w.Header().Set(util.ControlHeader, control)
+			level.Info(c.logger).Log("msg", "Sent control message to client", "fqdn", fqdn, "control", control)
+			return
+		}
+		w.Header().Set(util.AcceptEncodingHeader, strings.Join(util.PushEncodings, ", "))
+		if cfg.DeltaCacheSize > 0 {
+			w.Header().Set(util.AcceptDeltaHeader, "1")
+		}
+		if cfg.VerifyPushChecksums {
+			w.Header().Set(util.VerifyChecksumHeader, strconv.FormatInt(cfg.VerifyPushMaxBytes, 10))
+		}
+		if cfg.ResumablePushMaxBytes > 0 {
+			w.Header().Set(util.AcceptChunksHeader, "1")
+		}
+		noteAccess(w, request.Header.Get("Id"), fqdn)
+		requests := []*http.Request{request}
+		if s := r.Header.Get(util.BatchSizeHeader); s != "" && version >= util.ProtocolBatches {
+			if n, err := strconv.Atoi(s); err == nil && n > 1 && cfg.MaxPollBatch > 1 {
+				if n > cfg.MaxPollBatch {
+					n = cfg.MaxPollBatch
+				}
+				requests = append(requests, c.moreScrapeInstructions(fqdn, pollInstance(r), n-1)...)
+			}
+			w.Header().Set(util.BatchSizeHeader, strconv.Itoa(len(requests)))
+		}
+		// Send full requests as the body of the response.
+		if err := writeScrapeRequests(w, requests); err != nil {
+			level.Info(c.logger).Log("msg", "Error responding to /poll", "fqdn", fqdn, "err", err)
+			return
+		}
+		for _, request := range requests {
+			level.Debug(c.logger).Log("msg", "Responded to /poll", "scrape_id", request.Header.Get("Id"), "fqdn", fqdn, "url", request.URL.String(), "batch_size", len(requests))
+		}
+		return
+	}
+
+	// Scrape response from client.
+	if r.URL.Path == "/push" {
+		// The body is streamed through to Prometheus as it arrives, unless
+		// it's to be checked first.
+		pushed := c.now()
+		if cfg.VerifyPushChecksums {
+			if err := c.verifyPush(cfg, w, r); errors.Is(err, errPushTooLarge) {
+				level.Info(c.logger).Log("msg", "Refusing a push too large to verify", "remote_addr", r.RemoteAddr, "err", err)
+				c.metrics.observeStage(stagePush, pushed, "too_large")
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			} else if errors.Is(err, errPushCorrupted) {
+				level.Info(c.logger).Log("msg", "Asking for a corrupted push again", "remote_addr", r.RemoteAddr, "err", err)
+				c.metrics.observeStage(stagePush, pushed, "corrupted")
+				w.Header().Set("Retry-After", "0")
+				pushErrorResponse(w, util.PushCorruptedStatus, err)
+				return
+			} else if err != nil {
+				level.Info(c.logger).Log("msg", "Error reading pushed response", "err", err)
+				c.metrics.observeStage(stagePush, pushed, "invalid")
+				http.Error(w, fmt.Sprintf("Error reading pushed response: %s", err.Error()), 400)
+				return
+			}
+		}
+		c.acceptPush(w, r, r.Body, r.Header.Get("Content-Encoding"), pushed)
+		return
+	}
+
+	if r.URL.Path == "/push-batch" {
+		handlePushBatch(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/push-chunk" {
+		handlePushChunk(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/debug/errors" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		c.failures.writeSummary(w, 50)
+		return
+	}
+
+	if r.URL.Path == "/debug/state" {
+		handleDebugState(c, w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/debug/pprof/") && c.pprof != nil {
+		c.pprof.ServeHTTP(w, r)
+		return
+	}
+
+	if r.URL.Path == "/discovery" {
+		handleDiscoveryReport(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/remote-write" {
+		handleRemoteWrite(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/publish" {
+		handlePublish(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/tunnel" {
+		handleTunnel(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/admin/discovered" {
+		handleDiscoveredTargets(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/peer/clients" {
+		handlePeerClients(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/admin/clients" {
+		handleClientApprovals(c, w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/api/v1/") {
+		handleAPI(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/admin/client-tokens" {
+		handleClientTokens(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/admin/status" {
+		handleStatusPage(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/admin/blocklist" {
+		handleBlocklist(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/admin/debug" {
+		handleClientDebug(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/admin/restart" {
+		handleRestartRollout(c, w, r)
+		return
+	}
+
+	if r.URL.Path == "/-/healthy" {
+		fmt.Fprintln(w, "Healthy")
+		return
+	}
+	if r.URL.Path == "/-/ready" {
+		if c.isDraining() {
+			http.Error(w, "Shutting down", 503)
+			return
+		}
+		fmt.Fprintln(w, "Ready")
+		return
+	}
+
+	if r.URL.Path == "/-/reload" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		if err := c.Reload(); err != nil {
+			level.Warn(c.logger).Log("msg", "Error reloading config", "err", err)
+			http.Error(w, fmt.Sprintf("Error reloading config: %s", err), 500)
+		}
+		return
+	}
+
+	if r.URL.Path == "/clients" {
+		// Only the clients of the tenant asking, if any.
+		tenant := tenantOf(r.Context())
+		known := c.AllKnownClients()
+		targets := make([]*targetGroup, 0, len(known))
+		listed := map[string]bool{}
+		for _, k := range known {
+			if t, fqdn := splitTenantClient(k); t == tenant {
+				targets = append(targets, &targetGroup{Targets: []string{sdTarget(fqdn)}})
+				listed[k] = true
+			}
+		}
+		// Keep stubbed clients listed while their device is away.
+		for _, fqdn := range cfg.stubbedClients() {
+			if !listed[fqdn] && tenant == "" {
+				targets = append(targets, &targetGroup{Targets: []string{sdTarget(fqdn)}})
+			}
+		}
+		groups := map[string]*targetGroup{}
+		for _, dt := range c.DiscoveredTargets(tenant) {
+			_, fqdn := splitTenantClient(dt.Client)
+			if dt.State != approvalApproved {
+				continue
+			}
+			if len(dt.Labels) > 0 {
+				// Targets with labels of their own get a group each.
+				labels := map[string]string{"__meta_pushprox_client": fqdn}
+				for name, value := range dt.Labels {
+					labels["__meta_pushprox_"+name] = value
+				}
+				targets = append(targets, &targetGroup{Targets: []string{dt.Target}, Labels: labels})
+				continue
+			}
+			group, ok := groups[fqdn]
+			if !ok {
+				group = &targetGroup{Labels: map[string]string{"__meta_pushprox_client": fqdn}}
+				groups[fqdn] = group
+				targets = append(targets, group)
+			}
+			group.Targets = append(group.Targets, dt.Target)
+		}
+		json.NewEncoder(w).Encode(targets)
+		level.Debug(c.logger).Log("msg", "Responded to /clients", "client_count", len(known))
+		return
+	}
+
+	http.Error(w, "404: Unknown path", 404)
+}
+
+// Pass on a scrape result pushed by a client, with its body as sent and how
+// that's encoded.
+func (c *Coordinator) acceptPush(w http.ResponseWriter, r *http.Request, wireBody io.Reader, encoding string, pushed time.Time) {
+	wire := &countingReader{r: wireBody}
+	body, err := util.NewPushReader(wire, encoding)
+	if err != nil {
+		level.Info(c.logger).Log("msg", "Error reading pushed response", "err", err)
+		c.metrics.observeStage(stagePush, pushed, "invalid")
+		http.Error(w, fmt.Sprintf("Error reading pushed response: %s", err.Error()), 415)
+		return
+	}
+	uncompressed := &countingReader{r: body}
+	defer func() {
+		c.metrics.pushWireBytes.WithLabelValues(encoding).Add(float64(wire.n))
+		c.metrics.pushUncompressedBytes.WithLabelValues(encoding).Add(float64(uncompressed.n))
+	}()
+	// The decompressor is safe to close however the push ends, as it's only
+	// reused once any read in progress is done.
+	defer body.Close()
+	br := bufioReaders.Get().(*bufio.Reader)
+	br.Reset(uncompressed)
+	// Only reuse the bufio.Reader once nothing can still be reading the body.
+	release := func() {
+		br.Reset(nil)
+		bufioReaders.Put(br)
+	}
+	scrapeResult, err := http.ReadResponse(br, nil)
+	if err != nil {
+		release()
+		level.Info(c.logger).Log("msg", "Error reading pushed response", "err", err)
+		c.metrics.observeStage(stagePush, pushed, "invalid")
+		http.Error(w, fmt.Sprintf("Error reading pushed response: %s", err.Error()), 400)
+		return
+	}
+	id := scrapeResult.Header.Get("Id")
+	noteAccess(w, id, "")
+	if err := c.resolveDelta(scrapeResult); err != nil {
+		release()
+		if err == errDeltaBaseMissing {
+			level.Debug(c.logger).Log("msg", "Asking for the whole of a push sent as a delta", "scrape_id", id)
+			pushErrorResponse(w, util.DeltaBaseMissingStatus, err)
+			return
+		}
+		level.Info(c.logger).Log("msg", "Error reading pushed delta", "scrape_id", id, "err", err)
+		c.metrics.observeStage(stagePush, pushed, "invalid")
+		http.Error(w, fmt.Sprintf("Error reading pushed delta: %s", err.Error()), 400)
+		return
+	}
+	level.Debug(c.logger).Log("msg", "Got /push", "scrape_id", id)
+	pending, _ := c.pendingResultFor(id)
+	err = c.ScrapeResult(scrapeResult)
+	if pending != nil && (err == nil || err == errAbandoned) {
+		c.addUsage(pending.fqdn, wire.n, 1)
+	}
+	c.metrics.observeStage(stagePush, pushed, stageOutcome(nil, err))
+	rejected := err == errDuplicateResult || err == errOrphaned || err == errUnknownScrape || err == errExpiredScrape
+	if err == nil || err == errAbandoned || rejected {
+		release()
+	}
+	if rejected {
+		c.metrics.rejectedPushes.WithLabelValues(failureReasonForError(err)).Inc()
+	}
+	if err == errDuplicateResult {
+		level.Info(c.logger).Log("msg", "Discarding late duplicate push", "scrape_id", id)
+		pushErrorResponse(w, 409, err)
+		return
+	}
+	if err == errUnknownScrape {
+		level.Info(c.logger).Log("msg", "Rejecting push for a scrape that wasn't issued", "scrape_id", id, "remote_addr", r.RemoteAddr)
+	}
+	if err == errAbandoned || err == errOrphaned || err == errUnknownScrape || err == errExpiredScrape {
+		// Drop the connection rather than reading the rest of the push,
+		// so the client stops sending it.
+		level.Debug(c.logger).Log("msg", "Abandoning push", "scrape_id", id, "err", err)
+		w.Header().Set("Connection", "close")
+		pushErrorResponse(w, util.PushAbandonedStatus, err)
+		if err == errAbandoned {
+			c.metrics.abandonedPushes.Inc()
+		}
+		return
+	}
+	if err != nil {
+		level.Info(c.logger).Log("msg", "Error pushing", "scrape_id", id, "err", err)
+		http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), 500)
+	}
+}
+
+// The FQDN of the client making r as fqdn, once its certificate, SSH key,
+// inventory entry, JWT and DNS have been checked to allow it, as for polls.
+// Otherwise the error is sent and false returned.
+func (c *Coordinator) clientIdentity(cfg *runtimeConfig, w http.ResponseWriter, r *http.Request, fqdn string) (string, bool) {
+	fqdn = NormalizeFQDN(strings.TrimSpace(fqdn))
+	if cfg.TLS.ClientFQDNFromCert {
+		certName, ok := certFQDN(r, fqdn)
+		if !ok {
+			http.Error(w, "A verified client certificate with a name is required", 403)
+			return "", false
+		}
+		if certName != fqdn {
+			level.Debug(c.logger).Log("msg", "Taking client to be the name in its certificate", "fqdn", fqdn, "certificate_fqdn", certName)
+			fqdn = certName
+		}
+	}
+	if strings.Contains(fqdn, "/") || !cfg.clientAllowed(fqdn) {
+		http.Error(w, "Clients may not register with this FQDN", 403)
+		return "", false
+	}
+	if keyFQDN, ok := sshClientOf(r.Context()); ok && fqdn != keyFQDN {
+		http.Error(w, "Clients over SSH may only register as the FQDN of their key", 403)
+		return "", false
+	}
+	if ok, status := cfg.inventoryAllows(fqdn, r); !ok {
+		level.Info(c.logger).Log("msg", "Rejecting client not allowed by the inventory", "fqdn", fqdn, "path", r.URL.Path, "status", status)
+		http.Error(w, "Client is not in the inventory or has the wrong token", status)
+		return "", false
+	}
+	if !cfg.jwtAllows(fqdn, r) {
+		level.Info(c.logger).Log("msg", "Rejecting client with a JWT not for its FQDN", "fqdn", fqdn, "path", r.URL.Path)
+		http.Error(w, "The client's JWT does not allow this FQDN", 403)
+		return "", false
+	}
+	if !c.dnsAllowed(r.Context(), cfg, fqdn, r.RemoteAddr) {
+		http.Error(w, "Client address does not match the DNS of its FQDN", 403)
+		return "", false
+	}
+	return fqdn, true
+}
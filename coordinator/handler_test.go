@@ -0,0 +1,62 @@
+package coordinator
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// Hides any io.ByteWriter, as an http.ResponseWriter has none.
+type plainWriter struct {
+	io.Writer
+}
+
+func scrapeRequests(t testing.TB, n int) []*http.Request {
+	var requests []*http.Request
+	for i := 0; i < n; i++ {
+		r, err := http.NewRequest("GET", "http://node1.example.com:9100/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+		r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+		r.Header.Set("Id", "0123456789abcdef0123456789abcdef")
+		requests = append(requests, r)
+	}
+	return requests
+}
+
+func TestWriteScrapeRequests(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeScrapeRequests(plainWriter{&buf}, scrapeRequests(t, 3)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(&buf)
+	for i := 0; i < 3; i++ {
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			t.Fatalf("request %d: %s", i, err)
+		}
+		if r.URL.String() != "http://node1.example.com:9100/metrics" || r.Header.Get("Id") != "0123456789abcdef0123456789abcdef" {
+			t.Errorf("request %d: got %s with Id %q", i, r.URL, r.Header.Get("Id"))
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left over", buf.Len())
+	}
+}
+
+// Was 4448 B/op with WriteProxy straight to the writer, as it set up a
+// bufio.Writer per request.
+func BenchmarkWriteScrapeRequests(b *testing.B) {
+	requests := scrapeRequests(b, 1)
+	var buf bytes.Buffer
+	w := plainWriter{&buf}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		writeScrapeRequests(w, requests)
+	}
+}
@@ -0,0 +1,85 @@
+package coordinator
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Which headers pass through the proxy. Hop-by-hop headers never do.
+type HeaderPolicy struct {
+	// Only these pass, if any are given.
+	Allow []string `yaml:"allow"`
+	// These never pass.
+	Deny []string `yaml:"deny"`
+}
+
+// Which headers of scrapes are passed on to targets, and which of their
+// responses are passed back to scrapers.
+type HeaderPolicyConfig struct {
+	Request  HeaderPolicy `yaml:"request"`
+	Response HeaderPolicy `yaml:"response"`
+}
+
+// Headers that are only about the connection they came over.
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// A HeaderPolicy, by canonical header name.
+type headerFilter struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+func compileHeaderPolicy(p HeaderPolicy) *headerFilter {
+	f := &headerFilter{deny: map[string]bool{}}
+	for _, name := range hopByHopHeaders {
+		f.deny[name] = true
+	}
+	for _, name := range p.Deny {
+		f.deny[http.CanonicalHeaderKey(name)] = true
+	}
+	if len(p.Allow) > 0 {
+		f.allow = map[string]bool{}
+		for _, name := range p.Allow {
+			f.allow[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return f
+}
+
+// Remove the headers the policy doesn't let through from h, and any the
+// Connection header says are hop-by-hop. Negotiation headers and those for
+// which keep is true stay regardless.
+func (f *headerFilter) apply(h http.Header, keep func(string) bool) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for name := range h {
+		if isNegotiationHeader(name) || keep != nil && keep(name) {
+			continue
+		}
+		if f.deny[name] || (f.allow != nil && !f.allow[name]) {
+			delete(h, name)
+		}
+	}
+}
+
+// Headers scrapers and targets negotiate the exposition format and encoding
+// with, which always pass so scrapes through the proxy get the same format as
+// direct ones.
+func isNegotiationHeader(name string) bool {
+	switch name {
+	case "Accept", "Accept-Encoding", "Content-Type", "Content-Encoding":
+		return true
+	}
+	return false
+}
+
+// Headers the proxy and clients use among themselves, such as
+// X-PushProx-Priority and X-PushProx-Stale.
+func isProxyHeader(name string) bool {
+	return strings.HasPrefix(name, "X-Pushprox-")
+}
@@ -0,0 +1,37 @@
+package coordinator
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderFilterKeepsNegotiationHeaders(t *testing.T) {
+	f := compileHeaderPolicy(HeaderPolicy{Allow: []string{"X-Allowed"}})
+	h := http.Header{}
+	for _, name := range []string{"Accept", "Accept-Encoding", "Content-Type", "Content-Encoding", "X-Allowed", "X-Other", "Connection"} {
+		h.Set(name, "x")
+	}
+	f.apply(h, nil)
+	for _, name := range []string{"Accept", "Accept-Encoding", "Content-Type", "Content-Encoding", "X-Allowed"} {
+		if h.Get(name) == "" {
+			t.Errorf("%s was dropped", name)
+		}
+	}
+	for _, name := range []string{"X-Other", "Connection"} {
+		if h.Get(name) != "" {
+			t.Errorf("%s was let through", name)
+		}
+	}
+}
+
+func TestHeaderFilterDenyDoesNotDropNegotiationHeaders(t *testing.T) {
+	f := compileHeaderPolicy(HeaderPolicy{Deny: []string{"Accept-Encoding", "Cookie"}})
+	h := http.Header{"Accept-Encoding": {"gzip"}, "Cookie": {"a=b"}}
+	f.apply(h, nil)
+	if h.Get("Accept-Encoding") != "gzip" {
+		t.Errorf("Accept-Encoding was dropped")
+	}
+	if h.Get("Cookie") != "" {
+		t.Errorf("Cookie was let through")
+	}
+}
@@ -0,0 +1,100 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// A synthetic series appended to scrapes with HealthSeries.
+type healthSeries struct {
+	name, help string
+	value      float64
+}
+
+// The series telling dashboards a scrape came through the proxy, and how
+// recently the client polled, so a target whose exporter is down can be told
+// apart from one whose tunnel is.
+func (c *Coordinator) healthSeries(ctx context.Context, r *http.Request) []healthSeries {
+	series := []healthSeries{{"pushprox_scrape_via_proxy", "Whether this scrape came through PushProx.", 1}}
+	fqdn := clientKey(ctx, c.routeFor(r.URL))
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	last, ok := shard.known[fqdn]
+	shard.mu.Unlock()
+	if ok {
+		series = append(series, healthSeries{"pushprox_client_last_poll_age_seconds", "How long ago the client this scrape went to last polled PushProx.", c.since(last).Seconds()})
+	}
+	return series
+}
+
+// Append the series to a successful scrape, as it's streamed. Only text and
+// delimited protobuf expositions that the target didn't compress have them
+// appended.
+func addHealthSeries(resp *http.Response, series []healthSeries) {
+	if resp.StatusCode/100 != 2 || resp.Header.Get(util.ScrapeErrorHeader) != "" || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	contentType := resp.Header.Get("Content-Type")
+	switch {
+	case util.CanAddTimestamps(contentType):
+		var buf bytes.Buffer
+		for _, s := range series {
+			fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", s.name, s.help, s.name, s.name, s.value)
+		}
+		util.RewriteBody(resp, func(w io.Writer, r io.Reader) error {
+			return appendAfter(w, r, buf.Bytes(), true)
+		})
+	case util.IsProtoDelimited(contentType):
+		var buf bytes.Buffer
+		enc := expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeProtoDelim))
+		for _, s := range series {
+			enc.Encode(&dto.MetricFamily{
+				Name:   proto.String(s.name),
+				Help:   proto.String(s.help),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(s.value)}}},
+			})
+		}
+		util.RewriteBody(resp, func(w io.Writer, r io.Reader) error {
+			return appendAfter(w, r, buf.Bytes(), false)
+		})
+	}
+}
+
+// Copy r to w followed by extra, for text starting it on a new line if r
+// doesn't end with one.
+func appendAfter(w io.Writer, r io.Reader, extra []byte, text bool) error {
+	buf := make([]byte, 32*1024)
+	last := byte('\n')
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			last = buf[n-1]
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if text && last != '\n' {
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(extra)
+	return err
+}
@@ -0,0 +1,108 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sizes of the coordinator's maps and how many goroutines are blocked in it,
+// to spot leaks before they run the proxy out of memory.
+type internalState struct {
+	RequestChannels   int            `json:"request_channels"`
+	ResponseChannels  int            `json:"response_channels"`
+	ControlChannels   int            `json:"control_channels"`
+	KnownClients      int            `json:"known_clients"`
+	Issued            int            `json:"issued"`
+	Answered          int            `json:"answered"`
+	Warm              int            `json:"warm"`
+	Coalescing        int            `json:"coalescing"`
+	LastGood          int            `json:"last_good"`
+	Discovered        int            `json:"discovered"`
+	Approvals         int            `json:"approvals"`
+	Queued            map[string]int `json:"queued"`
+	ScrapesInProgress int64          `json:"scrapes_in_progress"`
+	PollsWaiting      int64          `json:"polls_waiting"`
+	Goroutines        int            `json:"goroutines"`
+}
+
+func (c *Coordinator) internalState() internalState {
+	queued := map[string]int{}
+	requestChannels := c.clientShardSizes(func(s *clientShard) int {
+		for fqdn, n := range s.queued {
+			queued[fqdn] = n
+		}
+		return len(s.pools)
+	})
+	controlChannels := c.clientShardSizes(func(s *clientShard) int { return len(s.control) })
+	responseChannels := c.scrapeShardSizes(func(s *scrapeShard) int { return len(s.responses) })
+	issued := c.scrapeShardSizes(func(s *scrapeShard) int { return len(s.issued) })
+	answered := c.scrapeShardSizes(func(s *scrapeShard) int { return len(s.answered) })
+	known := c.clientShardSizes(func(s *clientShard) int { return len(s.known) })
+	warm := c.clientShardSizes(func(s *clientShard) int {
+		n := 0
+		for _, targets := range s.warm {
+			n += len(targets)
+		}
+		return n
+	})
+	approvals := c.clientShardSizes(func(s *clientShard) int { return len(s.approvals) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return internalState{
+		RequestChannels:   requestChannels,
+		ResponseChannels:  responseChannels,
+		ControlChannels:   controlChannels,
+		KnownClients:      known,
+		Issued:            issued,
+		Answered:          answered,
+		Warm:              warm,
+		Coalescing:        len(c.coalescing),
+		LastGood:          len(c.lastGood),
+		Discovered:        len(c.discovered),
+		Approvals:         approvals,
+		Queued:            queued,
+		ScrapesInProgress: atomic.LoadInt64(&c.scrapesInProgress),
+		PollsWaiting:      atomic.LoadInt64(&c.pollsWaiting),
+		Goroutines:        runtime.NumGoroutine(),
+	}
+}
+
+// Gauges of the coordinator's internals.
+func (c *Coordinator) internalCollectors() []prometheus.Collector {
+	// The sizes are summed over the shards, each locked in turn.
+	shardSize := func(name, help string, size func() int) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, func() float64 {
+			return float64(size())
+		})
+	}
+	return []prometheus.Collector{
+		shardSize("pushprox_request_channels", "Clients with a pool of instances for scrapes to be sent to.", func() int {
+			return c.clientShardSizes(func(s *clientShard) int { return len(s.pools) })
+		}),
+		shardSize("pushprox_response_channels", "Scrapes with a channel for their result to be pushed to.", func() int {
+			return c.scrapeShardSizes(func(s *scrapeShard) int { return len(s.responses) })
+		}),
+		shardSize("pushprox_control_channels", "Clients with a channel for control messages to them.", func() int {
+			return c.clientShardSizes(func(s *clientShard) int { return len(s.control) })
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "pushprox_scrapes_in_progress",
+			Help: "Scrapes waiting in DoScrape for a client to pick them up or push their result.",
+		}, func() float64 { return float64(atomic.LoadInt64(&c.scrapesInProgress)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "pushprox_polls_waiting",
+			Help: "Polls from clients waiting for a scrape or control message.",
+		}, func() float64 { return float64(atomic.LoadInt64(&c.pollsWaiting)) }),
+	}
+}
+
+// Dump the sizes of the coordinator's internals as JSON.
+func handleDebugState(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.internalState())
+}
@@ -0,0 +1,97 @@
+package coordinator
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// A client expected to poll, from the inventory file.
+type InventoryClient struct {
+	FQDN string `yaml:"fqdn"`
+	// Token the client must poll with in place of the client tokens, empty
+	// for none.
+	Token string `yaml:"token"`
+}
+
+// Read the inventory file, if there is one.
+func (rc *runtimeConfig) loadInventory() error {
+	if rc.InventoryFile == "" {
+		if rc.InventoryStrict {
+			return errors.New("a strict inventory needs an inventory file")
+		}
+		return nil
+	}
+	content, err := ioutil.ReadFile(rc.InventoryFile)
+	if err != nil {
+		return fmt.Errorf("error loading inventory: %s", err)
+	}
+	var clients []InventoryClient
+	if err := yaml.UnmarshalStrict(content, &clients); err != nil {
+		return fmt.Errorf("error parsing inventory %s: %s", rc.InventoryFile, err)
+	}
+	rc.inventory = make(map[string]InventoryClient, len(clients))
+	for _, client := range clients {
+		if client.FQDN == "" {
+			return fmt.Errorf("inventory %s has a client without an fqdn", rc.InventoryFile)
+		}
+		client.FQDN = NormalizeFQDN(client.FQDN)
+		rc.inventory[client.FQDN] = client
+		if client.Token != "" {
+			rc.inventoryTokens = append(rc.inventoryTokens, client.Token)
+		}
+	}
+	return nil
+}
+
+// Whether a poll from the client may register as fqdn as far as the inventory
+// is concerned, and if not the status to fail it with.
+func (rc *runtimeConfig) inventoryAllows(fqdn string, r *http.Request) (bool, int) {
+	client, ok := rc.inventory[fqdn]
+	if !ok {
+		return !rc.InventoryStrict, http.StatusForbidden
+	}
+	if client.Token == "" {
+		return true, 0
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(client.Token)) != 1 {
+		return false, http.StatusUnauthorized
+	}
+	return true, 0
+}
+
+// Whether each client in the inventory has polled within the registration
+// timeout, to alert on those that have gone away.
+type inventoryCollector struct {
+	c    *Coordinator
+	desc *prometheus.Desc
+}
+
+func newInventoryCollector(c *Coordinator) inventoryCollector {
+	return inventoryCollector{c: c, desc: prometheus.NewDesc(
+		"pushprox_inventory_client_present",
+		"Whether a client in the inventory has polled within the registration timeout.",
+		[]string{"fqdn"}, nil,
+	)}
+}
+
+func (ic inventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ic.desc
+}
+
+func (ic inventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	for fqdn := range ic.c.config().inventory {
+		present := 0.0
+		if ic.c.isKnownClient(fqdn) {
+			present = 1
+		}
+		ch <- prometheus.MustNewConstMetric(ic.desc, prometheus.GaugeValue, present, fqdn)
+	}
+}
@@ -0,0 +1,255 @@
+package coordinator
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTs clients may authenticate with instead of a client token. The subject
+// is the FQDN the client may register as, or several separated by commas,
+// where "*.example.com" allows any name under example.com.
+type ClientJWTConfig struct {
+	// HMAC secret the proxy signs its own tokens with, from
+	// /admin/client-tokens, and checks them against.
+	SigningKeyFile string `yaml:"signing_key_file"`
+	// PEM public keys or certificates of an identity provider whose RSA,
+	// ECDSA or Ed25519 signed tokens are accepted.
+	PublicKeyFiles []string `yaml:"public_key_files"`
+	// Required iss and aud claims, if set.
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// IDs (jti) of tokens no longer accepted.
+	RevokedIDs []string `yaml:"revoked_ids"`
+}
+
+// Default lifetime of tokens signed by the proxy.
+const defaultClientJWTTTL = 24 * time.Hour
+
+var errJWTRevoked = errors.New("token has been revoked")
+
+type jwtVerifier struct {
+	cfg        ClientJWTConfig
+	secret     []byte
+	publicKeys []crypto.PublicKey
+	revoked    map[string]bool
+}
+
+// Load the keys for client JWTs, if any are configured.
+func (rc *runtimeConfig) loadClientJWT() error {
+	cfg := rc.Authorization.ClientJWT
+	if cfg.SigningKeyFile == "" && len(cfg.PublicKeyFiles) == 0 {
+		return nil
+	}
+	v := &jwtVerifier{cfg: cfg, revoked: map[string]bool{}}
+	if cfg.SigningKeyFile != "" {
+		secret, err := ioutil.ReadFile(cfg.SigningKeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading JWT signing key: %s", err)
+		}
+		v.secret = []byte(strings.TrimSpace(string(secret)))
+		if len(v.secret) < 32 {
+			return fmt.Errorf("JWT signing key %s must be at least 32 bytes", cfg.SigningKeyFile)
+		}
+	}
+	for _, path := range cfg.PublicKeyFiles {
+		keys, err := loadPublicKeys(path)
+		if err != nil {
+			return fmt.Errorf("error loading JWT public key %s: %s", path, err)
+		}
+		v.publicKeys = append(v.publicKeys, keys...)
+	}
+	for _, id := range cfg.RevokedIDs {
+		v.revoked[id] = true
+	}
+	rc.clientJWT = v
+	return nil
+}
+
+// The public keys of a PEM file, from PUBLIC KEY or CERTIFICATE blocks.
+func loadPublicKeys(path string) ([]crypto.PublicKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+	return keys, nil
+}
+
+// The subject of a valid token.
+func (v *jwtVerifier) subject(token string) (string, error) {
+	opts := []jwt.ParserOption{jwt.WithExpirationRequired()}
+	if v.cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.cfg.Issuer))
+	}
+	if v.cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(v.cfg.Audience))
+	}
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		// Only ever check a signature with the kind of key it's for, so a
+		// public key can't be used as an HMAC secret.
+		switch t.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if v.secret == nil {
+				return nil, errors.New("no signing key for HMAC tokens")
+			}
+			return v.secret, nil
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA, *jwt.SigningMethodEd25519:
+			keys := jwt.VerificationKeySet{}
+			for _, k := range v.publicKeys {
+				keys.Keys = append(keys.Keys, k)
+			}
+			return keys, nil
+		}
+		return nil, fmt.Errorf("unsupported signing method %s", t.Method.Alg())
+	}, opts...)
+	if err != nil {
+		return "", err
+	}
+	if v.revoked[claims.ID] && claims.ID != "" {
+		return "", errJWTRevoked
+	}
+	return claims.Subject, nil
+}
+
+// Whether a JWT subject allows the FQDN. A name without a port allows it with
+// any port.
+func subjectAllows(subject, fqdn string) bool {
+	host := fqdnHost(fqdn)
+	for _, s := range strings.Split(subject, ",") {
+		s = NormalizeFQDN(strings.TrimSpace(s))
+		if s == fqdn || s == host || strings.HasPrefix(s, "*.") && strings.HasSuffix(host, s[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the request has a valid client JWT.
+func (rc *runtimeConfig) hasClientJWT(r *http.Request) bool {
+	if rc.clientJWT == nil {
+		return false
+	}
+	_, err := rc.clientJWT.subject(clientToken(r))
+	return err == nil
+}
+
+// Whether a poll may register as fqdn as far as its JWT is concerned. Polls
+// authenticated some other way are left to those checks.
+func (rc *runtimeConfig) jwtAllows(fqdn string, r *http.Request) bool {
+	if rc.clientJWT == nil {
+		return true
+	}
+	sub, err := rc.clientJWT.subject(clientToken(r))
+	return err != nil || subjectAllows(sub, fqdn)
+}
+
+// A token signed by the proxy, as returned by the admin API.
+type ClientJWT struct {
+	Token   string `json:"token"`
+	ID      string `json:"id"`
+	Subject string `json:"subject"`
+	Expires string `json:"expires"`
+}
+
+// Sign a token a client may register as the FQDNs with, until ttl from now.
+func (c *Coordinator) SignClientJWT(fqdns []string, ttl time.Duration) (*ClientJWT, error) {
+	v := c.config().clientJWT
+	if v == nil || v.secret == nil {
+		return nil, errors.New("no JWT signing key is configured")
+	}
+	if len(fqdns) == 0 {
+		return nil, errors.New("at least one FQDN is needed")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		ID:        hex.EncodeToString(id),
+		Subject:   strings.Join(fqdns, ","),
+		Issuer:    v.cfg.Issuer,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+	if v.cfg.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{v.cfg.Audience}
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(v.secret)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientJWT{
+		Token:   token,
+		ID:      claims.ID,
+		Subject: claims.Subject,
+		Expires: claims.ExpiresAt.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+func handleClientTokens(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	r.ParseForm()
+	var fqdns []string
+	for _, f := range r.Form["fqdn"] {
+		if f = strings.TrimSpace(f); f != "" {
+			fqdns = append(fqdns, f)
+		}
+	}
+	ttl := defaultClientJWTTTL
+	if v := r.FormValue("ttl"); v != "" {
+		var err error
+		ttl, err = time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid ttl: %q", v), 400)
+			return
+		}
+	}
+	token, err := c.SignClientJWT(fqdns, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+}
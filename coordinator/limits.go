@@ -0,0 +1,120 @@
+package coordinator
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Limits for particular clients in place of the defaults, such as higher
+// ones for a datacenter gateway than for a small device. Zero fields keep the
+// default.
+type ClientLimits struct {
+	// Matched against the FQDN of the client, or <tenant>/<fqdn> for a
+	// tenant's.
+	Regex string `yaml:"regex"`
+	// Labels the client must have polled with, such as "site=berlin". With a
+	// regex as well, both must match.
+	Selector string `yaml:"selector"`
+	// Maximum number of scrapes waiting for the client.
+	MaxQueue int `yaml:"max_queue"`
+	// Maximum number of scrapes of the client in progress, waiting for it or
+	// dispatched to it.
+	MaxConcurrency int `yaml:"max_concurrency"`
+	// Scrapes per second passed on to the client, and how many can come at
+	// once.
+	ScrapeRateLimit float64 `yaml:"scrape_rate_limit"`
+	ScrapeBurst     int     `yaml:"scrape_burst"`
+	// Scrapes with a higher timeout are clamped to this.
+	MaxScrapeTimeout time.Duration `yaml:"max_scrape_timeout"`
+	// Newest version of the protocol to speak with the client.
+	MaxProtocolVersion int `yaml:"max_protocol_version"`
+}
+
+type compiledLimits struct {
+	re       *regexp.Regexp
+	selector map[string]string
+	limits   ClientLimits
+}
+
+func (rc *runtimeConfig) compileClientLimits() error {
+	for _, l := range rc.ClientLimits {
+		if l.Regex == "" && l.Selector == "" {
+			return fmt.Errorf("client limits need a regex or a selector")
+		}
+		if l.MaxProtocolVersion < 0 || l.MaxProtocolVersion > util.ProtocolVersion {
+			return fmt.Errorf("client limits max_protocol_version must be between 1 and %d", util.ProtocolVersion)
+		}
+		cl := compiledLimits{limits: l}
+		if l.Regex != "" {
+			re, err := anchoredRegexp(l.Regex)
+			if err != nil {
+				return fmt.Errorf("invalid client limits regex %q: %s", l.Regex, err)
+			}
+			cl.re = re
+		}
+		if l.Selector != "" {
+			selector, err := parseSelector(l.Selector)
+			if err != nil {
+				return err
+			}
+			cl.selector = selector
+		}
+		rc.clientLimits = append(rc.clientLimits, cl)
+	}
+	return nil
+}
+
+// The limits of a client with the labels, from the first matching
+// client_limits entry over the defaults.
+func (rc *runtimeConfig) limitsFor(fqdn string, labels map[string]string) ClientLimits {
+	limits := ClientLimits{
+		MaxQueue:           rc.MaxQueue,
+		ScrapeRateLimit:    rc.ScrapeRateLimit,
+		ScrapeBurst:        rc.ScrapeBurst,
+		MaxScrapeTimeout:   rc.ScrapeTimeouts.Max,
+		MaxProtocolVersion: rc.MaxProtocolVersion,
+	}
+	for _, cl := range rc.clientLimits {
+		if cl.re != nil && !cl.re.MatchString(fqdn) {
+			continue
+		}
+		matched := true
+		for name, value := range cl.selector {
+			if v, ok := labels[name]; !ok || v != value {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if cl.limits.MaxQueue > 0 {
+			limits.MaxQueue = cl.limits.MaxQueue
+		}
+		if cl.limits.MaxConcurrency > 0 {
+			limits.MaxConcurrency = cl.limits.MaxConcurrency
+		}
+		if cl.limits.ScrapeRateLimit > 0 {
+			limits.ScrapeRateLimit = cl.limits.ScrapeRateLimit
+		}
+		if cl.limits.ScrapeBurst > 0 {
+			limits.ScrapeBurst = cl.limits.ScrapeBurst
+		}
+		if cl.limits.MaxScrapeTimeout > 0 {
+			limits.MaxScrapeTimeout = cl.limits.MaxScrapeTimeout
+		}
+		if cl.limits.MaxProtocolVersion > 0 {
+			limits.MaxProtocolVersion = cl.limits.MaxProtocolVersion
+		}
+		break
+	}
+	return limits
+}
+
+// The limits of a client, by the key it's known by.
+func (c *Coordinator) clientLimits(fqdn string) ClientLimits {
+	return c.config().limitsFor(fqdn, c.clientLabels(fqdn))
+}
@@ -0,0 +1,53 @@
+package coordinator
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Serve a static exposition for a client instead of scraping it, such as
+// while its device is being replaced. Returns nil if it isn't stubbed.
+func (rc *runtimeConfig) maintenanceStub(r *http.Request) *http.Response {
+	body, ok := rc.stubs[r.URL.Hostname()]
+	if !ok {
+		return nil
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; version=0.0.4"}, "Content-Length": {strconv.Itoa(len(body))}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// Read the expositions of stubbed clients.
+func (rc *runtimeConfig) loadMaintenanceStubs() error {
+	rc.stubs = make(map[string][]byte, len(rc.MaintenanceStubs))
+	for fqdn, path := range rc.MaintenanceStubs {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error loading maintenance stub for %q: %s", fqdn, err)
+		}
+		rc.stubs[fqdn] = body
+	}
+	return nil
+}
+
+// FQDNs of stubbed clients, sorted.
+func (rc *runtimeConfig) stubbedClients() []string {
+	fqdns := make([]string, 0, len(rc.stubs))
+	for fqdn := range rc.stubs {
+		fqdns = append(fqdns, fqdn)
+	}
+	sort.Strings(fqdns)
+	return fqdns
+}
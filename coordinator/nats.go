@@ -0,0 +1,197 @@
+package coordinator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+const (
+	// How long to wait before reconnecting to the NATS server.
+	natsRetryInterval = 5 * time.Second
+	// How long a scrape instruction is waited for on behalf of a client over
+	// NATS before checking it's still there.
+	natsPollDuration = 30 * time.Second
+	// The instance polls on behalf of clients over NATS are from.
+	natsInstance = "nats"
+)
+
+// Takes clients over a NATS server, by polling on their behalf and publishing
+// the scrapes they're handed, and passing on the results they publish back
+// as if pushed.
+type natsBridge struct {
+	c *Coordinator
+
+	mu   sync.Mutex
+	conn *util.NATSConn
+	// Clients registered over NATS, and when they last registered.
+	clients map[string]time.Time
+}
+
+func newNATSBridge(c *Coordinator) *natsBridge {
+	return &natsBridge{c: c, clients: map[string]time.Time{}}
+}
+
+// Stay connected to the NATS server at u until stop is closed.
+func (b *natsBridge) run(stop <-chan struct{}, u string) {
+	for {
+		conn, err := util.DialNATS(u, &net.Dialer{Timeout: 10 * time.Second}, b.c.config().NATSCAFile)
+		if err != nil {
+			level.Warn(b.c.logger).Log("msg", "Error connecting to NATS server", "err", err)
+		} else {
+			level.Info(b.c.logger).Log("msg", "Connected to NATS server")
+			b.c.metrics.natsConnected.Set(1)
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					conn.Close()
+				case <-done:
+				}
+			}()
+			err = b.serve(conn)
+			close(done)
+			conn.Close()
+			b.c.metrics.natsConnected.Set(0)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			level.Warn(b.c.logger).Log("msg", "Lost connection to NATS server", "err", err)
+		}
+		timer := time.NewTimer(natsRetryInterval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (b *natsBridge) serve(conn *util.NATSConn) error {
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+	if err := conn.Subscribe(util.NATSRegisterSubject, func(m util.NATSMsg) { b.register(string(m.Data)) }); err != nil {
+		return err
+	}
+	if err := conn.Subscribe(util.NATSResultSubject+"*", func(m util.NATSMsg) { go b.result(m) }); err != nil {
+		return err
+	}
+	return conn.Run()
+}
+
+func (b *natsBridge) publish(subject, reply string, data []byte) {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if err := conn.Publish(subject, reply, data); err != nil {
+		level.Warn(b.c.logger).Log("msg", "Error publishing to NATS server", "subject", subject, "err", err)
+	}
+}
+
+// A client announcing itself, with its FQDN. It's polled for until it stops.
+// NATS doesn't tell who published what, so a client polling over HTTP, which
+// has proved who it is, can't be taken over by registering its FQDN here.
+func (b *natsBridge) register(fqdn string) {
+	fqdn = NormalizeFQDN(strings.TrimSpace(fqdn))
+	if strings.Contains(fqdn, "/") || !util.IsNATSSubjectToken(fqdn) || !b.c.config().clientAllowed(fqdn) {
+		level.Info(b.c.logger).Log("msg", "Ignoring NATS registration of client with disallowed FQDN", "fqdn", fqdn)
+		return
+	}
+	for _, instance := range b.c.poolInstances(fqdn) {
+		if instance != natsInstance {
+			level.Info(b.c.logger).Log("msg", "Ignoring NATS registration of client polling over HTTP", "fqdn", fqdn)
+			return
+		}
+	}
+	b.mu.Lock()
+	_, polling := b.clients[fqdn]
+	b.clients[fqdn] = b.c.now()
+	b.mu.Unlock()
+	if !polling {
+		level.Info(b.c.logger).Log("msg", "Client registered over NATS", "fqdn", fqdn)
+		go b.poll(fqdn)
+	}
+}
+
+// Poll for a client over NATS for as long as it keeps registering.
+func (b *natsBridge) poll(fqdn string) {
+	for {
+		b.mu.Lock()
+		if b.c.since(b.clients[fqdn]) >= b.c.config().RegistrationTimeout {
+			delete(b.clients, fqdn)
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), natsPollDuration)
+		request, control, err := b.c.WaitForInstanceScrapeInstruction(ctx, fqdn, natsInstance)
+		cancel()
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+		case err == errShuttingDown:
+			b.mu.Lock()
+			delete(b.clients, fqdn)
+			b.mu.Unlock()
+			return
+		case err != nil:
+			level.Info(b.c.logger).Log("msg", "Error waiting for scrape instruction", "fqdn", fqdn, "err", err)
+			time.Sleep(natsRetryInterval)
+		case control != "":
+			b.publish(util.NATSControlSubject+fqdn, "", []byte(control))
+			level.Info(b.c.logger).Log("msg", "Sent control message to client", "fqdn", fqdn, "control", control)
+		default:
+			var buf bytes.Buffer
+			if err := request.WriteProxy(&buf); err != nil {
+				level.Warn(b.c.logger).Log("msg", "Error writing scrape request", "scrape_id", request.Header.Get("Id"), "err", err)
+				continue
+			}
+			b.publish(util.NATSScrapeSubject+fqdn, util.NATSResultSubject+request.Header.Get("Id"), buf.Bytes())
+		}
+	}
+}
+
+// Whether the client is registered over NATS.
+func (b *natsBridge) registered(fqdn string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.clients[fqdn]
+	return ok
+}
+
+// A result published by a client, in the same form as a push.
+func (b *natsBridge) result(m util.NATSMsg) {
+	result, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(m.Data)), nil)
+	if err != nil {
+		level.Info(b.c.logger).Log("msg", "Error reading scrape result from NATS", "subject", m.Subject, "err", err)
+		return
+	}
+	// Only results for scrapes of clients registered over NATS are taken
+	// from it, so they can't stand in for those of other clients.
+	id := result.Header.Get("Id")
+	pending, ok := b.c.pendingResultFor(id)
+	if !ok || m.Subject != util.NATSResultSubject+id || !b.registered(pending.fqdn) {
+		level.Info(b.c.logger).Log("msg", "Ignoring scrape result from NATS for a scrape not of a NATS client", "subject", m.Subject, "scrape_id", id)
+		return
+	}
+	err = b.c.ScrapeResult(result)
+	if err == nil || err == errAbandoned {
+		b.c.addUsage(pending.fqdn, int64(len(m.Data)), 1)
+	}
+	if err != nil && err != errAbandoned {
+		level.Debug(b.c.logger).Log("msg", "Scrape result from NATS not used", "subject", m.Subject, "err", err)
+	}
+}
@@ -0,0 +1,136 @@
+package coordinator_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robustperception/pushprox/coordinator"
+	"github.com/robustperception/pushprox/pushclient"
+	"github.com/robustperception/pushprox/pushproxtest"
+)
+
+const (
+	protobufType    = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	openMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	textType        = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// A target answering in the format asked for, as client_golang does, and
+// saying which encodings were asked for.
+func negotiatingTarget() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		accept := r.Header.Get("Accept")
+		switch {
+		case strings.Contains(accept, "application/vnd.google.protobuf"):
+			w.Header().Set("Content-Type", protobufType)
+			w.Write([]byte{0x06, 0x0a, 0x02, 'u', 'p', 0x18, 0x01})
+		case strings.Contains(accept, "application/openmetrics-text"):
+			w.Header().Set("Content-Type", openMetricsType)
+			w.Write([]byte("# TYPE up gauge\nup 1\n# EOF\n"))
+		default:
+			w.Header().Set("Content-Type", textType)
+			w.Write([]byte("up 1\n"))
+		}
+	})
+}
+
+func startNegotiationEnv(t *testing.T, cfg coordinator.Config) *pushproxtest.Env {
+	t.Helper()
+	env, err := pushproxtest.New(cfg, coordinator.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(env.Close)
+	clientCfg := pushclient.DefaultConfig()
+	clientCfg.FQDN = "node1"
+	if _, err := env.StartClient(clientCfg, map[string]http.Handler{"node1:9100": negotiatingTarget()}); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func scrapeWith(t *testing.T, env *pushproxtest.Env, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", "http://node1:9100/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	resp, err := env.Scraper().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s: %s", resp.Status, body)
+	}
+	return resp, body
+}
+
+func TestNegotiationThroughProxy(t *testing.T) {
+	env := startNegotiationEnv(t, coordinator.DefaultConfig())
+	for _, tc := range []struct {
+		name, accept, contentType, body string
+	}{
+		{
+			name:        "protobuf",
+			accept:      "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3",
+			contentType: protobufType,
+			body:        "\x06\x0a\x02up\x18\x01",
+		},
+		{
+			name:        "openmetrics",
+			accept:      "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			contentType: openMetricsType,
+			body:        "# TYPE up gauge\nup 1\n# EOF\n",
+		},
+		{
+			name:        "text",
+			accept:      "text/plain;version=0.0.4;q=1,*/*;q=0.1",
+			contentType: textType,
+			body:        "up 1\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := scrapeWith(t, env, http.Header{"Accept": {tc.accept}})
+			if got := resp.Header.Get("Content-Type"); got != tc.contentType {
+				t.Errorf("got Content-Type %q, want %q", got, tc.contentType)
+			}
+			if string(body) != tc.body {
+				t.Errorf("got body %q, want %q", body, tc.body)
+			}
+		})
+	}
+}
+
+func TestNegotiationPassesHeaderPolicy(t *testing.T) {
+	cfg := coordinator.DefaultConfig()
+	cfg.HeaderPolicy.Request.Allow = []string{"X-Prometheus-Scrape-Timeout-Seconds"}
+	cfg.HeaderPolicy.Response.Allow = []string{"X-Accept-Encoding"}
+	env := startNegotiationEnv(t, cfg)
+
+	resp, _ := scrapeWith(t, env, http.Header{
+		"Accept":          {"application/openmetrics-text;version=1.0.0"},
+		"Accept-Encoding": {"identity"},
+	})
+	if got := resp.Header.Get("Content-Type"); got != openMetricsType {
+		t.Errorf("got Content-Type %q, want %q", got, openMetricsType)
+	}
+	if got := resp.Header.Get("X-Accept-Encoding"); got != "identity" {
+		t.Errorf("target got Accept-Encoding %q, want %q", got, "identity")
+	}
+}
@@ -0,0 +1,65 @@
+package coordinator
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Tells the time, so programs and tests embedding a coordinator can control
+// how it sees time passing.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// A timer from afterFunc, as *time.Timer is.
+type clockTimer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// Clocks that also run timers by their own time, such as fake ones in tests.
+type timerClock interface {
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// What a coordinator needs from the program embedding it, beyond its Config.
+type Options struct {
+	// Where to register metrics, none are registered if nil.
+	Registerer prometheus.Registerer
+	// Where to log, nothing is logged if nil. If it's a util.LevelSetter, its
+	// level follows the configuration.
+	Logger log.Logger
+	// What registrations, caches, rate limits and scrape deadlines expire
+	// by and durations in metrics and logs are measured by, the system clock
+	// if nil.
+	Clock Clock
+	// What DNS checks of registrations look up with, net.DefaultResolver if
+	// nil.
+	Resolver Resolver
+	// Serves /debug/pprof/ to holders of an admin token, such as the handlers
+	// of net/http/pprof. Not served if nil.
+	Pprof http.Handler
+}
+
+func (c *Coordinator) now() time.Time {
+	return c.clock.Now()
+}
+
+func (c *Coordinator) since(t time.Time) time.Duration {
+	return c.clock.Now().Sub(t)
+}
+
+// Run f once d has passed by the coordinator's clock.
+func (c *Coordinator) afterFunc(d time.Duration, f func()) clockTimer {
+	if tc, ok := c.clock.(timerClock); ok {
+		return tc.AfterFunc(d, f)
+	}
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,113 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Shared state from periodically fetching the clients each peer has locally.
+type peerState struct {
+	peers  []string
+	client *http.Client
+	logger log.Logger
+
+	mu sync.Mutex
+	// Clients of each peer as of the last successful fetch.
+	clients map[string][]string
+}
+
+func newPeerState(peers string, logger log.Logger) *peerState {
+	s := &peerState{
+		logger:  logger,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		clients: map[string][]string{},
+	}
+	for _, p := range strings.Split(peers, ",") {
+		if p = strings.TrimSuffix(strings.TrimSpace(p), "/"); p != "" {
+			s.peers = append(s.peers, p)
+		}
+	}
+	return s
+}
+
+// Peers find out about clients by asking, so there's nothing to do.
+func (s *peerState) Register(ctx context.Context, fqdn string, ttl time.Duration) error {
+	return nil
+}
+
+// The first peer in the list with the client, if any.
+func (s *peerState) Owner(ctx context.Context, fqdn string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.peers {
+		for _, c := range s.clients[p] {
+			if c == fqdn {
+				return p, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (s *peerState) Clients(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var clients []string
+	for _, p := range s.peers {
+		clients = append(clients, s.clients[p]...)
+	}
+	return clients, nil
+}
+
+func (s *peerState) fetch(peer string) ([]string, error) {
+	resp, err := s.client.Get(peer + util.PathPrefix + "/peer/clients")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var clients []string
+	if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// Keep the clients of peers up to date. A peer that can't be reached is
+// treated as having no clients.
+func (s *peerState) run(stop <-chan struct{}, interval time.Duration) {
+	for {
+		for _, p := range s.peers {
+			clients, err := s.fetch(p)
+			if err != nil {
+				level.Warn(s.logger).Log("msg", "Error fetching clients of peer", "peer", p, "err", err)
+			}
+			s.mu.Lock()
+			s.clients[p] = clients
+			s.mu.Unlock()
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Respond with the clients polling this proxy, for its peers.
+func handlePeerClients(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.KnownClients())
+}
@@ -0,0 +1,295 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// A poll waiting for a scrape.
+type waitingPoll struct {
+	instance string
+	// Gets the scrape handed to the poll. Buffered so handing it over
+	// doesn't block.
+	requests chan *http.Request
+}
+
+// The instances of a client registered with the same FQDN, and their polls
+// waiting for a scrape. Scrapes go to the poll that has waited longest, so
+// they're spread over the instances that are polling.
+type clientPool struct {
+	// Oldest first.
+	idle []*waitingPoll
+	// Scrapes waiting for a poll.
+	queued []*queuedScrape
+	// Closed and replaced whenever a poll starts waiting, or a scrape stops
+	// waiting while there are polls it could have had.
+	changed chan struct{}
+	// When each instance last polled.
+	instances map[string]time.Time
+}
+
+// The pool of the client, created if need be. Must be called with the
+// shard's lock held, which guards the pool too.
+func (s *clientShard) poolFor(fqdn string) *clientPool {
+	pool, ok := s.pools[fqdn]
+	if !ok {
+		pool = &clientPool{changed: make(chan struct{}), instances: map[string]time.Time{}}
+		s.pools[fqdn] = pool
+	}
+	return pool
+}
+
+// The instance a poll is from, as the client names it or else its address.
+func pollInstance(r *http.Request) string {
+	if instance := r.Header.Get(util.InstanceHeader); instance != "" {
+		return instance
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Start a poll of the instance waiting for a scrape.
+func (c *Coordinator) addIdlePoll(fqdn, instance string) *waitingPoll {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	p := &waitingPoll{instance: instance, requests: make(chan *http.Request, 1)}
+	pool := shard.poolFor(fqdn)
+	pool.idle = append(pool.idle, p)
+	pool.instances[instance] = c.now()
+	pool.notify()
+	return p
+}
+
+// Wake the scrapes waiting for a poll. Must be called with the shard's lock
+// held.
+func (pool *clientPool) notify() {
+	close(pool.changed)
+	pool.changed = make(chan struct{})
+}
+
+// Stop the poll waiting for a scrape. Returns false if it was handed one in
+// the meantime, which is then in its channel.
+func (c *Coordinator) removeIdlePoll(fqdn string, p *waitingPoll) bool {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	pool := shard.poolFor(fqdn)
+	for i, idle := range pool.idle {
+		if idle == p {
+			pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Hand r to the poll of the client that has waited longest, from an instance
+// not in tried, waiting for one if there are none. Scrapes with a higher
+// priority waiting too get polls first. Returns the instance.
+func (c *Coordinator) dispatch(ctx context.Context, fqdn string, r *http.Request, tried map[string]bool, priority int) (string, error) {
+	s := &queuedScrape{priority: priority, tried: tried, request: r, taken: make(chan string, 1)}
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	pool := shard.poolFor(fqdn)
+	pool.queued = append(pool.queued, s)
+	shard.mu.Unlock()
+	defer func() {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		pool.removeQueued(s)
+		if len(pool.idle) > 0 {
+			// Scrapes it held back may be able to go now.
+			pool.notify()
+		}
+	}()
+	for {
+		shard.mu.Lock()
+		// A poll taking several may have taken it while this waited.
+		select {
+		case instance := <-s.taken:
+			shard.mu.Unlock()
+			return instance, nil
+		default:
+		}
+		for i, p := range pool.idle {
+			if !tried[p.instance] && !pool.preferredOver(s, p) {
+				pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+				// So no poll taking several can take it too.
+				pool.removeQueued(s)
+				shard.mu.Unlock()
+				p.requests <- r
+				return p.instance, nil
+			}
+		}
+		changed := pool.changed
+		shard.mu.Unlock()
+
+		select {
+		case instance := <-s.taken:
+			return instance, nil
+		case <-ctx.Done():
+			if instance, ok := withdraw(shard, pool, s); ok {
+				return instance, nil
+			}
+			return "", fmt.Errorf("%w for %q: %s", errNoClient, r.URL.String(), ctx.Err())
+		case <-c.draining:
+			if instance, ok := withdraw(shard, pool, s); ok {
+				return instance, nil
+			}
+			atomic.AddInt64(&c.drain.dropped, 1)
+			return "", errShuttingDown
+		case <-changed:
+		}
+	}
+}
+
+// Take the queued scrape out of the pool so no poll can take it any more,
+// returning the instance whose poll took it if one already did.
+func withdraw(shard *clientShard, pool *clientPool, s *queuedScrape) (string, bool) {
+	shard.mu.Lock()
+	pool.removeQueued(s)
+	shard.mu.Unlock()
+	select {
+	case instance := <-s.taken:
+		return instance, true
+	default:
+		return "", false
+	}
+}
+
+// Take up to n more scrapes waiting for the client that can go to the
+// instance, highest priority first, for a poll that takes several at once.
+func (c *Coordinator) moreScrapeInstructions(fqdn, instance string, n int) []*http.Request {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	pool := shard.poolFor(fqdn)
+	var requests []*http.Request
+	for len(requests) < n {
+		var next *queuedScrape
+		for _, q := range pool.queued {
+			if !q.tried[instance] && (next == nil || q.priority > next.priority) {
+				next = q
+			}
+		}
+		if next == nil {
+			break
+		}
+		pool.removeQueued(next)
+		if next.request.Context().Err() != nil {
+			// Timed out, dispatch gives up on it.
+			continue
+		}
+		next.taken <- instance
+		requests = append(requests, next.request)
+	}
+	return requests
+}
+
+// Whether a scrape that got resp or err from one instance of a pooled client
+// is worth retrying on another, as the instance didn't push a result in time
+// or failed to scrape the target.
+func retryOnAnotherInstance(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, errNoResponse)
+	}
+	return resp.Header.Get(util.ScrapeErrorHeader) != ""
+}
+
+// Whether the client has an instance that isn't in tried.
+func (c *Coordinator) hasUntriedInstance(fqdn string, tried map[string]bool) bool {
+	for _, instance := range c.poolInstances(fqdn) {
+		if !tried[instance] {
+			return true
+		}
+	}
+	return false
+}
+
+// The instances of the client that are polling or polled within the
+// registration timeout.
+func (c *Coordinator) poolInstances(fqdn string) []string {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	pool, ok := shard.pools[fqdn]
+	if !ok {
+		return nil
+	}
+	timeout := c.config().RegistrationTimeout
+	current := map[string]bool{}
+	for instance, t := range pool.instances {
+		if c.since(t) < timeout {
+			current[instance] = true
+		}
+	}
+	for _, p := range pool.idle {
+		current[p.instance] = true
+	}
+	instances := make([]string, 0, len(current))
+	for instance := range current {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	return instances
+}
+
+// Whether an instance of the client is waiting on a poll, or started one
+// within d.
+func (c *Coordinator) polledWithin(fqdn string, d time.Duration) bool {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	pool, ok := shard.pools[fqdn]
+	if !ok {
+		return false
+	}
+	if len(pool.idle) > 0 {
+		return true
+	}
+	for _, t := range pool.instances {
+		if c.since(t) < d {
+			return true
+		}
+	}
+	return false
+}
+
+// Forget instances that stopped polling, and pools that nothing is using, a
+// shard at a time.
+func (c *Coordinator) gcPools() {
+	timeout := c.config().RegistrationTimeout
+	for i := range c.clientShards {
+		shard := &c.clientShards[i]
+		shard.mu.Lock()
+		for fqdn, pool := range shard.pools {
+			for instance, t := range pool.instances {
+				if c.since(t) >= timeout {
+					delete(pool.instances, instance)
+				}
+			}
+			// Scrapes waiting for a poll hold on to the pool.
+			if len(pool.instances) == 0 && len(pool.idle) == 0 && len(pool.queued) == 0 && shard.queued[fqdn] == 0 {
+				delete(shard.pools, fqdn)
+			}
+		}
+		for fqdn := range shard.protocols {
+			if _, ok := shard.pools[fqdn]; !ok {
+				delete(shard.protocols, fqdn)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
@@ -0,0 +1,81 @@
+package coordinator
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// A priority for scrapes of particular targets. When scrapes of a client are
+// waiting for it to poll, those with a higher priority get the polls first.
+type ScrapePriority struct {
+	// Matched against the host:port of the target, and that followed by its
+	// path.
+	Regex    string `yaml:"regex"`
+	Priority int    `yaml:"priority"`
+}
+
+type compiledPriority struct {
+	re       *regexp.Regexp
+	priority int
+}
+
+func (rc *runtimeConfig) compilePriorities() error {
+	for _, sp := range rc.ScrapePriorities {
+		re, err := anchoredRegexp(sp.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid scrape priority regex %q: %s", sp.Regex, err)
+		}
+		rc.priorities = append(rc.priorities, compiledPriority{re: re, priority: sp.Priority})
+	}
+	return nil
+}
+
+// The priority of a scrape, from its util.PriorityHeader or else the first
+// matching scrape_priorities entry. 0 if neither gives one.
+func (rc *runtimeConfig) scrapePriority(r *http.Request) int {
+	if p, err := strconv.Atoi(r.Header.Get(util.PriorityHeader)); err == nil {
+		return p
+	}
+	for _, sp := range rc.priorities {
+		if sp.re.MatchString(r.URL.Host) || sp.re.MatchString(r.URL.Host+r.URL.Path) {
+			return sp.priority
+		}
+	}
+	return 0
+}
+
+// A scrape waiting for a poll of its client.
+type queuedScrape struct {
+	priority int
+	// Instances it won't go to.
+	tried map[string]bool
+	// The scrape, and the instance it's sent to when a poll taking several
+	// takes it.
+	request *http.Request
+	taken   chan string
+}
+
+// Whether a scrape other than s with a higher priority would take the poll.
+// Must be called with the lock held.
+func (pool *clientPool) preferredOver(s *queuedScrape, p *waitingPoll) bool {
+	for _, q := range pool.queued {
+		if q != s && q.priority > s.priority && !q.tried[p.instance] {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop s waiting for a poll. Must be called with the lock held.
+func (pool *clientPool) removeQueued(s *queuedScrape) {
+	for i, q := range pool.queued {
+		if q == s {
+			pool.queued = append(pool.queued[:i], pool.queued[i+1:]...)
+			return
+		}
+	}
+}
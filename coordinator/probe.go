@@ -0,0 +1,29 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+var errInvalidProbe = errors.New("invalid probe")
+
+// The target a scrape of /probe is for: the multi-target exporter, such as
+// the blackbox or SNMP exporter, at the host:port in its exporter parameter,
+// on the path in its path parameter or else /probe. The other parameters,
+// such as target and module, are passed on to the exporter.
+func probeTarget(u *url.URL) (*url.URL, error) {
+	params := u.Query()
+	exporter := params.Get("exporter")
+	if _, _, err := net.SplitHostPort(exporter); err != nil {
+		return nil, fmt.Errorf("%w: the exporter parameter must be host:port: %s", errInvalidProbe, err)
+	}
+	path := params.Get("path")
+	if path == "" {
+		path = "/probe"
+	}
+	return &url.URL{Scheme: "http", Host: exporter, Path: path, RawQuery: util.WithoutParams(u.RawQuery, "exporter", "path")}, nil
+}
@@ -0,0 +1,61 @@
+package coordinator
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// The version of the protocol to answer a client's poll in: the newest both
+// it and the proxy speak, but no newer than its max_protocol_version. Older
+// clients and those held back get polls answered as they expect, so what a
+// new version adds can be rolled out a few clients at a time.
+func (c *Coordinator) negotiateProtocol(fqdn string, r *http.Request) int {
+	version := util.ParseProtocolVersion(r.Header.Get(util.ProtocolVersionHeader))
+	if version > util.ProtocolVersion {
+		version = util.ProtocolVersion
+	}
+	if max := c.clientLimits(fqdn).MaxProtocolVersion; max > 0 && version > max {
+		version = max
+	}
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.protocols[fqdn] = version
+	return version
+}
+
+type protocolCollector struct {
+	c    *Coordinator
+	desc *prometheus.Desc
+}
+
+func newProtocolCollector(c *Coordinator) protocolCollector {
+	return protocolCollector{c: c, desc: prometheus.NewDesc(
+		"pushprox_clients_by_protocol_version",
+		"Clients by the version of the protocol they last polled in.",
+		[]string{"version"}, nil,
+	)}
+}
+
+func (pc protocolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.desc
+}
+
+func (pc protocolCollector) Collect(ch chan<- prometheus.Metric) {
+	clients := map[int]int{}
+	for i := range pc.c.clientShards {
+		shard := &pc.c.clientShards[i]
+		shard.mu.Lock()
+		for _, version := range shard.protocols {
+			clients[version]++
+		}
+		shard.mu.Unlock()
+	}
+	for version := util.ProtocolV1; version <= util.ProtocolVersion; version++ {
+		ch <- prometheus.MustNewConstMetric(pc.desc, prometheus.GaugeValue, float64(clients[version]), strconv.Itoa(version))
+	}
+}
@@ -0,0 +1,126 @@
+package coordinator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// The most of a published result that's kept.
+const maxPublishedSize = 64 << 20
+
+// Store the result of a scrape a client in push mode made on its own, to
+// serve to scrapes of the target while it's fresh.
+func handlePublish(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	cfg := c.config()
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if cfg.PublishedMaxAge <= 0 {
+		c.metrics.publishedResults.WithLabelValues("disabled").Inc()
+		http.Error(w, "Published results are not accepted, see --push-mode.max-age", 404)
+		return
+	}
+	fqdn := NormalizeFQDN(strings.TrimSpace(r.Header.Get(util.PublishClientHeader)))
+	if status, msg := c.publisherAllowed(cfg, r, fqdn); status != 0 {
+		c.metrics.publishedResults.WithLabelValues("forbidden").Inc()
+		http.Error(w, msg, status)
+		return
+	}
+	target, err := url.Parse(r.Header.Get(util.PublishTargetHeader))
+	if err != nil || target.Host == "" {
+		c.metrics.publishedResults.WithLabelValues("invalid").Inc()
+		http.Error(w, "A target URL is required", 400)
+		return
+	}
+	if NormalizeFQDN(target.Hostname()) != fqdnHost(fqdn) {
+		c.metrics.publishedResults.WithLabelValues("forbidden").Inc()
+		http.Error(w, "Clients may only publish results of their own targets", 403)
+		return
+	}
+	body, err := util.NewPushReader(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		c.metrics.publishedResults.WithLabelValues("invalid").Inc()
+		http.Error(w, fmt.Sprintf("Error reading published result: %s", err), 415)
+		return
+	}
+	defer body.Close()
+	resp, err := http.ReadResponse(bufio.NewReader(io.LimitReader(body, maxPublishedSize)), nil)
+	if err != nil {
+		c.metrics.publishedResults.WithLabelValues("invalid").Inc()
+		http.Error(w, fmt.Sprintf("Error reading published result: %s", err), 400)
+		return
+	}
+	result, err := bufferResponse(resp)
+	if err != nil {
+		c.metrics.publishedResults.WithLabelValues("invalid").Inc()
+		http.Error(w, fmt.Sprintf("Error reading published result: %s", err), 400)
+		return
+	}
+	// Only what came from the target is passed on.
+	for _, h := range []string{"Id", util.FetchTimeHeader, "X-Prometheus-Scrape-Timeout"} {
+		result.resp.Header.Del(h)
+	}
+	key := tenantOf(r.Context()) + " " + target.String()
+	c.mu.Lock()
+	c.published[key] = &cachedResponse{at: c.now(), result: result}
+	c.mu.Unlock()
+	noteAccess(w, "", clientKey(r.Context(), fqdn))
+	c.metrics.publishedResults.WithLabelValues("stored").Inc()
+	level.Debug(c.logger).Log("msg", "Stored published result", "fqdn", fqdn, "url", target.String())
+}
+
+// Whether the request may publish results as the client fqdn, checked as
+// polls are. If not, the status and message to fail it with.
+func (c *Coordinator) publisherAllowed(cfg *runtimeConfig, r *http.Request, fqdn string) (int, string) {
+	if cfg.TLS.ClientFQDNFromCert {
+		certName, ok := certFQDN(r, fqdn)
+		if !ok || certName != fqdn {
+			return 403, "Clients may only publish as the name in their certificate"
+		}
+	}
+	if fqdn == "" || strings.Contains(fqdn, "/") || !cfg.clientAllowed(fqdn) {
+		return 403, "Clients may not publish with this FQDN"
+	}
+	if keyFQDN, ok := sshClientOf(r.Context()); ok && fqdn != keyFQDN {
+		return 403, "Clients over SSH may only publish as the FQDN of their key"
+	}
+	if ok, status := cfg.inventoryAllows(fqdn, r); !ok {
+		return status, "Client is not in the inventory or has the wrong token"
+	}
+	if !cfg.jwtAllows(fqdn, r) {
+		return 403, "The client's JWT does not allow this FQDN"
+	}
+	if !c.isApproved(clientKey(r.Context(), fqdn)) {
+		return 403, "Client is not approved"
+	}
+	return 0, ""
+}
+
+// The latest published result of the scraped target, if it's fresh, with an
+// Age header of how old it is.
+func (c *Coordinator) publishedResult(ctx context.Context, r *http.Request) *http.Response {
+	maxAge := c.config().PublishedMaxAge
+	if maxAge <= 0 || r.Method != http.MethodGet {
+		return nil
+	}
+	c.mu.Lock()
+	cr, ok := c.published[tenantOf(ctx)+" "+r.URL.String()]
+	c.mu.Unlock()
+	if !ok || c.since(cr.at) >= maxAge {
+		return nil
+	}
+	resp := cr.result.copy()
+	resp.Header.Set("Age", strconv.Itoa(int(c.since(cr.at).Seconds())))
+	return resp
+}
@@ -0,0 +1,84 @@
+package coordinator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Take the results of a batch of scrapes handed out in one poll, pushed one
+// after another in one body as each is ready. Each is passed on as it
+// arrives, and the response says what became of each by scrape ID.
+func handlePushBatch(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	encoding := r.Header.Get("Content-Encoding")
+	wire := &countingReader{r: r.Body}
+	body, err := util.NewPushReader(wire, encoding)
+	if err != nil {
+		level.Info(c.logger).Log("msg", "Error reading pushed batch", "err", err)
+		http.Error(w, fmt.Sprintf("Error reading pushed batch: %s", err.Error()), 415)
+		return
+	}
+	defer body.Close()
+	uncompressed := &countingReader{r: body}
+	defer func() {
+		c.metrics.pushWireBytes.WithLabelValues(encoding).Add(float64(wire.n))
+		c.metrics.pushUncompressedBytes.WithLabelValues(encoding).Add(float64(uncompressed.n))
+	}()
+	br := bufio.NewReader(uncompressed)
+	outcomes := map[string]string{}
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		}
+		pushed, before := c.now(), wire.n
+		scrapeResult, err := http.ReadResponse(br, nil)
+		if err != nil {
+			level.Info(c.logger).Log("msg", "Error reading pushed batch", "err", err)
+			c.metrics.observeStage(stagePush, pushed, "invalid")
+			http.Error(w, fmt.Sprintf("Error reading pushed batch: %s", err.Error()), 400)
+			return
+		}
+		id := scrapeResult.Header.Get("Id")
+		level.Debug(c.logger).Log("msg", "Got result in /push-batch", "scrape_id", id)
+		pending, _ := c.pendingResultFor(id)
+		err = c.ScrapeResult(scrapeResult)
+		c.metrics.observeStage(stagePush, pushed, stageOutcome(nil, err))
+		switch err {
+		case nil, errAbandoned, errDuplicateResult, errOrphaned, errUnknownScrape, errExpiredScrape:
+		default:
+			// The scraper may still be reading the result, so the rest of
+			// the batch can't be got to.
+			level.Info(c.logger).Log("msg", "Error pushing", "scrape_id", id, "err", err)
+			http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), 500)
+			return
+		}
+		// Skip what the scraper didn't read, to get to the next result.
+		if _, err := io.Copy(ioutil.Discard, scrapeResult.Body); err != nil {
+			level.Info(c.logger).Log("msg", "Error reading pushed batch", "scrape_id", id, "err", err)
+			http.Error(w, fmt.Sprintf("Error reading pushed batch: %s", err.Error()), 400)
+			return
+		}
+		if pending != nil && (err == nil || err == errAbandoned) {
+			c.addUsage(pending.fqdn, wire.n-before, 1)
+		}
+		if err == errAbandoned {
+			c.metrics.abandonedPushes.Inc()
+		} else if err != nil {
+			c.metrics.rejectedPushes.WithLabelValues(failureReasonForError(err)).Inc()
+			level.Debug(c.logger).Log("msg", "Dropped result in pushed batch", "scrape_id", id, "err", err)
+		}
+		outcomes[id] = "ok"
+		if err != nil {
+			outcomes[id] = failureReasonForError(err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outcomes)
+}
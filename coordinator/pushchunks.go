@@ -0,0 +1,162 @@
+package coordinator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+var errChunkedPushesFull = errors.New("too many bytes of chunked pushes are held")
+
+// A push sent in chunks, held until all of it has arrived, so a client on an
+// unreliable link can carry on from where its connection broke rather than
+// send it all again.
+type chunkedPush struct {
+	encoding string
+	// Hex SHA-256 of the whole push, if the client sent one.
+	checksum string
+	total    int64
+	buf      bytes.Buffer
+	expires  time.Time
+	// Set while a chunk is being read.
+	busy bool
+}
+
+// The chunked push for a scrape, starting it if this is its first chunk.
+// Must be called with the lock held.
+func (c *Coordinator) chunkedPushFor(id string, total int64, encoding, checksum string) (*chunkedPush, error) {
+	if p, ok := c.chunkedPushes[id]; ok {
+		return p, nil
+	}
+	shard := c.scrapeShard(id)
+	shard.mu.Lock()
+	expires, err := shard.unansweredExpiry(id)
+	shard.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if max := c.config().ResumablePushMaxBytes; c.chunkedBytes+total > max {
+		return nil, errChunkedPushesFull
+	}
+	p := &chunkedPush{encoding: encoding, checksum: checksum, total: total, expires: expires}
+	c.chunkedPushes[id] = p
+	c.chunkedBytes += total
+	return p, nil
+}
+
+// Stop holding a chunked push. Must be called with the lock held.
+func (c *Coordinator) forgetChunkedPush(id string) {
+	if p, ok := c.chunkedPushes[id]; ok {
+		c.chunkedBytes -= p.total
+		delete(c.chunkedPushes, id)
+	}
+}
+
+// Drop chunked pushes whose scrape has expired. Must be called with the lock
+// held.
+func (c *Coordinator) gcChunkedPushes() {
+	for id, p := range c.chunkedPushes {
+		if c.now().After(p.expires) {
+			c.forgetChunkedPush(id)
+		}
+	}
+}
+
+// Take a chunk of a push with a POST, or say how much of one has arrived
+// with a GET. Once all of it has, it's passed on as any other push.
+func handlePushChunk(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	pushed := c.now()
+	if c.config().ResumablePushMaxBytes <= 0 {
+		http.Error(w, "Chunked pushes are not accepted", 404)
+		return
+	}
+	params := r.URL.Query()
+	id := params.Get("id")
+	noteAccess(w, id, "")
+	offset := func() int64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if p, ok := c.chunkedPushes[id]; ok {
+			return int64(p.buf.Len())
+		}
+		return 0
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set(util.PushOffsetHeader, strconv.FormatInt(offset(), 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "POST":
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	start, err := strconv.ParseInt(params.Get("offset"), 10, 64)
+	total, terr := strconv.ParseInt(params.Get("total"), 10, 64)
+	if err != nil || terr != nil || start < 0 || total <= 0 || start > total {
+		http.Error(w, "offset and total must be given, with offset at most total", 400)
+		return
+	}
+
+	c.mu.Lock()
+	p, err := c.chunkedPushFor(id, total, r.Header.Get("Content-Encoding"), r.Header.Get(util.ContentSHA256Trailer))
+	if err == nil && (p.busy || int64(p.buf.Len()) != start || p.total != total) {
+		// Another chunk is arriving, or the client lost track of what has.
+		received := p.buf.Len()
+		c.mu.Unlock()
+		w.Header().Set(util.PushOffsetHeader, strconv.Itoa(received))
+		http.Error(w, fmt.Sprintf("Expected a chunk of the %d byte push at offset %d", p.total, received), http.StatusConflict)
+		return
+	}
+	if err == nil {
+		p.busy = true
+	}
+	c.mu.Unlock()
+	switch {
+	case err == errChunkedPushesFull:
+		pushErrorResponse(w, http.StatusServiceUnavailable, err)
+		return
+	case err != nil:
+		c.metrics.rejectedPushes.WithLabelValues(failureReasonForError(err)).Inc()
+		pushErrorResponse(w, util.PushAbandonedStatus, err)
+		return
+	}
+
+	// What arrives before a broken connection is kept, for the client to
+	// carry on from.
+	_, err = io.Copy(&p.buf, io.LimitReader(r.Body, total-start))
+	c.mu.Lock()
+	p.busy = false
+	received := int64(p.buf.Len())
+	done := received == total
+	if done {
+		c.forgetChunkedPush(id)
+	}
+	c.mu.Unlock()
+	if !done {
+		if err != nil {
+			level.Debug(c.logger).Log("msg", "Chunk of push cut short", "scrape_id", id, "received", received, "total", total, "err", err)
+		}
+		w.Header().Set(util.PushOffsetHeader, strconv.FormatInt(received, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	level.Debug(c.logger).Log("msg", "Got all chunks of push", "scrape_id", id, "total", total)
+	if c.config().VerifyPushChecksums && p.checksum != "" && checksumOf(p.buf.Bytes()) != p.checksum {
+		c.metrics.corruptedPushes.Inc()
+		level.Info(c.logger).Log("msg", "Asking for a corrupted chunked push again", "scrape_id", id)
+		c.metrics.observeStage(stagePush, pushed, "corrupted")
+		w.Header().Set("Retry-After", "0")
+		pushErrorResponse(w, util.PushCorruptedStatus, errPushCorrupted)
+		return
+	}
+	c.acceptPush(w, r, &p.buf, p.encoding, pushed)
+}
@@ -0,0 +1,137 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	errTooFrequent = errors.New("target is scraped too often")
+	errRateLimited = errors.New("scrape rate limit exceeded")
+)
+
+// A minimum interval between scrapes of the targets matching a regex.
+type MinScrapeInterval struct {
+	// Matched against the host:port of the target and the FQDN of its client.
+	Regex    string        `yaml:"regex"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type compiledMinInterval struct {
+	re       *regexp.Regexp
+	interval time.Duration
+}
+
+func (rc *runtimeConfig) compileMinIntervals() error {
+	for _, mi := range rc.MinScrapeIntervals {
+		re, err := anchoredRegexp(mi.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid min scrape interval regex %q: %s", mi.Regex, err)
+		}
+		rc.minIntervals = append(rc.minIntervals, compiledMinInterval{re: re, interval: mi.Interval})
+	}
+	return nil
+}
+
+// The minimum interval between scrapes of the target, from the first
+// matching min_scrape_intervals entry or else the default.
+func (rc *runtimeConfig) minInterval(u *url.URL) time.Duration {
+	for _, mi := range rc.minIntervals {
+		if mi.re.MatchString(u.Host) || mi.re.MatchString(u.Hostname()) {
+			return mi.interval
+		}
+	}
+	return rc.MinScrapeInterval
+}
+
+// The longest minimum interval, for how long to keep results around.
+func (rc *runtimeConfig) maxMinInterval() time.Duration {
+	longest := rc.MinScrapeInterval
+	for _, mi := range rc.minIntervals {
+		if mi.interval > longest {
+			longest = mi.interval
+		}
+	}
+	return longest
+}
+
+// What the minimum interval between scrapes applies to: the host:port of the
+// target, or for multi-target exporters each target they're asked to probe.
+func limitedTarget(u *url.URL) string {
+	if target := u.Query().Get("target"); target != "" {
+		return u.Host + "?target=" + target
+	}
+	return u.Host
+}
+
+// Whether the target can be scraped now, recording that it is if so.
+func (c *Coordinator) allowScrape(target string, interval time.Duration) bool {
+	shard := c.clientShard(target)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if last, ok := shard.lastScraped[target]; ok && c.since(last) < interval {
+		return false
+	}
+	shard.lastScraped[target] = c.now()
+	return true
+}
+
+// The limiter for a rate and burst, reusing l if it's not nil and retuning
+// it if the configuration changed.
+func limiterFor(l *rate.Limiter, limit float64, burst int) *rate.Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if l == nil {
+		return rate.NewLimiter(rate.Limit(limit), burst)
+	}
+	if l.Limit() != rate.Limit(limit) {
+		l.SetLimit(rate.Limit(limit))
+	}
+	if l.Burst() != burst {
+		l.SetBurst(burst)
+	}
+	return l
+}
+
+// Whether a scrape of the client can be passed on within the per client and
+// global rate limits, taking a token from each if so.
+func (c *Coordinator) allowRate(fqdn string) bool {
+	cfg := c.config()
+	limits := c.clientLimits(fqdn)
+	var limiters []*rate.Limiter
+	if limits.ScrapeRateLimit > 0 {
+		shard := c.clientShard(fqdn)
+		shard.mu.Lock()
+		shard.rateLimiters[fqdn] = limiterFor(shard.rateLimiters[fqdn], limits.ScrapeRateLimit, limits.ScrapeBurst)
+		limiters = append(limiters, shard.rateLimiters[fqdn])
+		shard.mu.Unlock()
+	}
+	if cfg.GlobalScrapeRateLimit > 0 {
+		c.globalLimiterMu.Lock()
+		c.globalLimiter = limiterFor(c.globalLimiter, cfg.GlobalScrapeRateLimit, cfg.GlobalScrapeBurst)
+		limiters = append(limiters, c.globalLimiter)
+		c.globalLimiterMu.Unlock()
+	}
+
+	now := c.now()
+	var taken []*rate.Reservation
+	for _, l := range limiters {
+		r := l.ReserveN(now, 1)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			// Give back what was taken, as the scrape won't happen.
+			r.CancelAt(now)
+			for _, t := range taken {
+				t.CancelAt(now)
+			}
+			return false
+		}
+		taken = append(taken, r)
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package coordinator
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// Headers of remote write requests from clients passed on to the receiver.
+var remoteWriteHeaders = []string{"Content-Encoding", "Content-Type", "User-Agent", "X-Prometheus-Remote-Write-Version"}
+
+var remoteWriteClient = &http.Client{Timeout: time.Minute}
+
+// Relay a remote write request a client forwarded from its network to the
+// receiver, answering with the receiver's response so the sender's retries
+// work as they would talking to it directly.
+func handleRemoteWrite(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	cfg := c.config()
+	if cfg.RemoteWriteURL == "" {
+		http.Error(w, "Remote write is not enabled on this proxy", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	request, err := http.NewRequestWithContext(r.Context(), "POST", cfg.RemoteWriteURL, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, name := range remoteWriteHeaders {
+		if v := r.Header.Get(name); v != "" {
+			request.Header.Set(name, v)
+		}
+	}
+	request.ContentLength = r.ContentLength
+	resp, err := remoteWriteClient.Do(request)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Error relaying remote write", "url", cfg.RemoteWriteURL, "err", err)
+		c.metrics.remoteWriteRequests.WithLabelValues("error").Inc()
+		http.Error(w, fmt.Sprintf("Error relaying remote write: %s", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	c.metrics.remoteWriteRequests.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	copyHttpResponse(resp, w)
+}
@@ -0,0 +1,198 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+var errRolloutInProgress = errors.New("a restart rollout is already in progress")
+
+// A restart of all known clients, done in waves. A client counts as
+// restarted once it polls again after receiving the restart message.
+type restartRollout struct {
+	mu sync.Mutex
+
+	id          string
+	started     time.Time
+	waveSize    int
+	waveTimeout time.Duration
+	wave        int
+	finished    bool
+
+	// Clients yet to be told to restart.
+	pending []string
+	// Clients told to restart, and whether the message reached them yet.
+	restarting map[string]bool
+	done       []string
+	failed     []string
+	// Signalled as clients in the current wave come back.
+	progress chan struct{}
+}
+
+// Progress of a restart rollout, as returned by the admin API.
+type RestartRolloutStatus struct {
+	ID          string   `json:"id"`
+	Started     string   `json:"started"`
+	WaveSize    int      `json:"wave_size"`
+	WaveTimeout string   `json:"wave_timeout"`
+	Wave        int      `json:"wave"`
+	Finished    bool     `json:"finished"`
+	Pending     int      `json:"pending"`
+	Restarting  []string `json:"restarting"`
+	Done        []string `json:"done"`
+	Failed      []string `json:"failed"`
+}
+
+func (ro *restartRollout) status() *RestartRolloutStatus {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	restarting := make([]string, 0, len(ro.restarting))
+	for fqdn := range ro.restarting {
+		restarting = append(restarting, fqdn)
+	}
+	sort.Strings(restarting)
+	return &RestartRolloutStatus{
+		ID:          ro.id,
+		Started:     ro.started.UTC().Format(time.RFC3339),
+		WaveSize:    ro.waveSize,
+		WaveTimeout: ro.waveTimeout.String(),
+		Wave:        ro.wave,
+		Finished:    ro.finished,
+		Pending:     len(ro.pending),
+		Restarting:  restarting,
+		Done:        append([]string{}, ro.done...),
+		Failed:      append([]string{}, ro.failed...),
+	}
+}
+
+// Start restarting all currently known clients, waveSize at a time.
+func (c *Coordinator) StartRestartRollout(waveSize int, waveTimeout time.Duration) (*RestartRolloutStatus, error) {
+	if waveSize <= 0 {
+		return nil, fmt.Errorf("wave size must be positive, got %d", waveSize)
+	}
+	clients := c.KnownClients()
+	sort.Strings(clients)
+
+	c.mu.Lock()
+	if c.rollout != nil && !c.rollout.status().Finished {
+		c.mu.Unlock()
+		return nil, errRolloutInProgress
+	}
+	ro := &restartRollout{
+		id:          genId(),
+		started:     c.now(),
+		waveSize:    waveSize,
+		waveTimeout: waveTimeout,
+		pending:     clients,
+		restarting:  map[string]bool{},
+		done:        []string{},
+		failed:      []string{},
+		progress:    make(chan struct{}, 1),
+	}
+	c.rollout = ro
+	c.mu.Unlock()
+
+	level.Info(c.logger).Log("msg", "Starting restart rollout", "rollout_id", ro.id, "client_count", len(clients), "wave_size", waveSize)
+	go c.runRestartRollout(ro)
+	return ro.status(), nil
+}
+
+// Progress of the current or last restart rollout, nil if there's been none.
+func (c *Coordinator) RestartRolloutStatus() *RestartRolloutStatus {
+	ro := c.currentRollout()
+	if ro == nil {
+		return nil
+	}
+	return ro.status()
+}
+
+func (c *Coordinator) currentRollout() *restartRollout {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rollout
+}
+
+func (c *Coordinator) runRestartRollout(ro *restartRollout) {
+	logger := log.With(c.logger, "rollout_id", ro.id)
+	for {
+		ro.mu.Lock()
+		if len(ro.pending) == 0 {
+			ro.finished = true
+			ro.mu.Unlock()
+			level.Info(logger).Log("msg", "Restart rollout finished", "done", len(ro.done), "failed", len(ro.failed))
+			return
+		}
+		n := ro.waveSize
+		if n > len(ro.pending) {
+			n = len(ro.pending)
+		}
+		wave := ro.pending[:n]
+		ro.pending = ro.pending[n:]
+		ro.wave++
+		for _, fqdn := range wave {
+			ro.restarting[fqdn] = false
+		}
+		ro.mu.Unlock()
+
+		level.Info(logger).Log("msg", "Restarting wave of clients", "wave", ro.wave, "client_count", len(wave))
+		for _, fqdn := range wave {
+			c.sendControl(fqdn, util.ControlRestart)
+		}
+
+		timeout := time.NewTimer(ro.waveTimeout)
+	wait:
+		for {
+			ro.mu.Lock()
+			remaining := len(ro.restarting)
+			ro.mu.Unlock()
+			if remaining == 0 {
+				break
+			}
+			select {
+			case <-ro.progress:
+			case <-timeout.C:
+				break wait
+			}
+		}
+		timeout.Stop()
+
+		ro.mu.Lock()
+		for fqdn := range ro.restarting {
+			level.Warn(logger).Log("msg", "Client did not come back from restart in time", "fqdn", fqdn)
+			ro.failed = append(ro.failed, fqdn)
+			delete(ro.restarting, fqdn)
+		}
+		ro.mu.Unlock()
+	}
+}
+
+// A client polled, which completes its restart if it was told to restart.
+func (ro *restartRollout) clientPolled(fqdn string) {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	if delivered, ok := ro.restarting[fqdn]; ok && delivered {
+		delete(ro.restarting, fqdn)
+		ro.done = append(ro.done, fqdn)
+		select {
+		case ro.progress <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// A client was handed the restart message.
+func (ro *restartRollout) restartDelivered(fqdn string) {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	if _, ok := ro.restarting[fqdn]; ok {
+		ro.restarting[fqdn] = true
+	}
+}
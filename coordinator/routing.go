@@ -0,0 +1,55 @@
+package coordinator
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// The form of a client's FQDN that scrapes are routed by. IP literals are in
+// their canonical form without brackets, so "[2001:DB8::1]" and "2001:db8::1"
+// are the same client. A port is kept, for clients registered per port.
+func NormalizeFQDN(fqdn string) string {
+	host, port := fqdn, ""
+	if h, p, err := net.SplitHostPort(fqdn); err == nil {
+		host, port = h, p
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	return host
+}
+
+// The host part of a client's FQDN, without any port it registered with.
+func fqdnHost(fqdn string) string {
+	if host, _, err := net.SplitHostPort(fqdn); err == nil {
+		return host
+	}
+	return fqdn
+}
+
+// The client a scrape of u goes to. With port routing that's the client
+// registered as its host:port if there is one, otherwise the one registered
+// as its host.
+func (c *Coordinator) routeFor(u *url.URL) string {
+	host := NormalizeFQDN(u.Hostname())
+	if c.config().RouteByPort && u.Port() != "" {
+		if hostport := net.JoinHostPort(host, u.Port()); c.isKnownClient(hostport) {
+			return hostport
+		}
+	}
+	return host
+}
+
+// A client's FQDN as a file_sd_configs target, with IPv6 literals in
+// brackets so a port can be appended by relabelling.
+func sdTarget(fqdn string) string {
+	if strings.Contains(fqdn, ":") && net.ParseIP(fqdn) != nil {
+		return "[" + fqdn + "]"
+	}
+	return fqdn
+}
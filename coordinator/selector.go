@@ -0,0 +1,127 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+var (
+	errInvalidSelector   = errors.New("invalid label selector")
+	errNoSelectorMatch   = errors.New("no client matches the label selector")
+	errAmbiguousSelector = errors.New("more than one client matches the label selector")
+)
+
+// Parse a selector such as "site=berlin,job=node" into the labels it needs.
+func parseSelector(s string) (map[string]string, error) {
+	selector := map[string]string{}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		i := strings.Index(term, "=")
+		if i < 0 || !util.IsValidLabelName(strings.TrimSpace(term[:i])) {
+			return nil, fmt.Errorf("%w %q: %q is not name=value", errInvalidSelector, s, term)
+		}
+		selector[strings.TrimSpace(term[:i])] = strings.TrimSpace(term[i+1:])
+	}
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("%w: empty", errInvalidSelector)
+	}
+	return selector, nil
+}
+
+// The labels a client sent with its poll, if any.
+func pollLabels(r *http.Request) map[string]string {
+	values, err := url.ParseQuery(r.Header.Get(util.LabelsHeader))
+	if err != nil || len(values) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(values))
+	for name := range values {
+		labels[name] = values.Get(name)
+	}
+	return labels
+}
+
+// Record the labels the client polled with.
+func (c *Coordinator) setClientLabels(fqdn string, labels map[string]string) {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if labels == nil {
+		delete(shard.labels, fqdn)
+		return
+	}
+	shard.labels[fqdn] = labels
+}
+
+// The labels the client last polled with.
+func (c *Coordinator) clientLabels(fqdn string) map[string]string {
+	shard := c.clientShard(fqdn)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return shard.labels[fqdn]
+}
+
+// The one known and approved client of the tenant with all the labels of the
+// selector.
+func (c *Coordinator) resolveSelector(tenant string, selector map[string]string) (string, error) {
+	var matches []string
+	for _, key := range c.KnownClients() {
+		t, fqdn := splitTenantClient(key)
+		if t != tenant {
+			continue
+		}
+		labels := c.clientLabels(key)
+		matched := true
+		for name, value := range selector {
+			if v, ok := labels[name]; !ok || v != value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, fqdn)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", errNoSelectorMatch
+	case 1:
+		return matches[0], nil
+	}
+	sort.Strings(matches)
+	return "", fmt.Errorf("%w: %s", errAmbiguousSelector, strings.Join(matches, ", "))
+}
+
+// The target a scrape of /proxy is for, from the client its selector
+// parameter picks out and its port and path parameters. Other parameters
+// are passed on to the target.
+func (c *Coordinator) selectorTarget(tenant string, u *url.URL) (*url.URL, error) {
+	params := u.Query()
+	selector, err := parseSelector(params.Get("selector"))
+	if err != nil {
+		return nil, err
+	}
+	port := params.Get("port")
+	if port == "" {
+		return nil, fmt.Errorf("%w: no port parameter", errInvalidSelector)
+	}
+	path := params.Get("path")
+	if path == "" {
+		path = "/metrics"
+	}
+	fqdn, err := c.resolveSelector(tenant, selector)
+	if err != nil {
+		return nil, err
+	}
+	return &url.URL{Scheme: "http", Host: net.JoinHostPort(fqdn, port), Path: path, RawQuery: util.WithoutParams(u.RawQuery, "selector", "port", "path")}, nil
+}
@@ -0,0 +1,117 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log/level"
+)
+
+// Points each member has on the ring, so FQDNs spread evenly and only a
+// member's share moves when one joins or leaves.
+const shardPointsPerMember = 128
+
+// A consistent hash ring of the proxies sharing out clients between them.
+type hashRing struct {
+	points  []uint32
+	members map[uint32]string
+}
+
+func newHashRing(members []string) *hashRing {
+	ring := &hashRing{members: map[uint32]string{}}
+	for _, m := range members {
+		for i := 0; i < shardPointsPerMember; i++ {
+			p := crc32.ChecksumIEEE([]byte(m + "#" + strconv.Itoa(i)))
+			if _, ok := ring.members[p]; ok {
+				continue
+			}
+			ring.members[p] = m
+			ring.points = append(ring.points, p)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// The member owning the FQDN: the first point at or after its hash.
+func (ring *hashRing) owner(fqdn string) string {
+	h := crc32.ChecksumIEEE([]byte(fqdn))
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.members[ring.points[i]]
+}
+
+func (rc *runtimeConfig) compileShardRing() error {
+	if rc.ShardMembers == "" {
+		return nil
+	}
+	self := strings.TrimRight(rc.AdvertiseURL, "/")
+	if self == "" {
+		return fmt.Errorf("an advertise URL must be specified with shard members")
+	}
+	var members []string
+	found := false
+	for _, m := range strings.Split(rc.ShardMembers, ",") {
+		m = strings.TrimRight(strings.TrimSpace(m), "/")
+		if m == "" {
+			continue
+		}
+		if _, err := url.Parse(m); err != nil {
+			return fmt.Errorf("invalid shard member %q: %s", m, err)
+		}
+		found = found || m == self
+		members = append(members, m)
+	}
+	if !found {
+		return fmt.Errorf("shard members must include this proxy's advertise URL %q", self)
+	}
+	rc.shardSelf = self
+	rc.shardRing = newHashRing(members)
+	return nil
+}
+
+// The URL of the proxy owning a client, by the key it's known by, or empty
+// if it's this one. Tenants' clients aren't sharded.
+func (rc *runtimeConfig) shardOwner(fqdn string) string {
+	if rc.shardRing == nil || strings.Contains(fqdn, "/") {
+		return ""
+	}
+	if owner := rc.shardRing.owner(fqdn); owner != rc.shardSelf {
+		return owner
+	}
+	return ""
+}
+
+// Send the client or scraper to the proxy owning the client, at the path
+// it asked this one for.
+func (c *Coordinator) redirectToShard(w http.ResponseWriter, r *http.Request, owner, endpoint string) {
+	level.Debug(c.logger).Log("msg", "Redirecting to the proxy owning the client", "endpoint", endpoint, "owner", owner)
+	c.metrics.shardHandoffs.WithLabelValues(endpoint, "redirect").Inc()
+	http.Redirect(w, r, owner+r.RequestURI, http.StatusTemporaryRedirect)
+}
+
+// Pass a scrape on to the proxy owning its client, for scrapers that sent
+// it as to an HTTP proxy and so can't follow a redirect to another one.
+func (c *Coordinator) forwardToShard(ctx context.Context, r *http.Request, owner string) (*http.Response, error) {
+	ownerURL, err := url.Parse(owner)
+	if err != nil {
+		return nil, err
+	}
+	level.Debug(c.logger).Log("msg", "Forwarding scrape to the proxy owning the client", "url", r.URL.String(), "owner", owner)
+	c.metrics.shardHandoffs.WithLabelValues("scrape", "forward").Inc()
+	fr := r.Clone(context.WithValue(ctx, forwardToKey{}, ownerURL))
+	fr.Header.Set(forwardedHeader, "1")
+	resp, err := forwardTransport.RoundTrip(fr)
+	if err != nil {
+		return nil, fmt.Errorf("error forwarding scrape to %s: %w", owner, err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,159 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/redis/go-redis/v9"
+)
+
+// Header marking a scrape forwarded from another proxy, so it isn't
+// forwarded again.
+const forwardedHeader = "X-PushProx-Forwarded"
+
+// Registrations shared between proxies, so any of them can route a scrape
+// to the one its client is polling.
+type sharedState interface {
+	// Record that a client is polling this proxy.
+	Register(ctx context.Context, fqdn string, ttl time.Duration) error
+	// The URL of the proxy a client is polling, empty if none is known.
+	Owner(ctx context.Context, fqdn string) (string, error)
+	// All clients registered with any proxy.
+	Clients(ctx context.Context) ([]string, error)
+}
+
+type redisState struct {
+	client *redis.Client
+	prefix string
+	self   string
+}
+
+func newSharedState(cfg Config, logger log.Logger) (sharedState, error) {
+	if cfg.SharedPeers != "" {
+		if cfg.SharedRedisAddress != "" {
+			return nil, errors.New("only one of shared peers and a shared Redis address can be specified")
+		}
+		return newPeerState(cfg.SharedPeers, logger), nil
+	}
+	if cfg.SharedRedisAddress == "" {
+		return nil, nil
+	}
+	if cfg.AdvertiseURL == "" {
+		return nil, errors.New("an advertise URL must be specified with a shared Redis address")
+	}
+	if _, err := url.Parse(cfg.AdvertiseURL); err != nil {
+		return nil, fmt.Errorf("invalid advertise URL: %s", err)
+	}
+	return &redisState{
+		client: redis.NewClient(&redis.Options{Addr: cfg.SharedRedisAddress}),
+		prefix: cfg.SharedRedisKeyPrefix + ":client:",
+		self:   strings.TrimSuffix(cfg.AdvertiseURL, "/"),
+	}, nil
+}
+
+func (s *redisState) Register(ctx context.Context, fqdn string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+fqdn, s.self, ttl).Err()
+}
+
+func (s *redisState) Owner(ctx context.Context, fqdn string) (string, error) {
+	owner, err := s.client.Get(ctx, s.prefix+fqdn).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if owner == s.self {
+		// We'd know about it ourselves if it were still polling.
+		return "", err
+	}
+	return owner, err
+}
+
+func (s *redisState) Clients(ctx context.Context) ([]string, error) {
+	var clients []string
+	iter := s.client.Scan(ctx, 0, s.prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		clients = append(clients, strings.TrimPrefix(iter.Val(), s.prefix))
+	}
+	return clients, iter.Err()
+}
+
+type forwardToKey struct{}
+
+// Sends forwarded scrapes through the proxy in their context.
+var forwardTransport = &http.Transport{
+	Proxy: func(r *http.Request) (*url.URL, error) {
+		return r.Context().Value(forwardToKey{}).(*url.URL), nil
+	},
+}
+
+// Record a poll in the shared state, if there is one.
+func (c *Coordinator) registerShared(fqdn string) {
+	if c.shared == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.shared.Register(ctx, fqdn, c.config().RegistrationTimeout); err != nil {
+		level.Warn(c.logger).Log("msg", "Error registering client in shared state", "fqdn", fqdn, "err", err)
+	}
+}
+
+// Hand a scrape of a client we don't know to the proxy it's polling, if
+// another one is. Returns false if the scrape can't be forwarded.
+func (c *Coordinator) forwardScrape(ctx context.Context, r *http.Request, fqdn string) (*http.Response, bool, error) {
+	if c.shared == nil || r.Header.Get(forwardedHeader) != "" {
+		return nil, false, nil
+	}
+	owner, err := c.shared.Owner(ctx, fqdn)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Error looking up client in shared state", "fqdn", fqdn, "err", err)
+		return nil, false, nil
+	}
+	if owner == "" {
+		return nil, false, nil
+	}
+	ownerUrl, err := url.Parse(owner)
+	if err != nil {
+		return nil, false, nil
+	}
+	level.Info(c.logger).Log("msg", "Forwarding scrape to proxy client is polling", "url", r.URL.String(), "owner", owner)
+	fr := r.Clone(context.WithValue(ctx, forwardToKey{}, ownerUrl))
+	fr.Header.Set(forwardedHeader, "1")
+	resp, err := forwardTransport.RoundTrip(fr)
+	if err != nil {
+		return nil, true, fmt.Errorf("error forwarding scrape to %s: %w", owner, err)
+	}
+	return resp, true, nil
+}
+
+// Clients registered with this proxy or, with shared state, any of them.
+func (c *Coordinator) AllKnownClients() []string {
+	known := c.KnownClients()
+	if c.shared == nil {
+		return known
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shared, err := c.shared.Clients(ctx)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Error listing clients in shared state", "err", err)
+		return known
+	}
+	seen := map[string]struct{}{}
+	for _, k := range known {
+		seen[k] = struct{}{}
+	}
+	for _, k := range shared {
+		if _, ok := seen[k]; !ok {
+			seen[k] = struct{}{}
+			known = append(known, k)
+		}
+	}
+	return known
+}
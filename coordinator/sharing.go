@@ -0,0 +1,214 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// A response with its body buffered, so it can be handed out more than once.
+type bufferedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+func bufferResponse(resp *http.Response) (*bufferedResponse, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedResponse{resp: resp, body: body}, nil
+}
+
+// A copy of the response for one caller.
+func (br *bufferedResponse) copy() *http.Response {
+	resp := *br.resp
+	resp.Header = br.resp.Header.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(br.body))
+	resp.ContentLength = int64(len(br.body))
+	return &resp
+}
+
+// A scrape whose result can be shared by several DoScrape callers.
+type coalescedScrape struct {
+	started time.Time
+	done    chan struct{}
+
+	// The scrape runs on a context of its own, so it doesn't end with the
+	// caller that started it. It's cancelled once the latest deadline of
+	// the callers waiting on it passes, or they've all given up. Guarded by
+	// the coordinator's lock.
+	cancel    context.CancelFunc
+	timer     clockTimer
+	deadline  time.Time
+	unbounded bool
+	waiters   int
+
+	result *bufferedResponse
+	err    error
+}
+
+// Add a caller waiting on the scrape, letting it run until the caller's
+// deadline if that's later. The deadline is kept by the coordinator's clock,
+// as the scrape's own deadlines are. Must be called with the lock held.
+func (c *Coordinator) joinCoalesced(ctx context.Context, cs *coalescedScrape) {
+	cs.waiters++
+	d, ok := ctx.Deadline()
+	if !ok {
+		cs.unbounded = true
+		if cs.timer != nil {
+			cs.timer.Stop()
+		}
+		return
+	}
+	deadline := c.now().Add(time.Until(d))
+	if cs.unbounded || !deadline.After(cs.deadline) {
+		return
+	}
+	cs.deadline = deadline
+	remaining := cs.deadline.Sub(c.now())
+	if cs.timer == nil {
+		cs.timer = c.afterFunc(remaining, cs.cancel)
+	} else {
+		cs.timer.Reset(remaining)
+	}
+}
+
+// Wait for the result of the scrape, or for ctx to be done. Each caller only
+// gets its own context's error, never another's.
+func (c *Coordinator) waitCoalesced(ctx context.Context, cs *coalescedScrape) (*bufferedResponse, error) {
+	select {
+	case <-ctx.Done():
+		c.mu.Lock()
+		cs.waiters--
+		if cs.waiters == 0 {
+			// Nobody wants the result any more.
+			cs.cancel()
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	case <-cs.done:
+		return cs.result, cs.err
+	}
+}
+
+// Scrape with the body buffered, sharing the result with other callers
+// for the same key while it's in progress if coalescing is enabled.
+func (c *Coordinator) doBufferedScrape(ctx context.Context, key string, r *http.Request) (*bufferedResponse, error) {
+	if c.config().CoalesceWindow <= 0 {
+		resp, err := c.doScrape(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		return bufferResponse(resp)
+	}
+
+	c.mu.Lock()
+	cs, ok := c.coalescing[key]
+	if ok && c.since(cs.started) < c.config().CoalesceWindow {
+		c.joinCoalesced(ctx, cs)
+		c.mu.Unlock()
+		level.Debug(c.logger).Log("msg", "Coalescing with in progress scrape", "url", r.URL.String())
+		c.metrics.coalescedScrapes.Inc()
+		return c.waitCoalesced(ctx, cs)
+	}
+	scrapeCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	cs = &coalescedScrape{started: c.now(), done: make(chan struct{}), cancel: cancel}
+	c.joinCoalesced(ctx, cs)
+	c.coalescing[key] = cs
+	c.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		resp, err := c.doScrape(scrapeCtx, r.Clone(scrapeCtx))
+		if err == nil {
+			cs.result, cs.err = bufferResponse(resp)
+		} else {
+			cs.err = err
+		}
+		close(cs.done)
+
+		c.mu.Lock()
+		if cs.timer != nil {
+			cs.timer.Stop()
+		}
+		if c.coalescing[key] == cs {
+			delete(c.coalescing, key)
+		}
+		c.mu.Unlock()
+	}()
+	return c.waitCoalesced(ctx, cs)
+}
+
+type cachedResponse struct {
+	at     time.Time
+	result *bufferedResponse
+}
+
+// The last successful response for the key, if it's younger than maxAge.
+func (c *Coordinator) getLastGood(key string, maxAge time.Duration) *cachedResponse {
+	if maxAge <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cr, ok := c.lastGood[key]
+	if !ok || c.since(cr.at) >= maxAge {
+		return nil
+	}
+	return cr
+}
+
+func (c *Coordinator) setLastGood(key string, result *bufferedResponse) {
+	if cfg := c.config(); cfg.CacheTTL <= 0 && cfg.StaleMaxAge <= 0 && cfg.maxMinInterval() <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastGood[key] = &cachedResponse{at: c.now(), result: result}
+}
+
+// The cached response for the key, if it's within the TTL.
+func (c *Coordinator) getCachedResponse(key string) *bufferedResponse {
+	cr := c.getLastGood(key, c.config().CacheTTL)
+	if cr == nil {
+		return nil
+	}
+	return cr.result
+}
+
+func (c *Coordinator) hasStaleResponse(key string) bool {
+	return c.getLastGood(key, c.config().StaleMaxAge) != nil
+}
+
+// The last successful response for the key marked as stale, for when no
+// client is around to scrape it.
+func (c *Coordinator) getStaleResponse(key string) *http.Response {
+	cr := c.getLastGood(key, c.config().StaleMaxAge)
+	if cr == nil {
+		return nil
+	}
+	age := c.since(cr.at).Seconds()
+	resp := cr.result.copy()
+	resp.Header.Set("X-PushProx-Stale", fmt.Sprintf("%f", age))
+	// Only the text format can safely have a sample appended.
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" || strings.HasPrefix(ct, "text/plain") {
+		body := append([]byte{}, cr.result.body...)
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			body = append(body, '\n')
+		}
+		body = append(body, fmt.Sprintf("# HELP pushprox_stale_scrape_age_seconds Age of this stale scrape result served by PushProx.\n# TYPE pushprox_stale_scrape_age_seconds gauge\npushprox_stale_scrape_age_seconds %f\n", age)...)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Del("Content-Length")
+	}
+	return resp
+}
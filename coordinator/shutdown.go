@@ -0,0 +1,103 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errShuttingDown = errors.New("proxy is shutting down")
+
+// What happened while a coordinator was drained before shutting down, to
+// check that restarting proxies didn't lose scrapes.
+type ShutdownReport struct {
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	// Clients whose polls were answered with errShuttingDown, so they go to
+	// another proxy.
+	ClientsNotified int `json:"clients_notified"`
+	// Scrapes that were waiting for a client to pick them up.
+	QueuedScrapesDropped int64 `json:"queued_scrapes_dropped"`
+	// Scrapes clients had picked up, by whether their result came back.
+	ScrapesCompleted int64 `json:"scrapes_completed"`
+	ScrapesAborted   int64 `json:"scrapes_aborted"`
+}
+
+// Counts for the ShutdownReport, updated as the coordinator drains.
+type drainStats struct {
+	dropped   int64
+	completed int64
+	aborted   int64
+	// Clients told about the shutdown. Guarded by the coordinator's lock.
+	notified map[string]struct{}
+}
+
+func (c *Coordinator) isDraining() bool {
+	select {
+	case <-c.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Record that a client was told the proxy is shutting down.
+func (c *Coordinator) notifyShutdown(fqdn string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drain.notified[fqdn] = struct{}{}
+}
+
+// Record how a scrape a client picked up ended, if draining.
+func (c *Coordinator) drainedScrape(err error) {
+	if !c.isDraining() {
+		return
+	}
+	if err == nil {
+		atomic.AddInt64(&c.drain.completed, 1)
+	} else {
+		atomic.AddInt64(&c.drain.aborted, 1)
+	}
+}
+
+func (c *Coordinator) dispatchedScrapes() int {
+	return c.scrapeShardSizes(func(s *scrapeShard) int {
+		n := 0
+		for _, scrape := range s.scrapes {
+			if scrape.State == scrapeDispatched {
+				n++
+			}
+		}
+		return n
+	})
+}
+
+// Stop taking scrapes and polls, and wait until ctx is done for the scrapes
+// clients have already picked up to finish. Waiting polls are answered so
+// their clients can go to another proxy, and scrapes still waiting for a
+// client fail. Pushes are still accepted, so the coordinator must keep being
+// served until this returns.
+func (c *Coordinator) Drain(ctx context.Context) ShutdownReport {
+	report := ShutdownReport{Started: c.now()}
+	c.drainOnce.Do(func() { close(c.draining) })
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	remaining := c.dispatchedScrapes()
+	for remaining > 0 && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		remaining = c.dispatchedScrapes()
+	}
+	c.mu.Lock()
+	report.ClientsNotified = len(c.drain.notified)
+	c.mu.Unlock()
+	report.QueuedScrapesDropped = atomic.LoadInt64(&c.drain.dropped)
+	report.ScrapesCompleted = atomic.LoadInt64(&c.drain.completed)
+	// Those still going are cut off.
+	report.ScrapesAborted = atomic.LoadInt64(&c.drain.aborted) + int64(remaining)
+	report.DurationSeconds = c.since(report.Started).Seconds()
+	return report
+}
@@ -0,0 +1,169 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+func (rc *runtimeConfig) compileSSHClients() error {
+	rc.sshClients = map[string]string{}
+	for fqdn, key := range rc.SSHClients {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return fmt.Errorf("invalid SSH key of client %q: %s", fqdn, err)
+		}
+		rc.sshClients[string(pub.Marshal())] = NormalizeFQDN(fqdn)
+	}
+	return nil
+}
+
+type sshClientKey struct{}
+
+// The FQDN a client over SSH may register as, from the key it authenticated
+// with. False if the request didn't come over SSH.
+func sshClientOf(ctx context.Context) (string, bool) {
+	fqdn, ok := ctx.Value(sshClientKey{}).(string)
+	return fqdn, ok
+}
+
+// A channel from a client over SSH, with the FQDN of its key.
+type sshClientConn struct {
+	*util.SSHChannelConn
+	fqdn string
+}
+
+// Hands out the channels of clients over SSH as connections to serve HTTP on.
+type channelListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (l *channelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *channelListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *channelListener) Addr() net.Addr { return l.addr }
+
+// Accept clients over SSH on SSHListenAddress, serving their polls, pushes and
+// so on with handler as if they'd come over HTTP.
+func (c *Coordinator) ListenSSH(handler http.Handler) error {
+	cfg := c.config()
+	if cfg.SSHListenAddress == "" {
+		return nil
+	}
+	if cfg.SSHHostKeyFile == "" {
+		return errors.New("a host key file is needed to accept clients over SSH")
+	}
+	pem, err := ioutil.ReadFile(cfg.SSHHostKeyFile)
+	if err != nil {
+		return err
+	}
+	hostKey, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return fmt.Errorf("invalid SSH host key: %s", err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			// Keys can change on reload.
+			fqdn, ok := c.config().sshClients[string(key.Marshal())]
+			if !ok {
+				return nil, errors.New("unknown client key")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"fqdn": fqdn}}, nil
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+	lc := net.ListenConfig{KeepAlive: 30 * time.Second}
+	l, err := lc.Listen(context.Background(), "tcp", cfg.SSHListenAddress)
+	if err != nil {
+		return err
+	}
+	channels := &channelListener{addr: l.Addr(), conns: make(chan net.Conn), done: make(chan struct{})}
+	server := &http.Server{
+		Handler: handler,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, sshClientKey{}, conn.(*sshClientConn).fqdn)
+		},
+	}
+	level.Info(c.logger).Log("msg", "Listening for clients over SSH", "address", cfg.SSHListenAddress, "host_key", ssh.FingerprintSHA256(hostKey.PublicKey()))
+	go func() {
+		<-c.stop
+		l.Close()
+		channels.Close()
+		server.Close()
+	}()
+	go server.Serve(channels)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-c.stop:
+					return
+				default:
+				}
+				level.Warn(c.logger).Log("msg", "Error accepting SSH connection", "address", cfg.SSHListenAddress, "err", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go c.serveSSH(conn, serverConfig, channels)
+		}
+	}()
+	return nil
+}
+
+func (c *Coordinator) serveSSH(conn net.Conn, serverConfig *ssh.ServerConfig, channels *channelListener) {
+	logger := log.With(c.logger, "remote_addr", conn.RemoteAddr())
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	sc, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		level.Info(logger).Log("msg", "SSH handshake with client failed", "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	fqdn := sc.Permissions.Extensions["fqdn"]
+	level.Info(logger).Log("msg", "Client connected over SSH", "fqdn", fqdn)
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != util.SSHChannelType {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		select {
+		case channels.conns <- &sshClientConn{SSHChannelConn: &util.SSHChannelConn{Channel: ch, Local: sc.LocalAddr(), Remote: sc.RemoteAddr()}, fqdn: fqdn}:
+		case <-channels.done:
+			ch.Close()
+		}
+	}
+	level.Info(logger).Log("msg", "Client disconnected from SSH", "fqdn", fqdn)
+}
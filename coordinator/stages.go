@@ -0,0 +1,99 @@
+package coordinator
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Stages of a scrape through the proxy, for the stage metrics.
+const (
+	// Checking the scrape can be passed on to a client.
+	stageAccept = "accept"
+	// Waiting for the client to pick it up.
+	stageDispatch = "dispatch"
+	// Waiting for the client to scrape the target and start pushing.
+	stageClientScrape = "client_scrape"
+	// Receiving and relaying the pushed result.
+	stagePush = "push"
+	// The whole scrape, until the response to the scraper is done.
+	stageDeliver = "deliver"
+)
+
+// Outcomes of a stage besides failure reasons. Failures of the target rather
+// than of the proxy or client, such as a refused connection or a non-2xx
+// status, are target_error, so the proxy tier can be measured on its own.
+const (
+	outcomeSuccess     = "success"
+	outcomeTargetError = "target_error"
+)
+
+// The outcome of a stage that produced resp, if any, or err.
+func stageOutcome(resp *http.Response, err error) string {
+	switch {
+	case err != nil:
+		return failureReasonForError(err)
+	case resp != nil && (resp.Header.Get(util.ScrapeErrorHeader) != "" || resp.StatusCode/100 != 2):
+		return outcomeTargetError
+	}
+	return outcomeSuccess
+}
+
+func (m *metrics) observeStage(stage string, start time.Time, outcome string) {
+	m.stageOutcomes.WithLabelValues(stage, outcome).Inc()
+	m.stageDuration.WithLabelValues(stage).Observe(m.clock.Now().Sub(start).Seconds())
+}
+
+// Note how long a scrape waited for a poll, and how long the client took to
+// fetch it from the target and the rest of the time until its result arrived,
+// as metrics and a Server-Timing header in milliseconds for the scraper. The
+// client reports the fetch time, so clocks don't need to agree.
+func (m *metrics) notePhases(resp *http.Response, pollWait, client time.Duration) {
+	m.phaseDuration.WithLabelValues("poll_wait").Observe(pollWait.Seconds())
+	timing := fmt.Sprintf("pushprox_poll_wait;dur=%.3f", pollWait.Seconds()*1000)
+	if fetched := resp.Header.Get(util.FetchTimeHeader); fetched != "" {
+		resp.Header.Del(util.FetchTimeHeader)
+		seconds, err := strconv.ParseFloat(fetched, 64)
+		if err == nil && seconds >= 0 {
+			fetch := time.Duration(seconds * float64(time.Second))
+			if fetch > client {
+				fetch = client
+			}
+			m.phaseDuration.WithLabelValues("client_fetch").Observe(fetch.Seconds())
+			m.phaseDuration.WithLabelValues("transfer").Observe((client - fetch).Seconds())
+			timing += fmt.Sprintf(", pushprox_client_fetch;dur=%.3f, pushprox_transfer;dur=%.3f", fetch.Seconds()*1000, (client-fetch).Seconds()*1000)
+		}
+	}
+	resp.Header.Add("Server-Timing", timing)
+}
+
+// Times the stages of a scrape one after another.
+type stageTimer struct {
+	m     *metrics
+	stage string
+	start time.Time
+}
+
+func (m *metrics) startStage(stage string) *stageTimer {
+	return &stageTimer{m: m, stage: stage, start: m.clock.Now()}
+}
+
+// End the current stage successfully and start the next.
+func (t *stageTimer) next(stage string) {
+	t.nextAfter(outcomeSuccess, stage)
+}
+
+// End the current stage with the outcome and start the next, such as when
+// retrying an earlier one.
+func (t *stageTimer) nextAfter(outcome, stage string) {
+	t.m.observeStage(t.stage, t.start, outcome)
+	t.stage, t.start = stage, t.m.clock.Now()
+}
+
+// End the current stage with the outcome.
+func (t *stageTimer) end(outcome string) {
+	t.m.observeStage(t.stage, t.start, outcome)
+}
@@ -0,0 +1,121 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// What's saved to the state file.
+type savedState struct {
+	// Clients and when they last polled.
+	Clients   map[string]time.Time `json:"clients"`
+	Approvals map[string]string    `json:"approvals,omitempty"`
+	// The labels clients polled with, for label selectors.
+	Labels map[string]map[string]string `json:"labels,omitempty"`
+}
+
+// Load clients saved by SaveState. They keep their last poll time, so ones
+// that haven't polled for too long expire as usual.
+func (c *Coordinator) LoadState(path string) (int, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var state savedState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return 0, err
+	}
+
+	limit := c.now().Add(-c.config().RegistrationTimeout)
+	loaded := 0
+	for fqdn, t := range state.Clients {
+		shard := c.clientShard(fqdn)
+		shard.mu.Lock()
+		last, ok := shard.known[fqdn]
+		if !t.Before(limit) && !t.Before(last) {
+			shard.known[fqdn] = t
+			if !ok {
+				atomic.AddInt64(&c.knownClients, 1)
+			}
+			if labels, ok := state.Labels[fqdn]; ok {
+				shard.labels[fqdn] = labels
+			}
+			loaded++
+		}
+		shard.mu.Unlock()
+	}
+	for fqdn, s := range state.Approvals {
+		shard := c.clientShard(fqdn)
+		shard.mu.Lock()
+		if _, ok := shard.approvals[fqdn]; !ok {
+			shard.approvals[fqdn] = s
+		}
+		shard.mu.Unlock()
+	}
+	return loaded, nil
+}
+
+// Save known clients with their labels and approvals, replacing the file
+// atomically.
+func (c *Coordinator) SaveState(path string) error {
+	state := savedState{
+		Clients:   make(map[string]time.Time, atomic.LoadInt64(&c.knownClients)),
+		Approvals: map[string]string{},
+		Labels:    map[string]map[string]string{},
+	}
+	for i := range c.clientShards {
+		shard := &c.clientShards[i]
+		shard.mu.Lock()
+		for fqdn, t := range shard.known {
+			state.Clients[fqdn] = t
+			if labels, ok := shard.labels[fqdn]; ok {
+				state.Labels[fqdn] = labels
+			}
+		}
+		for fqdn, s := range shard.approvals {
+			state.Approvals[fqdn] = s
+		}
+		shard.mu.Unlock()
+	}
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Save state to path every minute, and once more when stopped so a restart
+// picks up where it left off.
+func (c *Coordinator) SaveStatePeriodically(path string) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for stopped := false; !stopped; {
+		select {
+		case <-c.stop:
+			stopped = true
+		case <-ticker.C:
+		}
+		if err := c.SaveState(path); err != nil {
+			level.Warn(c.logger).Log("msg", "Error saving state", "file", path, "err", err)
+		}
+	}
+}
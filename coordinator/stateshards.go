@@ -0,0 +1,215 @@
+package coordinator
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// How many shards what's kept of each client and each scrape is split over,
+// so polls and scrapes of different clients rarely wait on the same lock.
+const stateShards = 64
+
+// The shard a client's FQDN or a scrape's ID falls in, by its FNV-1a hash.
+func shardOf(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % stateShards)
+}
+
+// What's kept of the clients whose FQDN falls in a shard, used for every
+// poll and scrape.
+type clientShard struct {
+	mu sync.Mutex
+	// Instances of clients and their polls waiting for a scrape.
+	pools map[string]*clientPool
+	// Control messages waiting to be delivered to clients.
+	control map[string]chan string
+	// How many scrapes are waiting for each client to pick them up, and
+	// how many it's picked up and not pushed the result of yet.
+	queued   map[string]int
+	inFlight map[string]int
+	// The version of the protocol each client last polled in.
+	protocols map[string]int
+	// When each client last contacted us.
+	known map[string]time.Time
+	// Labels clients polled with, for scrapes by label selector.
+	labels map[string]map[string]string
+	// Approval state of clients, if approval is required.
+	approvals map[string]string
+	// Scrape rate limits of each client.
+	rateLimiters map[string]*rate.Limiter
+	// What each client has pushed, and what each tenant whose name falls in
+	// the shard has.
+	usage       map[string]*Usage
+	tenantUsage map[string]*Usage
+	// Cold start targets of each client that have been scraped since it
+	// registered.
+	warm map[string]map[string]struct{}
+	// When each target with a minimum interval whose host:port falls in the
+	// shard was last scraped.
+	lastScraped map[string]time.Time
+}
+
+// What's kept of the scrapes whose ID falls in a shard.
+type scrapeShard struct {
+	mu sync.Mutex
+	// Scrapes waiting for their result to be pushed.
+	responses map[string]*pendingResult
+	// Scrapes in doScrape.
+	scrapes map[string]*InflightScrape
+	// Scrapes handed to clients, and when they expire.
+	issued map[string]time.Time
+	// Scrapes a result has been received for, and when.
+	answered map[string]time.Time
+}
+
+func (c *Coordinator) initShards() {
+	for i := range c.clientShards {
+		c.clientShards[i] = clientShard{
+			pools:        map[string]*clientPool{},
+			control:      map[string]chan string{},
+			queued:       map[string]int{},
+			inFlight:     map[string]int{},
+			protocols:    map[string]int{},
+			known:        map[string]time.Time{},
+			labels:       map[string]map[string]string{},
+			approvals:    map[string]string{},
+			rateLimiters: map[string]*rate.Limiter{},
+			usage:        map[string]*Usage{},
+			tenantUsage:  map[string]*Usage{},
+			warm:         map[string]map[string]struct{}{},
+			lastScraped:  map[string]time.Time{},
+		}
+		c.scrapeShards[i] = scrapeShard{
+			responses: map[string]*pendingResult{},
+			scrapes:   map[string]*InflightScrape{},
+			issued:    map[string]time.Time{},
+			answered:  map[string]time.Time{},
+		}
+	}
+}
+
+func (c *Coordinator) clientShard(fqdn string) *clientShard {
+	return &c.clientShards[shardOf(fqdn)]
+}
+
+func (c *Coordinator) scrapeShard(id string) *scrapeShard {
+	return &c.scrapeShards[shardOf(id)]
+}
+
+// How many of what's kept of clients there are over all shards, by size.
+func (c *Coordinator) clientShardSizes(size func(*clientShard) int) int {
+	n := 0
+	for i := range c.clientShards {
+		s := &c.clientShards[i]
+		s.mu.Lock()
+		n += size(s)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// How many of what's kept of scrapes there are over all shards, by size.
+func (c *Coordinator) scrapeShardSizes(size func(*scrapeShard) int) int {
+	n := 0
+	for i := range c.scrapeShards {
+		s := &c.scrapeShards[i]
+		s.mu.Lock()
+		n += size(s)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// How many scrapes are waiting for the client to pick them up, and how many
+// it's picked up and not pushed the result of yet.
+func (c *Coordinator) clientScrapeCounts(fqdn string) (queued, inFlight int) {
+	s := c.clientShard(fqdn)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued[fqdn], s.inFlight[fqdn]
+}
+
+// The version of the protocol the client last polled in, 0 if it hasn't.
+func (c *Coordinator) clientProtocol(fqdn string) int {
+	s := c.clientShard(fqdn)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.protocols[fqdn]
+}
+
+// Forget clients that haven't contacted us within the registration timeout,
+// and what's kept of clients that are gone, a shard at a time. Usage is kept
+// until its month is over so a client can't get a fresh quota by going away
+// and coming back. Returns how many clients were forgotten.
+func (c *Coordinator) gcClientShards() int {
+	cfg := c.config()
+	limit := c.now().Add(-cfg.RegistrationTimeout)
+	month := c.now().UTC().Format("2006-01")
+	keepScraped := cfg.maxMinInterval()
+	deleted := 0
+	for i := range c.clientShards {
+		s := &c.clientShards[i]
+		s.mu.Lock()
+		for fqdn, t := range s.known {
+			if t.Before(limit) {
+				delete(s.known, fqdn)
+				delete(s.warm, fqdn)
+				deleted++
+			}
+		}
+		for fqdn := range s.labels {
+			if _, ok := s.known[fqdn]; !ok {
+				delete(s.labels, fqdn)
+			}
+		}
+		for fqdn := range s.rateLimiters {
+			if _, ok := s.known[fqdn]; !ok {
+				delete(s.rateLimiters, fqdn)
+			}
+		}
+		for fqdn, u := range s.usage {
+			if _, ok := s.known[fqdn]; !ok && u.Month != month {
+				delete(s.usage, fqdn)
+			}
+		}
+		for tenant, u := range s.tenantUsage {
+			if cfg.tenant(tenant) == nil && u.Month != month {
+				delete(s.tenantUsage, tenant)
+			}
+		}
+		for target, t := range s.lastScraped {
+			if c.since(t) >= keepScraped {
+				delete(s.lastScraped, target)
+			}
+		}
+		s.mu.Unlock()
+	}
+	atomic.AddInt64(&c.knownClients, -int64(deleted))
+	return deleted
+}
+
+// Forget answered and issued scrapes that are long over, a shard at a time.
+func (c *Coordinator) gcScrapeShards() {
+	for i := range c.scrapeShards {
+		s := &c.scrapeShards[i]
+		s.mu.Lock()
+		for id, t := range s.answered {
+			if c.since(t) > answeredRetention {
+				delete(s.answered, id)
+			}
+		}
+		for id, expires := range s.issued {
+			if c.since(expires) > answeredRetention {
+				delete(s.issued, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
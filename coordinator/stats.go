@@ -0,0 +1,180 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// The dimension rolling clients up by their tenant rather than a label.
+const tenantDimension = "tenant"
+
+// Split comma separated dimensions to roll clients up by.
+func parseStatsDimensions(dimensions string) ([]string, error) {
+	if dimensions == "" {
+		return nil, nil
+	}
+	var parsed []string
+	seen := map[string]bool{}
+	for _, d := range strings.Split(dimensions, ",") {
+		d = strings.TrimSpace(d)
+		if !util.IsValidLabelName(d) || strings.HasPrefix(d, "__") || seen[d] {
+			return nil, fmt.Errorf("invalid or duplicate stats dimension %q", d)
+		}
+		seen[d] = true
+		parsed = append(parsed, d)
+	}
+	return parsed, nil
+}
+
+// Statistics of the clients with the same values of some labels.
+type StatsGroup struct {
+	Labels map[string]string `json:"labels"`
+	// Clients known or waiting for approval, by approval state, and how
+	// many of them are polling.
+	Clients int            `json:"clients"`
+	States  map[string]int `json:"states"`
+	Polling int            `json:"polling"`
+	// Scrapes picked up and not answered yet, and waiting to be picked up.
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+	// Scrapes over the last 15 minutes, and how many failed.
+	Scrapes   int     `json:"scrapes"`
+	Failed    int     `json:"failed"`
+	ErrorRate float64 `json:"error_rate"`
+	// Bytes pushed today, in UTC.
+	DailyBytes int64 `json:"daily_bytes"`
+}
+
+func (g *StatsGroup) add(s ClientStatus, dailyBytes int64) {
+	g.Clients++
+	g.States[s.State]++
+	if !s.LastPoll.IsZero() {
+		g.Polling++
+	}
+	g.InFlight += s.InFlight
+	g.Queued += s.Queued
+	g.Scrapes += s.Scrapes
+	g.Failed += s.Failed
+	if g.Scrapes > 0 {
+		g.ErrorRate = float64(g.Failed) / float64(g.Scrapes)
+	}
+	g.DailyBytes += dailyBytes
+}
+
+// Statistics of all clients and of them rolled up by dimensions.
+type Stats struct {
+	Dimensions []string     `json:"dimensions"`
+	Total      StatsGroup   `json:"total"`
+	Groups     []StatsGroup `json:"groups"`
+}
+
+// The value of a dimension for a client, empty if it has none.
+func dimensionValue(s ClientStatus, dimension string) string {
+	if dimension == tenantDimension {
+		tenant, _ := splitTenantClient(s.FQDN)
+		return tenant
+	}
+	return s.Labels[dimension]
+}
+
+// Roll the statistics of clients up by the values of dimensions, sorting the
+// groups by them.
+func (c *Coordinator) Stats(dimensions []string) Stats {
+	clients, _ := c.Usage()
+	daily := make(map[string]int64, len(clients))
+	for _, u := range clients {
+		daily[u.FQDN] = u.DailyBytes
+	}
+	stats := Stats{
+		Dimensions: dimensions,
+		Total:      StatsGroup{Labels: map[string]string{}, States: map[string]int{}},
+		Groups:     []StatsGroup{},
+	}
+	groups := map[string]*StatsGroup{}
+	var keys []string
+	for _, s := range c.ClientStatuses() {
+		values := make([]string, len(dimensions))
+		for i, d := range dimensions {
+			values[i] = dimensionValue(s, d)
+		}
+		key := strings.Join(values, "\xff")
+		g, ok := groups[key]
+		if !ok {
+			g = &StatsGroup{Labels: make(map[string]string, len(dimensions)), States: map[string]int{}}
+			for i, d := range dimensions {
+				g.Labels[d] = values[i]
+			}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.add(s, daily[s.FQDN])
+		stats.Total.add(s, daily[s.FQDN])
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		stats.Groups = append(stats.Groups, *groups[key])
+	}
+	return stats
+}
+
+// Exposes the statistics of clients rolled up by the configured dimensions,
+// so dashboards of many sites don't have to aggregate per client series.
+type rollupCollector struct {
+	c *Coordinator
+}
+
+func newRollupCollector(c *Coordinator) rollupCollector {
+	return rollupCollector{c: c}
+}
+
+// The dimensions can change with the configuration, so the metrics aren't
+// described up front.
+func (rc rollupCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (rc rollupCollector) Collect(ch chan<- prometheus.Metric) {
+	dimensions := rc.c.config().statsDimensions
+	if len(dimensions) == 0 {
+		return
+	}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("pushprox_rollup_"+name, help, dimensions, nil)
+	}
+	clients := desc("clients", "Clients known or waiting for approval.")
+	polling := desc("clients_polling", "Clients that have polled within --registration.timeout.")
+	pending := desc("clients_pending_approval", "Clients waiting for approval.")
+	inFlight := desc("scrapes_in_flight", "Scrapes picked up by clients and not answered yet.")
+	queued := desc("scrapes_queued", "Scrapes waiting for clients to pick them up.")
+	scrapes := desc("recent_scrapes", "Scrapes over the last 15 minutes.")
+	failed := desc("recent_failed_scrapes", "Scrapes over the last 15 minutes that failed.")
+	errorRatio := desc("recent_scrape_error_ratio", "Ratio of scrapes over the last 15 minutes that failed, 0 if there were none.")
+	for _, g := range rc.c.Stats(dimensions).Groups {
+		values := make([]string, len(dimensions))
+		for i, d := range dimensions {
+			values[i] = g.Labels[d]
+		}
+		gauge := func(desc *prometheus.Desc, v float64) {
+			// Label values come from clients, so one that isn't valid only
+			// loses that group rather than failing the whole scrape.
+			m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, v, values...)
+			if err != nil {
+				level.Warn(rc.c.logger).Log("msg", "Can't expose rollup of clients", "labels", strings.Join(values, ","), "err", err)
+				return
+			}
+			ch <- m
+		}
+		gauge(clients, float64(g.Clients))
+		gauge(polling, float64(g.Polling))
+		gauge(pending, float64(g.States[approvalPending]))
+		gauge(inFlight, float64(g.InFlight))
+		gauge(queued, float64(g.Queued))
+		gauge(scrapes, float64(g.Scrapes))
+		gauge(failed, float64(g.Failed))
+		gauge(errorRatio, g.ErrorRate)
+	}
+}
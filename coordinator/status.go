@@ -0,0 +1,126 @@
+package coordinator
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// What is going on with a client, for the status page and the API.
+type ClientStatus struct {
+	FQDN     string    `json:"fqdn"`
+	State    string    `json:"state"`
+	LastPoll time.Time `json:"last_poll"`
+	// Instances registered with the FQDN, as they name themselves.
+	Instances []string `json:"instances"`
+	// Labels the client polled with.
+	Labels map[string]string `json:"labels,omitempty"`
+	// The version of the protocol it last polled in.
+	ProtocolVersion int `json:"protocol_version,omitempty"`
+	// Scrapes picked up and not answered yet, and waiting to be picked up.
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+	// Scrapes over the last 15 minutes, and how many failed.
+	Scrapes    int      `json:"scrapes"`
+	Failed     int      `json:"failed"`
+	ErrorRate  float64  `json:"error_rate"`
+	Discovered []string `json:"discovered_targets"`
+}
+
+func (s ClientStatus) ErrorPercent() float64 {
+	return 100 * s.ErrorRate
+}
+
+func (s ClientStatus) SinceLastPoll() string {
+	if s.LastPoll.IsZero() {
+		return "never"
+	}
+	return time.Since(s.LastPoll).Truncate(time.Second).String() + " ago"
+}
+
+// All clients this proxy knows of or has been asked to approve, with what's
+// going on with them.
+func (c *Coordinator) ClientStatuses() []ClientStatus {
+	scrapes, failed := c.failures.clientScrapes()
+	discovered := c.ApprovedDiscoveredTargets()
+
+	statuses := []ClientStatus{}
+	for i := range c.clientShards {
+		shard := &c.clientShards[i]
+		shard.mu.Lock()
+		fqdns := map[string]bool{}
+		for fqdn := range shard.known {
+			fqdns[fqdn] = true
+		}
+		for fqdn := range shard.approvals {
+			fqdns[fqdn] = true
+		}
+		for fqdn := range fqdns {
+			statuses = append(statuses, ClientStatus{
+				FQDN:     fqdn,
+				State:    c.approvalState(shard, fqdn),
+				LastPoll: shard.known[fqdn],
+				Labels:   shard.labels[fqdn],
+			})
+		}
+		shard.mu.Unlock()
+	}
+	// What's kept of the clients' scrapes takes the shards' locks itself.
+	for i := range statuses {
+		s := &statuses[i]
+		s.Queued, s.InFlight = c.clientScrapeCounts(s.FQDN)
+		s.Instances = c.poolInstances(s.FQDN)
+		s.ProtocolVersion = c.clientProtocol(s.FQDN)
+		s.Scrapes, s.Failed = scrapes[s.FQDN], failed[s.FQDN]
+		s.Discovered = discovered[s.FQDN]
+		if s.Scrapes > 0 {
+			s.ErrorRate = float64(s.Failed) / float64(s.Scrapes)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].FQDN < statuses[j].FQDN })
+	return statuses
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>PushProx clients</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.pending { background: #ffe8a0; }
+.rejected, .unhealthy { background: #f8c0c0; }
+</style>
+</head>
+<body>
+<h1>Clients</h1>
+<p>{{len .Clients}} clients. Scrapes and errors are over the last {{.Window}}.</p>
+<table>
+<tr><th>FQDN</th><th>State</th><th>Last poll</th><th>Instances</th><th>Protocol</th><th>In flight</th><th>Queued</th><th>Scrapes</th><th>Error rate</th><th>Discovered targets</th></tr>
+{{range .Clients}}<tr class="{{.State}}{{if ge .ErrorPercent 50.0}} unhealthy{{end}}">
+<td>{{.FQDN}}</td>
+<td>{{.State}}</td>
+<td title="{{.LastPoll.Format "2006-01-02 15:04:05Z07:00"}}">{{.SinceLastPoll}}</td>
+<td>{{range .Instances}}{{.}}<br>{{end}}</td>
+<td>{{if .ProtocolVersion}}{{.ProtocolVersion}}{{end}}</td>
+<td>{{.InFlight}}</td>
+<td>{{.Queued}}</td>
+<td>{{.Scrapes}}</td>
+<td>{{if .Scrapes}}{{printf "%.1f%%" .ErrorPercent}}{{else}}-{{end}}</td>
+<td>{{range .Discovered}}{{.}}<br>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Show the clients as an HTML page, for people.
+func handleStatusPage(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, struct {
+		Clients []ClientStatus
+		Window  time.Duration
+	}{c.ClientStatuses(), failureWindow})
+}
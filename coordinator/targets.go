@@ -0,0 +1,98 @@
+package coordinator
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long a target's stats are kept once it's no longer scraped.
+const targetStatsRetention = time.Hour
+
+// How scrapes of a target through the proxy have gone, as shown by the API.
+type TargetStats struct {
+	Tenant string `json:"tenant,omitempty"`
+	FQDN   string `json:"fqdn"`
+	Path   string `json:"path"`
+	// "up" if the last scrape succeeded, otherwise "down".
+	Health              string    `json:"health"`
+	Scrapes             int64     `json:"scrapes"`
+	Successes           int64     `json:"successes"`
+	SuccessRate         float64   `json:"success_rate"`
+	LastStatus          int       `json:"last_status"`
+	LastError           string    `json:"last_error"`
+	LastScrape          time.Time `json:"last_scrape"`
+	LastDurationSeconds float64   `json:"last_scrape_duration_seconds"`
+}
+
+type targetKey struct {
+	tenant, fqdn, path string
+}
+
+// Stats of each target and path scraped.
+type targetStats struct {
+	mu      sync.Mutex
+	clock   Clock
+	targets map[targetKey]*TargetStats
+}
+
+func newTargetStats(clock Clock) *targetStats {
+	return &targetStats{clock: clock, targets: map[targetKey]*TargetStats{}}
+}
+
+// Record a scrape of the path on the target, as host and port, with the
+// status it was answered with and why it failed, if it did.
+func (s *targetStats) record(tenant, fqdn, path string, status int, errMsg string, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := targetKey{tenant: tenant, fqdn: fqdn, path: path}
+	t, ok := s.targets[k]
+	if !ok {
+		t = &TargetStats{Tenant: tenant, FQDN: fqdn, Path: path}
+		s.targets[k] = t
+	}
+	t.Scrapes++
+	t.Health = "down"
+	if errMsg == "" && status/100 == 2 {
+		t.Successes++
+		t.Health = "up"
+	}
+	t.SuccessRate = float64(t.Successes) / float64(t.Scrapes)
+	t.LastStatus = status
+	t.LastError = errMsg
+	t.LastScrape = s.clock.Now()
+	t.LastDurationSeconds = duration.Seconds()
+}
+
+// Forget targets not scraped within targetStatsRetention.
+func (s *targetStats) gc() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, t := range s.targets {
+		if s.clock.Now().Sub(t.LastScrape) > targetStatsRetention {
+			delete(s.targets, k)
+		}
+	}
+}
+
+// Stats of the targets scraped within targetStatsRetention, by tenant, FQDN
+// and path.
+func (c *Coordinator) TargetStats() []TargetStats {
+	s := c.targets
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]TargetStats, 0, len(s.targets))
+	for _, t := range s.targets {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Tenant != list[j].Tenant {
+			return list[i].Tenant < list[j].Tenant
+		}
+		if list[i].FQDN != list[j].FQDN {
+			return list[i].FQDN < list[j].FQDN
+		}
+		return list[i].Path < list[j].Path
+	})
+	return list
+}
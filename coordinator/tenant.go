@@ -0,0 +1,159 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// A team sharing the proxy with others. Its clients are kept apart from those
+// of other tenants and of no tenant, and scrapes from its scrapers only reach
+// its own clients, even ones with the same FQDN as another tenant's.
+type TenantConfig struct {
+	Name string `yaml:"name"`
+	// Bearer tokens its clients poll, push and so on with. Clients can also
+	// pick the tenant with a proxy URL ending in /tenants/<name>, if it has
+	// no tokens.
+	ClientTokens []string `yaml:"client_tokens"`
+	// Tokens its scrapers give in Proxy-Authorization, as a bearer token or
+	// the password of a proxy_url such as http://team-a:<token>@proxy:8080.
+	// Scrapes of /tenants/<name>/pushprox/clients and the like need them too,
+	// if there are any.
+	ScraperTokens []string `yaml:"scraper_tokens"`
+	// Maximum number of clients, 0 for no limit.
+	MaxClients int `yaml:"max_clients"`
+	// Bytes all its clients together may push in a UTC day and month, 0 for
+	// no limit.
+	DailyBytes   int64 `yaml:"daily_bytes"`
+	MonthlyBytes int64 `yaml:"monthly_bytes"`
+}
+
+// Paths starting with this and a tenant name are for that tenant.
+const tenantPathPrefix = "/tenants/"
+
+type tenantKey struct{}
+
+// The tenant a request is for, empty if none.
+func tenantOf(ctx context.Context) string {
+	name, _ := ctx.Value(tenantKey{}).(string)
+	return name
+}
+
+// The key a tenant's client is known by, which is its FQDN for clients of no
+// tenant.
+func tenantClient(tenant, fqdn string) string {
+	if tenant == "" {
+		return fqdn
+	}
+	return tenant + "/" + fqdn
+}
+
+// The tenant and FQDN of a client's key.
+func splitTenantClient(key string) (string, string) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// The client key for a request's FQDN, in the request's tenant.
+func clientKey(ctx context.Context, fqdn string) string {
+	return tenantClient(tenantOf(ctx), fqdn)
+}
+
+func (rc *runtimeConfig) tenant(name string) *TenantConfig {
+	for i := range rc.Tenants {
+		if rc.Tenants[i].Name == name {
+			return &rc.Tenants[i]
+		}
+	}
+	return nil
+}
+
+// Split a path for a tenant into the tenant and the rest of it.
+func tenantPath(path string) (string, string, bool) {
+	if !strings.HasPrefix(path, tenantPathPrefix) {
+		return "", "", false
+	}
+	rest := strings.TrimPrefix(path, tenantPathPrefix)
+	i := strings.Index(rest, "/")
+	if i <= 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i:], true
+}
+
+// The token a scraper gave in Proxy-Authorization, as a bearer token or a
+// basic auth password.
+func scraperToken(r *http.Request) string {
+	auth := r.Header.Get("Proxy-Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if strings.HasPrefix(auth, "Basic ") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+		if err != nil {
+			return ""
+		}
+		if i := strings.Index(string(decoded), ":"); i >= 0 {
+			return string(decoded[i+1:])
+		}
+	}
+	return ""
+}
+
+// The tenant of a request, from the tenant its path named or else the one
+// whose token it has, its scraper token if it's from a scraper. Nil for none.
+// False if the path named a tenant that doesn't exist or the request doesn't
+// have its token.
+func (rc *runtimeConfig) requestTenant(r *http.Request, named string, scrape bool) (*TenantConfig, bool) {
+	tokens := func(t *TenantConfig) []string {
+		if scrape {
+			return t.ScraperTokens
+		}
+		return t.ClientTokens
+	}
+	token := clientToken(r)
+	if scrape {
+		token = scraperToken(r)
+	}
+	if named != "" {
+		t := rc.tenant(named)
+		if t == nil || len(tokens(t)) > 0 && !tokenIn(token, tokens(t)) {
+			return nil, false
+		}
+		return t, true
+	}
+	if token == "" {
+		return nil, true
+	}
+	for i := range rc.Tenants {
+		if tokenIn(token, tokens(&rc.Tenants[i])) {
+			return &rc.Tenants[i], true
+		}
+	}
+	return nil, true
+}
+
+// How many clients of the tenant are known.
+func (c *Coordinator) tenantClientCount(tenant string) int {
+	timeout := c.config().RegistrationTimeout
+	n := 0
+	for i := range c.clientShards {
+		shard := &c.clientShards[i]
+		shard.mu.Lock()
+		for key, at := range shard.known {
+			if t, _ := splitTenantClient(key); t == tenant && c.since(at) < timeout {
+				n++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// Whether a client of the tenant can't register as the tenant is full.
+func (c *Coordinator) tenantFull(t *TenantConfig, key string) bool {
+	return t != nil && t.MaxClients > 0 && !c.isKnownClient(key) && c.tenantClientCount(t.Name) >= t.MaxClients
+}
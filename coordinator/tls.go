@@ -0,0 +1,260 @@
+package coordinator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// TLS for the proxy's listener.
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// One of NoClientCert, RequestClientCert, RequireAnyClientCert,
+	// VerifyClientCertIfGiven or RequireAndVerifyClientCert.
+	ClientAuthType string `yaml:"client_auth_type"`
+	// How often to check the files for a rotated certificate, 0 to only
+	// load them with the config.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	// Register clients as the name in their verified certificate, rather
+	// than whatever FQDN they poll with.
+	ClientFQDNFromCert bool `yaml:"client_fqdn_from_cert"`
+}
+
+func (t TLSConfig) enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// A certificate, key and client CAs loaded together.
+type tlsBundle struct {
+	config *tls.Config
+	// The same, also offering HTTP/2.
+	http2Config *tls.Config
+	// Of the contents of the files, to tell when they've changed.
+	sum    [sha256.Size]byte
+	expiry time.Time
+}
+
+// Read the files of a bundle, each once so they're consistent with the sum.
+func readTLSFiles(t TLSConfig) (cert, key, ca []byte, sum [sha256.Size]byte, err error) {
+	if cert, err = ioutil.ReadFile(t.CertFile); err != nil {
+		return nil, nil, nil, sum, fmt.Errorf("error reading certificate: %s", err)
+	}
+	if key, err = ioutil.ReadFile(t.KeyFile); err != nil {
+		return nil, nil, nil, sum, fmt.Errorf("error reading key: %s", err)
+	}
+	if t.ClientCAFile != "" {
+		if ca, err = ioutil.ReadFile(t.ClientCAFile); err != nil {
+			return nil, nil, nil, sum, fmt.Errorf("error reading client CAs: %s", err)
+		}
+	}
+	sum = sha256.Sum256(bytes.Join([][]byte{cert, key, ca}, []byte{0}))
+	return cert, key, ca, sum, nil
+}
+
+// Load and check the whole bundle, so a bad or half written set of files
+// is caught before any of it is used.
+func loadTLSBundle(t TLSConfig) (*tlsBundle, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("both cert_file and key_file must be specified for TLS")
+	}
+	authType, ok := clientAuthTypes[t.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", t.ClientAuthType)
+	}
+	certPEM, keyPEM, caPEM, sum, err := readTLSFiles(t)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing TLS certificate: %s", err)
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("TLS certificate is not valid until %s", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("TLS certificate expired at %s", leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+	b := &tlsBundle{
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   authType,
+		},
+		sum:    sum,
+		expiry: leaf.NotAfter,
+	}
+	if t.ClientCAFile != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", t.ClientCAFile)
+		}
+		b.config.ClientCAs = pool
+	}
+	if authType >= tls.VerifyClientCertIfGiven && b.config.ClientCAs == nil {
+		return nil, fmt.Errorf("client_auth_type %s needs a client_ca_file", t.ClientAuthType)
+	}
+	if t.ClientFQDNFromCert && authType < tls.VerifyClientCertIfGiven {
+		return nil, errors.New("client_fqdn_from_cert needs a client_auth_type that verifies certificates")
+	}
+	b.http2Config = b.config.Clone()
+	b.http2Config.NextProtos = []string{"h2", "http/1.1"}
+	return b, nil
+}
+
+// Load the bundle, if TLS is configured.
+func (rc *runtimeConfig) loadTLS() error {
+	if !rc.TLS.enabled() {
+		if rc.TLS.ClientFQDNFromCert {
+			return errors.New("client_fqdn_from_cert needs TLS")
+		}
+		return nil
+	}
+	b, err := loadTLSBundle(rc.TLS)
+	if err != nil {
+		return err
+	}
+	rc.tls = b
+	return nil
+}
+
+// Switch to a bundle, nil if TLS isn't configured.
+func (c *Coordinator) setTLSBundle(b *tlsBundle) {
+	c.tlsBundle.Store(b)
+	if b != nil {
+		c.metrics.tlsReloadSuccess.Set(1)
+		c.metrics.tlsExpiry.Set(float64(b.expiry.Unix()))
+	}
+}
+
+func (c *Coordinator) currentTLSBundle() *tlsBundle {
+	b, _ := c.tlsBundle.Load().(*tlsBundle)
+	return b
+}
+
+// Load the bundle again if its files changed. If the new one is no good the
+// current one is kept.
+func (c *Coordinator) reloadTLS() {
+	t := c.config().TLS
+	current := c.currentTLSBundle()
+	if !t.enabled() || current == nil {
+		return
+	}
+	_, _, _, sum, err := readTLSFiles(t)
+	c.mu.Lock()
+	seen := err == nil && (sum == current.sum || sum == c.badTLSSum)
+	c.mu.Unlock()
+	if seen {
+		return
+	}
+	b, err := loadTLSBundle(t)
+	if err != nil {
+		// Don't count the same bad files again.
+		c.mu.Lock()
+		c.badTLSSum = sum
+		c.mu.Unlock()
+		c.metrics.tlsReloadSuccess.Set(0)
+		c.metrics.tlsReloadFailures.Inc()
+		level.Warn(c.logger).Log("msg", "Error reloading TLS certificate, keeping the current one", "err", err)
+		return
+	}
+	if c.currentTLSBundle() != current {
+		// The config was reloaded meanwhile.
+		return
+	}
+	c.setTLSBundle(b)
+	level.Info(c.logger).Log("msg", "Reloaded TLS certificate", "expiry", b.expiry)
+}
+
+// Check for rotated certificates every reload_interval.
+func (c *Coordinator) watchTLS() {
+	for {
+		interval := c.config().TLS.ReloadInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-c.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if c.config().TLS.ReloadInterval > 0 {
+			c.reloadTLS()
+		}
+	}
+}
+
+// TLS configuration for a listener that follows reloads of the configuration
+// and certificate, or uses ACME, nil if TLS isn't configured. Turning TLS on or off needs a
+// new listener.
+func (c *Coordinator) TLSConfig() *tls.Config {
+	if c.acme != nil {
+		return c.acme.tlsConfig()
+	}
+	if c.currentTLSBundle() == nil {
+		return nil
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if b := c.currentTLSBundle(); b != nil {
+				if c.config().HTTP2 {
+					return b.http2Config, nil
+				}
+				return b.config, nil
+			}
+			return nil, errors.New("TLS is no longer configured")
+		},
+	}
+}
+
+// The FQDN a poll registers as with ClientFQDNFromCert: the one it gave if its
+// verified certificate is for that name, otherwise the certificate's first
+// DNS name, or its common name if it has none. False without a verified
+// certificate.
+func certFQDN(r *http.Request, given string) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := cert.DNSNames
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = []string{cert.Subject.CommonName}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	host := fqdnHost(given)
+	for _, name := range names {
+		if strings.EqualFold(name, host) {
+			return given, true
+		}
+	}
+	return NormalizeFQDN(strings.ToLower(names[0])), true
+}
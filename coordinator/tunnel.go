@@ -0,0 +1,178 @@
+package coordinator
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// A port the proxy listens on to tunnel TCP connections through a client to
+// an address in its network, such as a debug UI behind NAT.
+type TunnelConfig struct {
+	// Address to listen on, such as :6060.
+	Listen string `yaml:"listen"`
+	// FQDN of the client to tunnel through.
+	Client string `yaml:"client"`
+	// host:port the client connects to.
+	Target string `yaml:"target"`
+}
+
+// How long a client has to connect back once a tunnel is accepted.
+const tunnelOpenTimeout = 30 * time.Second
+
+// What a client connecting back for a tunnel gave, the connection carrying
+// it or why it couldn't connect to the target.
+type tunnelResult struct {
+	conn net.Conn
+	err  error
+}
+
+// A hijacked connection, reading what was buffered before it was hijacked
+// first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// A hard to guess ID, so only the client asked to can connect a tunnel.
+func newTunnelID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Listen on the ports of the tunnels in the configuration, until Stop. Tunnels
+// are only read on startup.
+func (c *Coordinator) ListenTunnels() error {
+	for _, t := range c.config().Tunnels {
+		if t.Listen == "" || t.Client == "" || t.Target == "" {
+			return errors.New("tunnels need a listen address, client and target")
+		}
+		l, err := net.Listen("tcp", t.Listen)
+		if err != nil {
+			return err
+		}
+		level.Info(c.logger).Log("msg", "Listening for tunnel", "address", t.Listen, "client", t.Client, "target", t.Target)
+		go func() {
+			<-c.stop
+			l.Close()
+		}()
+		go c.serveTunnel(l, t)
+	}
+	return nil
+}
+
+func (c *Coordinator) serveTunnel(l net.Listener, t TunnelConfig) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-c.stop:
+				return
+			default:
+			}
+			level.Warn(c.logger).Log("msg", "Error accepting tunnel connection", "address", t.Listen, "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go c.tunnel(conn, t)
+	}
+}
+
+// Have the client connect back for the accepted connection, and tunnel it.
+func (c *Coordinator) tunnel(in net.Conn, t TunnelConfig) {
+	id := newTunnelID()
+	logger := log.With(c.logger, "tunnel_id", id, "client", t.Client, "target", t.Target)
+	ch := make(chan tunnelResult, 1)
+	c.mu.Lock()
+	c.tunnels[id] = ch
+	c.mu.Unlock()
+	c.sendControl(NormalizeFQDN(t.Client), fmt.Sprintf("%s %s %s", util.ControlTunnel, id, t.Target))
+
+	timer := time.NewTimer(tunnelOpenTimeout)
+	defer timer.Stop()
+	var res tunnelResult
+	received := false
+	select {
+	case res = <-ch:
+		received = true
+	case <-timer.C:
+		res.err = errors.New("client didn't connect back in time")
+	case <-c.stop:
+		res.err = errShuttingDown
+	}
+	if !received {
+		c.mu.Lock()
+		_, waiting := c.tunnels[id]
+		delete(c.tunnels, id)
+		c.mu.Unlock()
+		if !waiting {
+			// The client is connecting back regardless.
+			if late := <-ch; late.conn != nil {
+				late.conn.Close()
+			}
+		}
+	}
+	if res.err != nil {
+		level.Info(logger).Log("msg", "Error opening tunnel", "err", res.err)
+		c.metrics.tunnelConnections.WithLabelValues(t.Listen, "failed").Inc()
+		in.Close()
+		return
+	}
+	c.metrics.tunnelConnections.WithLabelValues(t.Listen, "opened").Inc()
+	level.Debug(logger).Log("msg", "Opened tunnel", "remote_addr", in.RemoteAddr())
+	util.Splice(in, res.conn)
+	level.Debug(logger).Log("msg", "Closed tunnel")
+}
+
+// A client connecting back for a tunnel, upgrading the request to carry it.
+func handleTunnel(c *Coordinator, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	c.mu.Lock()
+	ch, ok := c.tunnels[id]
+	delete(c.tunnels, id)
+	c.mu.Unlock()
+	if !ok {
+		http.Error(w, "Unknown or expired tunnel", http.StatusNotFound)
+		return
+	}
+	if msg := r.Header.Get(util.TunnelErrorHeader); msg != "" {
+		ch <- tunnelResult{err: fmt.Errorf("client failed to connect to target: %s", msg)}
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !strings.EqualFold(r.Header.Get("Upgrade"), util.TunnelUpgrade) || !ok {
+		ch <- tunnelResult{err: errors.New("client request for the tunnel couldn't be upgraded")}
+		http.Error(w, "Tunnels need an HTTP/1.1 request upgraded to "+util.TunnelUpgrade, http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		ch <- tunnelResult{err: err}
+		return
+	}
+	// The server's timeouts are for requests, not tunnels.
+	conn.SetDeadline(time.Time{})
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + util.TunnelUpgrade + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		ch <- tunnelResult{err: err}
+		return
+	}
+	ch <- tunnelResult{conn: &bufferedConn{Conn: conn, r: rw.Reader}}
+}
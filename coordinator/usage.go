@@ -0,0 +1,216 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errQuotaExceeded = errors.New("byte quota exceeded")
+
+// A limit on the bytes clients matching a regex may push, each on their own,
+// such as for clients on metered links. Days and months are in UTC.
+type ClientQuota struct {
+	// Matched against the FQDN of the client, or <tenant>/<fqdn> for a
+	// tenant's.
+	Regex        string `yaml:"regex"`
+	DailyBytes   int64  `yaml:"daily_bytes"`
+	MonthlyBytes int64  `yaml:"monthly_bytes"`
+}
+
+type compiledQuota struct {
+	re    *regexp.Regexp
+	quota ClientQuota
+}
+
+func (rc *runtimeConfig) compileQuotas() error {
+	for _, q := range rc.ClientQuotas {
+		re, err := anchoredRegexp(q.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid client quota regex %q: %s", q.Regex, err)
+		}
+		rc.quotas = append(rc.quotas, compiledQuota{re: re, quota: q})
+	}
+	return nil
+}
+
+// What a client or tenant has used, in total and in the current day and
+// month.
+type Usage struct {
+	Scrapes      int64  `json:"scrapes"`
+	Bytes        int64  `json:"bytes"`
+	DailyBytes   int64  `json:"daily_bytes"`
+	Day          string `json:"day"`
+	MonthlyBytes int64  `json:"monthly_bytes"`
+	Month        string `json:"month"`
+}
+
+// Start a new day or month if it's now a different one.
+func (u *Usage) roll(now time.Time) {
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DailyBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthlyBytes = month, 0
+	}
+}
+
+func (u *Usage) add(now time.Time, bytes, scrapes int64) {
+	u.roll(now)
+	u.Scrapes += scrapes
+	u.Bytes += bytes
+	u.DailyBytes += bytes
+	u.MonthlyBytes += bytes
+}
+
+// Whether the usage has reached either limit, 0 for none.
+func (u *Usage) over(now time.Time, daily, monthly int64) bool {
+	u.roll(now)
+	return daily > 0 && u.DailyBytes >= daily || monthly > 0 && u.MonthlyBytes >= monthly
+}
+
+// Count bytes and scrapes pushed by a client, and its tenant.
+func (c *Coordinator) addUsage(key string, bytes, scrapes int64) {
+	now := c.now()
+	shard := c.clientShard(key)
+	shard.mu.Lock()
+	u, ok := shard.usage[key]
+	if !ok {
+		u = &Usage{}
+		shard.usage[key] = u
+	}
+	u.add(now, bytes, scrapes)
+	shard.mu.Unlock()
+	if tenant, _ := splitTenantClient(key); tenant != "" {
+		shard := c.clientShard(tenant)
+		shard.mu.Lock()
+		tu, ok := shard.tenantUsage[tenant]
+		if !ok {
+			tu = &Usage{}
+			shard.tenantUsage[tenant] = tu
+		}
+		tu.add(now, bytes, scrapes)
+		shard.mu.Unlock()
+	}
+}
+
+// Whether the client or its tenant has used up a quota.
+func (c *Coordinator) overQuota(cfg *runtimeConfig, key string) bool {
+	now := c.now()
+	for _, q := range cfg.quotas {
+		if q.re.MatchString(key) {
+			shard := c.clientShard(key)
+			shard.mu.Lock()
+			u, ok := shard.usage[key]
+			over := ok && u.over(now, q.quota.DailyBytes, q.quota.MonthlyBytes)
+			shard.mu.Unlock()
+			if over {
+				return true
+			}
+			break
+		}
+	}
+	tenant, _ := splitTenantClient(key)
+	if t := cfg.tenant(tenant); t != nil {
+		shard := c.clientShard(tenant)
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		if u, ok := shard.tenantUsage[tenant]; ok && u.over(now, t.DailyBytes, t.MonthlyBytes) {
+			return true
+		}
+	}
+	return false
+}
+
+// Usage of a client, for the API.
+type ClientUsage struct {
+	FQDN string `json:"fqdn"`
+	Usage
+}
+
+// Usage of a tenant, for the API.
+type TenantUsage struct {
+	Tenant string `json:"tenant"`
+	Usage
+}
+
+// Usage of all clients and tenants, sorted.
+func (c *Coordinator) Usage() ([]ClientUsage, []TenantUsage) {
+	now := c.now()
+	clients := []ClientUsage{}
+	tenants := []TenantUsage{}
+	for i := range c.clientShards {
+		shard := &c.clientShards[i]
+		shard.mu.Lock()
+		for key, u := range shard.usage {
+			u.roll(now)
+			clients = append(clients, ClientUsage{FQDN: key, Usage: *u})
+		}
+		for tenant, u := range shard.tenantUsage {
+			u.roll(now)
+			tenants = append(tenants, TenantUsage{Tenant: tenant, Usage: *u})
+		}
+		shard.mu.Unlock()
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].FQDN < clients[j].FQDN })
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Tenant < tenants[j].Tenant })
+	return clients, tenants
+}
+
+type usageCollector struct {
+	c                          *Coordinator
+	bytes, scrapes, periodDesc *prometheus.Desc
+	tenantPeriodDesc           *prometheus.Desc
+}
+
+func newUsageCollector(c *Coordinator) usageCollector {
+	return usageCollector{
+		c: c,
+		bytes: prometheus.NewDesc(
+			"pushprox_client_pushed_bytes_total",
+			"Bytes of scrape results pushed by each client as received, compressed if they were. Tenants' clients are <tenant>/<fqdn>.",
+			[]string{"fqdn"}, nil,
+		),
+		scrapes: prometheus.NewDesc(
+			"pushprox_client_pushed_scrapes_total",
+			"Scrape results pushed by each client.",
+			[]string{"fqdn"}, nil,
+		),
+		periodDesc: prometheus.NewDesc(
+			"pushprox_client_period_pushed_bytes",
+			"Bytes pushed by each client in the current UTC day or month, as counted against quotas.",
+			[]string{"fqdn", "period"}, nil,
+		),
+		tenantPeriodDesc: prometheus.NewDesc(
+			"pushprox_tenant_period_pushed_bytes",
+			"Bytes pushed by the clients of each tenant in the current UTC day or month, as counted against quotas.",
+			[]string{"tenant", "period"}, nil,
+		),
+	}
+}
+
+func (uc usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- uc.bytes
+	ch <- uc.scrapes
+	ch <- uc.periodDesc
+	ch <- uc.tenantPeriodDesc
+}
+
+func (uc usageCollector) Collect(ch chan<- prometheus.Metric) {
+	clients, tenants := uc.c.Usage()
+	for _, u := range clients {
+		ch <- prometheus.MustNewConstMetric(uc.bytes, prometheus.CounterValue, float64(u.Bytes), u.FQDN)
+		ch <- prometheus.MustNewConstMetric(uc.scrapes, prometheus.CounterValue, float64(u.Scrapes), u.FQDN)
+		ch <- prometheus.MustNewConstMetric(uc.periodDesc, prometheus.GaugeValue, float64(u.DailyBytes), u.FQDN, "day")
+		ch <- prometheus.MustNewConstMetric(uc.periodDesc, prometheus.GaugeValue, float64(u.MonthlyBytes), u.FQDN, "month")
+	}
+	for _, u := range tenants {
+		ch <- prometheus.MustNewConstMetric(uc.tenantPeriodDesc, prometheus.GaugeValue, float64(u.DailyBytes), u.Tenant, "day")
+		ch <- prometheus.MustNewConstMetric(uc.tenantPeriodDesc, prometheus.GaugeValue, float64(u.MonthlyBytes), u.Tenant, "month")
+	}
+}
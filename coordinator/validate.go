@@ -0,0 +1,30 @@
+package coordinator
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Read the body of a pushed result to check it's well formed, leaving it to
+// be read again. Results compressed by the target or that aren't a successful
+// scrape aren't checked.
+func (c *Coordinator) validateResult(resp *http.Response, fqdn string) error {
+	if resp.StatusCode/100 != 2 || resp.Header.Get(util.ScrapeErrorHeader) != "" || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		err = util.ValidateExposition(resp.Header.Get("Content-Type"), body)
+	}
+	if err != nil {
+		c.metrics.invalidResults.WithLabelValues(fqdn).Inc()
+		return fmt.Errorf("%w: %s", errInvalidResult, err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
@@ -0,0 +1,67 @@
+package coordinator
+
+import (
+	"errors"
+
+	"github.com/go-kit/log/level"
+)
+
+var errStuckScrape = errors.New("scrape was still outstanding long past its timeout")
+
+// Expire scrapes still outstanding --scrape.stuck-grace after the longest
+// scrape timeout, which only a bug can leave them, logging what happened to
+// each so where it stalled can be found. Channels for results left behind
+// by scrapes that are over go too.
+func (c *Coordinator) expireStuckScrapes() {
+	cfg := c.config()
+	if cfg.StuckScrapeGrace <= 0 {
+		return
+	}
+	limit := cfg.ScrapeTimeouts.Max + cfg.StuckScrapeGrace
+	stuck := map[string]bool{}
+	for i := range c.scrapeShards {
+		shard := &c.scrapeShards[i]
+		var expired []InflightScrape
+		shard.mu.Lock()
+		for id, s := range shard.scrapes {
+			if c.since(s.Started) > limit {
+				expired = append(expired, *s)
+				delete(shard.scrapes, id)
+			}
+		}
+		shard.mu.Unlock()
+		for _, s := range expired {
+			stuck[s.ID] = true
+			c.logStuckScrape(s)
+			c.metrics.stuckScrapes.WithLabelValues(s.State).Inc()
+			s.cancel(errStuckScrape)
+		}
+	}
+	for i := range c.scrapeShards {
+		shard := &c.scrapeShards[i]
+		var leftBehind []*pendingResult
+		shard.mu.Lock()
+		for id, p := range shard.responses {
+			if c.since(p.since) > limit {
+				delete(shard.responses, id)
+				p.stop()
+				if !stuck[p.scrapeID] {
+					leftBehind = append(leftBehind, p)
+				}
+			}
+		}
+		shard.mu.Unlock()
+		for _, p := range leftBehind {
+			level.Warn(c.logger).Log("msg", "Dropping channel for a result left behind by a scrape that's over", "scrape_id", p.scrapeID, "fqdn", p.fqdn, "since", p.since)
+			c.metrics.stuckScrapes.WithLabelValues("untracked").Inc()
+		}
+	}
+}
+
+func (c *Coordinator) logStuckScrape(s InflightScrape) {
+	keyvals := []interface{}{"msg", "Expiring stuck scrape", "scrape_id", s.ID, "fqdn", s.FQDN, "url", s.URL, "scraper", s.Scraper, "state", s.State, "started", s.Started, "age", c.since(s.Started)}
+	if s.Dispatched != nil {
+		keyvals = append(keyvals, "instance", s.Instance, "dispatched", *s.Dispatched, "waiting_for_result", c.since(*s.Dispatched))
+	}
+	level.Warn(c.logger).Log(keyvals...)
+}
@@ -1,177 +0,0 @@
-package main
-
-import (
-	"context"
-	"flag"
-	"fmt"
-	"net/http"
-	"os"
-	"sync"
-	"sync/atomic"
-	"time"
-
-	"github.com/prometheus/common/log"
-
-	"github.com/robustperception/pushprox/util"
-)
-
-var (
-	registrationTimeout = flag.Duration("registration.timeout", 5*time.Minute, "After how long a registration expires.")
-)
-
-type Coordinator struct {
-	mu sync.Mutex
-
-	// Clients waiting for a scrape.
-	waiting map[string]chan *http.Request
-	// Responses from clients.
-	responses map[string]chan *http.Response
-	// Clients we know about and when they last contacted us.
-	known map[string]time.Time
-}
-
-func NewCoordinator() *Coordinator {
-	c := &Coordinator{
-		waiting:   map[string]chan *http.Request{},
-		responses: map[string]chan *http.Response{},
-		known:     map[string]time.Time{},
-	}
-	go c.gc()
-	return c
-}
-
-var idCounter int64
-
-// Generate a unique ID
-func genId() string {
-	id := atomic.AddInt64(&idCounter, 1)
-	// TODO: Add MAC address.
-	// TODO: Sign these to prevent spoofing.
-	return fmt.Sprintf("%d-%d-%d", time.Now().Unix(), id, os.Getpid())
-}
-
-func (c *Coordinator) getRequestChannel(fqdn string) chan *http.Request {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	ch, ok := c.waiting[fqdn]
-	if !ok {
-		ch = make(chan *http.Request)
-		c.waiting[fqdn] = ch
-	}
-	return ch
-}
-
-func (c *Coordinator) getResponseChannel(id string) chan *http.Response {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	ch, ok := c.responses[id]
-	if !ok {
-		ch = make(chan *http.Response)
-		c.responses[id] = ch
-	}
-	return ch
-}
-
-// Remove a response channel. Idempotent.
-func (c *Coordinator) removeResponseChannel(id string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.responses, id)
-}
-
-// Request a scrape.
-func (c *Coordinator) DoScrape(ctx context.Context, r *http.Request) (*http.Response, error) {
-	id := genId()
-	log.With("scrape_id", id).With("url", r.URL.String()).Info("DoScrape")
-	r.Header.Add("Id", id)
-	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("Matching client not found for %q: %s", r.URL.String(), ctx.Err())
-	case c.getRequestChannel(r.URL.Hostname()) <- r:
-	}
-
-	respCh := c.getResponseChannel(id)
-	defer c.removeResponseChannel(id)
-
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case resp := <-respCh:
-		return resp, nil
-	}
-}
-
-// Client registering to accept a scrape request. Blocking.
-func (c *Coordinator) WaitForScrapeInstruction(fqdn string) (*http.Request, error) {
-	log.With("fqdn", fqdn).Info("WaitForScrapeInstruction")
-	c.addKnownClient(fqdn)
-	// TODO: What if the client times out?
-	ch := c.getRequestChannel(fqdn)
-	for {
-		request := <-ch
-		select {
-		case <-request.Context().Done():
-			// Request has timed out, get another one.
-		default:
-			return request, nil
-		}
-	}
-}
-
-// Client sending a scrape result in.
-func (c *Coordinator) ScrapeResult(r *http.Response) error {
-	id := r.Header.Get("Id")
-	log.With("scrape_id", id).Info("ScrapeResult")
-	ctx, _ := context.WithTimeout(context.Background(), util.GetScrapeTimeout(r.Header))
-	// Don't expose internal headers.
-	r.Header.Del("Id")
-	r.Header.Del("X-Prometheus-Scrape-Timeout-Seconds")
-	select {
-	case c.getResponseChannel(id) <- r:
-		return nil
-	case <-ctx.Done():
-		c.removeResponseChannel(id)
-		return ctx.Err()
-	}
-}
-
-func (c *Coordinator) addKnownClient(fqdn string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	c.known[fqdn] = time.Now()
-}
-
-// What clients are alive.
-func (c *Coordinator) KnownClients() []string {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	limit := time.Now().Add(-*registrationTimeout)
-	known := make([]string, 0, len(c.known))
-	for k, t := range c.known {
-		if limit.Before(t) {
-			known = append(known, k)
-		}
-	}
-	return known
-}
-
-// Garbagee collect old clients.
-func (c *Coordinator) gc() {
-	for range time.Tick(1 * time.Minute) {
-		func() {
-			c.mu.Lock()
-			defer c.mu.Unlock()
-			limit := time.Now().Add(-*registrationTimeout)
-			deleted := 0
-			for k, ts := range c.known {
-				if ts.Before(limit) {
-					delete(c.known, k)
-					deleted++
-				}
-			}
-			log.With("deleted", deleted).With("remaining", len(c.known)).Info("GC of clients completed")
-		}()
-	}
-}
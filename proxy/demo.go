@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/robustperception/pushprox/coordinator"
+	"github.com/robustperception/pushprox/pushclient"
+)
+
+const (
+	// What the demo client registers as, and the target to scrape through it.
+	demoFQDN   = "demo"
+	demoTarget = demoFQDN + ":9100"
+)
+
+// Serve made up metrics on a local port, returning its host:port.
+func startDemoExporter() (string, error) {
+	reg := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "demo_requests_total",
+		Help: "Requests handled by the made up service, by status code.",
+	}, []string{"code"})
+	temperature := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "demo_temperature_celsius",
+		Help: "Temperature of the made up server room.",
+	})
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "demo_request_duration_seconds",
+		Help: "How long requests to the made up service took.",
+	})
+	reg.MustRegister(requests, temperature, latency)
+	go func() {
+		start := time.Now()
+		for range time.Tick(time.Second) {
+			for i := rand.Intn(20); i > 0; i-- {
+				code := "200"
+				if rand.Intn(20) == 0 {
+					code = "500"
+				}
+				requests.WithLabelValues(code).Inc()
+				latency.Observe(rand.ExpFloat64() / 10)
+			}
+			temperature.Set(21 + 3*math.Sin(time.Since(start).Minutes()))
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(l, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	return l.Addr().String(), nil
+}
+
+// Run a made up exporter and a client for it against the proxy listening on
+// listenAddress, so it can be tried out without any other setup.
+func startDemo(listenAddress string, cfg coordinator.Config, tls bool, logger log.Logger) error {
+	exporter, err := startDemoExporter()
+	if err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	clientCfg := pushclient.DefaultConfig()
+	clientCfg.FQDN = demoFQDN
+	clientCfg.ProxyURL = "http://" + net.JoinHostPort(host, port)
+	if tls {
+		clientCfg.ProxyURL = "https://" + net.JoinHostPort(host, port)
+		clientCfg.ProxyTLS.InsecureSkipVerify = true
+	}
+	if len(cfg.Authorization.ClientTokens) > 0 {
+		clientCfg.BearerToken = cfg.Authorization.ClientTokens[0]
+	}
+	clientCfg.TargetRewrites = map[string]string{demoTarget: exporter}
+	client, err := pushclient.New(clientCfg, nil, log.With(logger, "component", "demo_client"))
+	if err != nil {
+		return err
+	}
+	go client.Run()
+	level.Info(logger).Log("msg", "Started demo client and exporter", "try", "curl -x "+clientCfg.ProxyURL+" http://"+demoTarget+"/metrics")
+	return nil
+}
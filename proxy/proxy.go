@@ -1,98 +1,217 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
-	"flag"
-	"fmt"
-	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/prometheus/common/log"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/promlog"
+	"github.com/prometheus/common/version"
+	"github.com/quic-go/quic-go/http3"
+	"gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/robustperception/pushprox/coordinator"
 	"github.com/robustperception/pushprox/util"
 )
 
 var (
-	listenAddress = flag.String("web.listen-address", ":8080", "Address to listen on for proxy and client requests.")
+	listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for proxy and client requests.").Default(":8080").String()
+	http3Address  = kingpin.Flag("web.http3-listen-address", "Experimental. UDP address to also serve HTTP/3 on, such as :8080, for clients on lossy links. Needs TLS. Empty to disable.").String()
+	idleTimeout   = kingpin.Flag("web.idle-timeout", "How long to keep idle connections from clients and scrapers open for reuse.").Default("5m").Duration()
+	tcpKeepAlive  = kingpin.Flag("web.tcp-keepalive", "Interval of TCP keepalives on accepted connections, so stateful firewalls don't drop them while idle. Negative to disable.").Default("30s").Duration()
+	primeFile     = kingpin.Flag("registration.prime-file", "File in file_sd_configs format, such as a saved copy of /clients, to load known clients from on startup.").String()
+	stateFile     = kingpin.Flag("registration.state-file", "File to save known clients, their labels and approvals to every minute and on shutdown, and to load them from on startup so they survive restarts.").String()
+	configFile    = kingpin.Flag("config.file", "YAML file of settings, which take precedence over flags. Reloaded on SIGHUP or a POST to /-/reload.").String()
+	drainTimeout  = kingpin.Flag("shutdown.drain-timeout", "On SIGTERM or SIGINT, how long to wait for scrapes clients have picked up to finish before exiting.").Default("15s").Duration()
+	reportFile    = kingpin.Flag("shutdown.report-file", "File to write a JSON report of what happened while draining to on shutdown, as well as logging it.").String()
+	enablePprof   = kingpin.Flag("web.enable-pprof", "Serve Go's profiling endpoints at /debug/pprof/ to holders of an admin token, to look into memory growth and the like.").Bool()
+	demo          = kingpin.Flag("demo", "Also run a client with a made up exporter behind it, registered as \"demo\", to try the proxy out with.").Bool()
 )
 
-func copyHttpResponse(resp *http.Response, w http.ResponseWriter) {
-	for k, v := range resp.Header {
-		w.Header()[k] = v
-	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-}
-
-type targetGroup struct {
-	Targets []string          `json:"targets"`
-	Labels  map[string]string `json:"labels"`
-}
-
 func main() {
-	flag.Parse()
-	coordinator := NewCoordinator()
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Proxy request
-		if r.URL.Host != "" {
-			ctx, _ := context.WithTimeout(r.Context(), util.GetScrapeTimeout(r.Header))
-			request := r.WithContext(ctx)
-			request.RequestURI = ""
-
-			resp, err := coordinator.DoScrape(ctx, request)
-			if err != nil {
-				log.With("url", request.URL.String()).Infof("Error scraping: %s", err)
-				http.Error(w, fmt.Sprintf("Error scraping %q: %s", request.URL.String(), err.Error()), 500)
-				return
+	var cfg coordinator.Config
+	cfg.RegisterFlags(kingpin.CommandLine, "")
+	var logFormat promlog.AllowedFormat
+	kingpin.Flag("log.format", "Output format of log messages. One of: logfmt, json.").Default("logfmt").SetValue(&logFormat)
+	util.SetEnvars(kingpin.CommandLine, "PUSHPROX")
+	kingpin.Version(version.Print("pushprox-proxy"))
+	kingpin.HelpFlag.Short('h')
+	kingpin.Parse()
+	logger := util.NewLogger(&cfg.LogLevel, &logFormat)
+	base := cfg
+	if *configFile != "" {
+		var err error
+		if cfg, err = coordinator.LoadConfigFile(*configFile, base); err != nil {
+			fatal(logger, "Error loading config", "file", *configFile, "err", err)
+		}
+	}
+	prometheus.MustRegister(version.NewCollector("pushprox"))
+	opts := coordinator.Options{Registerer: prometheus.DefaultRegisterer, Logger: logger}
+	if *enablePprof {
+		opts.Pprof = util.PprofHandler()
+	}
+	c, err := coordinator.NewWithOptions(cfg, opts)
+	if err != nil {
+		fatal(logger, "Error starting", "err", err)
+	}
+	go c.Run(context.Background())
+	if err := c.ListenTunnels(); err != nil {
+		fatal(logger, "Error listening for tunnels", "err", err)
+	}
+	if *configFile != "" {
+		c.SetConfigFile(*configFile, base)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := c.Reload(); err != nil {
+					level.Warn(logger).Log("msg", "Error reloading config", "file", *configFile, "err", err)
+				}
 			}
-			defer resp.Body.Close()
-			copyHttpResponse(resp, w)
-			return
+		}()
+	}
+	if *primeFile != "" {
+		known, err := coordinator.LoadSDFile(*primeFile)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Error loading known clients", "file", *primeFile, "err", err)
+		} else {
+			c.PrimeKnownClients(known)
+			level.Info(logger).Log("msg", "Loaded known clients", "file", *primeFile, "client_count", len(known))
 		}
+	}
+	// Closed once the state has been saved for the last time, if it's saved.
+	stateSaved := make(chan struct{})
+	if *stateFile != "" {
+		loaded, err := c.LoadState(*stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			level.Warn(logger).Log("msg", "Error loading state", "file", *stateFile, "err", err)
+		} else {
+			level.Info(logger).Log("msg", "Loaded state", "file", *stateFile, "client_count", loaded)
+		}
+		go func() {
+			c.SaveStatePeriodically(*stateFile)
+			close(stateSaved)
+		}()
+	} else {
+		close(stateSaved)
+	}
 
-		// Client registering and asking for scrapes.
-		if r.URL.Path == "/poll" {
-			fqdn, _ := ioutil.ReadAll(r.Body)
-			request, _ := coordinator.WaitForScrapeInstruction(strings.TrimSpace(string(fqdn)))
-			request.WriteProxy(w) // Send full request as the body of the response.
-			log.With("url", request.URL.String()).With("scrape_id", request.Header.Get("Id")).Info("Responded to /poll")
+	metrics := promhttp.Handler()
+	versionHandler := util.VersionHandler()
+	// Not http.DefaultServeMux, which net/http/pprof registers on.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Scrapes of targets' /metrics go to the coordinator.
+		path, ok := c.SelfPath(r)
+		if ok && path == "/metrics" {
+			metrics.ServeHTTP(w, r)
 			return
 		}
-
-		// Scrape response from client.
-		if r.URL.Path == "/push" {
-			buf := &bytes.Buffer{}
-			io.Copy(buf, r.Body)
-			scrapeResult, _ := http.ReadResponse(bufio.NewReader(buf), nil)
-			log.With("scrape_id", scrapeResult.Header.Get("Id")).Info("Got /push")
-			err := coordinator.ScrapeResult(scrapeResult)
-			if err != nil {
-				log.With("scrape_id", scrapeResult.Header.Get("Id")).Infof("Error pushing: %s", err)
-				http.Error(w, fmt.Sprintf("Error pushing: %s", err.Error()), 500)
-			}
+		if ok && path == "/version" {
+			versionHandler.ServeHTTP(w, r)
 			return
 		}
+		c.ServeHTTP(w, r)
+	})
 
-		if r.URL.Path == "/clients" {
-			known := coordinator.KnownClients()
-			targets := make([]*targetGroup, 0, len(known))
-			for _, k := range known {
-				targets = append(targets, &targetGroup{Targets: []string{k}})
+	if err := c.ListenACME(); err != nil {
+		fatal(logger, "Error listening for ACME challenges", "err", err)
+	}
+	if err := c.ListenSSH(mux); err != nil {
+		fatal(logger, "Error listening for clients over SSH", "err", err)
+	}
+
+	server := &http.Server{Addr: *listenAddress, TLSConfig: c.TLSConfig(), IdleTimeout: *idleTimeout, Handler: mux}
+	// Under systemd socket activation, the first socket passed takes the
+	// place of --web.listen-address.
+	activated, err := util.SystemdListeners()
+	if err != nil {
+		fatal(logger, "Error using sockets from systemd", "err", err)
+	}
+	var listener net.Listener
+	if len(activated) > 0 {
+		listener = activated[0]
+		level.Info(logger).Log("msg", "Listening on socket from systemd", "address", listener.Addr(), "tls", server.TLSConfig != nil)
+	} else {
+		lc := net.ListenConfig{KeepAlive: *tcpKeepAlive}
+		listener, err = lc.Listen(context.Background(), "tcp", *listenAddress)
+		if err != nil {
+			fatal(logger, "Error listening", "address", *listenAddress, "err", err)
+		}
+		level.Info(logger).Log("msg", "Listening", "address", *listenAddress, "tls", server.TLSConfig != nil)
+	}
+	if *demo {
+		if err := startDemo(*listenAddress, cfg, server.TLSConfig != nil, logger); err != nil {
+			fatal(logger, "Error starting demo", "err", err)
+		}
+	}
+	var h3 *http3.Server
+	if *http3Address != "" {
+		if server.TLSConfig == nil {
+			fatal(logger, "--web.http3-listen-address needs TLS")
+		}
+		h3 = &http3.Server{Addr: *http3Address, TLSConfig: http3.ConfigureTLSConfig(c.TLSConfig()), Handler: mux}
+		level.Info(logger).Log("msg", "Listening for HTTP/3", "address", *http3Address)
+		go func() {
+			if err := h3.ListenAndServe(); err != http.ErrServerClosed {
+				fatal(logger, "Error serving HTTP/3", "err", err)
 			}
-			json.NewEncoder(w).Encode(targets)
-			log.With("client_count", len(known)).Info("Responded to /clients")
-			return
+		}()
+	}
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			fatal(logger, "Error serving", "err", err)
 		}
+	}()
+	if _, err := util.SystemdNotify("READY=1"); err != nil {
+		level.Warn(logger).Log("msg", "Error notifying systemd", "err", err)
+	}
+	go util.RunSystemdWatchdog(c.Alive)
 
-		http.Error(w, "404: Unknown path", 404)
-	})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	<-term
+	util.SystemdNotify("STOPPING=1")
+	level.Info(logger).Log("msg", "Draining before shutting down", "timeout", *drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	report := c.Drain(ctx)
+	// Let the responses to the last scrapes finish too.
+	server.Shutdown(ctx)
+	if h3 != nil {
+		// Only clients use it, and Drain waited for their pushes.
+		h3.Close()
+	}
+	c.Stop()
+	<-stateSaved
+	level.Info(logger).Log("msg", "Shutdown report", "clients_notified", report.ClientsNotified,
+		"queued_scrapes_dropped", report.QueuedScrapesDropped, "scrapes_completed", report.ScrapesCompleted,
+		"scrapes_aborted", report.ScrapesAborted, "duration", time.Since(report.Started))
+	if *reportFile != "" {
+		content, _ := json.MarshalIndent(report, "", "  ")
+		if err := ioutil.WriteFile(*reportFile, append(content, '\n'), 0644); err != nil {
+			level.Error(logger).Log("msg", "Error writing shutdown report", "file", *reportFile, "err", err)
+		}
+	}
+}
 
-	log.With("address", *listenAddress).Info("Listening")
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+func fatal(logger log.Logger, msg string, keyvals ...interface{}) {
+	level.Error(logger).Log(append([]interface{}{"msg", msg}, keyvals...)...)
+	os.Exit(1)
 }
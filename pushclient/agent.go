@@ -0,0 +1,349 @@
+package pushclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v2"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// What agent mode reads of a Prometheus config file. Everything else in it,
+// such as rule files and remote write, is ignored.
+type agentConfigFile struct {
+	Global struct {
+		ScrapeInterval model.Duration `yaml:"scrape_interval"`
+		ScrapeTimeout  model.Duration `yaml:"scrape_timeout"`
+	} `yaml:"global"`
+	ScrapeConfigs []agentScrapeConfig `yaml:"scrape_configs"`
+}
+
+type agentScrapeConfig struct {
+	JobName        string              `yaml:"job_name"`
+	ScrapeInterval model.Duration      `yaml:"scrape_interval"`
+	ScrapeTimeout  model.Duration      `yaml:"scrape_timeout"`
+	MetricsPath    string              `yaml:"metrics_path"`
+	Scheme         string              `yaml:"scheme"`
+	Params         url.Values          `yaml:"params"`
+	HonorLabels    bool                `yaml:"honor_labels"`
+	StaticConfigs  []agentStaticConfig `yaml:"static_configs"`
+	// Anything else, such as service discovery or relabelling, which isn't
+	// supported.
+	Unsupported map[string]interface{} `yaml:",inline"`
+}
+
+type agentStaticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// A target of agent mode, scraped on its own schedule.
+type agentTarget struct {
+	job         string
+	url         string
+	interval    time.Duration
+	timeout     time.Duration
+	honorLabels bool
+	// The job, instance and static labels, added to every sample.
+	labels map[string]string
+}
+
+// Read the targets of the scrape configs in a Prometheus config file.
+func loadAgentTargets(path string) ([]*agentTarget, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file agentConfigFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	// Prometheus's defaults, with timeouts left unset no longer than the
+	// interval.
+	if file.Global.ScrapeInterval <= 0 {
+		file.Global.ScrapeInterval = model.Duration(time.Minute)
+	}
+	if file.Global.ScrapeTimeout <= 0 {
+		file.Global.ScrapeTimeout = model.Duration(10 * time.Second)
+		if file.Global.ScrapeTimeout > file.Global.ScrapeInterval {
+			file.Global.ScrapeTimeout = file.Global.ScrapeInterval
+		}
+	}
+	var targets []*agentTarget
+	jobs := map[string]bool{}
+	for _, sc := range file.ScrapeConfigs {
+		if sc.JobName == "" {
+			return nil, errors.New("a scrape config has no job_name")
+		}
+		if jobs[sc.JobName] {
+			return nil, fmt.Errorf("job %q is in more than one scrape config", sc.JobName)
+		}
+		jobs[sc.JobName] = true
+		if len(sc.Unsupported) > 0 {
+			var keys []string
+			for key := range sc.Unsupported {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			return nil, fmt.Errorf("job %q: %s not supported in agent mode", sc.JobName, strings.Join(keys, ", "))
+		}
+		interval, timeout := time.Duration(sc.ScrapeInterval), time.Duration(sc.ScrapeTimeout)
+		if interval <= 0 {
+			interval = time.Duration(file.Global.ScrapeInterval)
+		}
+		if timeout <= 0 {
+			timeout = time.Duration(file.Global.ScrapeTimeout)
+			if timeout > interval {
+				timeout = interval
+			}
+		}
+		if timeout > interval {
+			return nil, fmt.Errorf("job %q: scrape_timeout is longer than scrape_interval", sc.JobName)
+		}
+		if sc.MetricsPath == "" {
+			sc.MetricsPath = "/metrics"
+		}
+		if sc.Scheme == "" {
+			sc.Scheme = "http"
+		}
+		if sc.Scheme != "http" && sc.Scheme != "https" {
+			return nil, fmt.Errorf("job %q: scheme must be http or https", sc.JobName)
+		}
+		for _, static := range sc.StaticConfigs {
+			for name := range static.Labels {
+				if !util.IsValidLabelName(name) {
+					return nil, fmt.Errorf("job %q: invalid label name %q", sc.JobName, name)
+				}
+			}
+			for _, target := range static.Targets {
+				labels := map[string]string{"job": sc.JobName}
+				for name, value := range static.Labels {
+					labels[name] = value
+				}
+				if _, ok := labels["instance"]; !ok {
+					labels["instance"] = target
+				}
+				u := &url.URL{Scheme: sc.Scheme, Host: target, Path: sc.MetricsPath, RawQuery: sc.Params.Encode()}
+				targets = append(targets, &agentTarget{
+					job:         sc.JobName,
+					url:         u.String(),
+					interval:    interval,
+					timeout:     timeout,
+					honorLabels: sc.HonorLabels,
+					labels:      labels,
+				})
+			}
+		}
+	}
+	return targets, nil
+}
+
+// Agent mode: targets scraped by the client itself, with the latest result
+// of each kept to serve all together.
+type agent struct {
+	targets []*agentTarget
+
+	mu     sync.Mutex
+	latest map[*agentTarget][]*dto.MetricFamily
+
+	failures *prometheus.CounterVec
+}
+
+func newAgent() *agent {
+	return &agent{
+		latest: map[*agentTarget][]*dto.MetricFamily{},
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_agent_scrape_failures_total",
+				Help: "Scrapes of targets of --agent.config-file that failed, by job.",
+			},
+			[]string{"job"},
+		),
+	}
+}
+
+func (a *agent) collectors() []prometheus.Collector {
+	return []prometheus.Collector{a.failures}
+}
+
+// Whether a scrape is of the agent's endpoint rather than a target.
+func (a *agent) serves(cfg *runtimeConfig, u *url.URL) bool {
+	return len(a.targets) > 0 && u.Hostname() == cfg.FQDN && u.Path == cfg.AgentPath
+}
+
+// Scrape each of the agent's targets on its schedule, until the client is
+// stopped.
+func (c *Client) runAgent() {
+	for _, t := range c.agent.targets {
+		go c.runAgentTarget(t)
+	}
+}
+
+func (c *Client) runAgentTarget(t *agentTarget) {
+	// Spread the targets over their interval, as Prometheus does.
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(t.interval))))
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(t.interval)
+		families := c.agentScrape(t)
+		c.agent.mu.Lock()
+		c.agent.latest[t] = families
+		c.agent.mu.Unlock()
+	}
+}
+
+// Scrape a target, returning its samples labelled and stamped with the time
+// of the scrape, along with up and scrape_duration_seconds as Prometheus
+// adds them.
+func (c *Client) agentScrape(t *agentTarget) []*dto.MetricFamily {
+	start := time.Now()
+	families, err := c.scrapeAgentTarget(t)
+	up := 1.0
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Failed to scrape agent target", "job", t.job, "url", t.url, "err", err)
+		c.agent.failures.WithLabelValues(t.job).Inc()
+		families = nil
+		up = 0
+	}
+	families = append(families,
+		agentGauge("up", "Whether the last scrape of the target worked.", up),
+		agentGauge("scrape_duration_seconds", "How long the last scrape of the target took.", time.Since(start).Seconds()),
+	)
+	ms := start.UnixNano() / int64(time.Millisecond)
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			t.label(m)
+			if m.TimestampMs == nil {
+				m.TimestampMs = proto.Int64(ms)
+			}
+		}
+	}
+	return families
+}
+
+func (c *Client) scrapeAgentTarget(t *agentTarget) ([]*dto.MetricFamily, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, t.timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", t.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3")
+	request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(t.timeout.Seconds(), 'f', -1, 64))
+	resp, err := c.config().scrapeClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	var families []*dto.MetricFamily
+	// The protobuf decoder only keeps what it read ahead in a bufio.Reader.
+	dec := expfmt.NewDecoder(bufio.NewReader(resp.Body), expfmt.ResponseFormat(resp.Header))
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			return families, nil
+		} else if err != nil {
+			return nil, err
+		}
+		families = append(families, mf)
+	}
+}
+
+func agentGauge(name, help string, value float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{Gauge: &dto.Gauge{Value: proto.Float64(value)}},
+		},
+	}
+}
+
+// Add the target's labels to a sample. Labels it already has are kept with
+// honor_labels, and otherwise renamed with an exported_ prefix.
+func (t *agentTarget) label(m *dto.Metric) {
+	existing := map[string]*dto.LabelPair{}
+	for _, lp := range m.Label {
+		existing[lp.GetName()] = lp
+	}
+	for name, value := range t.labels {
+		if lp, ok := existing[name]; ok {
+			if t.honorLabels {
+				continue
+			}
+			lp.Name = proto.String("exported_" + name)
+		}
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+}
+
+// The latest samples of all the targets, as the /federate endpoint of a
+// Prometheus would serve them, in the format the scrape asked for.
+func (a *agent) response(request *http.Request) (*http.Response, error) {
+	byName := map[string]*dto.MetricFamily{}
+	var names []string
+	a.mu.Lock()
+	for _, t := range a.targets {
+		for _, mf := range a.latest[t] {
+			merged, ok := byName[mf.GetName()]
+			if !ok {
+				merged = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				byName[mf.GetName()] = merged
+				names = append(names, mf.GetName())
+			} else if merged.GetType() != mf.GetType() {
+				// Can't be served as one metric, the first target's wins.
+				continue
+			}
+			merged.Metric = append(merged.Metric, mf.Metric...)
+		}
+	}
+	a.mu.Unlock()
+	sort.Strings(names)
+
+	format := expfmt.Negotiate(request.Header)
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, format)
+	for _, name := range names {
+		if err := enc.Encode(byName[name]); err != nil {
+			return nil, err
+		}
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(&buf),
+		ContentLength: int64(buf.Len()),
+	}
+	resp.Header.Set("Content-Type", string(format))
+	return resp, nil
+}
@@ -0,0 +1,64 @@
+package pushclient
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Exponential backoff with jitter for talking to the proxy, shared by polls
+// and pushes. It resets on the first success.
+type backoff struct {
+	min, max time.Duration
+	gauge    prometheus.Gauge
+
+	mu      sync.Mutex
+	current time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min: min,
+		max: max,
+		gauge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_client_backoff_seconds",
+				Help: "How long the client is backing off for before polling the proxy, before jitter.",
+			},
+		),
+	}
+}
+
+func (b *backoff) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == 0 {
+		b.current = b.min
+	} else {
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	b.gauge.Set(b.current.Seconds())
+}
+
+func (b *backoff) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current = 0
+	b.gauge.Set(0)
+}
+
+// Wait between half and all of the current backoff.
+func (b *backoff) wait() {
+	b.mu.Lock()
+	d := b.current
+	b.mu.Unlock()
+	if d <= 0 {
+		return
+	}
+	time.Sleep(d/2 + time.Duration(rand.Int63n(int64(d/2)+1)))
+}
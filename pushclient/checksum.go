@@ -0,0 +1,71 @@
+package pushclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/log/level"
+)
+
+// How many more times a push the proxy got corrupted is sent.
+const corruptedPushRetries = 2
+
+// Bytes of what's pushed besides the body of a result, such as its headers,
+// left out of what the proxy holds to check it.
+const pushOverhead = 64 << 10
+
+var errPushCorrupted = errors.New("the push reached the proxy not matching its checksum")
+
+// Push a result to a proxy checking it against its checksum, holding on to
+// it to push it again if it arrives corrupted. Results over the maxBytes the
+// proxy holds are streamed without a checksum instead.
+func (c *Client) pushVerified(cfg *runtimeConfig, resp *http.Response, origRequest *http.Request, proxyURL string, encoding string, maxBytes int64) error {
+	maxBytes -= pushOverhead
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	if int64(len(body)) > maxBytes {
+		level.Debug(c.logger).Log("msg", "Pushing without a checksum as the result is too large for the proxy to check", "scrape_id", origRequest.Header.Get("id"), "proxy_url", proxyURL)
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return c.push(cfg, resp, origRequest, proxyURL, encoding, false)
+	}
+	resp.Body.Close()
+	return c.pushAgainIfCorrupted(cfg, bufferedResponse(resp, body), origRequest, proxyURL, encoding)
+}
+
+// A func returning copies of the response with the body read from it, to
+// push each time.
+func bufferedResponse(resp *http.Response, body []byte) func() *http.Response {
+	return func() *http.Response {
+		r := *resp
+		r.Header = resp.Header.Clone()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.TransferEncoding = nil
+		return &r
+	}
+}
+
+// Push the result from next, getting it again to push it again while the
+// proxy gets it corrupted.
+func (c *Client) pushAgainIfCorrupted(cfg *runtimeConfig, next func() *http.Response, origRequest *http.Request, proxyURL string, encoding string) error {
+	for i := 0; ; i++ {
+		err := c.push(cfg, next(), origRequest, proxyURL, encoding, true)
+		if err != errPushCorrupted {
+			return err
+		}
+		c.corruptedPushes.Inc()
+		if i == corruptedPushRetries {
+			return err
+		}
+		level.Info(c.logger).Log("msg", "Pushing again as the proxy got the push corrupted", "scrape_id", origRequest.Header.Get("id"), "proxy_url", proxyURL)
+	}
+}
@@ -0,0 +1,694 @@
+package pushclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// A client, which polls proxies for scrapes and performs them.
+type Client struct {
+	logger log.Logger
+	// Holds a *runtimeConfig.
+	cfg       atomic.Value
+	proxies   *proxySelector
+	backoff   *backoff
+	discovery *discoveryConfig
+	health    pollHealth
+	// Looks for annotated pods, if enabled.
+	kubernetes *kubernetesDiscovery
+	throttle   *uploadThrottle
+	// Last results pushed, for deltas.
+	deltas *deltaBases
+	// Push mode results waiting for the proxy to come back.
+	spool *spool
+	// Signed scrape requests already taken.
+	signed *signedScrapes
+	// Targets scraped by the client itself, if any.
+	agent *agent
+
+	corruptedPushes     prometheus.Counter
+	resumedPushes       prometheus.Counter
+	rejectedScrapes     *prometheus.CounterVec
+	srvLookupFailures   prometheus.Counter
+	protocolVersion     prometheus.Gauge
+	configReloadSuccess prometheus.Gauge
+	configReloadTime    prometheus.Gauge
+	tlsReloadFailures   prometheus.Counter
+
+	// The version of the protocol the proxy last answered a poll in.
+	protocol int32
+
+	// Scrapes in progress.
+	scrapes sync.WaitGroup
+	// Done once Stop is called, ending polls.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu         sync.Mutex
+	configFile string
+	baseConfig Config
+	// Of the last TLS files that failed to load.
+	badTLSSum [sha256.Size]byte
+
+	// While the proxy has asked for debug logging.
+	debugMu    sync.Mutex
+	debugTimer *time.Timer
+}
+
+// A new client, with its metrics registered with reg if it's not nil. If
+// logger is a util.LevelSetter, its level follows the configuration.
+func New(cfg Config, reg prometheus.Registerer, logger log.Logger) (*Client, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	c := &Client{
+		logger:   logger,
+		proxies:  newProxySelector(cfg.ProxyURL, logger),
+		backoff:  newBackoff(cfg.BackoffMin, cfg.BackoffMax),
+		throttle: newUploadThrottle(),
+		deltas:   newDeltaBases(),
+		spool:    newSpool(),
+		signed:   newSignedScrapes(),
+		agent:    newAgent(),
+		corruptedPushes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_corrupted_pushes_total",
+				Help: "Pushes the proxy got not matching their checksum, so they were sent again.",
+			},
+		),
+		resumedPushes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_resumed_pushes_total",
+				Help: "Times a push in chunks carried on from where the proxy had it after being cut short.",
+			},
+		),
+		rejectedScrapes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_rejected_scrape_requests_total",
+				Help: "Scrape requests from the proxy refused as not signed as --scrape.verify-key-file needs, by why.",
+			}, []string{"reason"},
+		),
+		configReloadSuccess: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_client_config_last_reload_successful",
+				Help: "Whether the last reload of the config file succeeded.",
+			},
+		),
+		tlsReloadFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_tls_reload_failures_total",
+				Help: "Rotated TLS certificates that failed to load, so the previous ones were kept.",
+			},
+		),
+		srvLookupFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_proxy_srv_lookup_failures_total",
+				Help: "Lookups of the proxies in --proxy.srv that failed, so the last ones found were kept.",
+			},
+		),
+		protocolVersion: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_client_protocol_version",
+				Help: "The version of the protocol the proxy last answered a poll in.",
+			},
+		),
+		configReloadTime: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_client_config_last_reload_success_timestamp_seconds",
+				Help: "When the config file was last reloaded successfully.",
+			},
+		),
+	}
+	if cfg.ProxySRV != "" {
+		if len(c.proxies.urls) > 0 {
+			return nil, errors.New("a proxy URL and SRV record can't both be given")
+		}
+		if cfg.ProxySRVScheme != "http" && cfg.ProxySRVScheme != "https" {
+			return nil, fmt.Errorf("invalid proxy SRV scheme %q, it must be http or https", cfg.ProxySRVScheme)
+		}
+		if cfg.ProxySRVRefresh <= 0 {
+			return nil, errors.New("the proxy SRV refresh interval must be positive")
+		}
+		urls, err := lookupProxySRV(cfg.ProxySRV, cfg.ProxySRVScheme)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up proxies: %s", err)
+		}
+		c.proxies.urls = urls
+	}
+	if len(c.proxies.urls) == 0 {
+		return nil, errors.New("a proxy URL must be specified")
+	}
+	c.ctx, c.stop = context.WithCancel(context.Background())
+	if err := c.ApplyConfig(cfg); err != nil {
+		return nil, err
+	}
+	c.configReloadSuccess.Set(1)
+	c.configReloadTime.SetToCurrentTime()
+	if cfg.DiscoveryCIDRs != "" {
+		dc, err := parseDiscoveryConfig(cfg.DiscoveryCIDRs, cfg.DiscoveryPorts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid discovery configuration: %s", err)
+		}
+		c.discovery = dc
+	}
+	if cfg.AgentConfigFile != "" {
+		targets, err := loadAgentTargets(cfg.AgentConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid agent configuration: %s", err)
+		}
+		c.agent.targets = targets
+	}
+	if cfg.DiscoveryKubernetesNode != "" {
+		kd, err := newKubernetesDiscovery(cfg.DiscoveryKubernetesNode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Kubernetes discovery configuration: %s", err)
+		}
+		c.kubernetes = kd
+	}
+	if reg != nil {
+		for _, collector := range append([]prometheus.Collector{c.backoff.gauge, c.configReloadSuccess, c.configReloadTime, c.tlsReloadFailures, c.throttle.waited, c.corruptedPushes, c.resumedPushes, c.rejectedScrapes, c.srvLookupFailures, c.protocolVersion}, append(c.spool.collectors(), c.agent.collectors()...)...) {
+			if err := reg.Register(collector); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// Hands the result of a scrape back to the proxy.
+type pushFunc func(cfg *runtimeConfig, resp *http.Response, request *http.Request) error
+
+func (c *Client) doScrape(request *http.Request, push pushFunc) {
+	// The poll may have waited through a reload.
+	cfg := c.config()
+	logger := log.With(c.logger, "scrape_id", request.Header.Get("id"))
+	ctx, cancel := context.WithTimeout(request.Context(), cfg.ScrapeTimeouts.GetScrapeTimeout(request.Header))
+	defer cancel()
+	request = request.WithContext(ctx)
+	// Checked before anything about the request is changed.
+	unsigned := c.checkSignature(cfg, request)
+
+	// We cannot handle http requests at the proxy, as we would only
+	// see a CONNECT, so use a URL parameter to trigger it. Other parameters,
+	// such as those of multi-target exporters, are passed on untouched.
+	if request.URL.Query().Get("_scheme") == "https" {
+		request.URL.Scheme = "https"
+		request.URL.RawQuery = util.WithoutParams(request.URL.RawQuery, "_scheme")
+	}
+	addScrapeHeaders(request, cfg.Headers)
+
+	var scrapeResp *http.Response
+	var scrapeErr *util.ScrapeError
+	start := time.Now()
+	if unsigned != nil {
+		scrapeErr = unsigned
+	} else if c.agent.serves(cfg, request.URL) {
+		var err error
+		if scrapeResp, err = c.agent.response(request); err != nil {
+			scrapeErr = util.NewScrapeError(fmt.Errorf("failed to serve agent samples: %w", err))
+		}
+	} else if !cfg.targetAllowed(request.URL.Host) {
+		scrapeErr = &util.ScrapeError{Kind: util.ScrapeErrorForbidden, Error: fmt.Sprintf("scraping %s is not allowed", request.URL.Host)}
+	} else if !cfg.allowedMethods[request.Method] {
+		scrapeErr = &util.ScrapeError{Kind: util.ScrapeErrorForbidden, Error: fmt.Sprintf("the %s method is not allowed", request.Method)}
+	} else {
+		if host, ok := cfg.TargetRewrites[request.URL.Host]; ok {
+			level.Debug(logger).Log("msg", "Rewriting target", "target", request.URL.Host, "rewritten_target", host)
+			request.URL.Host = host
+		}
+		var err error
+		scrapeResp, err = c.scrapeWithRetries(ctx, cfg, request)
+		level.Debug(logger).Log("msg", "Scrape of target finished", "duration", time.Since(start))
+		if err != nil {
+			scrapeErr = util.NewScrapeError(fmt.Errorf("failed to scrape %s: %w", request.URL.String(), err))
+		}
+	}
+	if scrapeErr != nil {
+		level.Warn(logger).Log("msg", "Failed to scrape target", "kind", scrapeErr.Kind, "err", scrapeErr.Error)
+		err := push(cfg, scrapeErrorResponse(scrapeErr), request)
+		if err == errPushAbandoned {
+			level.Debug(logger).Log("msg", "Scraper went away before the failed scrape response was pushed")
+			return
+		}
+		if err != nil {
+			c.backoff.failure()
+			level.Warn(logger).Log("msg", "Failed to push failed scrape response", "err", err)
+			return
+		}
+		c.backoff.success()
+		level.Debug(logger).Log("msg", "Pushed failed scrape response", "duration", time.Since(start))
+		return
+	}
+	level.Debug(logger).Log("msg", "Retrieved scrape response", "duration", time.Since(start))
+	scrapeResp.Header.Set(util.FetchTimeHeader, fmt.Sprintf("%f", time.Since(start).Seconds()))
+	level.Debug(logger).Log("msg", "Scrape response headers", "status", scrapeResp.Status, "headers", fmt.Sprint(scrapeResp.Header))
+	if cfg.Timestamps && util.CanAddTimestamps(scrapeResp.Header.Get("Content-Type")) {
+		addTimestamps(scrapeResp, start)
+	}
+	if cfg.labels != nil && util.CanAddLabels(scrapeResp.Header.Get("Content-Type")) {
+		addLabels(scrapeResp, cfg.labels)
+	}
+
+	err := push(cfg, scrapeResp, request)
+	if err == errPushAbandoned {
+		level.Debug(logger).Log("msg", "Scraper went away, stopped pushing scrape result", "duration", time.Since(start))
+		return
+	}
+	if err != nil {
+		c.backoff.failure()
+		level.Warn(logger).Log("msg", "Failed to push scrape response", "err", err)
+		return
+	}
+	c.backoff.success()
+	level.Debug(logger).Log("msg", "Pushed scrape result", "duration", time.Since(start))
+}
+
+// A response to push for a scrape that failed.
+func scrapeErrorResponse(scrapeErr *util.ScrapeError) *http.Response {
+	body, _ := json.Marshal(scrapeErr)
+	resp := &http.Response{
+		StatusCode: 500,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set(util.ScrapeErrorHeader, scrapeErr.Kind)
+	return resp
+}
+
+// Stamp the samples of a scrape with the time it happened, as it's streamed.
+func addTimestamps(resp *http.Response, t time.Time) {
+	util.RewriteBody(resp, func(w io.Writer, r io.Reader) error {
+		return util.AddTimestamps(w, r, t)
+	})
+}
+
+// Add labels to the samples of a scrape, as it's streamed.
+func addLabels(resp *http.Response, el *util.ExtraLabels) {
+	util.RewriteBody(resp, func(w io.Writer, r io.Reader) error {
+		return util.AddLabels(w, r, el)
+	})
+}
+
+var errPushAbandoned = errors.New("the proxy abandoned the push as the scraper went away")
+
+// Report the result of the scrape back up to the proxy it came from, as a
+// delta or in chunks if it accepts them.
+// The proxy checks pushes against their checksum if verifyMaxBytes isn't 0,
+// holding up to that many bytes of each.
+func (c *Client) doPush(cfg *runtimeConfig, resp *http.Response, origRequest *http.Request, proxyURL string, encoding string, delta bool, verifyMaxBytes int64, chunked bool) error {
+	if delta && cfg.PushDelta && resp.Header.Get(util.ScrapeErrorHeader) == "" {
+		return c.pushDelta(cfg, resp, origRequest, proxyURL, encoding)
+	}
+	if chunked && cfg.PushChunkSize > 0 {
+		return c.pushChunked(cfg, resp, origRequest, proxyURL, encoding)
+	}
+	if verifyMaxBytes > 0 {
+		return c.pushVerified(cfg, resp, origRequest, proxyURL, encoding, verifyMaxBytes)
+	}
+	return c.push(cfg, resp, origRequest, proxyURL, encoding, true)
+}
+
+// Push the result, with its checksum in a trailer if checksum is true.
+func (c *Client) push(cfg *runtimeConfig, resp *http.Response, origRequest *http.Request, proxyURL string, encoding string, checksum bool) error {
+	linkResult(resp, origRequest)
+
+	u, _ := url.Parse(proxyURL + util.PathPrefix + "/push")
+
+	// Stream the response up rather than buffering it all in memory, with
+	// the checksum of what was sent in a trailer.
+	pr, pw := io.Pipe()
+	sum := sha256.New()
+	cw, err := util.NewPushWriter(io.MultiWriter(pw, sum), encoding)
+	if err != nil {
+		return err
+	}
+	var trailer http.Header
+	if checksum {
+		trailer = http.Header{util.ContentSHA256Trailer: nil}
+	}
+	// Get the headers to the proxy before waiting on the body, so it can
+	// start answering the scrape.
+	resp.Body = &flushFirst{ReadCloser: resp.Body, w: cw}
+	go func() {
+		// Also stops the scrape if the push is cut short.
+		defer resp.Body.Close()
+		err := resp.Write(cw)
+		if err == nil {
+			err = cw.Close()
+		}
+		if err == nil && trailer != nil {
+			// Read once the body is done with, which closing it signals.
+			trailer.Set(util.ContentSHA256Trailer, hex.EncodeToString(sum.Sum(nil)))
+		}
+		pw.CloseWithError(err)
+	}()
+	request := &http.Request{
+		Method:  "POST",
+		URL:     u,
+		Header:  http.Header{},
+		Body:    &throttledBody{ReadCloser: pr, ctx: origRequest.Context(), t: c.throttle},
+		Trailer: trailer,
+	}
+	if encoding != "" {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+	cfg.setAuthorization(request)
+	request = request.WithContext(origRequest.Context())
+	pushResp, err := cfg.proxyClient.Do(request)
+	if err != nil {
+		return err
+	}
+	pushResp.Body.Close()
+	if pushResp.StatusCode == util.PushAbandonedStatus {
+		return errPushAbandoned
+	}
+	if pushResp.StatusCode == util.DeltaBaseMissingStatus {
+		return errDeltaBaseMissing
+	}
+	if pushResp.StatusCode == util.PushCorruptedStatus {
+		return errPushCorrupted
+	}
+	return nil
+}
+
+// Link the result of a scrape to its request, with the remaining deadline.
+func linkResult(resp *http.Response, origRequest *http.Request) {
+	resp.Header.Set("id", origRequest.Header.Get("id"))
+	deadline, _ := origRequest.Context().Deadline()
+	resp.Header.Set("X-Prometheus-Scrape-Timeout", fmt.Sprintf("%f", float64(time.Until(deadline))/1e9))
+}
+
+// A body that flushes w before it's first read from.
+type flushFirst struct {
+	io.ReadCloser
+	w       util.PushWriter
+	flushed bool
+}
+
+func (f *flushFirst) Read(p []byte) (int, error) {
+	if !f.flushed {
+		f.flushed = true
+		if err := f.w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return f.ReadCloser.Read(p)
+}
+
+// Authenticate a request to the proxy.
+func (rc *runtimeConfig) setAuthorization(request *http.Request) {
+	if rc.bearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+rc.bearerToken)
+	}
+}
+
+// POST to the proxy.
+func (rc *runtimeConfig) post(ctx context.Context, client *http.Client, url, contentType string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	rc.setAuthorization(request)
+	return client.Do(request)
+}
+
+// A poll of the proxy at u, registering the client with it.
+func (rc *runtimeConfig) newPoll(ctx context.Context, u string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", u+util.PathPrefix+"/poll", strings.NewReader(rc.FQDN))
+	if err != nil {
+		return nil, err
+	}
+	if rc.Instance != "" {
+		request.Header.Set(util.InstanceHeader, rc.Instance)
+	}
+	if rc.PollBatchSize > 1 {
+		request.Header.Set(util.BatchSizeHeader, strconv.Itoa(rc.PollBatchSize))
+	}
+	request.Header.Set(util.ProtocolVersionHeader, strconv.Itoa(util.ProtocolVersion))
+	if len(rc.Labels) > 0 {
+		labels := url.Values{}
+		for name, value := range rc.Labels {
+			labels.Set(name, value)
+		}
+		request.Header.Set(util.LabelsHeader, labels.Encode())
+	}
+	rc.setAuthorization(request)
+	return request, nil
+}
+
+// Poll one of proxies for a scrape and start it, backing off with b on failure.
+// Polls count towards the client being ready if health is given.
+func (c *Client) poll(proxies *proxySelector, b *backoff, health *pollHealth) {
+	cfg := c.config()
+	// A full proxy redirects new clients to another one, which we then stick with.
+	pollClient := &http.Client{
+		Transport: cfg.proxyClient.Transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	// Don't pound the proxy if it's having trouble.
+	b.wait()
+	proxyURL := proxies.get()
+	pollCtx, cancel := proxies.context(c.ctx)
+	defer cancel()
+	ctx, done := pollCtx, func(bool) {}
+	if health != nil {
+		ctx, done = health.trace(ctx)
+	}
+	pollRequest, err := cfg.newPoll(ctx, proxyURL)
+	if err != nil {
+		done(false)
+		level.Error(c.logger).Log("msg", "Error creating poll", "proxy_url", proxyURL, "err", err)
+		b.failure()
+		return
+	}
+	resp, err := pollClient.Do(pollRequest)
+	if err != nil && pollCtx.Err() != nil {
+		// Stopped, or moved to another proxy.
+		done(false)
+		return
+	}
+	if err != nil {
+		done(false)
+		level.Info(c.logger).Log("msg", "Error polling", "proxy_url", proxyURL, "err", err)
+		proxies.failed(proxyURL)
+		b.failure()
+		return
+	}
+	defer resp.Body.Close()
+	done(resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent)
+	if resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusPermanentRedirect {
+		loc, err := resp.Location()
+		if err != nil {
+			level.Info(c.logger).Log("msg", "Error following redirect from proxy", "err", err)
+			b.failure()
+			return
+		}
+		// Older proxies redirect to the poll path without the prefix.
+		newUrl := strings.TrimSuffix(strings.TrimSuffix(loc.String(), "/poll"), util.PathPrefix)
+		level.Info(c.logger).Log("msg", "Redirected to another proxy", "proxy_url", newUrl)
+		proxies.redirectTo(newUrl)
+		return
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		// The proxy had nothing for us within its maximum poll duration.
+		b.success()
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		level.Info(c.logger).Log("msg", "Error polling", "proxy_url", proxyURL, "status", resp.Status)
+		b.failure()
+		return
+	}
+	b.success()
+	c.noteProtocol(proxyURL, util.ParseProtocolVersion(resp.Header.Get(util.ProtocolVersionHeader)))
+	if control := resp.Header.Get(util.ControlHeader); control != "" {
+		c.handleControl(control)
+		return
+	}
+	// Proxies asked for batches say how many scrapes they sent.
+	n := 1
+	if s := resp.Header.Get(util.BatchSizeHeader); s != "" {
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			level.Warn(c.logger).Log("msg", "Invalid batch size from proxy", "proxy_url", proxyURL, "batch_size", s)
+			return
+		}
+	}
+	br := bufio.NewReader(resp.Body)
+	requests := make([]*http.Request, 0, n)
+	for len(requests) < n {
+		request, err := http.ReadRequest(br)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Error reading scrape request", "proxy_url", proxyURL, "err", err)
+			break
+		}
+		// The body of a POST or the like has to be read before the poll is
+		// done with.
+		if err := keepBody(request); err != nil {
+			level.Warn(c.logger).Log("msg", "Error reading scrape request body", "proxy_url", proxyURL, "err", err)
+			break
+		}
+		level.Debug(c.logger).Log("msg", "Got scrape request", "scrape_id", request.Header.Get("id"), "url", request.URL.String())
+		level.Debug(c.logger).Log("msg", "Scrape request headers", "scrape_id", request.Header.Get("id"), "headers", fmt.Sprint(request.Header))
+		request.RequestURI = ""
+		requests = append(requests, request)
+	}
+
+	encoding := util.NegotiatePushEncoding(cfg.PushCompression, resp.Header.Get(util.AcceptEncodingHeader))
+	delta := resp.Header.Get(util.AcceptDeltaHeader) != ""
+	verifyMaxBytes := util.VerifyChecksumMaxBytes(resp.Header.Get(util.VerifyChecksumHeader))
+	chunked := resp.Header.Get(util.AcceptChunksHeader) != ""
+	push := func(cfg *runtimeConfig, resp *http.Response, request *http.Request) error {
+		return c.doPush(cfg, resp, request, proxyURL, encoding, delta, verifyMaxBytes, chunked)
+	}
+	// Results of a batch go back together, unless they need pushing in a
+	// way of their own.
+	if len(requests) > 1 && verifyMaxBytes == 0 && !(chunked && cfg.PushChunkSize > 0) && !(delta && cfg.PushDelta) {
+		push = c.newBatchPush(cfg, proxyURL, encoding, len(requests)).push
+	}
+	for _, request := range requests {
+		request := request
+		c.scrapes.Add(1)
+		go func() {
+			defer c.scrapes.Done()
+			c.doScrape(request, push)
+		}()
+	}
+}
+
+// Note the version of the protocol the proxy answered in. Proxies only
+// answer in versions the client speaks, so this is for knowing how far a
+// rollout has got.
+func (c *Client) noteProtocol(proxyURL string, version int) {
+	if old := atomic.SwapInt32(&c.protocol, int32(version)); int(old) != version {
+		level.Info(c.logger).Log("msg", "Proxy speaks protocol version", "proxy_url", proxyURL, "version", version, "client_version", util.ProtocolVersion)
+		c.protocolVersion.Set(float64(version))
+	}
+}
+
+// Read the body of a scrape request into memory, so it can be retried.
+func keepBody(request *http.Request) error {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		request.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return nil
+}
+
+// Act on a control message from the proxy.
+func (c *Client) handleControl(control string) {
+	command, args := util.ParseControl(control)
+	switch command {
+	case util.ControlDebug:
+		if len(args) != 1 {
+			level.Warn(c.logger).Log("msg", "Ignoring malformed debug control message", "control", control)
+			return
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Ignoring malformed debug control message", "control", control, "err", err)
+			return
+		}
+		c.enableDebug(d)
+	case util.ControlTunnel:
+		if len(args) != 2 {
+			level.Warn(c.logger).Log("msg", "Ignoring malformed tunnel control message", "control", control)
+			return
+		}
+		go c.openTunnel(args[0], args[1])
+	case util.ControlRestart:
+		level.Info(c.logger).Log("msg", "Restarting as instructed by proxy, waiting for scrapes in progress")
+		c.scrapes.Wait()
+		if err := restart(); err != nil {
+			level.Error(c.logger).Log("msg", "Error restarting", "err", err)
+		}
+	default:
+		level.Warn(c.logger).Log("msg", "Ignoring unknown control message from proxy", "control", control)
+	}
+}
+
+// Poll the proxies for scrapes and perform them, until stopped.
+func (c *Client) Run() {
+	if len(c.proxies.urls) > 1 || c.config().ProxySRV != "" {
+		go c.proxies.probe(c.ctx, c.config().ProxyProbeInterval, func() http.RoundTripper { return c.config().proxyClient.Transport })
+	}
+	if cfg := c.config(); cfg.ProxySRV != "" {
+		go c.runProxySRV(cfg.ProxySRV, cfg.ProxySRVScheme, cfg.ProxySRVRefresh)
+	}
+	level.Info(c.logger).Log("msg", "Starting client", "fqdn", c.config().FQDN, "proxy_url", c.proxies.get())
+	go c.watchTLS()
+	if c.discovery != nil {
+		go c.runDiscovery(c.discovery)
+	}
+	if c.kubernetes != nil {
+		go c.runKubernetesDiscovery(c.kubernetes)
+	}
+	if u := c.config().MigrationProxyURL; u != "" {
+		go c.runMigration(u, c.config().MigrationAcceptScrapes)
+	}
+	if len(c.config().pushModeTargets) > 0 {
+		go c.runPushMode()
+	}
+	if len(c.agent.targets) > 0 {
+		go c.runAgent()
+	}
+	if u := c.config().NATSURL; u != "" {
+		c.runNATS(u)
+	}
+	for c.ctx.Err() == nil {
+		c.health.beat()
+		c.poll(c.proxies, c.backoff, &c.health)
+	}
+}
+
+// Stop polling, cutting short polls waiting on proxies, so Run returns, and
+// stop discovery, push mode and other background work. Scrapes already
+// picked up carry on.
+func (c *Client) Stop() {
+	c.stop()
+}
+
+// Wait for d, returning false if the client is stopped first, so background
+// loops end with it.
+func (c *Client) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-c.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
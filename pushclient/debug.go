@@ -0,0 +1,55 @@
+package pushclient
+
+import (
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/promlog"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Log verbosely for a while, as asked for by the proxy. Asking again
+// extends or shortens the period.
+func (c *Client) enableDebug(d time.Duration) {
+	setter, ok := c.logger.(util.LevelSetter)
+	if !ok {
+		level.Warn(c.logger).Log("msg", "Can't enable debug logging, the logger's level is fixed")
+		return
+	}
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+	if c.debugTimer != nil {
+		c.debugTimer.Stop()
+	}
+	var debug promlog.AllowedLevel
+	debug.Set("debug")
+	setter.SetLevel(&debug)
+	level.Info(c.logger).Log("msg", "Debug logging enabled by proxy", "duration", d)
+	c.debugTimer = time.AfterFunc(d, func() {
+		c.debugMu.Lock()
+		c.debugTimer = nil
+		c.debugMu.Unlock()
+		c.applyLogLevel()
+		level.Info(c.logger).Log("msg", "Debug logging expired")
+	})
+}
+
+// Log at the configured level, or info if none is, unless the proxy asked
+// for debug logging.
+func (c *Client) applyLogLevel() {
+	setter, ok := c.logger.(util.LevelSetter)
+	if !ok {
+		return
+	}
+	c.debugMu.Lock()
+	defer c.debugMu.Unlock()
+	if c.debugTimer != nil {
+		return
+	}
+	lvl := c.config().LogLevel
+	if lvl.String() == "" {
+		lvl.Set("info")
+	}
+	setter.SetLevel(&lvl)
+}
@@ -0,0 +1,100 @@
+package pushclient
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// How long to keep the last result of a target that's no longer scraped.
+const deltaBaseRetention = time.Hour
+
+var errDeltaBaseMissing = errors.New("the proxy doesn't have the result the delta is against")
+
+// The last result of each target a proxy acknowledged, to push deltas
+// against.
+type deltaBases struct {
+	mu    sync.Mutex
+	bases map[string]*deltaBase
+}
+
+type deltaBase struct {
+	hash string
+	body []byte
+	used time.Time
+}
+
+func newDeltaBases() *deltaBases {
+	return &deltaBases{bases: map[string]*deltaBase{}}
+}
+
+func (d *deltaBases) get(key string) (*deltaBase, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.bases[key]
+	return b, ok
+}
+
+func (d *deltaBases) set(key string, body []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for k, b := range d.bases {
+		if now.Sub(b.used) > deltaBaseRetention {
+			delete(d.bases, k)
+		}
+	}
+	d.bases[key] = &deltaBase{hash: util.DeltaHash(body), body: body, used: now}
+}
+
+func (d *deltaBases) forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.bases, key)
+}
+
+// Push the result of a scrape as a delta against the last one of the target
+// the proxy acknowledged, or whole if there isn't one or the proxy no longer
+// has it.
+func (c *Client) pushDelta(cfg *runtimeConfig, resp *http.Response, origRequest *http.Request, proxyURL string, encoding string) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	withBody := func(b []byte) *http.Response {
+		r := *resp
+		r.Header = resp.Header.Clone()
+		r.Header.Set(util.DeltaKeepHeader, "1")
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		r.ContentLength = int64(len(b))
+		r.TransferEncoding = nil
+		return &r
+	}
+	whole := func() *http.Response { return withBody(body) }
+	key := proxyURL + " " + origRequest.URL.String()
+	next := whole
+	if base, ok := c.deltas.get(key); ok {
+		if delta := util.Delta(base.body, body); len(delta) < len(body) {
+			next = func() *http.Response {
+				r := withBody(delta)
+				r.Header.Set(util.DeltaBaseHeader, base.hash)
+				return r
+			}
+		}
+	}
+	err = c.pushAgainIfCorrupted(cfg, next, origRequest, proxyURL, encoding)
+	if err == errDeltaBaseMissing {
+		c.deltas.forget(key)
+		err = c.pushAgainIfCorrupted(cfg, whole, origRequest, proxyURL, encoding)
+	}
+	if err == nil {
+		c.deltas.set(key, body)
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package pushclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Don't scan more than a /20 per CIDR.
+const maxDiscoveryHosts = 4096
+
+type discoveryConfig struct {
+	networks []*net.IPNet
+	ports    []int
+}
+
+func parseDiscoveryConfig(cidrs, ports string) (*discoveryConfig, error) {
+	dc := &discoveryConfig{}
+	for _, s := range strings.Split(cidrs, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones > 12 {
+			return nil, fmt.Errorf("CIDR %s has more than %d addresses", network, maxDiscoveryHosts)
+		}
+		dc.networks = append(dc.networks, network)
+	}
+	for _, s := range strings.Split(ports, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %s", s, err)
+		}
+		dc.ports = append(dc.ports, port)
+	}
+	return dc, nil
+}
+
+func (dc *discoveryConfig) contains(ip net.IP) bool {
+	for _, n := range dc.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Neighbours in the kernel's ARP table, which saves probing every address.
+// Empty if the table isn't available.
+func arpNeighbours(dc *discoveryConfig) []net.IP {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	ips := []net.IP{}
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip the header.
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] == "00:00:00:00:00:00" {
+			continue
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil && dc.contains(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// Every address in the configured networks.
+func allAddresses(dc *discoveryConfig) []net.IP {
+	ips := []net.IP{}
+	for _, n := range dc.networks {
+		for ip := n.IP.Mask(n.Mask); n.Contains(ip); ip = nextIP(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Whether something that looks like an exporter is at the address.
+func probeExporter(client *http.Client, hostport string) bool {
+	conn, err := net.DialTimeout("tcp", hostport, 500*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	resp, err := client.Get("http://" + hostport + "/metrics")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// Look for exporters on neighbouring hosts, returning their host:ports.
+func discoverExporters(dc *discoveryConfig) []string {
+	ips := arpNeighbours(dc)
+	if len(ips) == 0 {
+		ips = allAddresses(dc)
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	var (
+		mtx   sync.Mutex
+		found = []string{}
+		wg    sync.WaitGroup
+		sem   = make(chan struct{}, 64)
+	)
+	for _, ip := range ips {
+		for _, port := range dc.ports {
+			hostport := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if probeExporter(client, hostport) {
+					mtx.Lock()
+					found = append(found, hostport)
+					mtx.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	sort.Strings(found)
+	return found
+}
+
+// Tell the proxy about discovered exporters, which an operator has to approve
+// before they can be scraped, and any labels for them. If complete, they're
+// all there are and the proxy forgets the others.
+func (c *Client) advertiseExporters(targets []string, labels map[string]map[string]string, complete bool) error {
+	cfg := c.config()
+	body, err := json.Marshal(struct {
+		FQDN     string                       `json:"fqdn"`
+		Targets  []string                     `json:"targets"`
+		Labels   map[string]map[string]string `json:"labels,omitempty"`
+		Complete bool                         `json:"complete,omitempty"`
+	}{FQDN: cfg.FQDN, Targets: targets, Labels: labels, Complete: complete})
+	if err != nil {
+		return err
+	}
+	resp, err := cfg.post(context.Background(), cfg.proxyClient, c.proxies.get()+util.PathPrefix+"/discovery", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *Client) runDiscovery(dc *discoveryConfig) {
+	for {
+		targets := discoverExporters(dc)
+		logger := log.With(c.logger, "target_count", len(targets))
+		if err := c.advertiseExporters(targets, nil, false); err != nil {
+			level.Warn(logger).Log("msg", "Error advertising discovered exporters", "err", err)
+		} else {
+			level.Info(logger).Log("msg", "Advertised discovered exporters")
+		}
+		if !c.sleep(c.config().DiscoveryInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package pushclient
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Which proxy to talk to. Proxies are given in order of preference; we fail
+// over to the next one when the current one is unreachable, and go back to
+// a more preferred one once it's reachable again.
+type proxySelector struct {
+	logger log.Logger
+
+	mu   sync.Mutex
+	urls []string
+	// Index into urls of the proxy in use.
+	current int
+	// A proxy we were redirected to, which takes precedence until it fails.
+	redirect string
+	// Closed when the proxies are replaced and the one in use is gone.
+	moved chan struct{}
+}
+
+func newProxySelector(urls string, logger log.Logger) *proxySelector {
+	ps := &proxySelector{logger: logger}
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+			ps.urls = append(ps.urls, u)
+		}
+	}
+	return ps
+}
+
+func (ps *proxySelector) get() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.redirect != "" {
+		return ps.redirect
+	}
+	return ps.urls[ps.current]
+}
+
+// Use a proxy we were redirected to.
+func (ps *proxySelector) redirectTo(u string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.redirect = strings.TrimRight(u, "/")
+}
+
+// The proxy at u couldn't be reached, move on to the next.
+func (ps *proxySelector) failed(u string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.redirect != "" {
+		if ps.redirect == u {
+			level.Info(ps.logger).Log("msg", "Proxy we were redirected to is unreachable, going back to configured proxies", "proxy_url", u)
+			ps.redirect = ""
+		}
+		return
+	}
+	if len(ps.urls) == 1 || ps.urls[ps.current] != u {
+		return
+	}
+	ps.current = (ps.current + 1) % len(ps.urls)
+	level.Info(ps.logger).Log("msg", "Failing over to next proxy", "proxy_url", ps.urls[ps.current], "failed_proxy_url", u)
+}
+
+// Whether a proxy responds at all.
+func probeProxy(client *http.Client, u string) bool {
+	resp, err := client.Get(u + "/")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
+
+// Periodically go back to the most preferred reachable proxy, talking to
+// them through the current transport, until ctx is done.
+func (ps *proxySelector) probe(ctx context.Context, interval time.Duration, transport func() http.RoundTripper) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		client := &http.Client{Timeout: 5 * time.Second, Transport: transport()}
+		ps.mu.Lock()
+		preferred := append([]string{}, ps.urls[:ps.current]...)
+		ps.mu.Unlock()
+		for _, u := range preferred {
+			if !probeProxy(client, u) {
+				continue
+			}
+			ps.switchBackTo(u)
+			break
+		}
+	}
+}
+
+// Go back to the proxy at u, if it's still more preferred than the one in
+// use. The proxies may have been replaced while it was probed.
+func (ps *proxySelector) switchBackTo(u string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for i, known := range ps.urls[:ps.current] {
+		if known == u {
+			ps.current = i
+			level.Info(ps.logger).Log("msg", "More preferred proxy is reachable again, switching back", "proxy_url", u)
+			return
+		}
+	}
+}
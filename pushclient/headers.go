@@ -0,0 +1,74 @@
+package pushclient
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A header to add to scrapes of a target, or all targets if Target is empty.
+type TargetHeader struct {
+	Target string `yaml:"target"`
+	Name   string `yaml:"name"`
+	Value  string `yaml:"value"`
+}
+
+// Repeatable flag of headers, as [<host:port>=]<name>: <value>.
+type targetHeaderFlag []TargetHeader
+
+func (f *targetHeaderFlag) String() string {
+	s := make([]string, 0, len(*f))
+	for _, h := range *f {
+		if h.Target != "" {
+			s = append(s, h.Target+"="+h.Name+": <hidden>")
+		} else {
+			s = append(s, h.Name+": <hidden>")
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+// Lets kingpin know the flag can be repeated.
+func (f *targetHeaderFlag) IsCumulative() bool {
+	return true
+}
+
+func (f *targetHeaderFlag) Set(v string) error {
+	h, err := ParseTargetHeader(v)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, h)
+	return nil
+}
+
+// Parse a header given as [<host:port>=]<name>: <value>.
+func ParseTargetHeader(v string) (TargetHeader, error) {
+	h := TargetHeader{}
+	if i := strings.Index(v, "="); i > 0 {
+		if _, port, err := net.SplitHostPort(v[:i]); err == nil {
+			if _, err := strconv.Atoi(port); err == nil {
+				h.Target = v[:i]
+				v = v[i+1:]
+			}
+		}
+	}
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return h, fmt.Errorf("header %q must be of the form '<name>: <value>'", v)
+	}
+	h.Name = http.CanonicalHeaderKey(strings.TrimSpace(v[:i]))
+	h.Value = strings.TrimSpace(v[i+1:])
+	return h, nil
+}
+
+// Add the configured headers for the target to a scrape request.
+func addScrapeHeaders(request *http.Request, headers []TargetHeader) {
+	for _, h := range headers {
+		if h.Target == "" || h.Target == request.URL.Host {
+			request.Header.Set(h.Name, h.Value)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package pushclient
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Whether the client is in touch with a proxy.
+type pollHealth struct {
+	mu sync.Mutex
+	// Polls that have reached the proxy and are waiting on it.
+	polling int
+	// When a poll last got a response.
+	lastPoll time.Time
+	// When the poll loop last went round or heard back from a poll.
+	lastLoop time.Time
+}
+
+// How long the poll loop may go beyond backing off without going round or
+// hearing back from a poll, such as while connecting, before it's wedged.
+const pollStallSlack = time.Minute
+
+// Note the poll loop going round.
+func (h *pollHealth) beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastLoop = time.Now()
+}
+
+// Track a poll made with the returned context, until done is called.
+func (h *pollHealth) trace(ctx context.Context) (traced context.Context, done func(ok bool)) {
+	reached := false
+	traced = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				return
+			}
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			reached = true
+			h.polling++
+		},
+	})
+	return traced, func(ok bool) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if reached {
+			h.polling--
+		}
+		h.lastLoop = time.Now()
+		if ok {
+			h.lastPoll = time.Now()
+		}
+	}
+}
+
+// Whether a poll is waiting on a proxy, or one got a response within maxAge.
+func (h *pollHealth) ready(maxAge time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.polling > 0 || (!h.lastPoll.IsZero() && time.Since(h.lastPoll) <= maxAge)
+}
+
+// Whether a poll is waiting on a proxy, or the poll loop went round within
+// maxStall.
+func (h *pollHealth) alive(maxStall time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.polling > 0 || time.Since(h.lastLoop) <= maxStall
+}
+
+// Whether the poll loop is getting on with polling, whether or not the proxy
+// answers, rather than wedged.
+func (c *Client) Alive() bool {
+	return c.health.alive(c.config().BackoffMax + pollStallSlack)
+}
+
+// Whether the client is polling a proxy successfully, so it can be scraped
+// through it.
+func (c *Client) Ready() bool {
+	return c.health.ready(c.config().ReadyMaxPollAge)
+}
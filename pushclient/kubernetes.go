@@ -0,0 +1,143 @@
+package pushclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Where Kubernetes mounts the credentials of a pod's service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// The parts of a pod that say whether and where it has an exporter.
+type kubernetesPod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// Talks to the API server of the cluster the client runs in, as its service
+// account.
+type kubernetesDiscovery struct {
+	node   string
+	apiURL string
+	client *http.Client
+}
+
+func newKubernetesDiscovery(node string) (*kubernetesDiscovery, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the service account's ca.crt")
+	}
+	return &kubernetesDiscovery{
+		node:   node,
+		apiURL: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// The exporters of running pods on the node with a prometheus.io/scrape
+// annotation of "true", by host:port from their prometheus.io/port
+// annotation, with their labels.
+func (kd *kubernetesDiscovery) discover() ([]string, map[string]map[string]string, error) {
+	// The token is rotated, so it's read each time.
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, nil, err
+	}
+	u := kd.apiURL + "/api/v1/pods?fieldSelector=" + url.QueryEscape("spec.nodeName="+kd.node)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := kd.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status listing pods %s", resp.Status)
+	}
+	var pods struct {
+		Items []kubernetesPod `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, nil, err
+	}
+	targets := []string{}
+	labels := map[string]map[string]string{}
+	for _, pod := range pods.Items {
+		a := pod.Metadata.Annotations
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" || a["prometheus.io/scrape"] != "true" {
+			continue
+		}
+		port, err := strconv.Atoi(a["prometheus.io/port"])
+		if err != nil {
+			continue
+		}
+		target := net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port))
+		targets = append(targets, target)
+		labels[target] = map[string]string{
+			"kubernetes_namespace": pod.Metadata.Namespace,
+			"kubernetes_pod":       pod.Metadata.Name,
+			"kubernetes_node":      kd.node,
+		}
+		if path := a["prometheus.io/path"]; path != "" {
+			labels[target]["metrics_path"] = path
+		}
+	}
+	sort.Strings(targets)
+	return targets, labels, nil
+}
+
+func (c *Client) runKubernetesDiscovery(kd *kubernetesDiscovery) {
+	// Pods come and go, so the proxy forgets the ones no longer there, unless
+	// exporters on neighbouring hosts are advertised too.
+	complete := c.discovery == nil
+	for {
+		targets, labels, err := kd.discover()
+		logger := log.With(c.logger, "node", kd.node, "target_count", len(targets))
+		if err != nil {
+			level.Warn(logger).Log("msg", "Error discovering pods", "err", err)
+		} else if err := c.advertiseExporters(targets, labels, complete); err != nil {
+			level.Warn(logger).Log("msg", "Error advertising discovered pods", "err", err)
+		} else {
+			level.Info(logger).Log("msg", "Advertised discovered pods")
+		}
+		if !c.sleep(c.config().DiscoveryInterval) {
+			return
+		}
+	}
+}
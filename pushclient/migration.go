@@ -0,0 +1,63 @@
+package pushclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// How often to register with the proxy being migrated to, well within its
+// registration timeout.
+const migrationRegisterInterval = time.Minute
+
+// Register with the proxy being migrated to, to mirror the registration with
+// the usual proxies so it knows of the client before the switch. With
+// acceptScrapes it's polled for scrapes as well, so the client can be
+// scraped through both while Prometheus is moved over.
+func (c *Client) runMigration(u string, acceptScrapes bool) {
+	level.Info(c.logger).Log("msg", "Registering with proxy being migrated to", "proxy_url", u, "accept_scrapes", acceptScrapes)
+	if acceptScrapes {
+		cfg := c.config()
+		proxies := newProxySelector(u, c.logger)
+		b := newBackoff(cfg.BackoffMin, cfg.BackoffMax)
+		for c.ctx.Err() == nil {
+			c.poll(proxies, b, nil)
+		}
+		return
+	}
+	for {
+		if err := c.registerWith(strings.TrimRight(u, "/")); err != nil {
+			level.Info(c.logger).Log("msg", "Error registering with proxy being migrated to", "proxy_url", u, "err", err)
+		}
+		if !c.sleep(migrationRegisterInterval) {
+			return
+		}
+	}
+}
+
+// Register with the proxy at u without waiting for a scrape.
+func (c *Client) registerWith(u string) error {
+	cfg := c.config()
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	defer cancel()
+	request, err := cfg.newPoll(ctx, u)
+	if err != nil {
+		return err
+	}
+	request.Header.Set(util.RegisterOnlyHeader, "true")
+	resp, err := cfg.proxyClient.Do(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
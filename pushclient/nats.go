@@ -0,0 +1,135 @@
+package pushclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// How often to tell the proxy the client is there over NATS.
+const natsRegisterInterval = 10 * time.Second
+
+// Take scrapes from the NATS server at u rather than polling the proxy, until
+// the client is stopped.
+func (c *Client) runNATS(u string) {
+	logger := log.With(c.logger, "fqdn", c.config().FQDN)
+	for {
+		c.health.beat()
+		c.backoff.wait()
+		if c.ctx.Err() != nil {
+			return
+		}
+		conn, err := util.DialNATS(u, c.config().dialer(10*time.Second), c.config().NATSCAFile)
+		if err != nil {
+			level.Info(logger).Log("msg", "Error connecting to NATS server", "err", err)
+			c.backoff.failure()
+			continue
+		}
+		c.backoff.success()
+		level.Info(logger).Log("msg", "Connected to NATS server")
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-c.ctx.Done():
+				conn.Close()
+			case <-done:
+			}
+		}()
+		err = c.serveNATS(conn)
+		close(done)
+		conn.Close()
+		if c.ctx.Err() != nil {
+			return
+		}
+		level.Info(logger).Log("msg", "Lost connection to NATS server", "err", err)
+		c.backoff.failure()
+	}
+}
+
+func (c *Client) serveNATS(conn *util.NATSConn) error {
+	fqdn := c.config().FQDN
+	if !util.IsNATSSubjectToken(fqdn) {
+		return fmt.Errorf("FQDN %q can't be used in a NATS subject", fqdn)
+	}
+	err := conn.Subscribe(util.NATSScrapeSubject+fqdn, func(m util.NATSMsg) {
+		if m.Reply == "" {
+			return
+		}
+		c.scrapes.Add(1)
+		go func() {
+			defer c.scrapes.Done()
+			c.natsScrape(conn, m)
+		}()
+	})
+	if err != nil {
+		return err
+	}
+	if err := conn.Subscribe(util.NATSControlSubject+fqdn, func(m util.NATSMsg) { go c.handleControl(string(m.Data)) }); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			if err := conn.Publish(util.NATSRegisterSubject, "", []byte(fqdn)); err != nil {
+				return
+			}
+			// This takes the place of the poll loop.
+			c.health.beat()
+			timer := time.NewTimer(natsRegisterInterval)
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+	return conn.Run()
+}
+
+// Perform a scrape published to the client, publishing the result to the
+// reply subject of the scrape.
+func (c *Client) natsScrape(conn *util.NATSConn, m util.NATSMsg) {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(m.Data)))
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Error reading scrape request from NATS", "err", err)
+		return
+	}
+	if err := keepBody(request); err != nil {
+		level.Warn(c.logger).Log("msg", "Error reading scrape request body from NATS", "err", err)
+		return
+	}
+	level.Debug(c.logger).Log("msg", "Got scrape request over NATS", "scrape_id", request.Header.Get("id"), "url", request.URL.String())
+	request.RequestURI = ""
+	c.doScrape(request, func(cfg *runtimeConfig, resp *http.Response, request *http.Request) error {
+		linkResult(resp, request)
+		var buf bytes.Buffer
+		err := resp.Write(&buf)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if max := conn.MaxPayload(); max > 0 && buf.Len() > max {
+			// Tell the proxy rather than leaving the scrape to time out.
+			scrapeErr := &util.ScrapeError{Kind: util.ScrapeErrorOther, Error: fmt.Sprintf("scrape result of %d bytes is over the NATS server's maximum payload of %d bytes", buf.Len(), max)}
+			buf.Reset()
+			resp := scrapeErrorResponse(scrapeErr)
+			linkResult(resp, request)
+			if err := resp.Write(&buf); err != nil {
+				return err
+			}
+		}
+		if err := c.throttle.wait(request.Context(), buf.Len()); err != nil {
+			return err
+		}
+		return conn.Publish(m.Reply, "", buf.Bytes())
+	})
+}
@@ -0,0 +1,110 @@
+package pushclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// The results of a batch of scrapes from one poll, pushed to the proxy one
+// after another in one request as each is ready.
+type batchPush struct {
+	c *Client
+
+	mu sync.Mutex
+	pw *io.PipeWriter
+	w  util.PushWriter
+	// Results still to be written.
+	remaining int
+	// The first error writing the batch, after which nothing more is.
+	err error
+	// Gets the outcome of the request once the proxy has answered it.
+	done chan error
+}
+
+// Start pushing a batch of n results to the proxy, sending them as they're
+// handed to push.
+func (c *Client) newBatchPush(cfg *runtimeConfig, proxyURL string, encoding string, n int) *batchPush {
+	pr, pw := io.Pipe()
+	b := &batchPush{c: c, pw: pw, remaining: n, done: make(chan error, 1)}
+	if b.w, b.err = util.NewPushWriter(pw, encoding); b.err != nil {
+		b.done <- b.err
+		return b
+	}
+	go func() {
+		err := c.sendBatch(cfg, proxyURL, encoding, pr)
+		// Writing to the batch fails from now on if it didn't all go.
+		pr.CloseWithError(fmt.Errorf("batch push ended: %v", err))
+		b.done <- err
+	}()
+	return b
+}
+
+func (c *Client) sendBatch(cfg *runtimeConfig, proxyURL string, encoding string, body io.ReadCloser) error {
+	request, err := http.NewRequest("POST", proxyURL+util.PathPrefix+"/push-batch", &throttledBody{ReadCloser: body, ctx: context.Background(), t: c.throttle})
+	if err != nil {
+		return err
+	}
+	if encoding != "" {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+	cfg.setAuthorization(request)
+	resp, err := cfg.proxyClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pushing batch returned HTTP status %s", resp.Status)
+	}
+	var outcomes map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&outcomes); err != nil {
+		return fmt.Errorf("error reading response to batch push: %s", err)
+	}
+	for id, outcome := range outcomes {
+		if outcome != "ok" {
+			level.Debug(c.logger).Log("msg", "Result in batch push was dropped by the proxy", "scrape_id", id, "reason", outcome)
+		}
+	}
+	return nil
+}
+
+// Add a result to the batch. Once it's the last, the batch is finished and
+// the outcome of the whole push returned.
+func (b *batchPush) push(cfg *runtimeConfig, resp *http.Response, origRequest *http.Request) error {
+	linkResult(resp, origRequest)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// The end of each result has to be marked for the next to be found.
+	if resp.ContentLength < 0 {
+		resp.TransferEncoding = []string{"chunked"}
+		resp.Close = false
+	}
+	if b.err == nil {
+		b.err = resp.Write(b.w)
+		if b.err == nil {
+			b.err = b.w.Flush()
+		}
+	}
+	// Also stops the scrape if the push was cut short.
+	resp.Body.Close()
+	err := b.err
+	if b.remaining--; b.remaining > 0 {
+		return err
+	}
+	if b.err == nil {
+		b.err = b.w.Close()
+	}
+	b.pw.CloseWithError(b.err)
+	if doneErr := <-b.done; err == nil {
+		err = doneErr
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package pushclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// How long to wait before sending a chunk again after the proxy couldn't
+// take it, such as while it's still reading the one that broke.
+const chunkRetryInterval = time.Second
+
+var errChunksRefused = errors.New("the proxy has no room for the push in chunks")
+
+// Push a result to a proxy in chunks, holding on to it so a chunk cut short
+// can be carried on from where the proxy got to. If the proxy has no room
+// for it, it's pushed whole.
+func (c *Client) pushChunked(cfg *runtimeConfig, resp *http.Response, origRequest *http.Request, proxyURL string, encoding string) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	next := bufferedResponse(resp, body)
+	for i := 0; ; i++ {
+		err := c.pushInChunks(cfg, next(), origRequest, proxyURL, encoding)
+		if err == errChunksRefused {
+			level.Debug(c.logger).Log("msg", "Pushing whole as the proxy has no room for chunks", "scrape_id", origRequest.Header.Get("id"), "proxy_url", proxyURL)
+			return c.push(cfg, next(), origRequest, proxyURL, encoding, true)
+		}
+		if err != errPushCorrupted {
+			return err
+		}
+		c.corruptedPushes.Inc()
+		if i == corruptedPushRetries {
+			return err
+		}
+		level.Info(c.logger).Log("msg", "Pushing again as the proxy got the push corrupted", "scrape_id", origRequest.Header.Get("id"), "proxy_url", proxyURL)
+	}
+}
+
+func (c *Client) pushInChunks(cfg *runtimeConfig, resp *http.Response, origRequest *http.Request, proxyURL string, encoding string) error {
+	linkResult(resp, origRequest)
+	var wire bytes.Buffer
+	cw, err := util.NewPushWriter(&wire, encoding)
+	if err != nil {
+		return err
+	}
+	err = resp.Write(cw)
+	resp.Body.Close()
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		return err
+	}
+	data := wire.Bytes()
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	ctx := origRequest.Context()
+	id := origRequest.Header.Get("id")
+	chunkURL := proxyURL + util.PathPrefix + "/push-chunk?id=" + url.QueryEscape(id)
+	offset := 0
+	for {
+		end := offset + cfg.PushChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		request, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s&offset=%d&total=%d", chunkURL, offset, len(data)), nil)
+		if err != nil {
+			return err
+		}
+		request.Body = &throttledBody{ReadCloser: ioutil.NopCloser(bytes.NewReader(data[offset:end])), ctx: ctx, t: c.throttle}
+		request.ContentLength = int64(end - offset)
+		if encoding != "" {
+			request.Header.Set("Content-Encoding", encoding)
+		}
+		request.Header.Set(util.ContentSHA256Trailer, checksum)
+		cfg.setAuthorization(request)
+		pushResp, err := cfg.proxyClient.Do(request)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			level.Debug(c.logger).Log("msg", "Chunk of push cut short, finding out how much the proxy got", "scrape_id", id, "offset", offset, "err", err)
+			if offset, err = c.pushedOffset(cfg, chunkURL, origRequest); err != nil {
+				return err
+			}
+			c.resumedPushes.Inc()
+			continue
+		}
+		pushResp.Body.Close()
+		switch pushResp.StatusCode {
+		case http.StatusNoContent, http.StatusConflict:
+			got, err := strconv.Atoi(pushResp.Header.Get(util.PushOffsetHeader))
+			if err != nil {
+				return fmt.Errorf("proxy did not say how much of the push it got: %s", err)
+			}
+			if pushResp.StatusCode == http.StatusConflict && got == offset {
+				if err := sleepOrDone(ctx, chunkRetryInterval); err != nil {
+					return err
+				}
+			}
+			offset = got
+		case http.StatusServiceUnavailable:
+			return errChunksRefused
+		case util.PushAbandonedStatus:
+			return errPushAbandoned
+		case util.PushCorruptedStatus:
+			return errPushCorrupted
+		default:
+			return nil
+		}
+	}
+}
+
+// How much of the push the proxy has, asking until it answers or the scrape
+// times out.
+func (c *Client) pushedOffset(cfg *runtimeConfig, chunkURL string, origRequest *http.Request) (int, error) {
+	ctx := origRequest.Context()
+	for {
+		if err := sleepOrDone(ctx, chunkRetryInterval); err != nil {
+			return 0, err
+		}
+		request, err := http.NewRequestWithContext(ctx, "GET", chunkURL, nil)
+		if err != nil {
+			return 0, err
+		}
+		cfg.setAuthorization(request)
+		resp, err := cfg.proxyClient.Do(request)
+		if err != nil {
+			level.Debug(c.logger).Log("msg", "Failed to ask how much of the push the proxy got", "scrape_id", origRequest.Header.Get("id"), "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			return 0, fmt.Errorf("asking how much of the push the proxy got returned HTTP status %s", resp.Status)
+		}
+		return strconv.Atoi(resp.Header.Get(util.PushOffsetHeader))
+	}
+}
+
+// Wait for d, or until ctx is done.
+func sleepOrDone(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
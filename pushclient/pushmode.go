@@ -0,0 +1,110 @@
+package pushclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Scrape the push mode targets every interval and publish the results to the
+// proxy until stopped, backfilling anything spooled while it was unreachable.
+// Reloads take effect from the next round.
+func (c *Client) runPushMode() {
+	for {
+		cfg := c.config()
+		for _, target := range cfg.pushModeTargets {
+			go c.publishScrape(target.String())
+		}
+		if cfg.SpoolDir != "" {
+			go c.backfill(cfg)
+		}
+		if !c.sleep(cfg.PushModeInterval) {
+			return
+		}
+	}
+}
+
+// Scrape the target and publish the result, or the failure, to the proxy.
+func (c *Client) publishScrape(target string) {
+	request, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Invalid push mode target", "url", target, "err", err)
+		return
+	}
+	scraped := time.Now()
+	c.doScrape(request, func(cfg *runtimeConfig, resp *http.Response, request *http.Request) error {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.TransferEncoding = nil
+		err = c.publish(cfg, resp, target)
+		if err == errProxyUnreachable && cfg.SpoolDir != "" && resp.StatusCode == http.StatusOK && resp.Header.Get(util.ScrapeErrorHeader) == "" && util.CanAddTimestamps(resp.Header.Get("Content-Type")) {
+			if serr := c.spool.add(cfg, target, scraped, body); serr != nil {
+				level.Warn(c.logger).Log("msg", "Failed to spool scrape result", "url", target, "err", serr)
+			} else {
+				level.Debug(c.logger).Log("msg", "Spooled scrape result as the proxy is unreachable", "url", target)
+			}
+		}
+		return err
+	})
+}
+
+var errProxyUnreachable = errors.New("proxy unreachable")
+
+// Publish a scrape result of the target to the current proxy.
+func (c *Client) publish(cfg *runtimeConfig, resp *http.Response, target string) error {
+	encoding := util.NegotiatePushEncoding(cfg.PushCompression, strings.Join(util.PushEncodings, ","))
+	var buf bytes.Buffer
+	cw, err := util.NewPushWriter(&buf, encoding)
+	if err != nil {
+		return err
+	}
+	err = resp.Write(cw)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.PushModeInterval)
+	defer cancel()
+	if err := c.throttle.wait(ctx, buf.Len()); err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", c.proxies.get()+util.PathPrefix+"/publish", &buf)
+	if err != nil {
+		return err
+	}
+	request.Header.Set(util.PublishTargetHeader, target)
+	request.Header.Set(util.PublishClientHeader, cfg.FQDN)
+	if encoding != "" {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+	cfg.setAuthorization(request)
+	publishResp, err := cfg.proxyClient.Do(request)
+	if err != nil {
+		level.Debug(c.logger).Log("msg", "Error publishing scrape result", "url", target, "err", err)
+		return errProxyUnreachable
+	}
+	publishResp.Body.Close()
+	if publishResp.StatusCode/100 == 5 {
+		return errProxyUnreachable
+	}
+	if publishResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused published result: %s", publishResp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package pushclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Headers of remote write requests passed on to the proxy.
+var remoteWriteHeaders = []string{"Content-Encoding", "Content-Type", "User-Agent", "X-Prometheus-Remote-Write-Version"}
+
+// A handler taking Prometheus remote write requests from the client's network
+// and forwarding them to the proxy, which relays them to its receiver. Serve
+// it at /api/v1/write so senders can be pointed at the client as they would be
+// at Prometheus.
+func (c *Client) RemoteWriteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := c.config()
+		if !cfg.RemoteWrite {
+			http.Error(w, "Remote write forwarding is not enabled", http.StatusNotFound)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		u := c.proxies.get() + util.PathPrefix + "/remote-write"
+		request, err := http.NewRequestWithContext(r.Context(), "POST", u, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, name := range remoteWriteHeaders {
+			if v := r.Header.Get(name); v != "" {
+				request.Header.Set(name, v)
+			}
+		}
+		request.ContentLength = r.ContentLength
+		cfg.setAuthorization(request)
+		resp, err := cfg.proxyClient.Do(request)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Error forwarding remote write", "url", u, "err", err)
+			http.Error(w, fmt.Sprintf("Error forwarding remote write: %s", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	})
+}
@@ -0,0 +1,102 @@
+package pushclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Dials targets for scrapes, looking their names up in the hosts file and
+// then the DNS server from the config, if set.
+type targetDialer struct {
+	dialer *net.Dialer
+	// Addresses of names in the hosts file, lower case.
+	hosts map[string][]string
+}
+
+func newTargetDialer(rc *runtimeConfig) (*targetDialer, error) {
+	d := rc.dialer(30 * time.Second)
+	d.KeepAlive = 30 * time.Second
+	td := &targetDialer{dialer: d}
+	if rc.ScrapeHostsFile != "" {
+		hosts, err := parseHostsFile(rc.ScrapeHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		td.hosts = hosts
+	}
+	if rc.ScrapeDNSServer != "" {
+		server := rc.ScrapeDNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dnsDialer := &net.Dialer{Timeout: 5 * time.Second}
+				if rc.sourceIP != nil {
+					if strings.HasPrefix(network, "udp") {
+						dnsDialer.LocalAddr = &net.UDPAddr{IP: rc.sourceIP}
+					} else {
+						dnsDialer.LocalAddr = &net.TCPAddr{IP: rc.sourceIP}
+					}
+				}
+				return dnsDialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return td, nil
+}
+
+// Read a file in the format of /etc/hosts.
+func parseHostsFile(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hosts := map[string][]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: want an IP followed by names", path, n)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(name)
+			hosts[name] = append(hosts[name], fields[0])
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// Dial addr, for an http.Transport, trying each address of its host in the
+// hosts file if it's there.
+func (td *targetDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return td.dialer.DialContext(ctx, network, addr)
+	}
+	ips, ok := td.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+	if !ok {
+		return td.dialer.DialContext(ctx, network, addr)
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = td.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
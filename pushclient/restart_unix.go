@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package pushclient
+
+import (
+	"os"
+	"syscall"
+)
+
+// Replace this process with a fresh copy of itself.
+func restart() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
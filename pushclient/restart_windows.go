@@ -0,0 +1,12 @@
+package pushclient
+
+import (
+	"os"
+)
+
+// A running process can't be replaced on Windows, so exit and rely on the
+// service recovery settings to start us again.
+func restart() error {
+	os.Exit(1)
+	return nil
+}
@@ -0,0 +1,62 @@
+package pushclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// Whether a scrape failed in a way that's likely to go away soon, such as the
+// exporter restarting.
+func isRetryable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Scrape the target, retrying transient failures as long as there's time
+// left before the scrape's deadline.
+func (c *Client) scrapeWithRetries(ctx context.Context, cfg *runtimeConfig, request *http.Request) (*http.Response, error) {
+	if cfg.Retries <= 0 {
+		return cfg.scrapeClient.Do(request)
+	}
+	backoff := cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := cfg.scrapeClient.Do(request)
+		if err == nil {
+			// Read it all now, so a reset part way through can be retried.
+			var body []byte
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil {
+				resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+				resp.ContentLength = int64(len(body))
+				resp.TransferEncoding = nil
+				return resp, nil
+			}
+		}
+		if attempt >= cfg.Retries || !isRetryable(err) {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return nil, err
+		}
+		level.Info(c.logger).Log("msg", "Retrying failed scrape", "scrape_id", request.Header.Get("id"), "attempt", attempt+1, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if request.GetBody != nil {
+			if request.Body, err = request.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package pushclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// Check a configuration as the client would on startup, without doing
+// anything with it.
+func CheckConfig(cfg Config) error {
+	_, err := New(cfg, nil, nil)
+	return err
+}
+
+// Go through a whole scrape with a proxy: register as a made up client with
+// a target of its own, scrape that target through the proxy as Prometheus
+// would, and check the result it pushed came back. Each step is reported to
+// progress as it's done.
+func SelfTest(ctx context.Context, cfg Config, logger log.Logger, progress io.Writer) error {
+	token := make([]byte, 8)
+	rand.Read(token)
+	id := hex.EncodeToString(token)
+	cfg.FQDN = "pushprox-selftest-" + id
+	// Only what's needed to talk to the proxy is kept.
+	cfg.AllowedTargets = nil
+	cfg.PushModeTargets = ""
+	cfg.SpoolDir = ""
+	cfg.DiscoveryCIDRs = ""
+	cfg.DiscoveryKubernetesNode = ""
+	cfg.MigrationProxyURL = ""
+	cfg.NATSURL = ""
+	cfg.AgentConfigFile = ""
+	cfg.PushChunkSize = 0
+	c, err := New(cfg, nil, logger)
+	if err != nil {
+		return err
+	}
+
+	// The made up target, reached whatever address the scrape is for.
+	expected := fmt.Sprintf("pushprox_selftest{id=%q} 1\n", id)
+	var scraped int32
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	go http.Serve(target, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&scraped, 1)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		io.WriteString(w, expected)
+	}))
+	var dialer net.Dialer
+	c.config().scrapeClient = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", target.Addr().String())
+		},
+	}}
+
+	start := time.Now()
+	step := func(format string, a ...interface{}) {
+		fmt.Fprintf(progress, "%s after %s\n", fmt.Sprintf(format, a...), time.Since(start).Round(time.Millisecond))
+	}
+	defer c.Stop()
+	go func() {
+		for c.ctx.Err() == nil {
+			c.poll(c.proxies, c.backoff, &c.health)
+		}
+	}()
+	for !c.Ready() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no poll of %s got through: %s", c.proxies.get(), ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	proxyURL := c.proxies.get()
+	step("Registered with %s as %s", proxyURL, cfg.FQDN)
+
+	transport, ok := c.config().proxyClient.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("scraping through the proxy over HTTP/3 isn't supported")
+	}
+	transport = transport.Clone()
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return err
+	}
+	transport.Proxy = http.ProxyURL(u)
+	scraper := &http.Client{Transport: transport}
+	request, err := http.NewRequestWithContext(ctx, "GET", "http://"+cfg.FQDN+":9100/metrics", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := scraper.Do(request)
+	if err != nil {
+		return fmt.Errorf("error scraping through the proxy: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading scrape through the proxy: %s", err)
+	}
+	if atomic.LoadInt32(&scraped) == 0 {
+		return fmt.Errorf("the proxy answered the scrape with HTTP status %s before the client got it: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	step("Client got the scrape and scraped the target")
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the scrape through the proxy returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if !strings.Contains(string(body), expected) {
+		return fmt.Errorf("the result of the scrape through the proxy was not what the target returned: %q", body)
+	}
+	step("Pushed result came back through the proxy")
+	return nil
+}
@@ -0,0 +1,73 @@
+package pushclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+var errReplayed = errors.New("scrape request was already taken")
+
+// Scrape IDs of signed scrape requests taken, until their signatures expire,
+// so one that was recorded can't be played back.
+type signedScrapes struct {
+	mu     sync.Mutex
+	ids    map[string]time.Time
+	pruned time.Time
+}
+
+func newSignedScrapes() *signedScrapes {
+	return &signedScrapes{ids: map[string]time.Time{}}
+}
+
+// Note that the scrape was taken, returning false if it already was.
+func (s *signedScrapes) take(id string, expires, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.pruned) > time.Minute {
+		for seen, e := range s.ids {
+			if now.After(e.Add(util.SignatureClockSkew)) {
+				delete(s.ids, seen)
+			}
+		}
+		s.pruned = now
+	}
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	s.ids[id] = expires
+	return true
+}
+
+// Check the proxy signed the scrape request, if it must have, returning why
+// it's refused if not. The signature isn't passed on to the target.
+func (c *Client) checkSignature(cfg *runtimeConfig, request *http.Request) *util.ScrapeError {
+	if cfg.scrapeVerifier == nil {
+		return nil
+	}
+	now := time.Now()
+	expires, err := cfg.scrapeVerifier.Verify(request, now)
+	if err == nil && !c.signed.take(request.Header.Get("Id"), expires, now) {
+		err = errReplayed
+	}
+	request.Header.Del(util.SignatureHeader)
+	request.Header.Del(util.SignatureExpiresHeader)
+	if err == nil {
+		return nil
+	}
+	reason := "invalid"
+	switch err {
+	case util.ErrUnsigned:
+		reason = "unsigned"
+	case util.ErrSignatureExpired:
+		reason = "expired"
+	case errReplayed:
+		reason = "replayed"
+	}
+	c.rejectedScrapes.WithLabelValues(reason).Inc()
+	return &util.ScrapeError{Kind: util.ScrapeErrorForbidden, Error: fmt.Sprintf("refusing to scrape %s: %s", request.URL.String(), err)}
+}
@@ -0,0 +1,211 @@
+package pushclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// Results of push mode scrapes that couldn't be published as the proxy was
+// unreachable, kept on disk to backfill through its remote write relay once
+// it's back. Each file is the target URL and the time of the scrape in
+// milliseconds on a line each, followed by the text format result.
+type spool struct {
+	// Held while adding, so the size limit holds.
+	mu sync.Mutex
+	// Set while backfilling, so only one backfill runs at a time.
+	backfilling int32
+
+	bytes      prometheus.Gauge
+	spooled    prometheus.Counter
+	dropped    *prometheus.CounterVec
+	backfilled prometheus.Counter
+}
+
+func newSpool() *spool {
+	return &spool{
+		bytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "pushprox_client_spool_bytes",
+				Help: "Bytes of scrape results in --push-mode.spool-dir waiting to be backfilled.",
+			},
+		),
+		spooled: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_spooled_results_total",
+				Help: "Push mode scrape results written to --push-mode.spool-dir as the proxy was unreachable.",
+			},
+		),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_spool_dropped_results_total",
+				Help: "Spooled scrape results thrown away, as the spool was full or they couldn't be backfilled.",
+			},
+			[]string{"reason"},
+		),
+		backfilled: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_backfilled_results_total",
+				Help: "Spooled scrape results delivered through the proxy's remote write relay.",
+			},
+		),
+	}
+}
+
+func (s *spool) collectors() []prometheus.Collector {
+	return []prometheus.Collector{s.bytes, s.spooled, s.dropped, s.backfilled}
+}
+
+type spoolFile struct {
+	path string
+	size int64
+}
+
+// The spooled files, oldest first, and their total size.
+func spoolFiles(dir string) ([]spoolFile, int64) {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.spool"))
+	sort.Strings(paths)
+	var files []spoolFile
+	var total int64
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		files = append(files, spoolFile{path: p, size: fi.Size()})
+		total += fi.Size()
+	}
+	return files, total
+}
+
+// Keep a result for later, throwing away the oldest ones to stay within the
+// size limit.
+func (s *spool) add(cfg *runtimeConfig, target string, scraped time.Time, body []byte) error {
+	ms := scraped.UnixNano() / int64(time.Millisecond)
+	content := append([]byte(target+"\n"+strconv.FormatInt(ms, 10)+"\n"), body...)
+	if int64(len(content)) > cfg.SpoolMaxSize {
+		s.dropped.WithLabelValues("full").Inc()
+		return fmt.Errorf("scrape result of %d bytes is over --push-mode.spool-max-size", len(content))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, total := spoolFiles(cfg.SpoolDir)
+	for len(files) > 0 && total+int64(len(content)) > cfg.SpoolMaxSize {
+		if err := os.Remove(files[0].path); err == nil {
+			s.dropped.WithLabelValues("full").Inc()
+		}
+		total -= files[0].size
+		files = files[1:]
+	}
+	// Named to sort by the time of the scrape.
+	f, err := ioutil.TempFile(cfg.SpoolDir, fmt.Sprintf("%020d-*.spool", scraped.UnixNano()))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	s.spooled.Inc()
+	s.bytes.Set(float64(total + int64(len(content))))
+	return nil
+}
+
+// Deliver spooled results through the proxy's remote write relay, oldest
+// first, stopping at the first that can't be delivered for now.
+func (c *Client) backfill(cfg *runtimeConfig) {
+	s := c.spool
+	if !atomic.CompareAndSwapInt32(&s.backfilling, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.backfilling, 0)
+	files, total := spoolFiles(cfg.SpoolDir)
+	defer func() { s.bytes.Set(float64(total)) }()
+	for _, f := range files {
+		err := c.backfillFile(cfg, f.path)
+		if err == errBackfillLater {
+			return
+		}
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Dropping spooled scrape result that can't be backfilled", "file", f.path, "err", err)
+			s.dropped.WithLabelValues("rejected").Inc()
+		} else {
+			s.backfilled.Inc()
+		}
+		os.Remove(f.path)
+		total -= f.size
+	}
+}
+
+var errBackfillLater = errors.New("the proxy can't take backfills for now")
+
+func (c *Client) backfillFile(cfg *runtimeConfig, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	parts := bytes.SplitN(content, []byte("\n"), 3)
+	if len(parts) != 3 {
+		return errors.New("truncated spool file")
+	}
+	target, err := url.Parse(string(parts[0]))
+	if err != nil {
+		return err
+	}
+	ms, err := strconv.ParseInt(string(parts[1]), 10, 64)
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{"instance": target.Host}
+	if cfg.PushModeJob != "" {
+		labels["job"] = cfg.PushModeJob
+	}
+	body, err := util.RemoteWrite(bytes.NewReader(parts[2]), labels, time.Unix(0, ms*int64(time.Millisecond)))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", c.proxies.get()+util.PathPrefix+"/remote-write", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range util.RemoteWriteHeaders {
+		request.Header.Set(name, value)
+	}
+	cfg.setAuthorization(request)
+	resp, err := cfg.proxyClient.Do(request)
+	if err != nil {
+		return errBackfillLater
+	}
+	resp.Body.Close()
+	// As with Prometheus, 4xx won't get any better on a retry.
+	if resp.StatusCode/100 == 4 && resp.StatusCode != 429 {
+		return fmt.Errorf("remote write refused: %s", resp.Status)
+	}
+	if resp.StatusCode/100 != 2 {
+		return errBackfillLater
+	}
+	level.Debug(c.logger).Log("msg", "Backfilled spooled scrape result", "url", target.String(), "file", path)
+	return nil
+}
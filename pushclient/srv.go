@@ -0,0 +1,145 @@
+package pushclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// How long to wait for a lookup of the proxies' SRV record.
+const srvLookupTimeout = 10 * time.Second
+
+// Look up the proxies in the SRV record of name, as URLs with the scheme, in
+// order of priority and shuffled by weight within each.
+func lookupProxySRV(name, scheme string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, addr := range addrs {
+		// A target of "." says there's no such service.
+		if host := strings.TrimSuffix(addr.Target, "."); host != "" {
+			urls = append(urls, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(addr.Port))))
+		}
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no proxies in the SRV record of %s", name)
+	}
+	return urls, nil
+}
+
+// Look up the proxies in the SRV record every interval, until the client is
+// stopped, keeping to what was last found if a lookup fails.
+func (c *Client) runProxySRV(name, scheme string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		urls, err := lookupProxySRV(name, scheme)
+		if err != nil {
+			level.Warn(c.logger).Log("msg", "Error looking up proxies, keeping to the last ones found", "srv", name, "err", err)
+			c.srvLookupFailures.Inc()
+			continue
+		}
+		c.updateProxies(urls)
+	}
+}
+
+// Move over to newly looked up proxies. If the one in use is gone, the
+// client registers with where it's going first, so it's known there before
+// it stops polling the old one.
+func (c *Client) updateProxies(urls []string) {
+	if !c.proxies.differs(urls) {
+		return
+	}
+	inUse := c.proxies.inUse()
+	for _, u := range urls {
+		if u == inUse {
+			level.Info(c.logger).Log("msg", "Proxies in SRV record changed", "proxy_urls", strings.Join(urls, ","))
+			c.proxies.replace(urls)
+			return
+		}
+	}
+	level.Info(c.logger).Log("msg", "Proxy in use is gone from SRV record, moving to new proxies", "proxy_url", urls[0], "old_proxy_url", inUse)
+	if err := c.registerWith(urls[0]); err != nil {
+		level.Warn(c.logger).Log("msg", "Error registering with new proxy before moving to it", "proxy_url", urls[0], "err", err)
+	}
+	c.proxies.replace(urls)
+}
+
+// Whether urls are other proxies than those in use, in whatever order.
+func (ps *proxySelector) differs(urls []string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(urls) != len(ps.urls) {
+		return true
+	}
+	a, b := append([]string{}, urls...), append([]string{}, ps.urls...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// The configured proxy in use, ignoring any redirect.
+func (ps *proxySelector) inUse() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.urls[ps.current]
+}
+
+// Replace the proxies, keeping to the one in use if it's among the new ones
+// and otherwise going to the most preferred.
+func (ps *proxySelector) replace(urls []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	inUse := ps.urls[ps.current]
+	ps.urls = urls
+	ps.current = 0
+	for i, u := range urls {
+		if u == inUse {
+			ps.current = i
+		}
+	}
+	if ps.urls[ps.current] != inUse && ps.moved != nil {
+		close(ps.moved)
+		ps.moved = nil
+	}
+}
+
+// A context for a request to the proxy in use, cancelled if it's replaced
+// by another, so a poll waiting on it doesn't hold the client there.
+func (ps *proxySelector) context(parent context.Context) (context.Context, context.CancelFunc) {
+	ps.mu.Lock()
+	if ps.moved == nil {
+		ps.moved = make(chan struct{})
+	}
+	moved := ps.moved
+	ps.mu.Unlock()
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-moved:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,164 @@
+package pushclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// How often to check the SSH connection to the proxy is still there.
+const sshKeepAliveInterval = 30 * time.Second
+
+// Connects to the proxy over SSH, with each HTTP connection to it a channel of
+// one SSH connection.
+type sshDialer struct {
+	address string
+	dialer  *net.Dialer
+	config  *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+func newSSHDialer(cfg Config, dialer *net.Dialer) (*sshDialer, error) {
+	if cfg.ProxySSHHostKey == "" {
+		return nil, errors.New("the proxy's SSH host key must be given to pin it")
+	}
+	if cfg.ProxySSHKeyFile == "" {
+		return nil, errors.New("a key file is needed to connect to the proxy over SSH")
+	}
+	pem, err := ioutil.ReadFile(cfg.ProxySSHKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH key: %s", err)
+	}
+	hostKeyCallback, err := pinnedHostKey(cfg.ProxySSHHostKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sshDialer{
+		address: cfg.ProxySSHAddress,
+		dialer:  dialer,
+		config: &ssh.ClientConfig{
+			User:            cfg.FQDN,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         dialer.Timeout,
+		},
+	}, nil
+}
+
+// Only accept the host key given, in authorized_keys format or as a SHA256
+// fingerprint as ssh-keygen -l shows.
+func pinnedHostKey(pin string) (ssh.HostKeyCallback, error) {
+	pin = strings.TrimSpace(pin)
+	if strings.HasPrefix(pin, "SHA256:") {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if ssh.FingerprintSHA256(key) != pin {
+				return fmt.Errorf("host key %s of the proxy does not match the pinned one", ssh.FingerprintSHA256(key))
+			}
+			return nil
+		}, nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pin))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH host key of the proxy: %s", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if !bytes.Equal(key.Marshal(), pub.Marshal()) {
+			return fmt.Errorf("host key %s of the proxy does not match the pinned one", ssh.FingerprintSHA256(key))
+		}
+		return nil
+	}, nil
+}
+
+// The SSH connection to the proxy, connecting if there isn't one.
+func (d *sshDialer) connect() (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, errors.New("SSH connection to the proxy closed")
+	}
+	if d.client != nil {
+		return d.client, nil
+	}
+	conn, err := d.dialer.Dial("tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(conn, d.address, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(sc, chans, reqs)
+	d.client = client
+	go d.keepAlive(client)
+	return client, nil
+}
+
+// Drop the connection once it stops answering, so the next dial reconnects.
+func (d *sshDialer) keepAlive(client *ssh.Client) {
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, _, err := client.SendRequest("keepalive@pushprox", true, nil); err != nil {
+			d.drop(client)
+			return
+		}
+	}
+}
+
+func (d *sshDialer) drop(client *ssh.Client) {
+	client.Close()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == client {
+		d.client = nil
+	}
+}
+
+// Dial the proxy, for an http.Transport. The address is ignored.
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	ch, reqs, err := client.OpenChannel(util.SSHChannelType, nil)
+	if err != nil {
+		// The connection may have gone, reconnect once.
+		d.drop(client)
+		if client, err = d.connect(); err != nil {
+			return nil, err
+		}
+		if ch, reqs, err = client.OpenChannel(util.SSHChannelType, nil); err != nil {
+			return nil, err
+		}
+	}
+	go ssh.DiscardRequests(reqs)
+	return &util.SSHChannelConn{Channel: ch, Local: client.LocalAddr(), Remote: client.RemoteAddr()}, nil
+}
+
+// Close the connection, and don't make another.
+func (d *sshDialer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	if d.client != nil {
+		d.client.Close()
+	}
+}
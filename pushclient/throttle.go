@@ -0,0 +1,84 @@
+package pushclient
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// Limits the bytes per second of pushes to the proxy, over all of them, so
+// they don't starve other traffic on a slow uplink.
+type uploadThrottle struct {
+	limiter *rate.Limiter
+	waited  prometheus.Counter
+}
+
+func newUploadThrottle() *uploadThrottle {
+	return &uploadThrottle{
+		limiter: rate.NewLimiter(rate.Inf, 1),
+		waited: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "pushprox_client_push_throttle_wait_seconds_total",
+				Help: "Time pushes to the proxy spent waiting on --push.rate-limit.",
+			},
+		),
+	}
+}
+
+// Switch to a new rate, 0 for no limit.
+func (t *uploadThrottle) apply(limit float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	if limit <= 0 {
+		t.limiter.SetLimit(rate.Inf)
+		return
+	}
+	t.limiter.SetLimit(rate.Limit(limit))
+	t.limiter.SetBurst(burst)
+}
+
+// Wait until n more bytes may be sent.
+func (t *uploadThrottle) wait(ctx context.Context, n int) error {
+	if t.limiter.Limit() == rate.Inf {
+		return nil
+	}
+	start := time.Now()
+	defer func() { t.waited.Add(time.Since(start).Seconds()) }()
+	for n > 0 {
+		chunk := n
+		if burst := t.limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := t.limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// A body read no faster than the throttle allows.
+type throttledBody struct {
+	io.ReadCloser
+	ctx context.Context
+	t   *uploadThrottle
+}
+
+func (tb *throttledBody) Read(p []byte) (int, error) {
+	if tb.t.limiter.Limit() != rate.Inf {
+		if burst := tb.t.limiter.Burst(); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	n, err := tb.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := tb.t.wait(tb.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
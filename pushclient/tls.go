@@ -0,0 +1,119 @@
+package pushclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// TLS for connections the client makes.
+type TLSConfig struct {
+	// CAs to verify the server with, rather than the system's.
+	CAFile string `yaml:"ca_file"`
+	// Certificate to authenticate with.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Name to verify the server's certificate against.
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// How often to check the files for a rotated certificate, 0 to only
+	// load them with the config.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// A transport using the TLS settings, with the files loaded now so a bad set
+// is caught before it's used.
+func newTransport(t TLSConfig) (*http.Transport, error) {
+	tc := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading CAs: %s", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS certificate: %s", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tc
+	return transport, nil
+}
+
+// Of the contents of the files of both TLS configs, to tell when they've
+// changed. Files that can't be read count as empty.
+func (rc *runtimeConfig) tlsFilesSum() [sha256.Size]byte {
+	var contents [][]byte
+	for _, t := range []TLSConfig{rc.ProxyTLS, rc.ScrapeTLS} {
+		for _, f := range []string{t.CAFile, t.CertFile, t.KeyFile} {
+			var b []byte
+			if f != "" {
+				b, _ = ioutil.ReadFile(f)
+			}
+			contents = append(contents, b)
+		}
+	}
+	return sha256.Sum256(bytes.Join(contents, []byte{0}))
+}
+
+// The shortest reload interval of the TLS configs, 0 if neither is reloaded.
+func (rc *runtimeConfig) tlsReloadInterval() time.Duration {
+	interval := rc.ProxyTLS.ReloadInterval
+	if d := rc.ScrapeTLS.ReloadInterval; d > 0 && (interval <= 0 || d < interval) {
+		interval = d
+	}
+	return interval
+}
+
+// Apply the config again whenever its TLS files change, so rotated
+// certificates are used for new connections. Polls and scrapes in progress
+// carry on over the connections they have. If the new files are no good the
+// current ones are kept, until the files change again.
+func (c *Client) watchTLS() {
+	for {
+		interval := c.config().tlsReloadInterval()
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		if !c.sleep(interval) {
+			return
+		}
+		rc := c.config()
+		if rc.tlsReloadInterval() <= 0 {
+			continue
+		}
+		sum := rc.tlsFilesSum()
+		c.mu.Lock()
+		seen := sum == rc.tlsSum || sum == c.badTLSSum
+		c.mu.Unlock()
+		if seen {
+			continue
+		}
+		if err := c.ApplyConfig(rc.Config); err != nil {
+			c.mu.Lock()
+			c.badTLSSum = sum
+			c.mu.Unlock()
+			c.tlsReloadFailures.Inc()
+			level.Warn(c.logger).Log("msg", "Error reloading TLS certificate, keeping the current one", "err", err)
+			continue
+		}
+		level.Info(c.logger).Log("msg", "Reloaded TLS certificate")
+	}
+}
@@ -0,0 +1,77 @@
+package pushclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The IP of a source address, which may be an interface to use the first
+// IPv4 address of, or its first global IPv6 address if it has none.
+func parseSourceAddress(s string) (net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an IP nor an interface", s)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v6 net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipnet.IP.To4(); ip != nil {
+			return ip, nil
+		}
+		if v6 == nil && ipnet.IP.IsGlobalUnicast() {
+			v6 = ipnet.IP
+		}
+	}
+	if v6 == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", s)
+	}
+	return v6, nil
+}
+
+// A dialer for connections out of the client, from the source address if
+// set.
+func (rc *runtimeConfig) dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if rc.sourceIP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: rc.sourceIP}
+	}
+	return d
+}
+
+// Apply the tuning of connections to the proxy to t.
+func (rc *runtimeConfig) tuneProxyTransport(t *http.Transport) {
+	d := rc.dialer(30 * time.Second)
+	d.KeepAlive = rc.ProxyKeepAlive
+	t.DialContext = d.DialContext
+	t.MaxIdleConns = rc.ProxyMaxIdleConns
+	t.MaxIdleConnsPerHost = rc.ProxyMaxIdleConns
+	t.IdleConnTimeout = rc.ProxyIdleConnTimeout
+	if !rc.ProxyHTTP2 {
+		disableHTTP2(t)
+	}
+}
+
+// Only talk HTTP/1.1 over t.
+func disableHTTP2(t *http.Transport) {
+	t.ForceAttemptHTTP2 = false
+	t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if t.TLSClientConfig != nil {
+		// Set up for HTTP/2 already, such as when cloned from a transport
+		// that used it.
+		t.TLSClientConfig = t.TLSClientConfig.Clone()
+		t.TLSClientConfig.NextProtos = nil
+	}
+}
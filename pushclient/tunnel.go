@@ -0,0 +1,70 @@
+package pushclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/robustperception/pushprox/util"
+)
+
+// How long to wait connecting to the target of a tunnel.
+const tunnelDialTimeout = 10 * time.Second
+
+// Connect to target for a tunnel the proxy accepted a connection for, and
+// tunnel it to the proxy.
+func (c *Client) openTunnel(id, target string) {
+	cfg := c.config()
+	logger := log.With(c.logger, "tunnel_id", id, "target", target)
+	var conn net.Conn
+	var err error
+	if cfg.tunnelAllowed == nil || !cfg.tunnelAllowed.MatchString(target) {
+		err = fmt.Errorf("tunnels to %s are not allowed", target)
+	} else {
+		conn, err = cfg.dialer(tunnelDialTimeout).Dial("tcp", target)
+	}
+	u := c.proxies.get() + util.PathPrefix + "/tunnel?id=" + url.QueryEscape(id)
+	request, reqErr := http.NewRequestWithContext(context.Background(), "POST", u, nil)
+	if reqErr != nil {
+		level.Warn(logger).Log("msg", "Error opening tunnel", "err", reqErr)
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	cfg.setAuthorization(request)
+	if err != nil {
+		// Let the proxy drop the connection now, rather than waiting.
+		level.Warn(logger).Log("msg", "Error opening tunnel", "err", err)
+		request.Header.Set(util.TunnelErrorHeader, err.Error())
+		if resp, err := cfg.tunnelClient.Do(request); err == nil {
+			resp.Body.Close()
+		}
+		return
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", util.TunnelUpgrade)
+	resp, err := cfg.tunnelClient.Do(request)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Error opening tunnel", "err", err)
+		conn.Close()
+		return
+	}
+	stream, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		level.Warn(logger).Log("msg", "Error opening tunnel", "err", fmt.Sprintf("unexpected status %s", resp.Status))
+		resp.Body.Close()
+		conn.Close()
+		return
+	}
+	level.Info(logger).Log("msg", "Opened tunnel")
+	util.Splice(conn, stream)
+	level.Debug(logger).Log("msg", "Closed tunnel")
+}
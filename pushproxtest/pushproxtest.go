@@ -0,0 +1,171 @@
+package pushproxtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/robustperception/pushprox/coordinator"
+	"github.com/robustperception/pushprox/pushclient"
+)
+
+// How long StartClient waits for a client to be polling.
+const clientStartTimeout = 10 * time.Second
+
+// A proxy and clients running in process, with httptest servers as the
+// targets behind the clients, for testing scrapes through them end to end.
+type Env struct {
+	// The proxy's coordinator, and the registry its metrics are in.
+	Coordinator *coordinator.Coordinator
+	Registry    *prometheus.Registry
+	// Where the proxy is served, to give Prometheus as a proxy_url.
+	URL string
+
+	logger log.Logger
+	server *httptest.Server
+	cancel context.CancelFunc
+	// Shared by scrapes, so connections to the proxy are reused.
+	transport *http.Transport
+
+	mu      sync.Mutex
+	clients []*pushclient.Client
+	targets []*httptest.Server
+}
+
+// Start a proxy with the configuration, such as coordinator.DefaultConfig()
+// with some settings changed. Its metrics go to a registry of its own rather
+// than the one in opts, and it logs nothing unless opts has a logger.
+func New(cfg coordinator.Config, opts coordinator.Options) (*Env, error) {
+	reg := prometheus.NewRegistry()
+	opts.Registerer = reg
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+	c, err := coordinator.NewWithOptions(cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.Run(ctx)
+	server := httptest.NewServer(c)
+	u, _ := url.Parse(server.URL)
+	return &Env{
+		Coordinator: c,
+		Registry:    reg,
+		URL:         server.URL,
+		logger:      opts.Logger,
+		server:      server,
+		cancel:      cancel,
+		transport:   &http.Transport{Proxy: http.ProxyURL(u)},
+	}, nil
+}
+
+// Start a client with the configuration, such as pushclient.DefaultConfig()
+// with an FQDN, polling the proxy. Each of targets, by the host:port it's
+// scraped as, is served by an httptest server the client's scrapes of it go
+// to. Returns once the proxy knows of the client, whether or not it has been
+// approved.
+func (e *Env) StartClient(cfg pushclient.Config, targets map[string]http.Handler) (*pushclient.Client, error) {
+	if cfg.FQDN == "" {
+		return nil, fmt.Errorf("the client needs an FQDN")
+	}
+	cfg.ProxyURL = e.URL
+	rewrites := make(map[string]string, len(cfg.TargetRewrites)+len(targets))
+	for from, to := range cfg.TargetRewrites {
+		rewrites[from] = to
+	}
+	for target, handler := range targets {
+		rewrites[target] = e.newTarget(handler)
+	}
+	cfg.TargetRewrites = rewrites
+	client, err := pushclient.New(cfg, prometheus.NewRegistry(), log.With(e.logger, "component", "client", "fqdn", cfg.FQDN))
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.clients = append(e.clients, client)
+	e.mu.Unlock()
+	go client.Run()
+
+	deadline := time.Now().Add(clientStartTimeout)
+	for !e.started(client, cfg.FQDN) {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("client %q didn't start polling the proxy within %s", cfg.FQDN, clientStartTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return client, nil
+}
+
+// Serve a target, returning its host:port.
+func (e *Env) newTarget(handler http.Handler) string {
+	server := httptest.NewServer(handler)
+	e.mu.Lock()
+	e.targets = append(e.targets, server)
+	e.mu.Unlock()
+	return server.Listener.Addr().String()
+}
+
+// Whether the proxy knows of the client, by the name it knows the client by,
+// and it's polling if it's been approved. Clients waiting for approval can't
+// be polling. Names from certificates are lower cased.
+func (e *Env) started(client *pushclient.Client, fqdn string) bool {
+	fqdn = coordinator.NormalizeFQDN(fqdn)
+	for _, s := range e.Coordinator.ClientStatuses() {
+		if strings.EqualFold(s.FQDN, fqdn) {
+			return s.State != "approved" || client.Ready()
+		}
+	}
+	return false
+}
+
+// An HTTP client scraping through the proxy, as Prometheus does with the
+// proxy as its proxy_url.
+func (e *Env) Scraper() *http.Client {
+	return &http.Client{Transport: e.transport}
+}
+
+// Scrape a URL, such as http://client:9100/metrics, through the proxy with
+// Prometheus's headers and the timeout.
+func (e *Env) Scrape(ctx context.Context, target string, timeout time.Duration) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "text/plain;version=0.0.4;q=1,*/*;q=0.1")
+	request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", timeout.Seconds()))
+	return e.Scraper().Do(request)
+}
+
+// Stop the clients and the proxy, and close the targets.
+func (e *Env) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, client := range e.clients {
+		client.Stop()
+	}
+	e.Coordinator.Stop()
+	e.cancel()
+	e.server.Close()
+	e.transport.CloseIdleConnections()
+	for _, target := range e.targets {
+		target.Close()
+	}
+}
+
+// A target serving the text exposition format body, as an exporter would.
+func Metrics(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		io.WriteString(w, body)
+	})
+}
@@ -0,0 +1,88 @@
+package pushproxtest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/robustperception/pushprox/coordinator"
+	"github.com/robustperception/pushprox/pushclient"
+)
+
+func newEnv(t *testing.T, cfg coordinator.Config) *Env {
+	t.Helper()
+	env, err := New(cfg, coordinator.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(env.Close)
+	return env
+}
+
+func clientConfig(fqdn string) pushclient.Config {
+	cfg := pushclient.DefaultConfig()
+	cfg.FQDN = fqdn
+	return cfg
+}
+
+func TestScrape(t *testing.T) {
+	env := newEnv(t, coordinator.DefaultConfig())
+	targets := map[string]http.Handler{"node1:9100": Metrics("up 1\n")}
+	if _, err := env.StartClient(clientConfig("node1"), targets); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := env.Scrape(ctx, "http://node1:9100/metrics", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %s: %s", resp.Status, body)
+	}
+	if string(body) != "up 1\n" {
+		t.Errorf("got body %q, want %q", body, "up 1\n")
+	}
+}
+
+func TestScrapeUnknownClient(t *testing.T) {
+	env := newEnv(t, coordinator.DefaultConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := env.Scrape(ctx, "http://unknown:9100/metrics", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("scrape of an unknown client succeeded")
+	}
+}
+
+func TestStartClientNormalizedFQDN(t *testing.T) {
+	env := newEnv(t, coordinator.DefaultConfig())
+	if _, err := env.StartClient(clientConfig("[2001:DB8::1]"), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartClientAwaitingApproval(t *testing.T) {
+	cfg := coordinator.DefaultConfig()
+	cfg.RequireApproval = true
+	env := newEnv(t, cfg)
+	if _, err := env.StartClient(clientConfig("node1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	approvals := env.Coordinator.ClientApprovals()
+	if len(approvals) != 1 || approvals[0].FQDN != "node1" || approvals[0].State != "pending" {
+		t.Errorf("got approvals %+v, want node1 pending", approvals)
+	}
+}
@@ -0,0 +1,7 @@
+package util
+
+// Header on polls with the most scrapes the client takes in one response. The
+// proxy answers clients that send it with the header set to how many scrape
+// requests follow one another in the body, and takes their results pushed
+// together to /push-batch.
+const BatchSizeHeader = "X-PushProx-Batch-Size"
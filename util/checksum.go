@@ -0,0 +1,33 @@
+package util
+
+import "strconv"
+
+// Header the proxy uses on /poll responses when it checks pushes against
+// their checksum before passing them on, with the most bytes of a push it
+// holds to check.
+const VerifyChecksumHeader = "X-PushProx-Verify-Checksum"
+
+// Bytes of a push held to check it by proxies that don't say, which sent 1.
+const DefaultVerifyChecksumMaxBytes = 16 << 20
+
+// The most bytes of a push the proxy holds to check it, from its
+// VerifyChecksumHeader, 0 if it doesn't check pushes.
+func VerifyChecksumMaxBytes(header string) int64 {
+	if header == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || n <= 1 {
+		return DefaultVerifyChecksumMaxBytes
+	}
+	return n
+}
+
+// Trailer on a push with the hex SHA-256 of its body as sent, compressed if
+// it is. Being a trailer, it can be worked out as the push is streamed.
+const ContentSHA256Trailer = "X-PushProx-Content-Sha256"
+
+// Status of the response to a push that arrived not matching its checksum,
+// such as mangled by a middlebox. The scrape is still waiting, and the client
+// should push the result again.
+const PushCorruptedStatus = 422
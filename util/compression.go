@@ -0,0 +1,179 @@
+package util
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Header the proxy uses on /poll responses to advertise which encodings it
+// accepts for pushed scrape results.
+const AcceptEncodingHeader = "X-PushProx-Accept-Encoding"
+
+// Encodings supported for pushed scrape results.
+var PushEncodings = []string{"gzip", "snappy"}
+
+func isPushEncoding(encoding string) bool {
+	for _, e := range PushEncodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// A compressing writer whose pending output can be flushed part way through.
+type PushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+func (nopWriteCloser) Flush() error { return nil }
+
+// Compressors are expensive to set up, so they're reused across pushes.
+var (
+	gzipWriters   = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	snappyWriters = sync.Pool{New: func() interface{} { return snappy.NewBufferedWriter(nil) }}
+	gzipReaders   sync.Pool
+	snappyReaders = sync.Pool{New: func() interface{} { return snappy.NewReader(nil) }}
+)
+
+var errPushReaderClosed = errors.New("read from closed push reader")
+
+// A compressing writer that goes back to its pool once closed.
+type pooledWriter struct {
+	PushWriter
+	pool *sync.Pool
+}
+
+func (w *pooledWriter) Close() error {
+	if w.PushWriter == nil {
+		return nil
+	}
+	err := w.PushWriter.Close()
+	w.pool.Put(w.PushWriter)
+	w.PushWriter = nil
+	return err
+}
+
+// A decompressing reader that goes back to its pool once closed, or if a
+// read is in progress then, once that's done.
+type pooledReader struct {
+	pool *sync.Pool
+
+	mu      sync.Mutex
+	r       io.Reader
+	reading bool
+	closed  bool
+}
+
+func (r *pooledReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return 0, errPushReaderClosed
+	}
+	r.reading = true
+	dr := r.r
+	r.mu.Unlock()
+
+	n, err := dr.Read(p)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reading = false
+	if r.closed {
+		r.release()
+	}
+	return n, err
+}
+
+func (r *pooledReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if !r.reading {
+		r.release()
+	}
+	return nil
+}
+
+// Must be called with the lock held.
+func (r *pooledReader) release() {
+	if r.r != nil {
+		r.pool.Put(r.r)
+		r.r = nil
+	}
+}
+
+// Wrap w so that what's written to it is compressed with the given encoding.
+// The empty encoding means no compression. Close must be called once done,
+// and the writer not used after.
+func NewPushWriter(w io.Writer, encoding string) (PushWriter, error) {
+	switch encoding {
+	case "":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(w)
+		return &pooledWriter{PushWriter: gw, pool: &gzipWriters}, nil
+	case "snappy":
+		sw := snappyWriters.Get().(*snappy.Writer)
+		sw.Reset(w)
+		return &pooledWriter{PushWriter: sw, pool: &snappyWriters}, nil
+	}
+	return nil, fmt.Errorf("unsupported push encoding %q", encoding)
+}
+
+// Wrap r so that what's read from it is decompressed from the given encoding.
+// The empty encoding means no compression. Closing it releases it for reuse
+// once any read in progress is done, and reads after fail.
+func NewPushReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case "gzip":
+		gr, ok := gzipReaders.Get().(*gzip.Reader)
+		if !ok {
+			var err error
+			if gr, err = gzip.NewReader(r); err != nil {
+				return nil, err
+			}
+		} else if err := gr.Reset(r); err != nil {
+			gzipReaders.Put(gr)
+			return nil, err
+		}
+		return &pooledReader{r: gr, pool: &gzipReaders}, nil
+	case "snappy":
+		sr := snappyReaders.Get().(*snappy.Reader)
+		sr.Reset(r)
+		return &pooledReader{r: sr, pool: &snappyReaders}, nil
+	}
+	return nil, fmt.Errorf("unsupported push encoding %q", encoding)
+}
+
+// Pick the encoding to push with, given the preferred one and the value of
+// the AcceptEncodingHeader from the proxy. Returns the empty string if
+// compression can't be used.
+func NegotiatePushEncoding(preferred string, accepted string) string {
+	if !isPushEncoding(preferred) {
+		return ""
+	}
+	for _, a := range strings.Split(accepted, ",") {
+		if strings.TrimSpace(a) == preferred {
+			return preferred
+		}
+	}
+	return ""
+}
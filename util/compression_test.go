@@ -0,0 +1,47 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPushReaderRoundTrip(t *testing.T) {
+	for _, encoding := range append([]string{""}, PushEncodings...) {
+		var buf bytes.Buffer
+		w, err := NewPushWriter(&buf, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("up 1\n"))
+		w.Close()
+		r, err := NewPushReader(&buf, encoding)
+		if err != nil {
+			t.Fatalf("%q: %s", encoding, err)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil || string(body) != "up 1\n" {
+			t.Errorf("%q: got %q, %v", encoding, body, err)
+		}
+		r.Close()
+	}
+}
+
+func TestPushReaderReadAfterClose(t *testing.T) {
+	for _, encoding := range PushEncodings {
+		var buf bytes.Buffer
+		w, _ := NewPushWriter(&buf, encoding)
+		w.Write([]byte("up 1\n"))
+		w.Close()
+		r, err := NewPushReader(&buf, encoding)
+		if err != nil {
+			t.Fatalf("%q: %s", encoding, err)
+		}
+		r.Close()
+		if _, err := r.Read(make([]byte, 10)); err != errPushReaderClosed {
+			t.Errorf("%q: got %v reading after close, want %v", encoding, err, errPushReaderClosed)
+		}
+		// Closing again is harmless.
+		r.Close()
+	}
+}
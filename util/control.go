@@ -0,0 +1,66 @@
+package util
+
+import (
+	"strings"
+)
+
+// Header on /poll responses carrying a control message for the client in
+// place of a scrape request. The body is empty in that case.
+const ControlHeader = "X-PushProx-Control"
+
+// Header on a /poll that only registers the client, such as with a proxy it's
+// being migrated to. The proxy responds straight away, with an empty body.
+const RegisterOnlyHeader = "X-PushProx-Register-Only"
+
+// Headers on a /publish from a client in push mode, with the result of a
+// scrape it made on its own as the body. They have the URL of the target and
+// the FQDN of the client.
+const (
+	PublishTargetHeader = "X-PushProx-Publish-Target"
+	PublishClientHeader = "X-PushProx-Publish-Client"
+)
+
+// Control messages. Some take arguments, separated by spaces.
+const (
+	// Restart the client process.
+	ControlRestart = "restart"
+	// Log verbosely for the duration given as the argument.
+	ControlDebug = "debug"
+	// Connect to the host:port given as the second argument and tunnel it
+	// to the proxy with a /tunnel request for the ID given as the first.
+	ControlTunnel = "tunnel"
+)
+
+// Split a control message into its command and arguments.
+func ParseControl(msg string) (string, []string) {
+	fields := strings.Fields(msg)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+// Header on a pushed scrape result indicating the client failed to scrape the
+// target, with the kind of failure as its value. The body is a ScrapeError.
+const ScrapeErrorHeader = "X-PushProx-Scrape-Error"
+
+// Header on a pushed scrape result with how long, in seconds, the client took
+// to get the response headers from the target.
+const FetchTimeHeader = "X-PushProx-Fetch-Seconds"
+
+// Status of the response to a push when the scraper went away before all of
+// it was relayed. The proxy stops reading the push, and the client should
+// stop sending it.
+const PushAbandonedStatus = 410
+
+// Header on a scrape through the proxy with its priority, an integer. Scrapes
+// with a higher priority get the client's polls first when it's busy.
+const PriorityHeader = "X-PushProx-Priority"
+
+// Header on a /poll naming the instance of the client polling, so several
+// instances can register with the same FQDN as a pool.
+const InstanceHeader = "X-PushProx-Instance"
+
+// Header on a /poll with the labels of the client, URL query encoded, so it
+// can be scraped by label selector.
+const LabelsHeader = "X-PushProx-Labels"
@@ -0,0 +1,121 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// Header the proxy uses on /poll responses when it accepts pushed scrape
+// results encoded as a delta against an earlier one.
+const AcceptDeltaHeader = "X-PushProx-Accept-Delta"
+
+// Headers on a pushed scrape result. With DeltaBaseHeader, the body is a
+// delta against the earlier result with that DeltaHash. With DeltaKeepHeader
+// the proxy keeps the result, so later ones can be deltas against it.
+const (
+	DeltaBaseHeader = "X-PushProx-Delta-Base"
+	DeltaKeepHeader = "X-PushProx-Delta-Keep"
+)
+
+// Status of the response to a push whose delta base the proxy doesn't have,
+// such as after a restart. The client should push the whole result again.
+const DeltaBaseMissingStatus = 412
+
+// Identifies a scrape result as a delta base.
+func DeltaHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Length of the runs of base looked for in the target.
+const deltaBlock = 16
+
+const (
+	deltaInsert = iota
+	deltaCopy
+)
+
+// Encode target as copies of runs of base and the bytes in between.
+func Delta(base, target []byte) []byte {
+	index := make(map[string]int, len(base)/deltaBlock)
+	for off := 0; off+deltaBlock <= len(base); off += deltaBlock {
+		if _, ok := index[string(base[off:off+deltaBlock])]; !ok {
+			index[string(base[off:off+deltaBlock])] = off
+		}
+	}
+	var out bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	emit := func(op byte, args ...int) {
+		out.WriteByte(op)
+		for _, a := range args {
+			out.Write(scratch[:binary.PutUvarint(scratch[:], uint64(a))])
+		}
+	}
+	insert := func(b []byte) {
+		if len(b) > 0 {
+			emit(deltaInsert, len(b))
+			out.Write(b)
+		}
+	}
+	literal := 0
+	for i := 0; i+deltaBlock <= len(target); {
+		off, ok := index[string(target[i:i+deltaBlock])]
+		if !ok {
+			i++
+			continue
+		}
+		for off > 0 && i > literal && base[off-1] == target[i-1] {
+			off--
+			i--
+		}
+		n := deltaBlock
+		for off+n < len(base) && i+n < len(target) && base[off+n] == target[i+n] {
+			n++
+		}
+		insert(target[literal:i])
+		emit(deltaCopy, off, n)
+		i += n
+		literal = i
+	}
+	insert(target[literal:])
+	return out.Bytes()
+}
+
+var errBadDelta = errors.New("invalid delta")
+
+// Rebuild the target from base and a delta from Delta, failing if it would
+// be more than max bytes.
+func ApplyDelta(base, delta []byte, max int) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	var out []byte
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch op {
+		case deltaInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) || len(out)+int(n) > max {
+				return nil, errBadDelta
+			}
+			start := len(delta) - r.Len()
+			out = append(out, delta[start:start+int(n)]...)
+			r.Seek(int64(n), io.SeekCurrent)
+		case deltaCopy:
+			off, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, errBadDelta
+			}
+			n, err := binary.ReadUvarint(r)
+			if err != nil || off > uint64(len(base)) || n > uint64(len(base))-off || len(out)+int(n) > max {
+				return nil, errBadDelta
+			}
+			out = append(out, base[off:off+n]...)
+		default:
+			return nil, errBadDelta
+		}
+	}
+	return out, nil
+}
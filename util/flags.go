@@ -0,0 +1,21 @@
+package util
+
+import (
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var envarReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// Let each visible flag of app also be set by an environment variable named
+// after it, such as PUSHPROX_WEB_LISTEN_ADDRESS for --web.listen-address with
+// the prefix PUSHPROX. Flags on the command line take precedence.
+func SetEnvars(app *kingpin.Application, prefix string) {
+	for _, f := range app.Model().Flags {
+		if f.Hidden || f.Name == "help" || f.Name == "version" {
+			continue
+		}
+		app.GetFlag(f.Name).Envar(prefix + "_" + strings.ToUpper(envarReplacer.Replace(f.Name)))
+	}
+}
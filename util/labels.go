@@ -0,0 +1,191 @@
+package util
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// Whether name is a valid label name.
+func IsValidLabelName(name string) bool {
+	return labelNameRE.MatchString(name)
+}
+
+// Whether samples in a response with this content type can have labels
+// added by AddLabels.
+func CanAddLabels(contentType string) bool {
+	return CanAddTimestamps(contentType)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// A set of labels to add to samples, rendered once.
+type ExtraLabels struct {
+	names    []string
+	values   []string
+	rendered []string
+}
+
+// Prepare labels to add with AddLabels. The names must be valid.
+func NewExtraLabels(labels map[string]string) *ExtraLabels {
+	el := &ExtraLabels{}
+	for name := range labels {
+		el.names = append(el.names, name)
+	}
+	sort.Strings(el.names)
+	for _, name := range el.names {
+		el.values = append(el.values, labels[name])
+		el.rendered = append(el.rendered, name+`="`+labelValueReplacer.Replace(labels[name])+`"`)
+	}
+	return el
+}
+
+// Copy a text format exposition from r to w, adding the labels to every
+// sample. Labels a sample already has are left alone, as the target knows
+// better.
+func AddLabels(w io.Writer, r io.Reader, el *ExtraLabels) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			if _, werr := bw.WriteString(el.addTo(line)); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return bw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (el *ExtraLabels) addTo(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || trimmed[0] == '#' {
+		return line
+	}
+	end := metricEnd(line)
+	nameEnd := strings.IndexAny(line[:end], " \t{")
+	if nameEnd < 0 {
+		nameEnd = end
+	}
+	var existing map[string]bool
+	inner := ""
+	if nameEnd < end && line[nameEnd] == '{' {
+		inner = strings.TrimSpace(strings.TrimSuffix(line[nameEnd+1:end], "}"))
+		existing = labelNames(inner)
+	}
+	labels := make([]string, 0, len(el.rendered)+1)
+	for i, name := range el.names {
+		if !existing[name] {
+			labels = append(labels, el.rendered[i])
+		}
+	}
+	if len(labels) == 0 {
+		return line
+	}
+	if inner != "" {
+		labels = append(labels, strings.TrimSuffix(inner, ","))
+	}
+	return line[:nameEnd] + "{" + strings.Join(labels, ",") + "}" + line[end:]
+}
+
+// The names of the labels in the inside of a label set.
+func labelNames(set string) map[string]bool {
+	names := map[string]bool{}
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(set); i++ {
+		switch {
+		case inQuotes && set[i] == '\\':
+			i++
+		case set[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && set[i] == '=':
+			names[strings.TrimSpace(set[start:i])] = true
+		case !inQuotes && set[i] == ',':
+			start = i + 1
+		}
+	}
+	return names
+}
+
+// Whether a response with this content type is the delimited protobuf format,
+// which can have labels added by AddLabelsProto.
+func IsProtoDelimited(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == expfmt.ProtoType && params["proto"] == expfmt.ProtoProtocol && params["encoding"] == "delimited"
+}
+
+// Copy a delimited protobuf exposition from r to w, adding the labels to every
+// metric as AddLabels does.
+func AddLabelsProto(w io.Writer, r io.Reader, el *ExtraLabels) error {
+	format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+	// The decoder wraps what it reads from in a bufio.Reader each time, which
+	// only keeps what it read ahead if it's one already.
+	dec := expfmt.NewDecoder(bufio.NewReader(r), format)
+	bw := bufio.NewWriter(w)
+	enc := expfmt.NewEncoder(bw, format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			return bw.Flush()
+		} else if err != nil {
+			return err
+		}
+		for _, m := range mf.Metric {
+			el.addToProto(m)
+		}
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+}
+
+func (el *ExtraLabels) addToProto(m *dto.Metric) {
+	existing := map[string]bool{}
+	for _, lp := range m.Label {
+		existing[lp.GetName()] = true
+	}
+	added := false
+	for i, name := range el.names {
+		if !existing[name] {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(el.values[i])})
+			added = true
+		}
+	}
+	if added {
+		sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+	}
+}
+
+// Pass the body of a response through rewrite as it's streamed.
+func RewriteBody(resp *http.Response, rewrite func(io.Writer, io.Reader) error) {
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		pw.CloseWithError(rewrite(pw, body))
+	}()
+	resp.Body = pr
+	// The length changes.
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.TransferEncoding = []string{"chunked"}
+}
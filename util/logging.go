@@ -0,0 +1,71 @@
+package util
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/promlog"
+)
+
+// A logger whose level can be changed while it's in use, such as one from
+// NewLogger.
+type LevelSetter interface {
+	SetLevel(*promlog.AllowedLevel)
+}
+
+// Millisecond timestamps in UTC, as Prometheus logs them.
+var timestamp = log.TimestampFormat(
+	func() time.Time { return time.Now().UTC() },
+	"2006-01-02T15:04:05.000Z07:00",
+)
+
+// A logger to stderr in the given format whose level can be changed with
+// SetLevel.
+type Logger struct {
+	base log.Logger
+
+	mu       sync.RWMutex
+	filtered log.Logger
+}
+
+func NewLogger(l *promlog.AllowedLevel, format *promlog.AllowedFormat) *Logger {
+	var base log.Logger
+	if format != nil && format.String() == "json" {
+		base = log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
+	} else {
+		base = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	}
+	// Three more frames than usual, for the level prefix, Log here and the
+	// level filter.
+	base = log.With(base, "ts", timestamp, "caller", log.Caller(6))
+	lg := &Logger{base: base}
+	lg.SetLevel(l)
+	return lg
+}
+
+func (lg *Logger) SetLevel(l *promlog.AllowedLevel) {
+	option := level.AllowInfo()
+	if l != nil {
+		switch l.String() {
+		case "debug":
+			option = level.AllowDebug()
+		case "warn":
+			option = level.AllowWarn()
+		case "error":
+			option = level.AllowError()
+		}
+	}
+	lg.mu.Lock()
+	lg.filtered = level.NewFilter(lg.base, option)
+	lg.mu.Unlock()
+}
+
+func (lg *Logger) Log(keyvals ...interface{}) error {
+	lg.mu.RLock()
+	l := lg.filtered
+	lg.mu.RUnlock()
+	return l.Log(keyvals...)
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"net/url"
+	"strings"
+)
+
+// The query string without the parameters with the given names. The others
+// are left exactly as they were, so parameters such as the target of a
+// multi-target exporter reach it as Prometheus sent them.
+func WithoutParams(rawQuery string, names ...string) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name := param
+		if i := strings.Index(param, "="); i >= 0 {
+			name = param[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		drop := false
+		for _, n := range names {
+			if name == n {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
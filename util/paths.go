@@ -0,0 +1,5 @@
+package util
+
+// Paths of the proxy's own endpoints, such as /poll and /clients, start with
+// this so they can't be mistaken for paths of targets being scraped.
+const PathPrefix = "/pushprox"
@@ -0,0 +1,33 @@
+package util
+
+import "strconv"
+
+// Header on polls with the newest version of the protocol between clients
+// and proxies the client speaks, and on the proxy's responses with the
+// version it answered in, the newest both speak. Clients and proxies that
+// don't send it speak version 1.
+const ProtocolVersionHeader = "X-PushProx-Protocol-Version"
+
+// Versions of the protocol. Each only adds to the one before, so either end
+// can fall back to what an older other end speaks.
+const (
+	// One scrape handed out per poll, and its result pushed in whatever
+	// encoding, and as a delta, with a checksum or in chunks, as the proxy
+	// offers in headers of the poll response.
+	ProtocolV1 = 1
+	// Several scrapes handed out in a poll response to clients asking for
+	// them with BatchSizeHeader, and their results pushed together.
+	ProtocolBatches = 2
+
+	// The newest version this build speaks.
+	ProtocolVersion = ProtocolBatches
+)
+
+// The version in a ProtocolVersionHeader, 1 without a valid one.
+func ParseProtocolVersion(s string) int {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < ProtocolV1 {
+		return ProtocolV1
+	}
+	return v
+}
@@ -1,25 +1,35 @@
 package util
 
 import (
-	"flag"
 	"net/http"
 	"strconv"
 	"time"
-)
 
-var (
-	maxScrapeTimeout     = flag.Duration("scrape.max-timeout", 5*time.Minute, "Any scrape with a timeout higher than this will have to clamped to this.")
-	defaultScrapeTimeout = flag.Duration("scrape.default-timeout", 15*time.Second, "If a scrape lacks a timeout, use this value.")
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-func GetScrapeTimeout(h http.Header) time.Duration {
-	timeout := *defaultScrapeTimeout
+// Limits on how long scrapes may take.
+type ScrapeTimeouts struct {
+	// Any scrape with a timeout higher than this is clamped to it.
+	Max time.Duration `yaml:"max_scrape_timeout"`
+	// Used for scrapes that lack a timeout.
+	Default time.Duration `yaml:"default_scrape_timeout"`
+}
+
+// Register flags for the timeouts, with names starting with prefix.
+func (t *ScrapeTimeouts) RegisterFlags(app *kingpin.Application, prefix string) {
+	app.Flag(prefix+"scrape.max-timeout", "Any scrape with a timeout higher than this will have to clamped to this.").Default("5m").DurationVar(&t.Max)
+	app.Flag(prefix+"scrape.default-timeout", "If a scrape lacks a timeout, use this value.").Default("15s").DurationVar(&t.Default)
+}
+
+func (t ScrapeTimeouts) GetScrapeTimeout(h http.Header) time.Duration {
+	timeout := t.Default
 	timeoutSeconds, err := strconv.ParseFloat(h.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
 	if err == nil {
 		timeout = time.Duration(timeoutSeconds * 1e9)
 	}
-	if timeout > *maxScrapeTimeout {
-		timeout = *maxScrapeTimeout
+	if timeout > t.Max {
+		timeout = t.Max
 	}
 	return timeout
 }
@@ -0,0 +1,9 @@
+package util
+
+// Header the proxy uses on /poll responses when it accepts pushes sent in
+// chunks to /push-chunk, which can be resumed after a broken connection.
+const AcceptChunksHeader = "X-PushProx-Accept-Chunks"
+
+// Header on responses from /push-chunk with how many bytes of the push have
+// arrived, where the next chunk should start.
+const PushOffsetHeader = "X-PushProx-Push-Offset"
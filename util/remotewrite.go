@@ -0,0 +1,132 @@
+package util
+
+import (
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Headers of a Prometheus remote write request with a body from RemoteWrite.
+var RemoteWriteHeaders = map[string]string{
+	"Content-Encoding":                  "snappy",
+	"Content-Type":                      "application/x-protobuf",
+	"X-Prometheus-Remote-Write-Version": "0.1.0",
+}
+
+// Convert a text format exposition to the snappy compressed body of a
+// Prometheus remote write request, with the extra labels on every series.
+// As when Prometheus scrapes, labels of the exposition clashing with them are
+// renamed with an exported_ prefix. Samples without a timestamp get t.
+func RemoteWrite(r io.Reader, extra map[string]string, t time.Time) ([]byte, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var req []byte
+	for _, name := range names {
+		for _, m := range families[name].Metric {
+			ts := t.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			series := func(suffix string, value float64, more ...string) {
+				labels := map[string]string{}
+				for _, lp := range m.Label {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+				for i := 0; i+1 < len(more); i += 2 {
+					labels[more[i]] = more[i+1]
+				}
+				for k, v := range extra {
+					if exported, ok := labels[k]; ok {
+						labels["exported_"+k] = exported
+					}
+					labels[k] = v
+				}
+				labels["__name__"] = name + suffix
+				req = protowire.AppendTag(req, 1, protowire.BytesType)
+				req = protowire.AppendBytes(req, encodeTimeSeries(labels, value, ts))
+			}
+			switch {
+			case m.Counter != nil:
+				series("", m.Counter.GetValue())
+			case m.Gauge != nil:
+				series("", m.Gauge.GetValue())
+			case m.Untyped != nil:
+				series("", m.Untyped.GetValue())
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					series("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				series("_sum", m.Summary.GetSampleSum())
+				series("_count", float64(m.Summary.GetSampleCount()))
+			case m.Histogram != nil:
+				series("_sum", m.Histogram.GetSampleSum())
+				series("_count", float64(m.Histogram.GetSampleCount()))
+				for _, b := range bucketsWithInf(m.Histogram) {
+					series("_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+			}
+		}
+	}
+	return snappy.Encode(nil, req), nil
+}
+
+// The buckets of a histogram, with the +Inf one the text format leaves out.
+func bucketsWithInf(h *dto.Histogram) []*dto.Bucket {
+	buckets := h.Bucket
+	if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), 1) {
+		count, inf := h.GetSampleCount(), math.Inf(1)
+		buckets = append(buckets[:len(buckets):len(buckets)], &dto.Bucket{CumulativeCount: &count, UpperBound: &inf})
+	}
+	return buckets
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// A TimeSeries message with one sample, its labels sorted by name.
+func encodeTimeSeries(labels map[string]string, value float64, ts int64) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []byte
+	for _, name := range names {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, labels[name])
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, label)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts))
+	out = protowire.AppendTag(out, 2, protowire.BytesType)
+	return protowire.AppendBytes(out, sample)
+}
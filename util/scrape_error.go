@@ -0,0 +1,62 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Kinds of failure scraping a target.
+const (
+	ScrapeErrorDial      = "dial"
+	ScrapeErrorTimeout   = "timeout"
+	ScrapeErrorRead      = "read"
+	ScrapeErrorForbidden = "forbidden"
+	ScrapeErrorOther     = "other"
+)
+
+// What the client pushes in place of a scrape result when it couldn't scrape
+// the target.
+type ScrapeError struct {
+	Kind  string `json:"kind"`
+	Error string `json:"error"`
+}
+
+// Classify an error from scraping a target.
+func NewScrapeError(err error) *ScrapeError {
+	se := &ScrapeError{Kind: ScrapeErrorOther, Error: err.Error()}
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		se.Kind = ScrapeErrorTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		se.Kind = ScrapeErrorDial
+	case errors.As(err, &opErr) && opErr.Op == "read":
+		se.Kind = ScrapeErrorRead
+	}
+	return se
+}
+
+// The status to return to the scraper for this error.
+func (se *ScrapeError) StatusCode() int {
+	switch se.Kind {
+	case ScrapeErrorTimeout:
+		return http.StatusGatewayTimeout
+	case ScrapeErrorForbidden:
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// Decode a pushed ScrapeError. For the benefit of older clients that just
+// put the error message in the header, that's used if the body isn't one.
+func ReadScrapeError(resp *http.Response) *ScrapeError {
+	se := &ScrapeError{}
+	if err := json.NewDecoder(resp.Body).Decode(se); err != nil || se.Kind == "" {
+		return &ScrapeError{Kind: ScrapeErrorOther, Error: resp.Header.Get(ScrapeErrorHeader)}
+	}
+	return se
+}
@@ -0,0 +1,273 @@
+package util
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers on scrape requests the proxy signs: when the signature expires, in
+// Unix seconds, and the signature of the request's method, URL, scrape ID,
+// expiry, body and headers, as <algorithm>=<base64>.
+const (
+	SignatureHeader        = "X-PushProx-Signature"
+	SignatureExpiresHeader = "X-PushProx-Signature-Expires"
+)
+
+const (
+	signatureHMAC    = "hmac-sha256"
+	signatureEd25519 = "ed25519"
+)
+
+// How far the clocks of the proxy and a client may be apart for a
+// signature to still be taken before it expires.
+const SignatureClockSkew = time.Minute
+
+var (
+	ErrUnsigned         = errors.New("scrape request is not signed")
+	ErrBadSignature     = errors.New("scrape request signature is not valid")
+	ErrSignatureExpired = errors.New("scrape request signature has expired")
+)
+
+// Headers not signed, as they don't reach the client as the proxy has them
+// or carry the signature.
+var unsignedHeaders = map[string]bool{
+	"Host":                 true,
+	"Content-Length":       true,
+	"Transfer-Encoding":    true,
+	"Trailer":              true,
+	SignatureHeader:        true,
+	SignatureExpiresHeader: true,
+}
+
+// What's signed of a scrape request: its method, URL, scrape ID, expiry, the
+// SHA-256 of its body and its headers, sorted by name.
+func signedScrape(r *http.Request, expires string) ([]byte, error) {
+	sum, err := bodySHA256(r)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{"pushprox-scrape-v2", r.Method, r.URL.String(), r.Header.Get("Id"), expires, sum}
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		if !unsignedHeaders[http.CanonicalHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range r.Header[name] {
+			// Empty ones aren't sent.
+			if value = strings.TrimSpace(value); value != "" {
+				lines = append(lines, http.CanonicalHeaderKey(name)+": "+value)
+			}
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// The hex SHA-256 of the request's body, leaving it to be read again.
+func bodySHA256(r *http.Request) (string, error) {
+	h := sha256.New()
+	switch {
+	case r.GetBody != nil:
+		body, err := r.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		if _, err := io.Copy(h, body); err != nil {
+			return "", err
+		}
+	case r.Body != nil && r.Body != http.NoBody:
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		h.Write(body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Signs scrape requests, with an HMAC secret or an Ed25519 private key.
+type ScrapeSigner struct {
+	secret  []byte
+	private ed25519.PrivateKey
+}
+
+// Load a key to sign scrape requests with: an Ed25519 private key as PKCS #8
+// PEM, or otherwise an HMAC secret of at least 32 bytes.
+func LoadScrapeSigner(path string) (*ScrapeSigner, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		secret, err := hmacSecret(path, content)
+		if err != nil {
+			return nil, err
+		}
+		return &ScrapeSigner{secret: secret}, nil
+	}
+	if block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s has a %s rather than a PRIVATE KEY", path, block.Type)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+	}
+	return &ScrapeSigner{private: private}, nil
+}
+
+func hmacSecret(path string, content []byte) ([]byte, error) {
+	secret := []byte(strings.TrimSpace(string(content)))
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("HMAC secret %s must be at least 32 bytes", path)
+	}
+	return secret, nil
+}
+
+// Sign the scrape request, with the signature expiring at expires.
+func (s *ScrapeSigner) Sign(r *http.Request, expires time.Time) error {
+	if _, ok := r.Header["User-Agent"]; !ok {
+		// Otherwise Go's own is sent, unsigned.
+		r.Header["User-Agent"] = []string{""}
+	}
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	msg, err := signedScrape(r, exp)
+	if err != nil {
+		return err
+	}
+	var sig string
+	if s.private != nil {
+		sig = signatureEd25519 + "=" + base64.RawURLEncoding.EncodeToString(ed25519.Sign(s.private, msg))
+	} else {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(msg)
+		sig = signatureHMAC + "=" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	r.Header.Set(SignatureExpiresHeader, exp)
+	r.Header.Set(SignatureHeader, sig)
+	return nil
+}
+
+// Checks the signatures of scrape requests, with an HMAC secret or Ed25519
+// public keys.
+type ScrapeVerifier struct {
+	secret []byte
+	public []ed25519.PublicKey
+}
+
+// Load keys to check scrape requests with: Ed25519 public keys or
+// certificates as PEM, any of which may have signed them, or otherwise an
+// HMAC secret of at least 32 bytes.
+func LoadScrapeVerifier(path string) (*ScrapeVerifier, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(content); block == nil {
+		secret, err := hmacSecret(path, content)
+		if err != nil {
+			return nil, err
+		}
+		return &ScrapeVerifier{secret: secret}, nil
+	}
+	v := &ScrapeVerifier{}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+				return nil, err
+			}
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			key = cert.PublicKey
+		default:
+			return nil, fmt.Errorf("%s has a %s rather than a PUBLIC KEY or CERTIFICATE", path, block.Type)
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s has a key that's not Ed25519", path)
+		}
+		v.public = append(v.public, public)
+	}
+	return v, nil
+}
+
+// Check the signature of a scrape request, returning when it expires.
+func (v *ScrapeVerifier) Verify(r *http.Request, now time.Time) (time.Time, error) {
+	alg, encoded, ok := strings.Cut(r.Header.Get(SignatureHeader), "=")
+	exp := r.Header.Get(SignatureExpiresHeader)
+	if !ok || exp == "" {
+		return time.Time{}, ErrUnsigned
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return time.Time{}, ErrBadSignature
+	}
+	seconds, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrBadSignature
+	}
+	msg, err := signedScrape(r, exp)
+	if err != nil {
+		return time.Time{}, err
+	}
+	valid := false
+	// Only ever check a signature with the kind of key it's for.
+	switch {
+	case alg == signatureHMAC && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(msg)
+		valid = hmac.Equal(sig, mac.Sum(nil))
+	case alg == signatureEd25519:
+		for _, public := range v.public {
+			if ed25519.Verify(public, msg, sig) {
+				valid = true
+				break
+			}
+		}
+	}
+	if !valid {
+		return time.Time{}, ErrBadSignature
+	}
+	expires := time.Unix(seconds, 0)
+	if now.After(expires.Add(SignatureClockSkew)) {
+		return expires, ErrSignatureExpired
+	}
+	return expires, nil
+}
@@ -0,0 +1,27 @@
+package util
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Type of the SSH channels clients open to the proxy, each carrying an HTTP
+// connection as if over TCP.
+const SSHChannelType = "pushprox-http"
+
+// An SSH channel used as a connection.
+type SSHChannelConn struct {
+	ssh.Channel
+	Local, Remote net.Addr
+}
+
+func (c *SSHChannelConn) LocalAddr() net.Addr  { return c.Local }
+func (c *SSHChannelConn) RemoteAddr() net.Addr { return c.Remote }
+
+// Deadlines aren't supported on channels, timeouts are left to the SSH
+// connection's keepalives.
+func (c *SSHChannelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *SSHChannelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *SSHChannelConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether samples in a response with this content type can have timestamps
+// added by AddTimestamps.
+func CanAddTimestamps(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/plain" && (params["version"] == "" || params["version"] == "0.0.4")
+}
+
+// Copy a text format exposition from r to w, adding the timestamp t to
+// every sample that doesn't already have one. This keeps samples at the time
+// they were scraped even if they're delivered later.
+func AddTimestamps(w io.Writer, r io.Reader, t time.Time) error {
+	ts := strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			if _, werr := bw.WriteString(addTimestamp(line, ts)); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return bw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func addTimestamp(line, ts string) string {
+	content := strings.TrimRight(line, "\r\n")
+	trimmed := strings.TrimSpace(content)
+	if trimmed == "" || trimmed[0] == '#' {
+		return line
+	}
+	// Everything after the metric name and labels is the value and
+	// optionally a timestamp.
+	rest := content[metricEnd(content):]
+	if len(strings.Fields(rest)) != 1 {
+		return line
+	}
+	return strings.TrimRight(content, " \t") + " " + ts + line[len(content):]
+}
+
+// The index just after the metric name and label set of a sample line,
+// taking care of quoted label values that might contain spaces or braces.
+func metricEnd(line string) int {
+	i := strings.IndexAny(line, " \t{")
+	if i < 0 {
+		return len(line)
+	}
+	if line[i] != '{' {
+		return i
+	}
+	inQuotes := false
+	for i++; i < len(line); i++ {
+		switch {
+		case inQuotes && line[i] == '\\':
+			i++
+		case line[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && line[i] == '}':
+			return i + 1
+		}
+	}
+	return len(line)
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"io"
+)
+
+// Protocol a client's /tunnel request to the proxy is upgraded to, after
+// which the connection carries the tunnelled TCP stream.
+const TunnelUpgrade = "pushprox-tunnel"
+
+// Header on a /tunnel request indicating the client couldn't connect to the
+// target, with why as its value. The request isn't upgraded in that case.
+const TunnelErrorHeader = "X-PushProx-Tunnel-Error"
+
+// Copy between a and b in both directions until one of them is done, then
+// close both.
+func Splice(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Check that body is a well formed exposition in the format contentType says,
+// text, OpenMetrics or delimited protobuf. Bodies in other formats aren't
+// checked.
+func ValidateExposition(contentType string, body []byte) error {
+	if contentType == "" {
+		return validateText(body)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q: %s", contentType, err)
+	}
+	switch {
+	case mediaType == "text/plain":
+		return validateText(body)
+	case mediaType == expfmt.OpenMetricsType:
+		return validateOpenMetrics(body)
+	case IsProtoDelimited(contentType):
+		return validateProto(body)
+	}
+	return nil
+}
+
+func validateText(body []byte) error {
+	var parser expfmt.TextParser
+	_, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	return err
+}
+
+// OpenMetrics is checked for its terminating "# EOF", and that its samples
+// would parse as the text format once their exemplars and timestamps are
+// checked and taken off.
+func validateOpenMetrics(body []byte) error {
+	var samples strings.Builder
+	eof := false
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if eof {
+			return fmt.Errorf("line %d: content after # EOF", n)
+		}
+		if line == "# EOF" {
+			eof = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		end := metricEnd(line)
+		rest := line[end:]
+		if i := strings.Index(rest, " # "); i >= 0 {
+			if !strings.HasPrefix(rest[i+3:], "{") {
+				return fmt.Errorf("line %d: invalid exemplar", n)
+			}
+			rest = rest[:i]
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 1 || len(fields) > 2 {
+			return fmt.Errorf("line %d: expected a value and optional timestamp", n)
+		}
+		for _, f := range fields {
+			if _, err := strconv.ParseFloat(f, 64); err != nil {
+				return fmt.Errorf("line %d: invalid number %q", n, f)
+			}
+		}
+		samples.WriteString(line[:end] + " " + fields[0] + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !eof {
+		return errors.New("missing # EOF")
+	}
+	return validateText([]byte(samples.String()))
+}
+
+func validateProto(body []byte) error {
+	dec := expfmt.NewDecoder(bufio.NewReader(bytes.NewReader(body)), expfmt.NewFormat(expfmt.TypeProtoDelim))
+	for {
+		if err := dec.Decode(&dto.MetricFamily{}); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/common/version"
+)
+
+// Serve the version the program was built from as JSON, as in Prometheus's
+// /api/v1/status/buildinfo.
+func VersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"version":   version.Version,
+			"revision":  version.GetRevision(),
+			"branch":    version.Branch,
+			"buildUser": version.BuildUser,
+			"buildDate": version.BuildDate,
+			"goVersion": version.GoVersion,
+		})
+	})
+}